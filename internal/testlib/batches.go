@@ -0,0 +1,225 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package testlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// BatchServer is a stand-in for the files and batches endpoints of the
+// OpenAI API. Batches are run as soon as they are created, unless Hold is
+// set; then they stay in progress until Complete is called.
+type BatchServer struct {
+	*httptest.Server
+
+	// Respond answers a request of a batch with a status code and a body.
+	// The default answers with the model and the last message of the request.
+	Respond func(request openai.BatchChatCompletionRequest) (int, string)
+	// Hold keeps created batches in progress.
+	Hold bool
+
+	mu      sync.Mutex
+	files   map[string][]byte
+	batches map[string]*openai.Batch
+	// requests are the requests of all created batches.
+	requests []openai.BatchChatCompletionRequest
+}
+
+// NewBatchServer starts a BatchServer and points OPENAI_API_BASE and
+// OPENAI_API_KEY at it. The server is closed on cleanup.
+func NewBatchServer(t *testing.T) *BatchServer {
+	t.Helper()
+	server := &BatchServer{
+		Respond: func(request openai.BatchChatCompletionRequest) (int, string) {
+			content := request.Body.Model + ": " + request.Body.Messages[len(request.Body.Messages)-1].Content
+			return http.StatusOK, fmt.Sprintf(`{"model":%q,"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+				request.Body.Model, content)
+		},
+		files:   make(map[string][]byte),
+		batches: make(map[string]*openai.Batch),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/files", server.uploadFile)
+	mux.HandleFunc("GET /v1/files/{id}/content", server.fileContent)
+	mux.HandleFunc("POST /v1/batches", server.createBatch)
+	mux.HandleFunc("GET /v1/batches/{id}", server.retrieveBatch)
+	mux.HandleFunc("POST /v1/batches/{id}/cancel", server.cancelBatch)
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Setenv("OPENAI_API_BASE", server.URL+"/v1")
+	SetAPIKey(t)
+	return server
+}
+
+// Requests returns the requests of all created batches.
+func (s *BatchServer) Requests() []openai.BatchChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.BatchChatCompletionRequest(nil), s.requests...)
+}
+
+// Complete runs the held batch id.
+func (s *BatchServer) Complete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.run(s.batches[id])
+}
+
+func (s *BatchServer) uploadFile(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil || r.FormValue("purpose") != string(openai.PurposeBatch) {
+		http.Error(w, `{"error":{"message":"invalid upload"}}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.addFile(data)
+	writeJSON(w, openai.File{ID: id, Object: "file", Bytes: len(data), FileName: header.Filename, Purpose: string(openai.PurposeBatch)})
+}
+
+func (s *BatchServer) fileContent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[r.PathValue("id")]
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such file"}}`, http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func (s *BatchServer) createBatch(w http.ResponseWriter, r *http.Request) {
+	var request openai.CreateBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[request.InputFileID]; !ok || request.Endpoint != openai.BatchEndpointChatCompletions {
+		http.Error(w, `{"error":{"message":"invalid batch"}}`, http.StatusBadRequest)
+		return
+	}
+	batch := &openai.Batch{
+		ID:               fmt.Sprintf("batch_%d", len(s.batches)+1),
+		Object:           "batch",
+		Endpoint:         request.Endpoint,
+		InputFileID:      request.InputFileID,
+		CompletionWindow: request.CompletionWindow,
+		Status:           "in_progress",
+		CreatedAt:        int(time.Now().Unix()),
+		Metadata:         request.Metadata,
+	}
+	s.batches[batch.ID] = batch
+	if !s.Hold {
+		s.run(batch)
+	}
+	writeJSON(w, batch)
+}
+
+func (s *BatchServer) retrieveBatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, ok := s.batches[r.PathValue("id")]
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such batch"}}`, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, batch)
+}
+
+func (s *BatchServer) cancelBatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, ok := s.batches[r.PathValue("id")]
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such batch"}}`, http.StatusNotFound)
+		return
+	}
+	if batch.Status == "in_progress" {
+		batch.Status = "cancelled"
+	}
+	writeJSON(w, batch)
+}
+
+// run answers the requests of batch and stores the results in an output and
+// an error file. s.mu must be held.
+func (s *BatchServer) run(batch *openai.Batch) {
+	var output, errors bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(s.files[batch.InputFileID]))
+	for scanner.Scan() {
+		var request openai.BatchChatCompletionRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			panic(err)
+		}
+		s.requests = append(s.requests, request)
+		status, body := s.Respond(request)
+		line := fmt.Sprintf(`{"id":"batch_req_%d","custom_id":%q,"response":{"status_code":%d,"body":%s},"error":null}`+"\n",
+			len(s.requests), request.CustomID, status, body)
+		batch.RequestCounts.Total++
+		if status == http.StatusOK {
+			batch.RequestCounts.Completed++
+			output.WriteString(line)
+		} else {
+			batch.RequestCounts.Failed++
+			errors.WriteString(line)
+		}
+	}
+	batch.Status = "completed"
+	if output.Len() > 0 {
+		id := s.addFile(output.Bytes())
+		batch.OutputFileID = &id
+	}
+	if errors.Len() > 0 {
+		id := s.addFile(errors.Bytes())
+		batch.ErrorFileID = &id
+	}
+}
+
+// addFile stores data and returns its ID. s.mu must be held.
+func (s *BatchServer) addFile(data []byte) string {
+	id := fmt.Sprintf("file-%d", len(s.files)+1)
+	s.files[id] = data
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
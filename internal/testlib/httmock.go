@@ -56,6 +56,44 @@ func RegisterExpectedChatResponse(response string) {
 	)
 }
 
+// RegisterRateLimitedChatResponse answers the first failures requests with
+// status and headers, and all following requests with response. It returns a
+// pointer to the number of received requests.
+func RegisterRateLimitedChatResponse(failures, status int, headers map[string]string, response string) *int {
+	calls := 0
+	success := httpmock.NewStringResponder(
+		200,
+		fmt.Sprintf(`{
+			"choices": [
+				{
+					"index": 0,
+					"finish_reason": "stop",
+					"message": {
+						"role": "assistant",
+						"content": "%s"
+					}
+				}
+			]
+		}`, response),
+	)
+	httpmock.RegisterResponder(
+		"POST",
+		fmt.Sprintf("%s%s", baseURL, chatCompletionSuffix),
+		func(req *http.Request) (*http.Response, error) {
+			calls++
+			if calls > failures {
+				return success(req)
+			}
+			resp := httpmock.NewStringResponse(status, `{"error":{"message":"rate limited","type":"requests"}}`)
+			for key, value := range headers {
+				resp.Header.Set(key, value)
+			}
+			return resp, nil
+		},
+	)
+	return &calls
+}
+
 func RegisterEmptyChatResponse() {
 	httpmock.RegisterResponder(
 		"POST",
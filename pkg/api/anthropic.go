@@ -0,0 +1,576 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+const (
+	// envKeyAnthropicAPIKey is the environment variable key for the Anthropic API key.
+	envKeyAnthropicAPIKey = "ANTHROPIC_API_KEY"
+	// envKeyAnthropicBaseURL is the environment variable key for the Anthropic API base URL override.
+	envKeyAnthropicBaseURL = "ANTHROPIC_BASE_URL"
+
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	anthropicMessagesSuffix = "/v1/messages"
+	anthropicModelsSuffix   = "/v1/models"
+	anthropicVersion        = "2023-06-01"
+	// anthropicStopRefusal is the stop reason of responses the model refused.
+	anthropicStopRefusal = "refusal"
+	// defaultAnthropicMaxTokens is used when maxTokens is not configured;
+	// unlike OpenAI, the Messages API rejects requests without max_tokens.
+	defaultAnthropicMaxTokens = 2048
+)
+
+// ErrMissingAnthropicAPIKey is returned, if the ANTHROPIC_API_KEY environment variable is not set.
+var ErrMissingAnthropicAPIKey = fmt.Errorf("%s env variable is not set", envKeyAnthropicAPIKey)
+
+// AnthropicClient is a client for the Anthropic Messages API.
+type AnthropicClient struct {
+	baseClient
+
+	HTTPClient *http.Client
+	apiKey     func() (string, error)
+	baseURL    string
+}
+
+// CreateAnthropicClient creates a new Anthropic client with the given config and output writer.
+// ANTHROPIC_BASE_URL is subject to the same validation as OPENAI_API_BASE.
+func CreateAnthropicClient(config *viper.Viper, out io.Writer, opts ...ClientOption) (*AnthropicClient, error) {
+	apiKey, err := newAPIKey(config, ProviderAnthropic, envKeyAnthropicAPIKey, ErrMissingAnthropicAPIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := defaultAnthropicBaseURL
+	if override, source, isSet := lookupAPIBase(config, envKeyAnthropicBaseURL); isSet {
+		if err = validateAPIBaseURL(config, source, override); err != nil {
+			return nil, err
+		}
+		baseURL = strings.TrimSuffix(override, "/")
+		slog.Debug(source+" override active", "url", baseURL)
+	}
+
+	base, err := newBaseClient(config, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &AnthropicClient{
+		baseClient: base,
+		HTTPClient: httpClient,
+		apiKey:     apiKey,
+		baseURL:    baseURL,
+	}
+	slog.Debug("Anthropic client created")
+	return client, nil
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	Stop        []string           `json:"stop_sequences,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+	Metadata    *anthropicMetadata `json:"metadata,omitempty"`
+}
+
+// anthropicMetadata tags a request with the user it is made for.
+type anthropicMetadata struct {
+	UserID string `json:"user_id"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID         string                  `json:"id"`
+	Model      string                  `json:"model"`
+	Role       string                  `json:"role"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u anthropicUsage) toOpenAI() openai.Usage {
+	return openai.Usage{
+		PromptTokens:     u.InputTokens,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      u.InputTokens + u.OutputTokens,
+	}
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	// Message is sent with message_start and carries the input tokens,
+	// Usage is sent with message_delta and carries the output tokens.
+	Message *anthropicResponse `json:"message,omitempty"`
+	Usage   *anthropicUsage    `json:"usage,omitempty"`
+	Error   *anthropicError    `json:"error,omitempty"`
+}
+
+// CreateCompletion creates a completion for the given prompt and modifier via the Anthropic Messages API.
+// It behaves like OpenAIClient.CreateCompletion: chat sessions are stored in the same format, so a chat can be
+// continued with either provider.
+func (c *AnthropicClient) CreateCompletion(ctx context.Context, chatID string, prompt []string, modifier string, input []string) (string, error) {
+	if err := checkSingleChoice(c.config); err != nil {
+		return "", err
+	}
+	if err := checkNoLogprobs(c.config); err != nil {
+		return "", err
+	}
+	if err := checkNoStructuredOutput(c.config); err != nil {
+		return "", err
+	}
+	messages, history, err := c.buildMessages(chatID, prompt, modifier, input)
+	if err != nil {
+		return "", err
+	}
+	if err = c.checkNoTools(modifier, messages); err != nil {
+		return "", err
+	}
+
+	var receivedMessage openai.ChatCompletionMessage
+	var usage openai.Usage
+	// Output of a failed model that reached the out writer rules out a fallback
+	printed := &outputTracker{w: c.out}
+	retriever := *c
+	retriever.out = printed
+	// The fallback models are tried in order, if a model fails
+	models := completionModels(c.config)
+	var model string
+	for i := range models {
+		model = models[i]
+		var req anthropicRequest
+		req, err = c.newRequest(model, c.fitContextWindowFor(model, messages, history))
+		if err != nil {
+			return "", err
+		}
+		printed.written = false
+		if req.Stream {
+			receivedMessage, usage, err = retriever.retrieveMessageStream(ctx, req)
+		} else {
+			receivedMessage, usage, err = retriever.retrieveMessage(ctx, req)
+		}
+		c.recordModelUsage(ProviderAnthropic, model, chatID, modifier, usage)
+		if i+1 < len(models) && shouldFallBack(err, printed) {
+			slog.Warn("Falling back to the next model", "failed", model, "model", models[i+1], "error", err)
+			continue
+		}
+		break
+	}
+	// Without a model left, a filtered response is kept as received
+	if errors.Is(err, ErrContentFiltered) && receivedMessage.Content != "" {
+		slog.Debug("Response was stopped by the content filter", "model", model)
+		err = nil
+		// Only a streamed response was printed while it was received
+		if !printed.written {
+			_, err = fmt.Fprintln(retriever.out, receivedMessage.Content)
+		}
+	}
+	if errors.Is(err, ErrInterrupted) {
+		return c.keepInterrupted(chatID, model, messages, receivedMessage, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("Model answered", "model", model)
+	slog.Debug("Received message from Anthropic API")
+
+	if err = c.saveChatMessages(chatID, model, messages, receivedMessage); err != nil {
+		return "", err
+	}
+	return receivedMessage.Content, nil
+}
+
+func (c *AnthropicClient) newRequest(model string, messages []openai.ChatCompletionMessage) (anthropicRequest, error) {
+	system, anthropicMessages, err := toAnthropicMessages(messages)
+	if err != nil {
+		return anthropicRequest{}, err
+	}
+
+	maxTokens := c.config.GetInt("maxTokens")
+	if maxTokens <= 0 {
+		maxTokens = defaultAnthropicMaxTokens
+	}
+	req := anthropicRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		System:    system,
+		Messages:  anthropicMessages,
+		Stop:      c.config.GetStringSlice("stop"),
+		Stream:    c.config.GetBool("stream"),
+	}
+	if user := c.config.GetString("user"); user != "" {
+		req.Metadata = &anthropicMetadata{UserID: user}
+	}
+	// Newer Claude models reject requests that set both temperature and
+	// top_p, so top_p is only sent when it deviates from the default.
+	if c.config.IsSet("temperature") {
+		temperature := c.config.GetFloat64("temperature")
+		req.Temperature = &temperature
+	}
+	if topP := c.config.GetFloat64("topP"); topP > 0 && topP < 1 {
+		req.TopP = &topP
+	}
+	return req, nil
+}
+
+// toAnthropicMessages maps the OpenAI-shaped conversation onto the Messages
+// API: system messages are lifted into the top-level system prompt, vision
+// parts become image blocks, and consecutive messages of the same role are
+// merged because the API expects user and assistant turns to alternate.
+func toAnthropicMessages(messages []openai.ChatCompletionMessage) (string, []anthropicMessage, error) {
+	var system []string
+	var converted []anthropicMessage
+	for _, message := range messages {
+		switch message.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleDeveloper:
+			system = append(system, message.Content)
+			continue
+		case openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+		default:
+			slog.Debug("Skipping message with unsupported role for Anthropic: " + message.Role)
+			continue
+		}
+
+		var blocks []anthropicContentBlock
+		if len(message.MultiContent) > 0 {
+			for _, part := range message.MultiContent {
+				block, err := toAnthropicContentBlock(part)
+				if err != nil {
+					return "", nil, err
+				}
+				blocks = append(blocks, block)
+			}
+		} else {
+			blocks = append(blocks, anthropicContentBlock{
+				Type: "text",
+				Text: message.Content,
+			})
+		}
+
+		if last := len(converted) - 1; last >= 0 && converted[last].Role == message.Role {
+			converted[last].Content = append(converted[last].Content, blocks...)
+			continue
+		}
+		converted = append(converted, anthropicMessage{
+			Role:    message.Role,
+			Content: blocks,
+		})
+	}
+	return strings.Join(system, "\n\n"), converted, nil
+}
+
+func toAnthropicContentBlock(part openai.ChatMessagePart) (anthropicContentBlock, error) {
+	switch part.Type {
+	case openai.ChatMessagePartTypeText:
+		return anthropicContentBlock{Type: "text", Text: part.Text}, nil
+	case openai.ChatMessagePartTypeImageURL:
+		if part.ImageURL == nil {
+			return anthropicContentBlock{}, errors.New("image part without URL")
+		}
+		source, err := toAnthropicImageSource(part.ImageURL.URL)
+		if err != nil {
+			return anthropicContentBlock{}, err
+		}
+		return anthropicContentBlock{Type: "image", Source: source}, nil
+	default:
+		return anthropicContentBlock{}, fmt.Errorf("unsupported message part type for Anthropic: %q", part.Type)
+	}
+}
+
+// toAnthropicImageSource converts the data URLs built by buildImageFileData
+// into base64 sources and passes remote images through as URL sources.
+func toAnthropicImageSource(imageURL string) (*anthropicImageSource, error) {
+	if !strings.HasPrefix(imageURL, "data:") {
+		return &anthropicImageSource{Type: "url", URL: imageURL}, nil
+	}
+	header, data, found := strings.Cut(strings.TrimPrefix(imageURL, "data:"), ",")
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !found || !isBase64 {
+		return nil, errors.New("image data URL must be base64 encoded")
+	}
+	return &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+// post sends req to the Messages API. Error statuses are returned as *APIError.
+func (c *AnthropicClient) post(ctx context.Context, req anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var httpReq *http.Request
+	httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+anthropicMessagesSuffix, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+	return c.do(httpReq)
+}
+
+// do authenticates and sends httpReq. Error statuses are returned as *APIError.
+func (c *AnthropicClient) do(httpReq *http.Request) (*http.Response, error) {
+	apiKey, err := c.apiKey()
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("x-api-key", apiKey)
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+
+	resp, err := newRetryingDoer(c.HTTPClient, c.config).Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, newAnthropicAPIError(resp)
+	}
+	return resp, nil
+}
+
+type anthropicModelsResponse struct {
+	Data []struct {
+		ID        string    `json:"id"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"data"`
+	HasMore bool   `json:"has_more"`
+	LastID  string `json:"last_id"`
+}
+
+// ListModels returns the models available via the Messages API. The list is
+// cached for a day.
+func (c *AnthropicClient) ListModels(ctx context.Context) ([]Model, error) {
+	return c.cachedModels(ctx, ProviderAnthropic, c.baseURL, func(ctx context.Context) ([]Model, error) {
+		var models []Model
+		query := url.Values{"limit": {"1000"}}
+		for {
+			httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+anthropicModelsSuffix+"?"+query.Encode(), nil)
+			if err != nil {
+				return nil, err
+			}
+			var resp *http.Response
+			resp, err = c.do(httpReq)
+			if err != nil {
+				return nil, err
+			}
+			var page anthropicModelsResponse
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, model := range page.Data {
+				models = append(models, Model{ID: model.ID, OwnedBy: ProviderAnthropic, Created: model.CreatedAt})
+			}
+			if !page.HasMore || page.LastID == "" {
+				return models, nil
+			}
+			query.Set("after_id", page.LastID)
+		}
+	})
+}
+
+func newAnthropicAPIError(resp *http.Response) error {
+	apiErr := &APIError{
+		Provider:   ProviderAnthropic,
+		StatusCode: resp.StatusCode,
+		Message:    resp.Status,
+	}
+	var errResp struct {
+		Error anthropicError `json:"error"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && json.Unmarshal(data, &errResp) == nil && errResp.Error.Message != "" {
+		apiErr.Type = errResp.Error.Type
+		apiErr.Message = errResp.Error.Message
+	}
+	return apiErr
+}
+
+func (c *AnthropicClient) retrieveMessage(ctx context.Context, req anthropicRequest) (openai.ChatCompletionMessage, openai.Usage, error) {
+	resp, err := c.post(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	defer resp.Body.Close()
+	slog.Debug("Received response")
+
+	var anthropicResp anthropicResponse
+	if err = json.NewDecoder(resp.Body).Decode(&anthropicResp); err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	usage := anthropicResp.Usage.toOpenAI()
+	var content strings.Builder
+	for _, block := range anthropicResp.Content {
+		if block.Type == "text" {
+			content.WriteString(block.Text)
+		}
+	}
+	if content.Len() == 0 {
+		if anthropicResp.StopReason == anthropicStopRefusal {
+			return openai.ChatCompletionMessage{}, usage, ErrContentFiltered
+		}
+		return openai.ChatCompletionMessage{}, usage, ErrEmptyResponse
+	}
+	message := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: content.String(),
+	}
+	if anthropicResp.StopReason == anthropicStopRefusal {
+		// The refusal is returned unprinted, in case a fallback model is left
+		return message, usage, ErrContentFiltered
+	}
+
+	if _, err = fmt.Fprintln(c.out, message.Content); err != nil {
+		return openai.ChatCompletionMessage{}, usage, err
+	}
+	slog.Debug("Printed response")
+	return message, usage, nil
+}
+
+func (c *AnthropicClient) retrieveMessageStream(ctx context.Context, req anthropicRequest) (openai.ChatCompletionMessage, openai.Usage, error) {
+	resp, err := c.post(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	defer resp.Body.Close()
+	slog.Debug("Streaming response")
+
+	receivedMessage := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+	}
+	var usage anthropicUsage
+	refused := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		// Only data lines carry information; the JSON payload repeats the
+		// event name in its type field.
+		data, isData := strings.CutPrefix(scanner.Text(), "data:")
+		if !isData {
+			continue
+		}
+		var event anthropicStreamEvent
+		if err = json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return openai.ChatCompletionMessage{}, usage.toOpenAI(), err
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				usage.InputTokens = event.Message.Usage.InputTokens
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+			refused = refused || event.Delta.StopReason == anthropicStopRefusal
+		case "content_block_delta":
+			if event.Delta.Type != "text_delta" {
+				continue
+			}
+			receivedMessage.Content += event.Delta.Text
+			if _, err = fmt.Fprint(c.out, event.Delta.Text); err != nil {
+				return openai.ChatCompletionMessage{}, usage.toOpenAI(), err
+			}
+		case "error":
+			slog.Debug("Stream error encountered")
+			apiErr := &APIError{Provider: ProviderAnthropic, StatusCode: resp.StatusCode}
+			if event.Error != nil {
+				apiErr.Type = event.Error.Type
+				apiErr.Message = event.Error.Message
+			}
+			return openai.ChatCompletionMessage{}, usage.toOpenAI(), apiErr
+		case "message_stop":
+			slog.Debug("Stream finished")
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			// Keep what was received before the interruption
+			return receivedMessage, usage.toOpenAI(), interruptStream(ctx, c.out)
+		}
+		return openai.ChatCompletionMessage{}, usage.toOpenAI(), err
+	}
+	// Print final linebreak
+	if _, err = fmt.Fprintf(c.out, "\n"); err != nil {
+		slog.Warn("Could not print final linebreak")
+	}
+	if refused {
+		return receivedMessage, usage.toOpenAI(), ErrContentFiltered
+	}
+	return receivedMessage, usage.toOpenAI(), nil
+}
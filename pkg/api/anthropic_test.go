@@ -0,0 +1,314 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+// newAnthropicStandIn starts an httptest stand-in for the Messages API that
+// records the last request and answers with handler.
+func newAnthropicStandIn(t *testing.T, handler func(w http.ResponseWriter, req anthropicRequest)) (*httptest.Server, *http.Request, *anthropicRequest) {
+	t.Helper()
+	var lastHTTPRequest http.Request
+	var lastRequest anthropicRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastHTTPRequest = *r
+		lastRequest = anthropicRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&lastRequest))
+		handler(w, lastRequest)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+	return server, &lastHTTPRequest, &lastRequest
+}
+
+func writeAnthropicMessage(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-test","content":[{"type":"text","text":%q}],"stop_reason":"end_turn"}`, text)
+}
+
+func TestCreateAnthropicClientMissingAPIKey(t *testing.T) {
+	prev, had := os.LookupEnv("ANTHROPIC_API_KEY")
+	require.NoError(t, os.Unsetenv("ANTHROPIC_API_KEY"))
+	t.Cleanup(func() {
+		if had {
+			_ = os.Setenv("ANTHROPIC_API_KEY", prev)
+		}
+	})
+
+	client, err := CreateAnthropicClient(nil, nil)
+	require.ErrorIs(t, err, ErrMissingAnthropicAPIKey)
+	require.Nil(t, client)
+}
+
+func TestCreateAnthropicClientBaseURLValidation(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	t.Setenv("ANTHROPIC_BASE_URL", "http://169.254.169.254/")
+
+	client, err := CreateAnthropicClient(testlib.NewTestCtx(t).Config, nil)
+	require.Error(t, err)
+	require.Nil(t, client)
+	require.Contains(t, err.Error(), "ANTHROPIC_BASE_URL")
+}
+
+func TestAnthropicSimplePrompt(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-test")
+	testCtx.Config.Set("maxTokens", 512)
+	_, httpReq, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		writeAnthropicMessage(w, "Hello World!")
+	})
+
+	var out bytes.Buffer
+	client, err := CreateAnthropicClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, "Hello World!\n", out.String())
+
+	require.Equal(t, anthropicMessagesSuffix, httpReq.URL.Path)
+	require.Equal(t, "test", httpReq.Header.Get("x-api-key"))
+	require.Equal(t, anthropicVersion, httpReq.Header.Get("anthropic-version"))
+	require.Empty(t, httpReq.Header.Get("Authorization"))
+	require.Equal(t, "claude-test", req.Model)
+	require.Equal(t, 512, req.MaxTokens)
+	require.Empty(t, req.System)
+	require.Len(t, req.Messages, 1)
+	require.Equal(t, "user", req.Messages[0].Role)
+	require.Equal(t, "Say: Hello World!", req.Messages[0].Content[0].Text)
+}
+
+func TestAnthropicPersonaAndChatHistory(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	t.Setenv("SHELL", "/bin/bash")
+	_, _, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		writeAnthropicMessage(w, "ls | sort")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	// The first turn maps the persona onto the system prompt.
+	_, err = client.CreateCompletion(context.Background(), "test_chat", []string{"list files"}, "sh", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, req.System)
+	require.Len(t, req.Messages, 1)
+
+	// The second turn replays the stored history with the system message lifted out.
+	_, err = client.CreateCompletion(context.Background(), "test_chat", []string{"sort by name"}, "sh", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, req.System)
+	require.Len(t, req.Messages, 3)
+	require.Equal(t, []string{"user", "assistant", "user"}, []string{req.Messages[0].Role, req.Messages[1].Role, req.Messages[2].Role})
+	require.Equal(t, "ls | sort", req.Messages[1].Content[0].Text)
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	var messages []openai.ChatCompletionMessage
+	messages, err = manager.GetSession("test_chat")
+	require.NoError(t, err)
+	require.Len(t, messages, 5)
+	require.Equal(t, openai.ChatMessageRoleSystem, messages[0].Role)
+	require.Equal(t, openai.ChatMessageRoleAssistant, messages[4].Role)
+}
+
+func TestAnthropicMergesConsecutivePromptsAndImages(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	_, _, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		writeAnthropicMessage(w, "A robot.")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	imageURL := "https://upload.wikimedia.org/wikipedia/en/c/cb/Marvin_%28HHGG%29.jpg"
+	_, err = client.CreateCompletion(context.Background(), "", []string{"what can you see?"}, "txt", []string{"testdata/marvin.jpg", imageURL})
+	require.NoError(t, err)
+
+	require.Len(t, req.Messages, 1)
+	blocks := req.Messages[0].Content
+	require.Len(t, blocks, 3)
+	require.Equal(t, "text", blocks[0].Type)
+	require.Equal(t, "image", blocks[1].Type)
+	require.Equal(t, "base64", blocks[1].Source.Type)
+	require.Equal(t, "image/jpeg", blocks[1].Source.MediaType)
+	require.NotEmpty(t, blocks[1].Source.Data)
+	require.Equal(t, "url", blocks[2].Source.Type)
+	require.Equal(t, imageURL, blocks[2].Source.URL)
+
+	// Two prompts (stdin and argument) are merged into one user turn.
+	_, err = client.CreateCompletion(context.Background(), "", []string{"stdin", "argument"}, "txt", nil)
+	require.NoError(t, err)
+	require.Len(t, req.Messages, 1)
+	require.Len(t, req.Messages[0].Content, 2)
+}
+
+func TestAnthropicStream(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("stream", true)
+	_, httpReq, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		var buf strings.Builder
+		buf.WriteString("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"role\":\"assistant\",\"content\":[],\"usage\":{\"input_tokens\":12,\"output_tokens\":1}}}\n\n")
+		buf.WriteString("event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n")
+		buf.WriteString("event: ping\ndata: {\"type\":\"ping\"}\n\n")
+		for _, part := range []string{"Hello", " World", "!"} {
+			fmt.Fprintf(&buf, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":%q}}\n\n", part)
+		}
+		buf.WriteString("event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n")
+		buf.WriteString("event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":3}}\n\n")
+		buf.WriteString("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+		_, _ = io.WriteString(w, buf.String())
+	})
+
+	var out bytes.Buffer
+	client, err := CreateAnthropicClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, "Hello World!\n", out.String())
+	require.True(t, req.Stream)
+	require.Equal(t, "text/event-stream", httpReq.Header.Get("Accept"))
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, ProviderAnthropic, records[0].Provider)
+	require.Equal(t, 12, records[0].PromptTokens)
+	require.Equal(t, 3, records[0].CompletionTokens)
+}
+
+func TestAnthropicStreamErrorEvent(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("stream", true)
+	newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, "overloaded_error", apiErr.Type)
+}
+
+func TestAnthropicErrorResponse(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"type":"error","error":{"type":"not_found_error","message":"model: claude-nope"}}`)
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "test_chat", []string{"hi"}, "txt", nil)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	require.Equal(t, "not_found_error", apiErr.Type)
+	require.Contains(t, err.Error(), "model: claude-nope")
+	// A failed request must not create the chat session.
+	require.NoFileExists(t, filepath.Join(testCtx.CacheDir, "test_chat"))
+}
+
+func TestAnthropicEmptyResponse(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		_, _ = io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[]}`)
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrEmptyResponse)
+}
+
+func TestAnthropicRetryOverloaded(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-test")
+	testCtx.Config.Set("retry.baseDelay", "1ms")
+	calls := 0
+	newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		calls++
+		if calls == 1 {
+			// Anthropic signals an overloaded API with the non-standard 529
+			w.WriteHeader(529)
+			_, _ = io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+			return
+		}
+		writeAnthropicMessage(w, "Hello World!")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, 2, calls)
+}
+
+func TestAnthropicStructuredOutputUnsupported(t *testing.T) {
+	for key, value := range map[string]any{"jsonMode": true, "jsonSchema": "person.schema.json"} {
+		testCtx := testlib.NewTestCtx(t)
+		testCtx.Config.Set(key, value)
+		testCtx.Config.Set("schemaRetries", 2)
+		newAnthropicStandIn(t, func(http.ResponseWriter, anthropicRequest) {
+			t.Fatal("unexpected request")
+		})
+		client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+		require.NoError(t, err)
+		_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+		require.ErrorIs(t, err, ErrStructuredOutputUnsupported, key)
+	}
+}
@@ -39,12 +39,16 @@ import (
 	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/viper"
 	"github.com/tbckr/sgpt/v2/pkg/chat"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
 	"github.com/tbckr/sgpt/v2/pkg/modifiers"
+	"github.com/tbckr/sgpt/v2/pkg/tools"
 )
 
 const (
 	// envKeyOpenAIApi is the environment variable key for the OpenAI API key.
 	envKeyOpenAIApi = "OPENAI_API_KEY"
+	// envKeyOpenAIAPIBase is the environment variable key for the OpenAI API base URL override.
+	envKeyOpenAIAPIBase = "OPENAI_API_BASE"
 
 	// Defaults for the OpenAI HTTP client. Without these, sgpt inherits
 	// http.Client's zero value and can hang indefinitely when the
@@ -57,15 +61,24 @@ const (
 	defaultDialTimeout           = 10 * time.Second
 	defaultResponseHeaderTimeout = 30 * time.Second
 	defaultTLSHandshakeTimeout   = 10 * time.Second
+
+	// maxToolRounds bounds the model→tool→model loop, so a model that keeps
+	// calling tools cannot run commands forever.
+	maxToolRounds = 10
 )
 
 var (
 	// DefaultModel is the default model used for chat completions.
-	DefaultModel = strings.Clone(openai.GPT3Dot5Turbo)
+	DefaultModel = strings.Clone(openai.GPT4oMini)
 	// ErrMissingAPIKey is returned, if the OPENAI_API_KEY environment variable is not set.
 	ErrMissingAPIKey = fmt.Errorf("%s env variable is not set", envKeyOpenAIApi)
 	// ErrEmptyResponse is returned when the API response contains no choices.
 	ErrEmptyResponse = errors.New("no choices returned in API response")
+	// ErrTooManyToolRounds is returned, if the model still calls tools after maxToolRounds rounds.
+	ErrTooManyToolRounds = fmt.Errorf("model called tools in more than %d consecutive rounds", maxToolRounds)
+	// ErrToolsUnsupported is returned, if tools are declared or a chat session contains tool calls for a provider
+	// that cannot call tools.
+	ErrToolsUnsupported = errors.New("provider does not support tools")
 )
 
 // Completer is the interface that wraps the CreateCompletion method.
@@ -75,115 +88,224 @@ type Completer interface {
 	CreateCompletion(ctx context.Context, chatID string, prompt []string, modifier string, input []string) (string, error)
 }
 
-// ClientOption is a functional option for configuring an OpenAIClient.
-type ClientOption func(*OpenAIClient)
+// ClientOption is a functional option for configuring a provider client.
+type ClientOption func(*baseClient)
 
 // WithSessionManager injects a custom SessionManager into the client.
-// When not provided, CreateClient creates a FilesystemChatSessionManager automatically.
+// When not provided, the client creates a FilesystemChatSessionManager automatically.
 func WithSessionManager(sm chat.SessionManager) ClientOption {
-	return func(c *OpenAIClient) {
+	return func(c *baseClient) {
 		c.chatSessionManager = sm
 	}
 }
 
-// OpenAIClient is a client for the OpenAI API.
-type OpenAIClient struct {
-	HTTPClient         *http.Client
+// WithErrorWriter sets the writer diagnostics like reasoning token counts,
+// reasoning summaries and tool call confirmations are printed to. When not
+// provided, the client writes to os.Stderr.
+func WithErrorWriter(w io.Writer) ClientOption {
+	return func(c *baseClient) {
+		c.errOut = w
+	}
+}
+
+// WithInput sets the reader confirmations for tool calls are read from.
+// When not provided, the client reads from os.Stdin.
+func WithInput(in io.Reader) ClientOption {
+	return func(c *baseClient) {
+		c.in = in
+	}
+}
+
+// baseClient holds the state every provider backend shares: the config, the
+// writer completions are printed to, the writer for diagnostics, the reader
+// confirmations are read from and the chat session manager. It also owns
+// the provider-independent half of a completion - resolving the persona,
+// loading the chat history and building the prompt messages - so that each
+// backend only has to translate those messages to its own wire format.
+type baseClient struct {
 	config             *viper.Viper
-	api                *openai.Client
 	out                io.Writer
+	errOut             io.Writer
+	in                 io.Reader
 	chatSessionManager chat.SessionManager
+	// logprobs of the last retrieved message, if requested
+	logprobs []TokenLogprob
 }
 
-// CreateClient creates a new OpenAI client with the given config and output writer.
-// Optional ClientOptions can be passed to override defaults (e.g. WithSessionManager).
-func CreateClient(config *viper.Viper, out io.Writer, opts ...ClientOption) (*OpenAIClient, error) {
-	// Check, if api key was set
-	apiKey, exists := os.LookupEnv(envKeyOpenAIApi)
-	if !exists {
-		return nil, ErrMissingAPIKey
+// newBaseClient applies opts and falls back to a filesystem-backed session
+// manager if none was injected.
+func newBaseClient(config *viper.Viper, out io.Writer, opts ...ClientOption) (baseClient, error) {
+	base := baseClient{
+		config: config,
+		out:    out,
+		errOut: os.Stderr,
+		in:     os.Stdin,
+	}
+	for _, opt := range opts {
+		opt(&base)
+	}
+	// Fail before anything is sent, not on the first request
+	if _, err := requestHeaders(config); err != nil {
+		return baseClient{}, err
+	}
+	if base.chatSessionManager == nil {
+		chatSessionManager, err := chat.NewFilesystemChatSessionManager(config)
+		if err != nil {
+			return baseClient{}, err
+		}
+		base.chatSessionManager = chatSessionManager
+		slog.Debug("Chat session manager initialized")
 	}
-	clientConfig := openai.DefaultConfig(apiKey)
+	return base, nil
+}
 
-	// Set HTTP Proxy and sensible timeouts; the previous zero-value
-	// http.Client would hang forever on a slow or unresponsive endpoint.
-	transport := &http.Transport{
+// newTransport returns the transport shared by all provider backends.
+// It sets an HTTP proxy and sensible timeouts; the previous zero-value
+// http.Client would hang forever on a slow or unresponsive endpoint.
+// The TLS configuration is taken from the tls section of config.
+func newTransport(config *viper.Viper) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           (&net.Dialer{Timeout: defaultDialTimeout}).DialContext,
 		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
 		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
+
+// newHTTPClient returns an HTTP client using newTransport.
+func newHTTPClient(config *viper.Viper) (*http.Client, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
 	}
-	httpClient := &http.Client{
+	return &http.Client{
 		Transport: transport,
-	}
-	clientConfig.HTTPClient = httpClient
+	}, nil
+}
+
+// OpenAIClient is a client for the OpenAI API.
+type OpenAIClient struct {
+	baseClient
 
-	// Validate OPENAI_API_BASE before applying it; an unvalidated override
-	// can redirect the Authorization header to an attacker-controlled host.
-	// The insecureAPIBase opt-out lets users with single-label LAN hostnames
-	// (e.g. http://thinkbox:8080/v1) bypass validation entirely.
-	allowInsecure := false
-	if config != nil {
-		allowInsecure = config.GetBool("insecureAPIBase")
+	HTTPClient *http.Client
+	api        *openai.Client
+	endpoint   string
+}
+
+// CreateClient creates a new OpenAI client with the given config and output writer.
+// Optional ClientOptions can be passed to override defaults (e.g. WithSessionManager).
+// If the azure provider is selected, the client talks to Azure OpenAI instead.
+func CreateClient(config *viper.Viper, out io.Writer, opts ...ClientOption) (*OpenAIClient, error) {
+	var clientConfig openai.ClientConfig
+	var auth *keyAuth
+	var err error
+	if isAzureProvider(config) {
+		clientConfig, auth, err = newAzureClientConfig(config)
+	} else {
+		clientConfig, auth, err = newOpenAIClientConfig(config)
 	}
-	if baseURL, isSet := os.LookupEnv("OPENAI_API_BASE"); isSet {
-		if err := validateAPIBaseURL(baseURL, allowInsecure); err != nil {
-			return nil, err
-		}
-		clientConfig.BaseURL = baseURL
-		if allowInsecure {
-			slog.Warn("OPENAI_API_BASE validation skipped via insecure-api-base", "url", baseURL)
-		} else {
-			slog.Debug("OPENAI_API_BASE override active", "url", baseURL)
-		}
+	if err != nil {
+		return nil, err
 	}
 
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	doer := newRetryingDoer(httpClient, config)
+	doer.auth = auth
+	clientConfig.HTTPClient = doer
+
 	// Build client and apply options
+	base, err := newBaseClient(config, out, opts...)
+	if err != nil {
+		return nil, err
+	}
 	client := &OpenAIClient{
+		baseClient: base,
 		HTTPClient: httpClient,
-		config:     config,
 		api:        openai.NewClientWithConfig(clientConfig),
-		out:        out,
-	}
-	for _, opt := range opts {
-		opt(client)
+		endpoint:   clientConfig.BaseURL,
 	}
 
-	// Fall back to filesystem-backed session manager if none was injected
-	if client.chatSessionManager == nil {
-		chatSessionManager, err := chat.NewFilesystemChatSessionManager(config)
-		if err != nil {
-			return nil, err
+	slog.Debug("OpenAI client created")
+	return client, nil
+}
+
+// newOpenAIClientConfig builds the go-openai config for OpenAI and compatible
+// endpoints. The API key is set on the requests by the returned keyAuth.
+func newOpenAIClientConfig(config *viper.Viper) (openai.ClientConfig, *keyAuth, error) {
+	// Check, if api key was set
+	apiKey, err := newAPIKey(config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	if err != nil {
+		return openai.ClientConfig{}, nil, err
+	}
+	clientConfig := openai.DefaultConfig("")
+
+	// Validate the apiBase of the profile or OPENAI_API_BASE before applying
+	// it; an unvalidated override can redirect the Authorization header to an
+	// attacker-controlled host. The insecureAPIBase opt-out lets users with
+	// single-label LAN hostnames (e.g. http://thinkbox:8080/v1) bypass
+	// validation entirely.
+	if baseURL, source, isSet := lookupAPIBase(config, envKeyOpenAIAPIBase); isSet {
+		if err = validateAPIBaseURL(config, source, baseURL); err != nil {
+			return openai.ClientConfig{}, nil, err
+		}
+		clientConfig.BaseURL = baseURL
+		if allowInsecureAPIBase(config) {
+			slog.Warn(source+" validation skipped via insecure-api-base", "url", baseURL)
+		} else {
+			slog.Debug(source+" override active", "url", baseURL)
 		}
-		client.chatSessionManager = chatSessionManager
-		slog.Debug("Chat session manager initialized")
 	}
+	return clientConfig, &keyAuth{key: apiKey, header: "Authorization", scheme: "Bearer "}, nil
+}
 
-	slog.Debug("OpenAI client created")
-	return client, nil
+// allowInsecureAPIBase reports whether base URL validation was disabled via
+// insecureAPIBase. A nil config keeps validation enabled.
+func allowInsecureAPIBase(config *viper.Viper) bool {
+	if config == nil {
+		return false
+	}
+	return config.GetBool("insecureAPIBase")
 }
 
-// validateAPIBaseURL accepts https for any host, and http only for loopback
+// validateAPIBaseURL validates the base URL read from source, unless
+// insecureAPIBase is set by the flag, the active profile or the config file.
+// It accepts https for any host, and http only for loopback
 // (localhost, 127.0.0.0/8, ::1) or private addresses (RFC1918 + RFC4193 ULA).
 // This blocks the cloud IMDS attack vector (169.254.0.0/16 is link-local, not
 // private) while permitting the dominant local-LLM pattern of plain-http
 // containers on the same host. When allowInsecure is true, the check is
 // skipped entirely so users with single-label LAN hostnames (e.g.
-// http://thinkbox:8080/v1) that can't be classified by IP literal can opt out.
+// http://thinkbox:8080/v1) that can't be classified by IP literal can opt out,
+// typically in the profile of that host.
 //
 // Note: 100.64.0.0/10 (CGNAT, RFC6598) is intentionally NOT in the allow-list
 // because IsPrivate() does not cover it; cloud and Tailscale environments use
 // this range for infrastructure that we don't want to silently route to.
-func validateAPIBaseURL(raw string, allowInsecure bool) error {
+func validateAPIBaseURL(config *viper.Viper, source, raw string) error {
+	return validateBaseURL(source, raw, allowInsecureAPIBase(config))
+}
+
+// validateBaseURL applies the validateAPIBaseURL rules to the base URL of any
+// provider backend. envKey names the variable the URL was read from so that
+// error messages point the user at the right setting.
+func validateBaseURL(envKey, raw string, allowInsecure bool) error {
 	if allowInsecure {
 		return nil
 	}
 	u, err := url.Parse(raw)
 	if err != nil {
-		return fmt.Errorf("OPENAI_API_BASE must be a valid URL: %w", err)
+		return fmt.Errorf("%s must be a valid URL: %w", envKey, err)
 	}
 	if u.Host == "" {
-		return fmt.Errorf("OPENAI_API_BASE must include a host: %q", raw)
+		return fmt.Errorf("%s must include a host: %q", envKey, raw)
 	}
 	switch u.Scheme {
 	case "https":
@@ -195,20 +317,20 @@ func validateAPIBaseURL(raw string, allowInsecure bool) error {
 		}
 		ip := net.ParseIP(host)
 		if ip == nil {
-			return fmt.Errorf("OPENAI_API_BASE: http only allowed for loopback or RFC1918/ULA hosts; use https or set insecureAPIBase=true (--insecure-api-base or insecureAPIBase: true in config.yaml) to override: %q", raw)
+			return fmt.Errorf("%s: http only allowed for loopback or RFC1918/ULA hosts; use https or set insecureAPIBase=true (--insecure-api-base or insecureAPIBase: true in config.yaml) to override: %q", envKey, raw)
 		}
 		// Explicitly reject link-local (IPv4 169.254/16 — cloud IMDS;
 		// IPv6 fe80::/10 — cross-VM same-segment exfiltration) and the
 		// IPv4 unspecified range (0.0.0.0/8 — routes ambiguously).
 		if ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
-			return fmt.Errorf("OPENAI_API_BASE: http to link-local or unspecified addresses is not allowed: %q", raw)
+			return fmt.Errorf("%s: http to link-local or unspecified addresses is not allowed: %q", envKey, raw)
 		}
 		if ip.IsLoopback() || ip.IsPrivate() {
 			return nil
 		}
-		return fmt.Errorf("OPENAI_API_BASE: http only allowed for loopback or RFC1918/ULA hosts; use https or set insecureAPIBase=true (--insecure-api-base or insecureAPIBase: true in config.yaml) to override: %q", raw)
+		return fmt.Errorf("%s: http only allowed for loopback or RFC1918/ULA hosts; use https or set insecureAPIBase=true (--insecure-api-base or insecureAPIBase: true in config.yaml) to override: %q", envKey, raw)
 	default:
-		return fmt.Errorf("OPENAI_API_BASE scheme must be http or https: %q", raw)
+		return fmt.Errorf("%s scheme must be http or https: %q", envKey, raw)
 	}
 }
 
@@ -216,18 +338,269 @@ func validateAPIBaseURL(raw string, allowInsecure bool) error {
 // and the completion is added to the chat with this ID. If no chatID is provided, only the modifier and prompt are
 // used to create the completion. The completion is printed to the out writer of the client and returned as a string.
 func (c *OpenAIClient) CreateCompletion(ctx context.Context, chatID string, prompt []string, modifier string, input []string) (string, error) {
-	var messages []openai.ChatCompletionMessage
-	var err error
+	messages, history, err := c.buildMessages(chatID, prompt, modifier, input)
+	if err != nil {
+		return "", err
+	}
+
+	// Create request
+	req, err := c.newChatRequest(messages, history)
+	if err != nil {
+		return "", err
+	}
+	jsonOutput, err := isJSONOutput(c.config)
+	if err != nil {
+		return "", err
+	}
+	if req.N > 1 {
+		// All choices are printed at once, after they are complete
+		req.Stream = false
+	}
+	if req.Stream {
+		// Streamed responses only report usage on request
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	// Declare tools from config and persona
+	availableTools, err := c.loadTools(modifier)
+	if err != nil {
+		return "", err
+	}
+	var toolRunner *tools.Runner
+	if len(availableTools) > 0 {
+		for _, tool := range availableTools {
+			req.Tools = append(req.Tools, tool.Definition())
+		}
+		// Prompts go to the error writer, so they never mix with the answer,
+		// e.g. JSON read by a script
+		toolRunner = tools.NewRunner(availableTools, c.in, c.errOut, APIKeyEnvKeys(c.config)...)
+		slog.Debug("Declared tools", "count", len(availableTools))
+	}
+
+	// Request JSON output, if configured
+	structured, err := newStructuredOutput(c.config)
+	if err != nil {
+		return "", err
+	}
+	if req.N > 1 && (len(req.Tools) > 0 || structured != nil) {
+		return "", ErrChoicesWithTools
+	}
+	// Output of a failed model that reached the out writer rules out a fallback
+	printed := &outputTracker{w: c.out}
+	tracked := *c
+	tracked.out = printed
+	retriever := &tracked
+	if structured != nil {
+		req.ResponseFormat = structured.format
+	}
+	if structured != nil || jsonOutput {
+		// Hold back the output until it validates, so scripts never see invalid JSON
+		quiet := tracked
+		quiet.out = io.Discard
+		retriever = &quiet
+	}
+
+	// Answer repeated requests from the response cache, if enabled
+	responses := c.newResponseCache(chatID, req)
+	cachedMessage, cacheHit := responses.get()
 
+	// Retrieve response
+	// Retrieve the completion and print to the out writer. The received message is returned to save it to the chat and
+	// to return it as a string (copy to clipboard). As long as the model calls tools, their results are sent back and
+	// the completion is retrieved again. Structured output that does not validate is re-requested the same way.
+	var receivedMessage openai.ChatCompletionMessage
+	var usage openai.Usage
+	toolRounds, schemaRetries, reasoningTokens := 0, 0, 0
+	// Rejected structured output and its corrections are sent from this
+	// index of messages on, but never saved to the chat session
+	rejectedFrom := -1
+	// The fallback models are tried in order, if a model fails
+	models, fallback := completionModels(c.config), 0
+	for {
+		printed.written = false
+		if cacheHit && toolRounds == 0 && schemaRetries == 0 {
+			receivedMessage, err = retriever.replayMessage(cachedMessage)
+		} else if req.Stream {
+			receivedMessage, usage, err = retriever.retrieveChatCompletionStream(ctx, req)
+		} else {
+			receivedMessage, usage, err = retriever.retrieveChatCompletion(ctx, req)
+		}
+		// Every round is billed, even if it fails afterwards
+		c.recordModelUsage(providerName(c.config), req.Model, chatID, modifier, usage)
+		if usage.CompletionTokensDetails != nil {
+			reasoningTokens += usage.CompletionTokensDetails.ReasoningTokens
+		}
+		if fallback+1 < len(models) && shouldFallBack(err, printed) {
+			fallback++
+			slog.Warn("Falling back to the next model", "failed", req.Model, "model", models[fallback], "error", err)
+			if err = c.useModel(&req, models[fallback], messages, history); err != nil {
+				return "", err
+			}
+			continue
+		}
+		// Without a model left, a filtered response is kept as received
+		if errors.Is(err, ErrContentFiltered) && receivedMessage.Content != "" {
+			slog.Debug("Response was stopped by the content filter", "model", req.Model)
+			err = nil
+			// Only a streamed response was printed while it was received
+			if !printed.written {
+				_, err = fmt.Fprintln(retriever.out, receivedMessage.Content)
+			}
+		}
+		if errors.Is(err, ErrInterrupted) {
+			return c.keepInterrupted(chatID, req.Model, withoutRejected(messages, rejectedFrom), receivedMessage, err)
+		}
+		if err != nil {
+			return "", err
+		}
+		// Set role of received message, if not set
+		// This seems to be a bug in the OpenAI API for now
+		if receivedMessage.Role == "" {
+			receivedMessage.Role = openai.ChatMessageRoleAssistant
+		}
+
+		slog.Debug("Received message from OpenAI API")
+
+		if len(receivedMessage.ToolCalls) > 0 && toolRunner != nil {
+			if toolRounds >= maxToolRounds {
+				return "", ErrTooManyToolRounds
+			}
+			toolRounds++
+			messages, err = runToolCalls(ctx, toolRunner, messages, receivedMessage)
+			if err != nil {
+				return "", err
+			}
+			req.Messages = c.fitContextWindowFor(req.Model, messages, history)
+			continue
+		}
+		if structured == nil {
+			break
+		}
+
+		validationErr := structured.validate(receivedMessage.Content)
+		if validationErr == nil {
+			if jsonOutput {
+				break
+			}
+			if _, err = fmt.Fprintln(c.out, receivedMessage.Content); err != nil {
+				return "", err
+			}
+			break
+		}
+		slog.Debug("Response failed validation", "error", validationErr, "response", receivedMessage.Content)
+		if schemaRetries >= structured.retries {
+			return "", fmt.Errorf("%w: %w", ErrSchemaValidation, validationErr)
+		}
+		schemaRetries++
+		if rejectedFrom < 0 {
+			rejectedFrom = len(messages)
+		}
+		messages = append(messages, receivedMessage, structured.correction(validationErr))
+		req.Messages = c.fitContextWindowFor(req.Model, messages, history)
+	}
+	slog.Debug("Model answered", "model", req.Model)
+
+	if err = c.printLogprobs(receivedMessage.Content, retriever.logprobs); err != nil {
+		return "", err
+	}
+	c.printReasoningTokens(reasoningTokens)
+
+	// An answer of a fallback model is not cached for the request to the first one
+	if (!cacheHit || schemaRetries > 0) && fallback == 0 {
+		responses.put(receivedMessage)
+	}
+	if err = c.saveChatMessages(chatID, req.Model, withoutRejected(messages, rejectedFrom), receivedMessage); err != nil {
+		return "", err
+	}
+	// Return received message
+	return receivedMessage.Content, nil
+}
+
+// withoutRejected returns messages up to rejectedFrom, the index of the first
+// rejected structured output, or all messages if none was rejected. Tool
+// calls after a rejected answer are dropped with it, so the chat session
+// continues with the prompt and the valid answer only.
+func withoutRejected(messages []openai.ChatCompletionMessage, rejectedFrom int) []openai.ChatCompletionMessage {
+	if rejectedFrom < 0 {
+		return messages
+	}
+	return messages[:rejectedFrom]
+}
+
+// newChatRequest returns the request for messages with the model, the
+// generation parameters and the logprobs of the config. The messages are
+// trimmed to the context window of the model.
+func (c *OpenAIClient) newChatRequest(messages []openai.ChatCompletionMessage, history int) (openai.ChatCompletionRequest, error) {
+	req := openai.ChatCompletionRequest{
+		Messages: c.fitContextWindow(messages, history),
+		Model:    c.config.GetString("model"),
+		Stream:   c.config.GetBool("stream"),
+		User:     c.config.GetString("user"),
+	}
+	if err := applyGenerationParams(c.config, &req); err != nil {
+		return openai.ChatCompletionRequest{}, err
+	}
+	if err := applyLogprobs(c.config, &req); err != nil {
+		return openai.ChatCompletionRequest{}, err
+	}
+	return req, nil
+}
+
+// recordModelUsage appends the token usage of a request to model to the
+// usage ledger. The model is passed in, as it differs from the configured
+// chat model for fallback models, embeddings and images. Failing to record
+// usage is logged but never fails the completion.
+func (c *baseClient) recordModelUsage(provider, model, chatID, modifier string, usage openai.Usage) {
+	if !ledger.Enabled(c.config) || (usage.PromptTokens == 0 && usage.CompletionTokens == 0) {
+		return
+	}
+	record := ledger.Record{
+		Provider:         provider,
+		Model:            model,
+		Persona:          modifier,
+		ChatID:           chatID,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		Cost:             ledger.Cost(c.config, model, usage.PromptTokens, usage.CompletionTokens),
+	}
+	if err := ledger.Append(c.config, record); err != nil {
+		slog.Warn("Could not record usage", "error", err)
+	}
+}
+
+// runToolCalls runs the tool calls of received and appends the assistant
+// message and the tool results to messages.
+func runToolCalls(ctx context.Context, runner *tools.Runner, messages []openai.ChatCompletionMessage, received openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
+	messages = append(messages, received)
+	for _, call := range received.ToolCalls {
+		result, err := runner.Run(ctx, call)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:       openai.ChatMessageRoleTool,
+			Content:    result,
+			ToolCallID: call.ID,
+		})
+	}
+	return messages, nil
+}
+
+// buildMessages assembles the conversation sent to the provider: the existing
+// chat history (or the persona's system message for a fresh conversation)
+// followed by the prompt messages. It also returns the number of history
+// messages, i.e. the index of the first prompt message.
+func (c *baseClient) buildMessages(chatID string, prompt []string, modifier string, input []string) ([]openai.ChatCompletionMessage, int, error) {
+	var messages []openai.ChatCompletionMessage
 	isChat := chatID != ""
 
 	// Load existing chat messages:
 	// If this is a chat, load existing messages from chat session.
 	// Optionally, adds a modifier message to the chat as well.
-	var loadedMessages []openai.ChatCompletionMessage
-	loadedMessages, err = c.loadChatMessages(isChat, chatID, modifier)
+	loadedMessages, err := c.loadChatMessages(isChat, chatID, modifier)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 	messages = append(messages, loadedMessages...)
 
@@ -235,54 +608,86 @@ func (c *OpenAIClient) CreateCompletion(ctx context.Context, chatID string, prom
 	var promptMessages []openai.ChatCompletionMessage
 	promptMessages, err = c.createPromptMessages(prompt, input)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 	messages = append(messages, promptMessages...)
 	slog.Debug("Added prompt message")
+	return messages, len(loadedMessages), nil
+}
 
-	// Create request
-	req := openai.ChatCompletionRequest{
-		Messages:    messages,
-		Model:       c.config.GetString("model"),
-		MaxTokens:   c.config.GetInt("max-tokens"),
-		Temperature: float32(c.config.GetFloat64("temperature")),
-		TopP:        float32(c.config.GetFloat64("top-p")),
-		Stream:      c.config.GetBool("stream"),
+// loadTools returns the tools declared in config merged with the tools of the
+// persona modifier.
+func (c *baseClient) loadTools(modifier string) ([]tools.Tool, error) {
+	configTools, err := tools.FromConfig(c.config)
+	if err != nil {
+		return nil, err
 	}
-
-	// Retrieve response
-	// Retrieve the completion and print to the out writer. The received message is returned to save it to the chat and
-	// to return it as a string (copy to clipboard).
-	var receivedMessage openai.ChatCompletionMessage
-	if c.config.GetBool("stream") {
-		receivedMessage, err = c.retrieveChatCompletionStream(ctx, req)
-	} else {
-		receivedMessage, err = c.retrieveChatCompletion(ctx, req)
+	var persona modifiers.Persona
+	persona, err = modifiers.GetPersona(c.config, modifier)
+	if err != nil {
+		return nil, err
 	}
+	return tools.Merge(configTools, persona.Tools), nil
+}
+
+// checkNoTools returns ErrToolsUnsupported for a provider that cannot call
+// tools, if the config or the persona of modifier declare tools or if the
+// chat session in messages contains tool calls or results. Dropping them
+// would silently ignore the tools or leave the model with a broken history.
+func (c *baseClient) checkNoTools(modifier string, messages []openai.ChatCompletionMessage) error {
+	declared, err := c.loadTools(modifier)
 	if err != nil {
-		return "", err
+		return err
 	}
-	// Set role of received message, if not set
-	// This seems to be a bug in the OpenAI API for now
-	if receivedMessage.Role == "" {
-		receivedMessage.Role = openai.ChatMessageRoleAssistant
+	if len(declared) > 0 {
+		return fmt.Errorf("%w: %s", ErrToolsUnsupported, providerName(c.config))
 	}
+	for _, message := range messages {
+		if message.Role == openai.ChatMessageRoleTool || len(message.ToolCalls) > 0 {
+			return fmt.Errorf("%w: %s: the chat session contains tool calls", ErrToolsUnsupported, providerName(c.config))
+		}
+	}
+	return nil
+}
 
-	slog.Debug("Received message from OpenAI API")
+// saveChatMessages appends the received message to messages and saves the
+// result together with the model that answered, if chatID names a chat
+// session. Without a chat session it is a no-op.
+func (c *baseClient) saveChatMessages(chatID, model string, messages []openai.ChatCompletionMessage, received openai.ChatCompletionMessage) error {
+	if chatID == "" {
+		return nil
+	}
+	messages = append(messages, received)
+	if err := c.chatSessionManager.SaveSession(chatID, messages); err != nil {
+		return err
+	}
+	slog.Debug("Saved chat session")
+	c.saveAnsweringModel(chatID, len(messages)-1, model)
+	return nil
+}
 
-	// If a session was provided, save received message to this chat
-	if isChat {
-		messages = append(messages, receivedMessage)
-		if err = c.chatSessionManager.SaveSession(chatID, messages); err != nil {
-			return "", err
+// saveAnsweringModel records the model that answered the message at index in
+// the metadata of the chat session, if the session manager stores metadata.
+// Failing to record it is logged but never fails the completion.
+func (c *baseClient) saveAnsweringModel(chatID string, index int, model string) {
+	store, ok := c.chatSessionManager.(chat.MetadataStore)
+	if !ok {
+		return
+	}
+	metadata, err := store.GetMetadata(chatID)
+	if err == nil {
+		if metadata.Models == nil {
+			metadata.Models = make(map[int]string)
 		}
-		slog.Debug("Saved chat session")
+		metadata.Models[index] = model
+		err = store.SaveMetadata(chatID, metadata)
+	}
+	if err != nil {
+		slog.Warn("Could not save chat session metadata", "error", err)
 	}
-	// Return received message
-	return receivedMessage.Content, nil
 }
 
-func (c *OpenAIClient) loadChatMessages(isChat bool, chatID, modifier string) (messages []openai.ChatCompletionMessage, err error) {
+func (c *baseClient) loadChatMessages(isChat bool, chatID, modifier string) (messages []openai.ChatCompletionMessage, err error) {
 	chatExists := false
 	// Load existing chat messages
 	if isChat {
@@ -322,7 +727,7 @@ func (c *OpenAIClient) loadChatMessages(isChat bool, chatID, modifier string) (m
 	return
 }
 
-func (c *OpenAIClient) createPromptMessages(prompts, input []string) (messages []openai.ChatCompletionMessage, err error) {
+func (c *baseClient) createPromptMessages(prompts, input []string) (messages []openai.ChatCompletionMessage, err error) {
 	if len(input) > 0 {
 		// Request to the gpt-4-vision API
 		slog.Warn("The GPT-4 Vision API is in beta and may not work as expected")
@@ -378,7 +783,7 @@ func (c *OpenAIClient) createPromptMessages(prompts, input []string) (messages [
 	return messages, nil
 }
 
-func (c *OpenAIClient) buildImageFileData(inputFile string) (imageData string, err error) {
+func (c *baseClient) buildImageFileData(inputFile string) (imageData string, err error) {
 	// Reject paths outside the working directory so --input cannot
 	// exfiltrate arbitrary files (e.g. /etc/passwd, ~/.ssh/id_rsa)
 	// to the OpenAI API.
@@ -406,35 +811,57 @@ func (c *OpenAIClient) buildImageFileData(inputFile string) (imageData string, e
 	return
 }
 
-func (c *OpenAIClient) retrieveChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (message openai.ChatCompletionMessage, err error) {
+func (c *OpenAIClient) retrieveChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (message openai.ChatCompletionMessage, usage openai.Usage, err error) {
 	var resp openai.ChatCompletionResponse
 	resp, err = c.api.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return
 	}
 	slog.Debug("Received response")
+	usage = resp.Usage
 	if len(resp.Choices) == 0 {
-		return openai.ChatCompletionMessage{}, ErrEmptyResponse
+		return openai.ChatCompletionMessage{}, usage, ErrEmptyResponse
+	}
+	if len(resp.Choices) > 1 {
+		message, err = c.pickChoice(ctx, resp.Choices)
+		return
 	}
 	message = resp.Choices[0].Message
+	c.logprobs = convertLogprobs(resp.Choices[0].LogProbs)
+	// The reasoning is shown, but never sent back or stored
+	if message.ReasoningContent != "" {
+		c.printReasoning(message.ReasoningContent + "\n")
+	}
+	message.ReasoningContent = ""
 
+	// Tool call rounds usually carry no text
+	if message.Content == "" && len(message.ToolCalls) > 0 {
+		return
+	}
+	if resp.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+		// The filtered response is returned unprinted, in case a fallback model is left
+		return message, usage, ErrContentFiltered
+	}
 	_, err = fmt.Fprintln(c.out, message.Content)
 	if err != nil {
-		return openai.ChatCompletionMessage{}, err
+		return openai.ChatCompletionMessage{}, usage, err
 	}
 	slog.Debug("Printed response")
 	return
 }
 
-func (c *OpenAIClient) retrieveChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error) {
+func (c *OpenAIClient) retrieveChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionMessage, openai.Usage, error) {
 	stream, err := c.api.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		return openai.ChatCompletionMessage{}, err
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
 	}
 	defer stream.Close()
 	slog.Debug("Streaming response")
 
 	var receivedMessage openai.ChatCompletionMessage
+	var usage openai.Usage
+	reasoning, filtered := false, false
+	c.logprobs = nil
 	for {
 		response, streamErr := stream.Recv()
 		if errors.Is(streamErr, io.EOF) {
@@ -442,27 +869,82 @@ func (c *OpenAIClient) retrieveChatCompletionStream(ctx context.Context, req ope
 			break
 		}
 		if streamErr != nil {
+			if ctx.Err() != nil {
+				// Keep what was received before the interruption
+				return receivedMessage, usage, interruptStream(ctx, c.out)
+			}
 			slog.Debug("Stream error encountered")
-			return openai.ChatCompletionMessage{}, streamErr
+			return openai.ChatCompletionMessage{}, usage, streamErr
 		}
 
+		// With include_usage, the last chunk carries the usage and no choices
+		if response.Usage != nil {
+			usage = *response.Usage
+		}
 		if len(response.Choices) == 0 {
 			continue
 		}
+		if response.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+			filtered = true
+		}
+		accumulateToolCalls(&receivedMessage, response.Choices[0].Delta.ToolCalls)
+		c.logprobs = append(c.logprobs, convertStreamLogprobs(response.Choices[0].Logprobs)...)
+		if delta := response.Choices[0].Delta.ReasoningContent; delta != "" {
+			reasoning = true
+			c.printReasoning(delta)
+		}
 		receivedContent := response.Choices[0].Delta.Content
 		// 1. Append received content to message
 		receivedMessage.Content += receivedContent
 		// 2. Print received content
 		_, err = fmt.Fprint(c.out, receivedContent)
 		if err != nil {
-			return openai.ChatCompletionMessage{}, err
+			return openai.ChatCompletionMessage{}, usage, err
 		}
 	}
+	if reasoning {
+		c.printReasoning("\n")
+	}
 	// Print final linebreak
-	_, err = fmt.Fprintf(c.out, "\n")
-	if err != nil {
-		slog.Warn("Could not print final linebreak")
+	if receivedMessage.Content != "" || len(receivedMessage.ToolCalls) == 0 {
+		_, err = fmt.Fprintf(c.out, "\n")
+		if err != nil {
+			slog.Warn("Could not print final linebreak")
+		}
+	}
+	if filtered {
+		// The filtered response is returned, in case no fallback model is left
+		return receivedMessage, usage, ErrContentFiltered
 	}
 	// Return received message to save it to the chat session
-	return receivedMessage, nil
+	return receivedMessage, usage, nil
+}
+
+// accumulateToolCalls merges streamed tool call fragments into message. The
+// first fragment of a call carries its ID and name, the following fragments
+// append to the arguments of the call at the same index.
+func accumulateToolCalls(message *openai.ChatCompletionMessage, deltas []openai.ToolCall) {
+	for _, delta := range deltas {
+		index := len(message.ToolCalls) - 1
+		if delta.Index != nil {
+			index = *delta.Index
+		} else if delta.ID != "" {
+			index = len(message.ToolCalls)
+		}
+		if index < 0 {
+			index = 0
+		}
+		for len(message.ToolCalls) <= index {
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+		}
+		call := &message.ToolCalls[index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		call.Function.Name += delta.Function.Name
+		call.Function.Arguments += delta.Function.Arguments
+	}
 }
@@ -0,0 +1,126 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+// DefaultAudioModel is used when neither the audio.model config key nor the
+// --model flag of the transcribe and translate commands is set.
+const DefaultAudioModel = openai.Whisper1
+
+// ErrAudioUnsupported is returned, if the selected provider cannot transcribe audio.
+var ErrAudioUnsupported = errors.New("provider does not support audio transcription")
+
+// AudioRequest describes an audio file to transcribe or translate.
+type AudioRequest struct {
+	Model string
+	// File is the audio file. It must be inside the working directory.
+	File string
+	// Translate translates the speech to English instead of transcribing it.
+	Translate bool
+	// Language is the ISO-639-1 language of the speech, e.g. "de". It
+	// improves accuracy and latency of transcriptions.
+	Language string
+	// Prompt guides the style of the transcript or spells out uncommon words.
+	Prompt string
+	// Format is the response format: text, srt, vtt or verbose_json. Empty
+	// means text.
+	Format string
+}
+
+// Transcriber is the interface that wraps the Transcribe method. It is
+// implemented by the OpenAI and Azure clients.
+type Transcriber interface {
+	// Transcribe returns the transcript of the audio file in the requested format.
+	Transcribe(ctx context.Context, req AudioRequest) (string, error)
+}
+
+// Transcribe transcribes or translates an audio file with the audio API.
+func (c *OpenAIClient) Transcribe(ctx context.Context, req AudioRequest) (string, error) {
+	// Reject paths outside the working directory like --input, so a
+	// recording cannot be swapped for an arbitrary file.
+	resolved, err := fs.ResolveUnderCwd(req.File)
+	if err != nil {
+		return "", err
+	}
+	var ext string
+	_, ext, err = fs.GetAudioFileType(resolved)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	data, err = fs.LoadAudioFromFile(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	// The API detects the format by the file name, so it must carry the
+	// extension of the sniffed content type.
+	name := filepath.Base(resolved)
+	if !strings.EqualFold(filepath.Ext(name), "."+ext) {
+		name += "." + ext
+	}
+	format := openai.AudioResponseFormat(req.Format)
+	if format == "" {
+		format = openai.AudioResponseFormatText
+	}
+	audioReq := openai.AudioRequest{
+		Model:    req.Model,
+		FilePath: name,
+		Reader:   bytes.NewReader(data),
+		Prompt:   req.Prompt,
+		Format:   format,
+	}
+
+	var resp openai.AudioResponse
+	if req.Translate {
+		slog.Debug("Requesting translation", "file", name, "model", req.Model)
+		resp, err = c.api.CreateTranslation(ctx, audioReq)
+	} else {
+		slog.Debug("Requesting transcription", "file", name, "model", req.Model)
+		audioReq.Language = req.Language
+		resp, err = c.api.CreateTranscription(ctx, audioReq)
+	}
+	if err != nil {
+		return "", err
+	}
+	if format != openai.AudioResponseFormatVerboseJSON && format != openai.AudioResponseFormatJSON {
+		return resp.Text, nil
+	}
+	var out []byte
+	out, err = json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
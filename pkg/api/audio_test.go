@@ -0,0 +1,148 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+// mp3Header is enough for content sniffing to detect an MP3 file.
+var mp3Header = []byte("ID3\x04\x00\x00\x00\x00\x00\x00")
+
+type audioForm struct {
+	fileName string
+	file     []byte
+	fields   map[string]string
+}
+
+func registerAudioResponder(t *testing.T, endpoint, contentType, body string) *audioForm {
+	t.Helper()
+	form := &audioForm{}
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/audio/"+endpoint, func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, req.ParseMultipartForm(1<<20))
+		file, header, err := req.FormFile("file")
+		require.NoError(t, err)
+		form.fileName = header.Filename
+		form.file, err = io.ReadAll(file)
+		require.NoError(t, err)
+		form.fields = map[string]string{}
+		for key, values := range req.MultipartForm.Value {
+			form.fields[key] = values[0]
+		}
+		resp := httpmock.NewStringResponse(http.StatusOK, body)
+		resp.Header.Set("Content-Type", contentType)
+		return resp, nil
+	})
+	return form
+}
+
+func writeAudioFile(t *testing.T, name string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), mp3Header, 0o600))
+}
+
+func TestTranscribe(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	writeAudioFile(t, "standup")
+	form := registerAudioResponder(t, "transcriptions", "text/plain", "Hello team.\n")
+
+	transcript, err := client.Transcribe(context.Background(), AudioRequest{
+		Model:    DefaultAudioModel,
+		File:     "standup",
+		Language: "de",
+		Prompt:   "sgpt",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Hello team.\n", transcript)
+	// The file name carries the extension of the sniffed format
+	require.Equal(t, "standup.mp3", form.fileName)
+	require.Equal(t, mp3Header, form.file)
+	require.Equal(t, map[string]string{
+		"model":           DefaultAudioModel,
+		"language":        "de",
+		"prompt":          "sgpt",
+		"response_format": "text",
+	}, form.fields)
+}
+
+func TestTranscribeVerboseJSON(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	writeAudioFile(t, "standup.mp3")
+	registerAudioResponder(t, "transcriptions", "application/json", `{"task":"transcribe","language":"english","duration":1.5,"text":"Hello team."}`)
+
+	transcript, err := client.Transcribe(context.Background(), AudioRequest{
+		Model:  DefaultAudioModel,
+		File:   "standup.mp3",
+		Format: string(openai.AudioResponseFormatVerboseJSON),
+	})
+	require.NoError(t, err)
+	require.Contains(t, transcript, `"duration": 1.5`)
+	require.Contains(t, transcript, `"text": "Hello team."`)
+}
+
+func TestTranslate(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	writeAudioFile(t, "interview.mp3")
+	form := registerAudioResponder(t, "translations", "text/plain", "1\n00:00:00,000 --> 00:00:01,500\nHello team.\n")
+
+	transcript, err := client.Transcribe(context.Background(), AudioRequest{
+		Model:     DefaultAudioModel,
+		File:      "interview.mp3",
+		Translate: true,
+		Language:  "de",
+		Format:    string(openai.AudioResponseFormatSRT),
+	})
+	require.NoError(t, err)
+	require.Contains(t, transcript, "00:00:00,000 --> 00:00:01,500")
+	require.Equal(t, "interview.mp3", form.fileName)
+	// Translations are always to English
+	require.NotContains(t, form.fields, "language")
+	require.Equal(t, "srt", form.fields["response_format"])
+}
+
+func TestTranscribeRejectsInvalidFiles(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not audio"), 0o600))
+	outside := filepath.Join(t.TempDir(), "secret.mp3")
+	require.NoError(t, os.WriteFile(outside, mp3Header, 0o600))
+
+	_, err := client.Transcribe(context.Background(), AudioRequest{Model: DefaultAudioModel, File: "notes.txt"})
+	require.ErrorIs(t, err, fs.ErrNotAudio)
+
+	_, err = client.Transcribe(context.Background(), AudioRequest{Model: DefaultAudioModel, File: outside})
+	require.ErrorIs(t, err, fs.ErrPathOutsideCwd)
+	require.Zero(t, httpmock.GetTotalCallCount())
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+const (
+	// envKeyAzureAPIKey is the environment variable key for the Azure OpenAI API key.
+	envKeyAzureAPIKey = "AZURE_OPENAI_API_KEY"
+	// envKeyAzureEndpoint is the environment variable key for the Azure OpenAI resource endpoint.
+	envKeyAzureEndpoint = "AZURE_OPENAI_ENDPOINT"
+	// envKeyAzureAPIVersion is the environment variable key the Azure SDKs use for the api-version.
+	envKeyAzureAPIVersion = "OPENAI_API_VERSION"
+	// envKeyAzureDeployment is the environment variable key for the fallback deployment name.
+	envKeyAzureDeployment = "AZURE_OPENAI_DEPLOYMENT"
+
+	// defaultAzureAPIVersion is the latest GA version of the Azure OpenAI data plane API.
+	defaultAzureAPIVersion = "2024-10-21"
+
+	// AzureAuthAPIKey sends the key in the api-key header.
+	AzureAuthAPIKey = "api-key"
+	// AzureAuthEntra sends the key as a Microsoft Entra ID bearer token.
+	AzureAuthEntra = "entra"
+)
+
+var (
+	// ErrMissingAzureAPIKey is returned, if the AZURE_OPENAI_API_KEY environment variable is not set.
+	ErrMissingAzureAPIKey = fmt.Errorf("%s env variable is not set", envKeyAzureAPIKey)
+	// ErrMissingAzureEndpoint is returned, if neither AZURE_OPENAI_ENDPOINT nor azure.endpoint is set.
+	ErrMissingAzureEndpoint = fmt.Errorf("azure endpoint is not set: set %s or azure.endpoint in config.yaml", envKeyAzureEndpoint)
+	// ErrUnknownAzureAuthType is returned for unsupported azure.authType values.
+	ErrUnknownAzureAuthType = errors.New("unknown azure auth type")
+)
+
+func isAzureProvider(config *viper.Viper) bool {
+	return providerName(config) == ProviderAzure
+}
+
+// newAzureClientConfig builds the go-openai config for Azure OpenAI. Environment
+// variables take precedence over the azure section of the config file, and the
+// endpoint is validated with the same rules as OPENAI_API_BASE because it
+// receives the API key.
+func newAzureClientConfig(config *viper.Viper) (openai.ClientConfig, *keyAuth, error) {
+	apiKey, err := newAPIKey(config, ProviderAzure, envKeyAzureAPIKey, ErrMissingAzureAPIKey)
+	if err != nil {
+		return openai.ClientConfig{}, nil, err
+	}
+
+	endpoint := lookupEnvOrConfig(config, envKeyAzureEndpoint, "azure.endpoint")
+	if endpoint == "" {
+		return openai.ClientConfig{}, nil, ErrMissingAzureEndpoint
+	}
+	if err = validateAPIBaseURL(config, envKeyAzureEndpoint, endpoint); err != nil {
+		return openai.ClientConfig{}, nil, err
+	}
+
+	clientConfig := openai.DefaultAzureConfig("", endpoint)
+	clientConfig.APIVersion = defaultAzureAPIVersion
+	if apiVersion := lookupEnvOrConfig(config, envKeyAzureAPIVersion, "azure.apiVersion"); apiVersion != "" {
+		clientConfig.APIVersion = apiVersion
+	}
+
+	auth := &keyAuth{key: apiKey}
+	switch authType := strings.ToLower(config.GetString("azure.authType")); authType {
+	case "", AzureAuthAPIKey:
+		clientConfig.APIType = openai.APITypeAzure
+		auth.header = openai.AzureAPIKeyHeader
+	case AzureAuthEntra:
+		clientConfig.APIType = openai.APITypeAzureAD
+		auth.header, auth.scheme = "Authorization", "Bearer "
+	default:
+		return openai.ClientConfig{}, nil, fmt.Errorf("%w: %q (use %q or %q)", ErrUnknownAzureAuthType, authType, AzureAuthAPIKey, AzureAuthEntra)
+	}
+
+	clientConfig.AzureModelMapperFunc = azureDeploymentMapper(config)
+	slog.Debug("Azure OpenAI mode active", "endpoint", endpoint, "apiVersion", clientConfig.APIVersion)
+	return clientConfig, auth, nil
+}
+
+// azureDeploymentMapper maps --model names to deployment names. Models listed
+// in azure.deployments use their mapped deployment; all others fall back to
+// AZURE_OPENAI_DEPLOYMENT or azure.deployment and finally to the model name
+// itself, which matches deployments named after their model.
+func azureDeploymentMapper(config *viper.Viper) func(string) string {
+	deployments := config.GetStringMapString("azure.deployments")
+	fallback := lookupEnvOrConfig(config, envKeyAzureDeployment, "azure.deployment")
+	return func(model string) string {
+		// viper lowercases map keys
+		if deployment, ok := deployments[strings.ToLower(model)]; ok {
+			slog.Debug("Mapped model to Azure deployment", "model", model, "deployment", deployment)
+			return deployment
+		}
+		if fallback != "" {
+			return fallback
+		}
+		return model
+	}
+}
+
+// lookupEnvOrConfig returns the environment variable envKey if it is set and
+// the config value for configKey otherwise.
+func lookupEnvOrConfig(config *viper.Viper, envKey, configKey string) string {
+	if value, isSet := os.LookupEnv(envKey); isSet && value != "" {
+		return value
+	}
+	if config == nil {
+		return ""
+	}
+	return config.GetString(configKey)
+}
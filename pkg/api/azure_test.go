@@ -0,0 +1,162 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+// newAzureStandIn starts an httptest stand-in for the Azure OpenAI data plane
+// that records the last request and answers with a fixed completion.
+func newAzureStandIn(t *testing.T) *http.Request {
+	t.Helper()
+	var lastHTTPRequest http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastHTTPRequest = *r
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hello World!"},"finish_reason":"stop"}]}`)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AZURE_OPENAI_API_KEY", "test")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", server.URL)
+	t.Setenv("AZURE_OPENAI_DEPLOYMENT", "")
+	t.Setenv("OPENAI_API_VERSION", "")
+	return &lastHTTPRequest
+}
+
+func TestCreateClientAzureMissingAPIKey(t *testing.T) {
+	prev, had := os.LookupEnv("AZURE_OPENAI_API_KEY")
+	require.NoError(t, os.Unsetenv("AZURE_OPENAI_API_KEY"))
+	t.Cleanup(func() {
+		if had {
+			_ = os.Setenv("AZURE_OPENAI_API_KEY", prev)
+		}
+	})
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+
+	client, err := CreateClient(testCtx.Config, nil)
+	require.ErrorIs(t, err, ErrMissingAzureAPIKey)
+	require.Nil(t, client)
+}
+
+func TestCreateClientAzureMissingEndpoint(t *testing.T) {
+	t.Setenv("AZURE_OPENAI_API_KEY", "test")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "")
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+
+	client, err := CreateClient(testCtx.Config, nil)
+	require.ErrorIs(t, err, ErrMissingAzureEndpoint)
+	require.Nil(t, client)
+}
+
+func TestCreateClientAzureEndpointValidation(t *testing.T) {
+	t.Setenv("AZURE_OPENAI_API_KEY", "test")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "http://169.254.169.254/")
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+
+	client, err := CreateClient(testCtx.Config, nil)
+	require.Error(t, err)
+	require.Nil(t, client)
+	require.Contains(t, err.Error(), "AZURE_OPENAI_ENDPOINT")
+}
+
+func TestCreateClientAzureUnknownAuthType(t *testing.T) {
+	newAzureStandIn(t)
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+	testCtx.Config.Set("azure.authType", "basic")
+
+	client, err := CreateClient(testCtx.Config, nil)
+	require.ErrorIs(t, err, ErrUnknownAzureAuthType)
+	require.Nil(t, client)
+}
+
+func TestAzureDeploymentMapping(t *testing.T) {
+	httpReq := newAzureStandIn(t)
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("azure.apiVersion", "2024-06-01")
+	testCtx.Config.Set("azure.deployments", map[string]string{"gpt-4o": "prod-gpt4o"})
+
+	var out bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+
+	require.Equal(t, "/openai/deployments/prod-gpt4o/chat/completions", httpReq.URL.Path)
+	require.Equal(t, "2024-06-01", httpReq.URL.Query().Get("api-version"))
+	require.Equal(t, "test", httpReq.Header.Get("api-key"))
+	require.Empty(t, httpReq.Header.Get("Authorization"))
+}
+
+func TestAzureDeploymentFallback(t *testing.T) {
+	httpReq := newAzureStandIn(t)
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+	testCtx.Config.Set("model", "gpt-4o-mini")
+
+	client, err := CreateClient(testCtx.Config, &bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "/openai/deployments/gpt-4o-mini/chat/completions", httpReq.URL.Path)
+	require.Equal(t, defaultAzureAPIVersion, httpReq.URL.Query().Get("api-version"))
+
+	t.Setenv("AZURE_OPENAI_DEPLOYMENT", "default-deployment")
+	client, err = CreateClient(testCtx.Config, &bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "/openai/deployments/default-deployment/chat/completions", httpReq.URL.Path)
+}
+
+func TestAzureEntraAuth(t *testing.T) {
+	httpReq := newAzureStandIn(t)
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("provider", ProviderAzure)
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("azure.authType", AzureAuthEntra)
+
+	client, err := CreateClient(testCtx.Config, &bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer test", httpReq.Header.Get("Authorization"))
+	require.Empty(t, httpReq.Header.Get("api-key"))
+}
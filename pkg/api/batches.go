@@ -0,0 +1,344 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+const (
+	// batchCompletionWindow is the only completion window the Batch API offers.
+	batchCompletionWindow = "24h"
+	// batchDiscount is the share of the list price the Batch API charges.
+	batchDiscount = 0.5
+	// maxBatchOutputLineSize bounds a single line of the output files.
+	maxBatchOutputLineSize = 16 << 20
+
+	// BatchStatusCompleted, BatchStatusFailed, BatchStatusExpired and
+	// BatchStatusCancelled are the statuses of batches that are done.
+	BatchStatusCompleted = "completed"
+	BatchStatusFailed    = "failed"
+	BatchStatusExpired   = "expired"
+	BatchStatusCancelled = "cancelled"
+)
+
+var (
+	// ErrBatchesUnsupported is returned, if the selected provider has no Batch API.
+	ErrBatchesUnsupported = errors.New("provider does not support the Batch API")
+	// ErrBatchTools is returned, if tools are declared for a batch request. They
+	// cannot be run, as the response arrives after sgpt has exited.
+	ErrBatchTools = errors.New("tools cannot be used with the Batch API")
+	// ErrBatchNotDone is returned, if the results of a batch are requested before it is done.
+	ErrBatchNotDone = errors.New("batch is not done yet")
+)
+
+// BatchLine is a chat completion request of a batch.
+type BatchLine struct {
+	// CustomID identifies the request in the results. It must be unique
+	// within the batch.
+	CustomID string
+	Request  openai.ChatCompletionRequest
+}
+
+// Batch is the state of a batch.
+type Batch struct {
+	ID           string
+	Status       string
+	CreatedAt    time.Time
+	OutputFileID string
+	ErrorFileID  string
+	Total        int
+	Completed    int
+	Failed       int
+	// Errors are the reasons the batch as a whole failed, e.g. an invalid
+	// input file.
+	Errors []string
+}
+
+// Done reports whether the batch will not make any more progress.
+func (b Batch) Done() bool {
+	switch b.Status {
+	case BatchStatusCompleted, BatchStatusFailed, BatchStatusExpired, BatchStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// BatchOutput is the result of a request of a batch. Error is set, if the
+// request failed.
+type BatchOutput struct {
+	CustomID string
+	Model    string
+	Content  string
+	Usage    openai.Usage
+	Error    string
+}
+
+// BatchSubmitter is the interface of clients that can send chat completions
+// via the Batch API of OpenAI, at half the price of synchronous requests. It
+// is implemented by OpenAIClient.
+type BatchSubmitter interface {
+	// NewBatchLine returns the request CreateCompletion would send for the
+	// prompts and the persona modifier.
+	NewBatchLine(customID string, prompts []string, modifier string) (BatchLine, error)
+	SubmitBatch(ctx context.Context, name string, lines []BatchLine) (Batch, error)
+	RetrieveBatch(ctx context.Context, id string) (Batch, error)
+	CancelBatch(ctx context.Context, id string) (Batch, error)
+	// BatchOutputs downloads the results of a batch that is done.
+	BatchOutputs(ctx context.Context, batch Batch) ([]BatchOutput, error)
+	// RecordBatchUsage records the usage of a result in the usage ledger,
+	// at the discounted price of the Batch API.
+	RecordBatchUsage(output BatchOutput, modifier string)
+}
+
+// NewBatchLine implements BatchSubmitter. The persona and the chat settings
+// are resolved like for CreateCompletion; responses are never streamed.
+func (c *OpenAIClient) NewBatchLine(customID string, prompts []string, modifier string) (BatchLine, error) {
+	messages, history, err := c.buildMessages("", prompts, modifier, nil)
+	if err != nil {
+		return BatchLine{}, err
+	}
+	req, err := c.newChatRequest(messages, history)
+	if err != nil {
+		return BatchLine{}, err
+	}
+	req.Stream = false
+	availableTools, err := c.loadTools(modifier)
+	if err != nil {
+		return BatchLine{}, err
+	}
+	if len(availableTools) > 0 {
+		return BatchLine{}, ErrBatchTools
+	}
+	// The response format is requested, but the response is not validated
+	structured, err := newStructuredOutput(c.config)
+	if err != nil {
+		return BatchLine{}, err
+	}
+	if structured != nil {
+		req.ResponseFormat = structured.format
+	}
+	return BatchLine{CustomID: customID, Request: req}, nil
+}
+
+// SubmitBatch implements BatchSubmitter. The lines are uploaded as a file
+// named after name and a batch is created for it.
+func (c *OpenAIClient) SubmitBatch(ctx context.Context, name string, lines []BatchLine) (Batch, error) {
+	if isAzureProvider(c.config) {
+		return Batch{}, ErrBatchesUnsupported
+	}
+	upload := openai.UploadBatchFileRequest{FileName: filepath.Base(name)}
+	for _, line := range lines {
+		upload.AddChatCompletion(line.CustomID, line.Request)
+	}
+	file, err := c.api.UploadBatchFile(ctx, upload)
+	if err != nil {
+		return Batch{}, err
+	}
+	slog.Debug("Uploaded batch input", "file", file.ID, "lines", len(lines))
+	response, err := c.api.CreateBatch(ctx, openai.CreateBatchRequest{
+		InputFileID:      file.ID,
+		Endpoint:         openai.BatchEndpointChatCompletions,
+		CompletionWindow: batchCompletionWindow,
+		Metadata:         map[string]any{"description": filepath.Base(name)},
+	})
+	if err != nil {
+		return Batch{}, err
+	}
+	slog.Debug("Created batch", "id", response.ID)
+	return newBatch(response.Batch), nil
+}
+
+// RetrieveBatch implements BatchSubmitter.
+func (c *OpenAIClient) RetrieveBatch(ctx context.Context, id string) (Batch, error) {
+	if isAzureProvider(c.config) {
+		return Batch{}, ErrBatchesUnsupported
+	}
+	response, err := c.api.RetrieveBatch(ctx, id)
+	if err != nil {
+		return Batch{}, err
+	}
+	return newBatch(response.Batch), nil
+}
+
+// CancelBatch implements BatchSubmitter. Requests that already completed
+// stay in the results.
+func (c *OpenAIClient) CancelBatch(ctx context.Context, id string) (Batch, error) {
+	if isAzureProvider(c.config) {
+		return Batch{}, ErrBatchesUnsupported
+	}
+	response, err := c.api.CancelBatch(ctx, id)
+	if err != nil {
+		return Batch{}, err
+	}
+	return newBatch(response.Batch), nil
+}
+
+// BatchOutputs implements BatchSubmitter. Results of successful requests
+// and failed requests are read from the output and the error file.
+func (c *OpenAIClient) BatchOutputs(ctx context.Context, batch Batch) ([]BatchOutput, error) {
+	if !batch.Done() {
+		return nil, fmt.Errorf("%w: %s", ErrBatchNotDone, batch.Status)
+	}
+	var outputs []BatchOutput
+	for _, fileID := range []string{batch.OutputFileID, batch.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		fileOutputs, err := c.readBatchOutputFile(ctx, fileID)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, fileOutputs...)
+	}
+	return outputs, nil
+}
+
+// RecordBatchUsage implements BatchSubmitter.
+func (c *OpenAIClient) RecordBatchUsage(output BatchOutput, modifier string) {
+	usage := output.Usage
+	if !ledger.Enabled(c.config) || (usage.PromptTokens == 0 && usage.CompletionTokens == 0) {
+		return
+	}
+	cost := ledger.Cost(c.config, output.Model, usage.PromptTokens, usage.CompletionTokens)
+	if cost != nil {
+		*cost *= batchDiscount
+	}
+	record := ledger.Record{
+		Provider:         providerName(c.config),
+		Model:            output.Model,
+		Persona:          modifier,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		Cost:             cost,
+	}
+	if err := ledger.Append(c.config, record); err != nil {
+		slog.Warn("Could not record usage", "error", err)
+	}
+}
+
+// batchOutputLine is a line of the output or the error file of a batch.
+type batchOutputLine struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *OpenAIClient) readBatchOutputFile(ctx context.Context, fileID string) ([]BatchOutput, error) {
+	content, err := c.api.GetFileContent(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	var outputs []BatchOutput
+	scanner := bufio.NewScanner(content)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchOutputLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line batchOutputLine
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("invalid line in batch file %s: %w", fileID, err)
+		}
+		outputs = append(outputs, line.output())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	slog.Debug("Downloaded batch results", "file", fileID, "results", len(outputs))
+	return outputs, nil
+}
+
+// output converts the line to a BatchOutput. Only the first choice of a
+// response is kept, like CreateCompletion returns only one.
+func (l batchOutputLine) output() BatchOutput {
+	output := BatchOutput{CustomID: l.CustomID}
+	switch {
+	case l.Error != nil:
+		output.Error = fmt.Sprintf("%s: %s", l.Error.Code, l.Error.Message)
+	case l.Response == nil:
+		output.Error = "no response"
+	case l.Response.StatusCode != http.StatusOK:
+		var body openai.ErrorResponse
+		if err := json.Unmarshal(l.Response.Body, &body); err == nil && body.Error != nil {
+			output.Error = fmt.Sprintf("status %d: %s", l.Response.StatusCode, body.Error.Message)
+		} else {
+			output.Error = fmt.Sprintf("status %d", l.Response.StatusCode)
+		}
+	default:
+		var body openai.ChatCompletionResponse
+		if err := json.Unmarshal(l.Response.Body, &body); err != nil {
+			output.Error = err.Error()
+			break
+		}
+		output.Model, output.Usage = body.Model, body.Usage
+		if len(body.Choices) == 0 {
+			output.Error = ErrEmptyResponse.Error()
+			break
+		}
+		output.Content = body.Choices[0].Message.Content
+	}
+	return output
+}
+
+func newBatch(batch openai.Batch) Batch {
+	converted := Batch{
+		ID:        batch.ID,
+		Status:    batch.Status,
+		CreatedAt: time.Unix(int64(batch.CreatedAt), 0),
+		Total:     batch.RequestCounts.Total,
+		Completed: batch.RequestCounts.Completed,
+		Failed:    batch.RequestCounts.Failed,
+	}
+	if batch.OutputFileID != nil {
+		converted.OutputFileID = *batch.OutputFileID
+	}
+	if batch.ErrorFileID != nil {
+		converted.ErrorFileID = *batch.ErrorFileID
+	}
+	if batch.Errors != nil {
+		for _, batchErr := range batch.Errors.Data {
+			converted.Errors = append(converted.Errors, batchErr.Message)
+		}
+	}
+	return converted
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func TestBatchSubmitAndOutputs(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := testlib.NewBatchServer(t)
+	server.Respond = func(request openai.BatchChatCompletionRequest) (int, string) {
+		if request.CustomID == "line-2" {
+			return http.StatusBadRequest, `{"error":{"message":"rejected","type":"invalid_request_error"}}`
+		}
+		return http.StatusOK, `{"model":"gpt-4o-2024-08-06","choices":[{"index":0,"message":{"role":"assistant","content":"ls"}}],"usage":{"prompt_tokens":1000000,"completion_tokens":0,"total_tokens":1000000}}`
+	}
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("temperature", 0.2)
+	testCtx.Config.Set("stream", true)
+	client, err := CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	first, err := client.NewBatchLine("line-1", []string{"list files"}, "sh")
+	require.NoError(t, err)
+	second, err := client.NewBatchLine("line-2", []string{"fail"}, "txt")
+	require.NoError(t, err)
+	ctx := context.Background()
+	batch, err := client.SubmitBatch(ctx, "input/prompts.jsonl", []BatchLine{first, second})
+	require.NoError(t, err)
+	require.Equal(t, "batch_1", batch.ID)
+
+	// The requests are built like the ones of CreateCompletion
+	requests := server.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, "line-1", requests[0].CustomID)
+	require.Equal(t, openai.BatchEndpointChatCompletions, requests[0].URL)
+	require.Equal(t, "gpt-4o", requests[0].Body.Model)
+	require.InDelta(t, 0.2, requests[0].Body.Temperature, 1e-6)
+	require.False(t, requests[0].Body.Stream)
+	require.Equal(t, openai.ChatMessageRoleSystem, requests[0].Body.Messages[0].Role)
+	require.Equal(t, "list files", requests[0].Body.Messages[1].Content)
+	require.Len(t, requests[1].Body.Messages, 1)
+
+	batch, err = client.RetrieveBatch(ctx, batch.ID)
+	require.NoError(t, err)
+	require.True(t, batch.Done())
+	require.Equal(t, 2, batch.Total)
+	require.Equal(t, 1, batch.Failed)
+
+	outputs, err := client.BatchOutputs(ctx, batch)
+	require.NoError(t, err)
+	require.Len(t, outputs, 2)
+	require.Equal(t, "line-1", outputs[0].CustomID)
+	require.Equal(t, "ls", outputs[0].Content)
+	require.Equal(t, "gpt-4o-2024-08-06", outputs[0].Model)
+	require.Empty(t, outputs[0].Error)
+	require.Equal(t, "line-2", outputs[1].CustomID)
+	require.Equal(t, "status 400: rejected", outputs[1].Error)
+
+	// Batch requests cost half the list price
+	client.RecordBatchUsage(outputs[0], "sh")
+	client.RecordBatchUsage(outputs[1], "txt")
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "sh", records[0].Persona)
+	require.NotNil(t, records[0].Cost)
+	require.InDelta(t, *ledger.Cost(testCtx.Config, "gpt-4o-2024-08-06", 1000000, 0)/2, *records[0].Cost, 1e-9)
+}
+
+func TestBatchCancel(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := testlib.NewBatchServer(t)
+	server.Hold = true
+	client, err := CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	line, err := client.NewBatchLine("line-1", []string{"hello"}, "txt")
+	require.NoError(t, err)
+	ctx := context.Background()
+	batch, err := client.SubmitBatch(ctx, "prompts.jsonl", []BatchLine{line})
+	require.NoError(t, err)
+	require.False(t, batch.Done())
+	_, err = client.BatchOutputs(ctx, batch)
+	require.ErrorIs(t, err, ErrBatchNotDone)
+
+	batch, err = client.CancelBatch(ctx, batch.ID)
+	require.NoError(t, err)
+	require.Equal(t, BatchStatusCancelled, batch.Status)
+	outputs, err := client.BatchOutputs(ctx, batch)
+	require.NoError(t, err)
+	require.Empty(t, outputs)
+}
+
+func TestNewBatchLineErrors(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("tools", []map[string]any{{
+		"name":        "echo_args",
+		"description": "Echo the arguments",
+		"parameters":  `{"type":"object","properties":{"text":{"type":"string"}}}`,
+		"command":     "cat",
+	}})
+	client, err := CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.NewBatchLine("line-1", []string{"hello"}, "txt")
+	require.ErrorIs(t, err, ErrBatchTools)
+
+	testCtx = testlib.NewTestCtx(t)
+	t.Setenv("AZURE_OPENAI_API_KEY", "test")
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "https://example.openai.azure.com")
+	testCtx.Config.Set("provider", ProviderAzure)
+	client, err = CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.SubmitBatch(context.Background(), "prompts.jsonl", nil)
+	require.ErrorIs(t, err, ErrBatchesUnsupported)
+}
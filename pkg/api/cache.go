@@ -0,0 +1,100 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/cache"
+)
+
+// responseCache wraps the cache entry of a single request. Cache errors are
+// logged and treated as misses, so a broken cache never fails a completion.
+type responseCache struct {
+	cache *cache.Cache
+	key   string
+	model string
+}
+
+// newResponseCache returns the cache for req, or nil if the request must not
+// be cached: chats depend on their history, tools run local commands and of
+// several choices only the picked one would be cached. Logprobs are not
+// cached, so responses requesting them are not either.
+func (c *OpenAIClient) newResponseCache(chatID string, req openai.ChatCompletionRequest) *responseCache {
+	if chatID != "" || len(req.Tools) > 0 || req.N > 1 || req.LogProbs || !cache.Enabled(c.config) {
+		return nil
+	}
+	key, err := cache.Key(providerName(c.config), c.endpoint, req)
+	if err != nil {
+		slog.Warn("Could not compute response cache key", "error", err)
+		return nil
+	}
+	return &responseCache{cache: cache.New(c.config), key: key, model: req.Model}
+}
+
+func (r *responseCache) get() (openai.ChatCompletionMessage, bool) {
+	if r == nil {
+		return openai.ChatCompletionMessage{}, false
+	}
+	entry, hit, err := r.cache.Get(r.key)
+	if err != nil {
+		slog.Warn("Could not read response cache", "error", err)
+		return openai.ChatCompletionMessage{}, false
+	}
+	if hit {
+		slog.Debug("Response cache hit", "key", r.key)
+	}
+	return entry.Message, hit
+}
+
+func (r *responseCache) put(message openai.ChatCompletionMessage) {
+	if r == nil {
+		return
+	}
+	if err := r.cache.Put(r.key, cache.Entry{Model: r.model, Message: message}); err != nil {
+		slog.Warn("Could not write response cache", "error", err)
+	}
+}
+
+// replayMessage prints a cached message the way a fresh response is printed.
+// Streamed output is written word by word, so consumers of the stream see
+// the same sequence of writes either way.
+func (c *OpenAIClient) replayMessage(message openai.ChatCompletionMessage) (openai.ChatCompletionMessage, error) {
+	if !c.config.GetBool("stream") {
+		if _, err := fmt.Fprintln(c.out, message.Content); err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+		return message, nil
+	}
+	for _, chunk := range strings.SplitAfter(message.Content, " ") {
+		if _, err := fmt.Fprint(c.out, chunk); err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+	}
+	if _, err := fmt.Fprintf(c.out, "\n"); err != nil {
+		slog.Warn("Could not print final linebreak")
+	}
+	return message, nil
+}
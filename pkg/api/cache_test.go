@@ -0,0 +1,92 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCache(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("cache.enabled", true)
+	requests := registerChatResponses(t, "application/json", chatResponse("Hello World!"))
+
+	for range 2 {
+		out.Reset()
+		result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+		require.NoError(t, err)
+		require.Equal(t, "Hello World!", result)
+		require.Equal(t, "Hello World!\n", out.String())
+	}
+	require.Len(t, *requests, 1)
+
+	// A different prompt is a different request
+	registerChatResponses(t, "application/json", chatResponse("Bye"))
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Bye"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Bye", result)
+}
+
+func TestResponseCacheStream(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("cache.enabled", true)
+	testCtx.Config.Set("stream", true)
+	requests := registerChatResponses(t, "text/event-stream",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello \"}}]}\n\n"+
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"World!\"}}]}\n\n"+
+			"data: [DONE]\n\n")
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	streamed := out.String()
+
+	out.Reset()
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, streamed, out.String())
+	require.Len(t, *requests, 1)
+
+	// Streamed and regular requests share the cache
+	testCtx.Config.Set("stream", false)
+	out.Reset()
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!\n", out.String())
+	require.Len(t, *requests, 1)
+}
+
+func TestResponseCacheSkipsChats(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("cache.enabled", true)
+	requests := registerChatResponses(t, "application/json", chatResponse("Hi"), chatResponse("Hi again"))
+
+	_, err := client.CreateCompletion(context.Background(), "cache_chat", []string{"Hi"}, "txt", nil)
+	require.NoError(t, err)
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "cache_chat", []string{"Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi again", result)
+	require.Len(t, *requests, 2)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+// ErrNoChoicePicked is returned, if the input ends before a valid choice is picked.
+var ErrNoChoicePicked = errors.New("no choice picked")
+
+// pickChoice prints every choice under a separator and returns the picked
+// one. Without the pick setting, the first choice is returned; with it, the
+// user is asked for the number of the choice. Only the returned choice is
+// saved to the chat session.
+func (c *baseClient) pickChoice(ctx context.Context, choices []openai.ChatCompletionChoice) (openai.ChatCompletionMessage, error) {
+	for i, choice := range choices {
+		if _, err := fmt.Fprintf(c.out, "--- choice %d/%d ---\n%s\n", i+1, len(choices), choice.Message.Content); err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+	}
+	picked := 0
+	if c.config.GetBool("pick") {
+		var err error
+		picked, err = c.readChoice(ctx, len(choices))
+		if err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+	}
+	slog.Debug("Picked choice", "choice", picked+1, "choices", len(choices))
+	message := choices[picked].Message
+	c.logprobs = convertLogprobs(choices[picked].LogProbs)
+	if message.ReasoningContent != "" {
+		c.printReasoning(message.ReasoningContent + "\n")
+		message.ReasoningContent = ""
+	}
+	return message, nil
+}
+
+// readChoice asks the user for a choice from 1 to count until a valid number
+// is entered and returns its index. It stops waiting when ctx is done.
+func (c *baseClient) readChoice(ctx context.Context, count int) (int, error) {
+	reader := bufio.NewReader(c.in)
+	for {
+		if _, err := fmt.Fprintf(c.out, "Pick a choice (1-%d): ", count); err != nil {
+			return 0, err
+		}
+		line, err := fs.ReadContext(ctx, func() (string, error) {
+			return reader.ReadString('\n')
+		})
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if n, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && n >= 1 && n <= count {
+			return n - 1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrNoChoicePicked, err)
+		}
+	}
+}
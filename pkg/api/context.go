@@ -0,0 +1,116 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"log/slog"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+	"github.com/tbckr/sgpt/v2/pkg/tokens"
+)
+
+// contextWindow returns the context window of model: the contextWindow
+// setting if set, the model table entry otherwise and 0 if it is unknown.
+func (c *baseClient) contextWindow(model string) int {
+	if window := c.config.GetInt("contextWindow"); window > 0 {
+		return window
+	}
+	if info, ok := models.Lookup(model); ok {
+		return info.ContextWindow
+	}
+	return 0
+}
+
+// fitContextWindow drops the oldest turns of the chat history until the
+// prompt plus maxTokens for the completion fit into the context window of
+// the model. A turn is a user message with all replies up to the next user
+// message, so tool results never lose their call. System messages and the
+// current turn, starting at index history, are always kept. The returned
+// slice is a copy; the chat session on disk keeps every message.
+func (c *baseClient) fitContextWindow(messages []openai.ChatCompletionMessage, history int) []openai.ChatCompletionMessage {
+	return c.fitContextWindowFor(c.config.GetString("model"), messages, history)
+}
+
+// fitContextWindowFor fits messages into the context window of model, like
+// fitContextWindow does for the configured model.
+func (c *baseClient) fitContextWindowFor(model string, messages []openai.ChatCompletionMessage, history int) []openai.ChatCompletionMessage {
+	window := c.contextWindow(model)
+	if window <= 0 || history <= 0 {
+		return messages
+	}
+	budget := window - c.config.GetInt("maxTokens")
+	// Loading an encoding takes a noticeable moment, so skip it for the
+	// common case of a short conversation.
+	if tokens.UpperBound(messages) <= budget {
+		return messages
+	}
+	counter, err := tokens.NewCounter(model)
+	if err != nil {
+		slog.Debug("Could not count tokens, sending full chat history", "error", err)
+		return messages
+	}
+
+	total := counter.CountMessages(messages)
+	if total <= budget {
+		return messages
+	}
+
+	dropped := make([]bool, len(messages))
+	droppedCount, droppedTokens := 0, 0
+	for start := 0; start < history && total > budget; {
+		if messages[start].Role == openai.ChatMessageRoleSystem {
+			start++
+			continue
+		}
+		end := start + 1
+		for end < history && messages[end].Role != openai.ChatMessageRoleUser {
+			end++
+		}
+		for i := start; i < end; i++ {
+			if messages[i].Role == openai.ChatMessageRoleSystem {
+				continue
+			}
+			tokenCount := counter.CountMessage(messages[i])
+			dropped[i] = true
+			total -= tokenCount
+			droppedCount++
+			droppedTokens += tokenCount
+			slog.Debug("Trimmed message from chat history", "index", i, "role", messages[i].Role, "tokens", tokenCount)
+		}
+		start = end
+	}
+
+	fitted := make([]openai.ChatCompletionMessage, 0, len(messages)-droppedCount)
+	for i, message := range messages {
+		if !dropped[i] {
+			fitted = append(fitted, message)
+		}
+	}
+	slog.Debug("Trimmed chat history to fit context window",
+		"model", model, "contextWindow", window, "maxTokens", c.config.GetInt("maxTokens"),
+		"droppedMessages", droppedCount, "droppedTokens", droppedTokens, "promptTokens", total)
+	if total > budget {
+		slog.Debug("Prompt exceeds context window even without chat history", "promptTokens", total, "budget", budget)
+	}
+	return fitted
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+func TestFitContextWindowLongChat(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("contextWindow", 400)
+	testCtx.Config.Set("maxTokens", 100)
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	history := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "You are a chat bot."}}
+	for i := range 10 {
+		history = append(history,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("question %d %s", i, strings.Repeat("word ", 20))},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: fmt.Sprintf("answer %d %s", i, strings.Repeat("word ", 20))},
+		)
+	}
+	require.NoError(t, manager.SaveSession("long_chat", history))
+
+	client, err := CreateClient(testCtx.Config, &bytes.Buffer{})
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	requests := registerChatResponses(t, "application/json", chatResponse("answer 10"))
+
+	_, err = client.CreateCompletion(context.Background(), "long_chat", []string{"question 10"}, "txt", nil)
+	require.NoError(t, err)
+
+	sent := (*requests)[0].Messages
+	require.Less(t, len(sent), len(history)+1)
+	// The system message and the prompt are kept, the oldest turns dropped
+	require.Equal(t, openai.ChatMessageRoleSystem, sent[0].Role)
+	require.Equal(t, openai.ChatMessageRoleUser, sent[1].Role)
+	require.NotContains(t, sent[1].Content, "question 0 ")
+	require.Equal(t, "question 10", sent[len(sent)-1].Content)
+	require.Contains(t, sent[len(sent)-2].Content, "answer 9 ")
+
+	// The session on disk keeps every message
+	var saved []openai.ChatCompletionMessage
+	saved, err = manager.GetSession("long_chat")
+	require.NoError(t, err)
+	require.Len(t, saved, len(history)+2)
+}
+
+func TestFitContextWindowKeepsToolResults(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("contextWindow", 60)
+	client := &baseClient{config: testCtx.Config}
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "read notes.txt"},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+			ID: "call_1", Function: openai.FunctionCall{Name: "read_file", Arguments: `{"path":"notes.txt"}`},
+		}}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: strings.Repeat("note ", 30)},
+		{Role: openai.ChatMessageRoleAssistant, Content: "The notes are about notes."},
+		{Role: openai.ChatMessageRoleUser, Content: "thanks"},
+	}
+	fitted := client.fitContextWindow(messages, 4)
+	require.Len(t, fitted, 1)
+	require.Equal(t, "thanks", fitted[0].Content)
+	// The input is not modified
+	require.Len(t, messages, 5)
+}
+
+func TestFitContextWindowUnknownModel(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "my-local-model")
+	client := &baseClient{config: testCtx.Config}
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("word ", 100000)},
+		{Role: openai.ChatMessageRoleUser, Content: "hi"},
+	}
+	require.Len(t, client.fitContextWindow(messages, 1), 2)
+}
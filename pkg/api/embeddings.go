@@ -0,0 +1,204 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+	"github.com/tbckr/sgpt/v2/pkg/tokens"
+)
+
+const (
+	// DefaultEmbeddingModel is used when neither the embeddings.model config
+	// key nor the --model flag of the embed command is set.
+	DefaultEmbeddingModel = string(openai.SmallEmbedding3)
+	// MaxEmbeddingBatchSize is the maximum number of inputs per embeddings
+	// request of the OpenAI API.
+	MaxEmbeddingBatchSize = 2048
+	// maxEmbeddingBatchTokens is the maximum number of tokens of all inputs of
+	// an embeddings request of the OpenAI API.
+	maxEmbeddingBatchTokens = 300000
+)
+
+var (
+	// ErrEmbeddingsUnsupported is returned, if the selected provider cannot create embeddings.
+	ErrEmbeddingsUnsupported = errors.New("provider does not support embeddings")
+	// ErrEmbeddingInputTooLong is returned, if an input exceeds the context window of the embedding model.
+	ErrEmbeddingInputTooLong = errors.New("input exceeds the context window of the embedding model")
+	// ErrEmbeddingCountMismatch is returned, if the provider returns another number of embeddings than inputs.
+	ErrEmbeddingCountMismatch = errors.New("provider returned a different number of embeddings than inputs")
+)
+
+// EmbeddingRequest describes the embeddings to create.
+type EmbeddingRequest struct {
+	Model  string
+	Inputs []string
+	// Dimensions shortens the embeddings, if the model supports it. Zero uses
+	// the model's default.
+	Dimensions int
+	// BatchSize is the maximum number of inputs sent per request. Zero or
+	// values above MaxEmbeddingBatchSize use MaxEmbeddingBatchSize.
+	BatchSize int
+}
+
+// Embedder is the interface that wraps the CreateEmbeddings method. It is
+// implemented by the OpenAI, Azure and Ollama clients.
+type Embedder interface {
+	// CreateEmbeddings returns one embedding per input, in the order of the
+	// inputs. Inputs are split into as many requests as the API limits require.
+	CreateEmbeddings(ctx context.Context, req EmbeddingRequest) ([][]float32, error)
+}
+
+// batchEmbeddingInputs splits req.Inputs into batches of at most req.BatchSize
+// inputs. If maxTokens is positive, a batch holds at most maxTokens tokens and
+// inputs longer than the context window of the model are rejected before any
+// request is sent.
+func batchEmbeddingInputs(req EmbeddingRequest, maxTokens int) ([][]string, error) {
+	batchSize := req.BatchSize
+	if batchSize <= 0 || batchSize > MaxEmbeddingBatchSize {
+		batchSize = MaxEmbeddingBatchSize
+	}
+	count := func(string) int { return 0 }
+	contextWindow := 0
+	if maxTokens > 0 {
+		counter, err := tokens.NewCounter(req.Model)
+		if err != nil {
+			return nil, err
+		}
+		count = counter.Count
+		if info, ok := models.Lookup(req.Model); ok {
+			contextWindow = info.ContextWindow
+		}
+	}
+
+	var batches [][]string
+	var batch []string
+	batchTokens := 0
+	for i, input := range req.Inputs {
+		inputTokens := count(input)
+		if contextWindow > 0 && inputTokens > contextWindow {
+			return nil, fmt.Errorf("%w: input %d has %d tokens, %s accepts %d", ErrEmbeddingInputTooLong, i+1, inputTokens, req.Model, contextWindow)
+		}
+		if len(batch) == batchSize || (len(batch) > 0 && batchTokens+inputTokens > maxTokens && maxTokens > 0) {
+			batches = append(batches, batch)
+			batch, batchTokens = nil, 0
+		}
+		batch = append(batch, input)
+		batchTokens += inputTokens
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// CreateEmbeddings creates embeddings with the OpenAI or Azure embeddings API.
+func (c *OpenAIClient) CreateEmbeddings(ctx context.Context, req EmbeddingRequest) ([][]float32, error) {
+	batches, err := batchEmbeddingInputs(req, maxEmbeddingBatchTokens)
+	if err != nil {
+		return nil, err
+	}
+	provider := providerName(c.config)
+	embeddings := make([][]float32, 0, len(req.Inputs))
+	for i, batch := range batches {
+		slog.Debug("Requesting embeddings", "batch", i+1, "batches", len(batches), "inputs", len(batch))
+		var resp openai.EmbeddingResponse
+		resp, err = c.api.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input:      batch,
+			Model:      openai.EmbeddingModel(req.Model),
+			Dimensions: req.Dimensions,
+			User:       c.config.GetString("user"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("%w: got %d for %d inputs", ErrEmbeddingCountMismatch, len(resp.Data), len(batch))
+		}
+		// The API does not guarantee the order of the data
+		sort.Slice(resp.Data, func(i, j int) bool {
+			return resp.Data[i].Index < resp.Data[j].Index
+		})
+		for _, data := range resp.Data {
+			embeddings = append(embeddings, data.Embedding)
+		}
+		c.recordModelUsage(provider, req.Model, "", "embed", resp.Usage)
+	}
+	return embeddings, nil
+}
+
+type ollamaEmbedRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+// CreateEmbeddings creates embeddings with the embed API of the Ollama server.
+// Ollama truncates inputs to the context window of the model itself, and has
+// no limit on the tokens per request.
+func (c *OllamaClient) CreateEmbeddings(ctx context.Context, req EmbeddingRequest) ([][]float32, error) {
+	batches, err := batchEmbeddingInputs(req, 0)
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, 0, len(req.Inputs))
+	for i, batch := range batches {
+		slog.Debug("Requesting embeddings", "batch", i+1, "batches", len(batches), "inputs", len(batch))
+		var resp *http.Response
+		resp, err = c.post(ctx, ollamaEmbedSuffix, req.Model, ollamaEmbedRequest{
+			Model:      req.Model,
+			Input:      batch,
+			Dimensions: req.Dimensions,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var embedResp ollamaEmbedResponse
+		err = json.NewDecoder(resp.Body).Decode(&embedResp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(embedResp.Embeddings) != len(batch) {
+			return nil, fmt.Errorf("%w: got %d for %d inputs", ErrEmbeddingCountMismatch, len(embedResp.Embeddings), len(batch))
+		}
+		embeddings = append(embeddings, embedResp.Embeddings...)
+		c.recordModelUsage(ProviderOllama, req.Model, "", "embed", openai.Usage{
+			PromptTokens: embedResp.PromptEvalCount,
+			TotalTokens:  embedResp.PromptEvalCount,
+		})
+	}
+	return embeddings, nil
+}
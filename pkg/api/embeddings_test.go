@@ -0,0 +1,152 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func TestBatchEmbeddingInputs(t *testing.T) {
+	batches, err := batchEmbeddingInputs(EmbeddingRequest{Model: DefaultEmbeddingModel, Inputs: []string{"a", "b", "c"}, BatchSize: 2}, maxEmbeddingBatchTokens)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"a", "b"}, {"c"}}, batches)
+
+	// Every input has 3 tokens, so two fit into a budget of 7 tokens.
+	batches, err = batchEmbeddingInputs(EmbeddingRequest{Model: DefaultEmbeddingModel, Inputs: []string{"a b c", "d e f", "g h i"}}, 7)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"a b c", "d e f"}, {"g h i"}}, batches)
+
+	_, err = batchEmbeddingInputs(EmbeddingRequest{Model: DefaultEmbeddingModel, Inputs: []string{"short", strings.Repeat("word ", 9000)}}, maxEmbeddingBatchTokens)
+	require.ErrorIs(t, err, ErrEmbeddingInputTooLong)
+	require.ErrorContains(t, err, "input 2")
+
+	// Without a token budget, inputs are neither counted nor checked.
+	batches, err = batchEmbeddingInputs(EmbeddingRequest{Model: DefaultEmbeddingModel, Inputs: []string{strings.Repeat("word ", 9000)}}, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+}
+
+func TestOpenAICreateEmbeddings(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	var requests []openai.EmbeddingRequestStrings
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/embeddings",
+		func(req *http.Request) (*http.Response, error) {
+			var embeddingReq openai.EmbeddingRequestStrings
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&embeddingReq))
+			requests = append(requests, embeddingReq)
+			// Answer in reverse order to check the embeddings are sorted by index.
+			var data []string
+			for i := len(embeddingReq.Input) - 1; i >= 0; i-- {
+				data = append(data, fmt.Sprintf(`{"index":%d,"embedding":[%d.5]}`, i, len(embeddingReq.Input[i])))
+			}
+			return httpmock.NewStringResponse(http.StatusOK, fmt.Sprintf(
+				`{"data":[%s],"model":"text-embedding-3-small","usage":{"prompt_tokens":1000000,"total_tokens":1000000}}`,
+				strings.Join(data, ","))), nil
+		})
+
+	embeddings, err := client.CreateEmbeddings(context.Background(), EmbeddingRequest{
+		Model:      DefaultEmbeddingModel,
+		Inputs:     []string{"a", "bb", "ccc"},
+		Dimensions: 256,
+		BatchSize:  2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1.5}, {2.5}, {3.5}}, embeddings)
+	require.Len(t, requests, 2)
+	require.Equal(t, []string{"a", "bb"}, requests[0].Input)
+	require.Equal(t, 256, requests[0].Dimensions)
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, DefaultEmbeddingModel, records[0].Model)
+	require.Equal(t, "embed", records[0].Persona)
+	require.NotNil(t, records[0].Cost)
+	require.InDelta(t, 0.02, *records[0].Cost, 1e-9)
+}
+
+func TestOpenAICreateEmbeddingsCountMismatch(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/embeddings",
+		httpmock.NewStringResponder(http.StatusOK, `{"data":[{"index":0,"embedding":[1]}]}`))
+
+	_, err := client.CreateEmbeddings(context.Background(), EmbeddingRequest{Model: DefaultEmbeddingModel, Inputs: []string{"a", "b"}})
+	require.ErrorIs(t, err, ErrEmbeddingCountMismatch)
+}
+
+func TestOllamaCreateEmbeddings(t *testing.T) {
+	var requests []ollamaEmbedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, ollamaEmbedSuffix, r.URL.Path)
+		var req ollamaEmbedRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+		var embeddings []string
+		for _, input := range req.Input {
+			embeddings = append(embeddings, fmt.Sprintf("[%d]", len(input)))
+		}
+		_, _ = fmt.Fprintf(w, `{"embeddings":[%s],"prompt_eval_count":4}`, strings.Join(embeddings, ","))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OLLAMA_HOST", server.URL)
+
+	testCtx := testlib.NewTestCtx(t)
+	client, err := CreateOllamaClient(testCtx.Config, nil)
+	require.NoError(t, err)
+
+	embeddings, err := client.CreateEmbeddings(context.Background(), EmbeddingRequest{
+		Model:     "nomic-embed-text",
+		Inputs:    []string{"a", "bb", "ccc"},
+		BatchSize: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}, {2}, {3}}, embeddings)
+	require.Len(t, requests, 2)
+	require.Equal(t, "nomic-embed-text", requests[0].Model)
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, ProviderOllama, records[0].Provider)
+	require.Equal(t, "nomic-embed-text", records[0].Model)
+}
+
+func TestAnthropicClientIsNoEmbedder(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	client, err := CreateAnthropicClient(testlib.NewTestCtx(t).Config, nil)
+	require.NoError(t, err)
+	var completer Completer = client
+	_, ok := completer.(Embedder)
+	require.False(t, ok)
+}
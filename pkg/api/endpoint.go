@@ -0,0 +1,243 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/shell"
+)
+
+var (
+	// ErrMissingAPIKeyEnv is returned, if the env variable named by apiKeyEnv is not set.
+	ErrMissingAPIKeyEnv = errors.New("env variable named by apiKeyEnv is not set")
+	// ErrEmptyAPIKey is returned, if apiKeyCommand, apiKeyFile or the keyring yield an empty key.
+	ErrEmptyAPIKey = errors.New("api key is empty")
+	// ErrKeyringUnsupported is returned, if apiKeyKeyring is set on a platform without Secret Service support.
+	ErrKeyringUnsupported = errors.New("keyring is only supported on Linux via secret-tool")
+)
+
+const (
+	// keyringService is the service attribute of keyring entries. Together with
+	// the provider attribute it identifies the API key of a provider.
+	keyringService = "sgpt"
+	// secretTool is the libsecret command line client for the Secret Service.
+	secretTool = "secret-tool"
+)
+
+// lookupAPIKey returns the API key of provider. The configured sources are
+// checked in this order, and only the first one configured is resolved:
+//
+//  1. apiKeyEnv, the name of an env variable that replaces envKey
+//  2. apiKeyCommand, a shell command printing the key, e.g. pass show openai
+//  3. apiKeyFile, a file containing the key
+//  4. apiKeyKeyring, the Secret Service keyring on Linux
+//
+// If none is configured, the key is read from envKey. missing is the error to
+// return if that is not set.
+func lookupAPIKey(config *viper.Viper, provider, envKey string, missing error) (string, error) {
+	if config != nil {
+		if name := config.GetString("apiKeyEnv"); name != "" {
+			key, exists := os.LookupEnv(name)
+			if !exists {
+				return "", fmt.Errorf("%w: %s", ErrMissingAPIKeyEnv, name)
+			}
+			return key, nil
+		}
+		if command := config.GetString("apiKeyCommand"); command != "" {
+			slog.Debug("Reading api key from apiKeyCommand")
+			output, err := shell.Output(context.Background(), command, APIKeyEnvKeys(config)...)
+			if err != nil {
+				return "", fmt.Errorf("apiKeyCommand failed: %w", err)
+			}
+			return firstLine(output, "apiKeyCommand")
+		}
+		if file := config.GetString("apiKeyFile"); file != "" {
+			slog.Debug("Reading api key from apiKeyFile", "file", file)
+			return readAPIKeyFile(file)
+		}
+		if config.GetBool("apiKeyKeyring") {
+			slog.Debug("Reading api key from keyring", "provider", provider)
+			return lookupKeyring(provider)
+		}
+	}
+	key, exists := os.LookupEnv(envKey)
+	if !exists {
+		return "", missing
+	}
+	return key, nil
+}
+
+// newAPIKey returns a function resolving the API key of provider, see
+// lookupAPIKey. Keys in env variables are looked up right away, so a missing
+// key is reported before anything else happens. apiKeyCommand, apiKeyFile and
+// the keyring may run a program that asks for a passphrase, so they are only
+// resolved by the first request that needs the key. Commands that never send
+// a request, like shell completion, never run them.
+func newAPIKey(config *viper.Viper, provider, envKey string, missing error) (func() (string, error), error) {
+	if DefersAPIKey(config) {
+		return sync.OnceValues(func() (string, error) {
+			return lookupAPIKey(config, provider, envKey, missing)
+		}), nil
+	}
+	key, err := lookupAPIKey(config, provider, envKey, missing)
+	if err != nil {
+		return nil, err
+	}
+	return func() (string, error) {
+		return key, nil
+	}, nil
+}
+
+// DefersAPIKey reports whether the API key is read from apiKeyCommand,
+// apiKeyFile or the keyring, which are only resolved by the first request.
+func DefersAPIKey(config *viper.Viper) bool {
+	if config == nil || config.GetString("apiKeyEnv") != "" {
+		return false
+	}
+	return config.GetString("apiKeyCommand") != "" || config.GetString("apiKeyFile") != "" || config.GetBool("apiKeyKeyring")
+}
+
+// keyAuth sets the API key of a client on its requests. go-openai only
+// accepts the key when the client is created, so the key of OpenAI and Azure
+// clients is set by the retryingDoer instead, once it is resolved.
+type keyAuth struct {
+	key    func() (string, error)
+	header string
+	scheme string
+}
+
+// authorize sets the key header on req, resolving the key if needed.
+func (a *keyAuth) authorize(req *http.Request) error {
+	key, err := a.key()
+	if err != nil {
+		return err
+	}
+	req.Header.Set(a.header, a.scheme+key)
+	return nil
+}
+
+// APIKeyEnvKeys returns the env variables that may hold an API key. They are
+// removed from the environment of every command SGPT runs: commands executed
+// on behalf of the user, tool commands and apiKeyCommand.
+func APIKeyEnvKeys(config *viper.Viper) []string {
+	keys := []string{envKeyOpenAIApi, envKeyAnthropicAPIKey, envKeyAzureAPIKey}
+	if config != nil {
+		if name := config.GetString("apiKeyEnv"); name != "" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// expandHome replaces a leading ~/ of file with the home directory.
+func expandHome(file string) (string, error) {
+	rest, ok := strings.CutPrefix(file, "~/")
+	if !ok {
+		return file, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+func readAPIKeyFile(file string) (string, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("apiKeyFile: %w", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		slog.Warn("apiKeyFile is accessible by other users", "file", file, "mode", info.Mode().Perm().String())
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("apiKeyFile: %w", err)
+	}
+	return firstLine(data, "apiKeyFile")
+}
+
+// lookupKeyring reads the API key of provider from the Secret Service. Keys
+// are stored with: secret-tool store --label=sgpt service sgpt provider <provider>
+func lookupKeyring(provider string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", ErrKeyringUnsupported
+	}
+	path, err := exec.LookPath(secretTool)
+	if err != nil {
+		return "", fmt.Errorf("apiKeyKeyring: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "lookup", "service", keyringService, "provider", provider)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// secret-tool exits with 1 and no output if there is no matching entry
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("apiKeyKeyring: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("apiKeyKeyring: no key stored for service %s and provider %s", keyringService, provider)
+	}
+	return firstLine(output, "apiKeyKeyring")
+}
+
+// firstLine returns the first line of data as the API key. Password managers
+// like pass store additional fields in the following lines.
+func firstLine(data []byte, source string) (string, error) {
+	line, _, _ := strings.Cut(string(data), "\n")
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return "", fmt.Errorf("%s: %w", source, ErrEmptyAPIKey)
+	}
+	return key, nil
+}
+
+// lookupAPIBase returns the base URL override of a provider and the name of
+// the setting it came from, which is used in validation errors. The apiBase
+// setting of the active profile takes precedence over envKey, so switching
+// profiles does not require re-exporting variables.
+func lookupAPIBase(config *viper.Viper, envKey string) (string, string, bool) {
+	if config != nil {
+		if apiBase := config.GetString("apiBase"); apiBase != "" {
+			return apiBase, "apiBase", true
+		}
+	}
+	value, isSet := os.LookupEnv(envKey)
+	return value, envKey, isSet
+}
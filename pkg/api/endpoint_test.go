@@ -0,0 +1,249 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+func TestLookupAPIKeyEnv(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+
+	key, err := lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.NotEmpty(t, key)
+
+	t.Setenv("GATEWAY_KEY", "gateway")
+	testCtx.Config.Set("apiKeyEnv", "GATEWAY_KEY")
+	key, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "gateway", key)
+
+	require.NoError(t, os.Unsetenv("GATEWAY_KEY"))
+	_, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.ErrorIs(t, err, ErrMissingAPIKeyEnv)
+	require.ErrorContains(t, err, "GATEWAY_KEY")
+}
+
+func TestLookupAPIKeyCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("apiKeyCommand tests require bash")
+	}
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("apiKeyCommand", `printf 'from-command\nlogin: me\n'`)
+
+	key, err := lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "from-command", key)
+
+	testCtx.Config.Set("apiKeyCommand", "exit 1")
+	_, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.ErrorContains(t, err, "apiKeyCommand")
+
+	testCtx.Config.Set("apiKeyCommand", "true")
+	_, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.ErrorIs(t, err, ErrEmptyAPIKey)
+}
+
+func TestLookupAPIKeyFile(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	file := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	testCtx.Config.Set("apiKeyFile", file)
+
+	key, err := lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", key)
+
+	testCtx.Config.Set("apiKeyFile", filepath.Join(t.TempDir(), "missing"))
+	_, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLookupAPIKeyKeyring(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the keyring is only supported on Linux")
+	}
+	// A fake secret-tool prints the arguments it was called with.
+	bin := t.TempDir()
+	script := "#!/bin/sh\nif [ \"$5\" = anthropic ]; then exit 1; fi\necho \"$1-$3-$5\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, secretTool), []byte(script), 0o700))
+	t.Setenv("PATH", bin)
+
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("apiKeyKeyring", true)
+
+	key, err := lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "lookup-sgpt-openai", key)
+
+	_, err = lookupAPIKey(testCtx.Config, ProviderAnthropic, envKeyAnthropicAPIKey, ErrMissingAnthropicAPIKey)
+	require.ErrorContains(t, err, "no key stored")
+}
+
+func TestLookupAPIKeyPrecedence(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	t.Setenv("GATEWAY_KEY", "from-env")
+	file := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(file, []byte("from-file"), 0o600))
+
+	// A configured source replaces OPENAI_API_KEY, and only the first one is resolved.
+	testCtx.Config.Set("apiKeyFile", file)
+	testCtx.Config.Set("apiKeyKeyring", true)
+	key, err := lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", key)
+
+	testCtx.Config.Set("apiKeyCommand", "exit 1")
+	testCtx.Config.Set("apiKeyEnv", "GATEWAY_KEY")
+	key, err = lookupAPIKey(testCtx.Config, ProviderOpenAI, envKeyOpenAIApi, ErrMissingAPIKey)
+	require.NoError(t, err)
+	require.Equal(t, "from-env", key)
+}
+
+func TestAPIKeyCommandResolvedOnFirstRequest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("apiKeyCommand tests require bash")
+	}
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	runs := filepath.Join(t.TempDir(), "runs")
+	// The command sees no API key env variable and logs every run
+	testCtx.Config.Set("apiKeyCommand", `echo run >> `+runs+`; echo "key-${OPENAI_API_KEY:-scrubbed}"`)
+
+	client, err := CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	require.NoFileExists(t, runs)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var authorization []string
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		authorization = append(authorization, req.Header.Get("Authorization"))
+		return httpmock.NewStringResponse(http.StatusOK, chatResponse("Hi")), nil
+	})
+	for range 2 {
+		_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"Bearer key-scrubbed", "Bearer key-scrubbed"}, authorization)
+	data, err := os.ReadFile(runs)
+	require.NoError(t, err)
+	require.Equal(t, "run\n", string(data))
+}
+
+func TestAnthropicAPIKeyCommandFailsOnRequest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("apiKeyCommand tests require bash")
+	}
+	testCtx := testlib.NewTestCtx(t)
+	requested := false
+	newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		requested = true
+		writeAnthropicMessage(w, "Hi")
+	})
+	testCtx.Config.Set("apiKeyCommand", "exit 1")
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.ErrorContains(t, err, "apiKeyCommand failed")
+	require.False(t, requested)
+}
+
+func TestAPIKeyEnvKeys(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	require.Equal(t, []string{envKeyOpenAIApi, envKeyAnthropicAPIKey, envKeyAzureAPIKey}, APIKeyEnvKeys(testCtx.Config))
+
+	testCtx.Config.Set("apiKeyEnv", "GATEWAY_KEY")
+	require.Contains(t, APIKeyEnvKeys(testCtx.Config), "GATEWAY_KEY")
+}
+
+func TestLookupAPIBase(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	t.Setenv(envKeyOpenAIAPIBase, "https://env.example.com/v1")
+
+	value, source, ok := lookupAPIBase(testCtx.Config, envKeyOpenAIAPIBase)
+	require.True(t, ok)
+	require.Equal(t, "https://env.example.com/v1", value)
+	require.Equal(t, envKeyOpenAIAPIBase, source)
+
+	testCtx.Config.Set("apiBase", "https://profile.example.com/v1")
+	value, source, ok = lookupAPIBase(testCtx.Config, envKeyOpenAIAPIBase)
+	require.True(t, ok)
+	require.Equal(t, "https://profile.example.com/v1", value)
+	require.Equal(t, "apiBase", source)
+}
+
+func TestCreateClientAPIBaseSettingValidation(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("apiBase", "http://gateway.example.com/v1")
+
+	_, err := CreateClient(testCtx.Config, nil)
+	require.ErrorContains(t, err, "apiBase")
+
+	testCtx.Config.Set("insecureAPIBase", true)
+	_, err = CreateClient(testCtx.Config, nil)
+	require.NoError(t, err)
+}
+
+func TestHeadersApplied(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("apiBase", "https://gateway.example.com/v1")
+	testCtx.Config.Set("headers", map[string]string{"X-Team": "platform"})
+
+	var out bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+
+	var team string
+	httpmock.RegisterResponder("POST", "https://gateway.example.com/v1/chat/completions",
+		func(req *http.Request) (*http.Response, error) {
+			team = req.Header.Get("X-Team")
+			return httpmock.NewStringResponse(http.StatusOK,
+				`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}]}`), nil
+		})
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", result)
+	require.Equal(t, "platform", team)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+// ErrContentFiltered is returned with the response, if the provider stopped
+// it because of its content filter or the model refused to answer.
+var ErrContentFiltered = errors.New("response was stopped by the content filter")
+
+// contextLengthMarkers identify errors about a prompt exceeding the context
+// window, which a model with a larger window may still answer.
+var contextLengthMarkers = []string{"context_length_exceeded", "maximum context length", "context length", "prompt is too long"}
+
+// completionModels returns the configured model followed by the
+// fallbackModels, without duplicates.
+func completionModels(config *viper.Viper) []string {
+	completion := []string{config.GetString("model")}
+	for _, model := range config.GetStringSlice("fallbackModels") {
+		if model != "" && !slices.Contains(completion, model) {
+			completion = append(completion, model)
+		}
+	}
+	return completion
+}
+
+// outputTracker records whether a model printed any of its answer to the
+// wrapped writer. Output that reached the out writer cannot be taken back, so
+// a model that printed part of its answer is never replaced by a fallback
+// model, just like a stream that printed output is never retried.
+type outputTracker struct {
+	w       io.Writer
+	written bool
+}
+
+func (o *outputTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		o.written = true
+	}
+	return o.w.Write(p)
+}
+
+// shouldFallBack reports whether the next model is tried after err, see
+// isFallbackError and outputTracker.
+func shouldFallBack(err error, printed *outputTracker) bool {
+	if !isFallbackError(err) {
+		return false
+	}
+	if printed.written {
+		slog.Debug("Not falling back, the answer was already printed", "error", err)
+		return false
+	}
+	return true
+}
+
+// isFallbackError reports whether err may not occur with another model:
+// rate limits and server errors left after the retries, network errors,
+// prompts exceeding the context window and content filter stops.
+// Cancellation by the user never falls back.
+func isFallbackError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrContentFiltered) {
+		return true
+	}
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		code, _ := openaiErr.Code.(string)
+		return isRetryableStatus(openaiErr.HTTPStatusCode) || isContextLengthError(code+" "+openaiErr.Message)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isRetryableStatus(requestErr.HTTPStatusCode)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// Anthropic reports overload in the middle of a stream with status 200
+		return isRetryableStatus(apiErr.StatusCode) || apiErr.Type == "overloaded_error" || isContextLengthError(apiErr.Message)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isContextLengthError(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range contextLengthMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// useModel switches req to model. The generation parameters depend on the
+// model, e.g. reasoning models get other ones, and so does the context window.
+func (c *OpenAIClient) useModel(req *openai.ChatCompletionRequest, model string, messages []openai.ChatCompletionMessage, history int) error {
+	req.Model = model
+	req.MaxTokens, req.MaxCompletionTokens = 0, 0
+	req.Temperature, req.TopP, req.PresencePenalty, req.FrequencyPenalty = 0, 0, 0, 0
+	req.ReasoningEffort, req.LogitBias = "", nil
+	if err := applyGenerationParams(c.config, req); err != nil {
+		return err
+	}
+	req.Messages = c.fitContextWindowFor(model, messages, history)
+	return nil
+}
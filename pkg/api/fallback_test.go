@@ -0,0 +1,252 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+// registerModelResponses answers chat completions with the response of the
+// requested model and returns the models in the order they were requested.
+func registerModelResponses(t *testing.T, responses map[string]*http.Response) *[]string {
+	t.Helper()
+	var requested []string
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(req *http.Request) (*http.Response, error) {
+			var body openai.ChatCompletionRequest
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+			requested = append(requested, body.Model)
+			resp, ok := responses[body.Model]
+			require.True(t, ok, body.Model)
+			return resp, nil
+		})
+	return &requested
+}
+
+func newFallbackTestClient(t *testing.T) (*testlib.TestCtx, *OpenAIClient, *bytes.Buffer) {
+	t.Helper()
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("model", "gpt-4o")
+	testCtx.Config.Set("fallbackModels", []string{"gpt-4o-mini", "gpt-4o", "o3-mini"})
+	testCtx.Config.Set("retry.maxAttempts", 1)
+	return testCtx, client, out
+}
+
+func TestCompletionModels(t *testing.T) {
+	testCtx, _, _ := newFallbackTestClient(t)
+	// The configured model is not tried twice
+	require.Equal(t, []string{"gpt-4o", "gpt-4o-mini", "o3-mini"}, completionModels(testCtx.Config))
+}
+
+func TestCreateCompletionFallback(t *testing.T) {
+	testCtx, client, _ := newFallbackTestClient(t)
+	requested := registerModelResponses(t, map[string]*http.Response{
+		"gpt-4o":      httpmock.NewStringResponse(http.StatusServiceUnavailable, `{"error":{"message":"overloaded","type":"server_error"}}`),
+		"gpt-4o-mini": httpmock.NewStringResponse(http.StatusBadRequest, `{"error":{"message":"This model's maximum context length is 128000 tokens.","code":"context_length_exceeded"}}`),
+		"o3-mini":     httpmock.NewStringResponse(http.StatusOK, chatResponse("Hi")),
+	})
+
+	result, err := client.CreateCompletion(context.Background(), "fallback", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", result)
+	require.Equal(t, []string{"gpt-4o", "gpt-4o-mini", "o3-mini"}, *requested)
+
+	// The model that answered is saved with the chat session
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	metadata, err := manager.(chat.MetadataStore).GetMetadata("fallback")
+	require.NoError(t, err)
+	require.Equal(t, map[int]string{1: "o3-mini"}, metadata.Models)
+}
+
+func TestCreateCompletionFallbackGenerationParams(t *testing.T) {
+	testCtx, client, _ := newFallbackTestClient(t)
+	testCtx.Config.Set("fallbackModels", []string{"o3-mini"})
+	testCtx.Config.Set("maxTokens", 100)
+	testCtx.Config.Set("temperature", 0.5)
+	var bodies []map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		bodies = append(bodies, body)
+		if len(bodies) == 1 {
+			return httpmock.NewStringResponse(http.StatusTooManyRequests, `{"error":{"message":"rate limited"}}`), nil
+		}
+		return httpmock.NewStringResponse(http.StatusOK, chatResponse("Hi")), nil
+	})
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Len(t, bodies, 2)
+	require.InDelta(t, 100, bodies[0]["max_tokens"], 0)
+	require.InDelta(t, 0.5, bodies[0]["temperature"], 0.001)
+	// The reasoning model gets its own parameters
+	require.Equal(t, "o3-mini", bodies[1]["model"])
+	require.InDelta(t, 100, bodies[1]["max_completion_tokens"], 0)
+	require.NotContains(t, bodies[1], "max_tokens")
+	require.NotContains(t, bodies[1], "temperature")
+}
+
+func TestCreateCompletionFallbackContentFilter(t *testing.T) {
+	testCtx, client, out := newFallbackTestClient(t)
+	filtered := `{"choices":[{"index":0,"finish_reason":"content_filter","message":{"role":"assistant","content":"I can"}}]}`
+	requested := registerModelResponses(t, map[string]*http.Response{
+		"gpt-4o":      httpmock.NewStringResponse(http.StatusOK, filtered),
+		"gpt-4o-mini": httpmock.NewStringResponse(http.StatusOK, chatResponse("Hi")),
+	})
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", result)
+	require.Equal(t, []string{"gpt-4o", "gpt-4o-mini"}, *requested)
+	// The filtered response is never printed before the fallback answer
+	require.Equal(t, "Hi\n", out.String())
+
+	// Without a fallback model, the filtered response is kept
+	httpmock.Reset()
+	out.Reset()
+	testCtx.Config.Set("fallbackModels", nil)
+	registerModelResponses(t, map[string]*http.Response{
+		"gpt-4o": httpmock.NewStringResponse(http.StatusOK, filtered),
+	})
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "I can", result)
+	require.Equal(t, "I can\n", out.String())
+}
+
+func TestCreateCompletionNoFallbackAfterStreamedOutput(t *testing.T) {
+	testCtx, client, out := newFallbackTestClient(t)
+	testCtx.Config.Set("stream", true)
+	requested := registerModelResponses(t, map[string]*http.Response{
+		"gpt-4o": streamResponse("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"I can\"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"content_filter\"}]}\n\n" +
+			"data: [DONE]\n\n"),
+		"gpt-4o-mini": streamResponse("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"),
+	})
+
+	// The streamed part cannot be taken back, so the filtered response is kept
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "I can", result)
+	require.Equal(t, "I can\n", out.String())
+	require.Equal(t, []string{"gpt-4o"}, *requested)
+}
+
+func TestCreateCompletionNoFallbackOnClientError(t *testing.T) {
+	_, client, _ := newFallbackTestClient(t)
+	requested := registerModelResponses(t, map[string]*http.Response{
+		"gpt-4o": httpmock.NewStringResponse(http.StatusUnauthorized, `{"error":{"message":"invalid api key"}}`),
+	})
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.ErrorContains(t, err, "invalid api key")
+	require.Equal(t, []string{"gpt-4o"}, *requested)
+}
+
+func TestAnthropicFallback(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-opus")
+	testCtx.Config.Set("fallbackModels", []string{"claude-sonnet", "claude-haiku"})
+	testCtx.Config.Set("retry.maxAttempts", 1)
+	var requested []string
+	newAnthropicStandIn(t, func(w http.ResponseWriter, req anthropicRequest) {
+		requested = append(requested, req.Model)
+		switch req.Model {
+		case "claude-opus":
+			w.WriteHeader(529)
+			_, _ = io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+		case "claude-sonnet":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","content":[],"stop_reason":"refusal"}`)
+		default:
+			writeAnthropicMessage(w, "Hi")
+		}
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", result)
+	require.Equal(t, []string{"claude-opus", "claude-sonnet", "claude-haiku"}, requested)
+}
+
+func TestAnthropicNoFallbackAfterStreamedOutput(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-opus")
+	testCtx.Config.Set("fallbackModels", []string{"claude-sonnet"})
+	testCtx.Config.Set("retry.maxAttempts", 1)
+	testCtx.Config.Set("stream", true)
+	var requested []string
+	newAnthropicStandIn(t, func(w http.ResponseWriter, req anthropicRequest) {
+		requested = append(requested, req.Model)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n")
+		_, _ = io.WriteString(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	})
+
+	var out bytes.Buffer
+	client, err := CreateAnthropicClient(testCtx.Config, &out)
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello"}, "txt", nil)
+	require.ErrorContains(t, err, "Overloaded")
+	require.Equal(t, []string{"claude-opus"}, requested)
+	require.Equal(t, "Hel", out.String())
+}
+
+func TestIsFallbackError(t *testing.T) {
+	tests := []struct {
+		err      error
+		fallback bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{ErrEmptyResponse, false},
+		{fmt.Errorf("wrapped: %w", ErrContentFiltered), true},
+		{&openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, true},
+		{&openai.APIError{HTTPStatusCode: http.StatusBadRequest, Code: "context_length_exceeded"}, true},
+		{&openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "invalid request"}, false},
+		{&openai.RequestError{HTTPStatusCode: http.StatusBadGateway, Err: errors.New("bad gateway")}, true},
+		{&APIError{Provider: ProviderAnthropic, StatusCode: http.StatusOK, Type: "overloaded_error"}, true},
+		{&APIError{Provider: ProviderAnthropic, StatusCode: http.StatusBadRequest, Message: "prompt is too long: 210000 tokens"}, true},
+		{&APIError{Provider: ProviderOllama, StatusCode: http.StatusNotFound}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.fallback, isFallbackError(tt.err), "%v", tt.err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"io"
+
+	"github.com/spf13/viper"
+)
+
+// Forker is the interface that wraps the Fork method. It is implemented by
+// all built-in provider clients.
+type Forker interface {
+	// Fork returns a client that shares the connections, retries and chat
+	// session manager of the client, but reads the settings of a completion
+	// from config and prints to out. The connection settings, like the API
+	// key and the base URL, are kept. Forks may be used concurrently, as
+	// long as they do not continue the same chat session.
+	Fork(config *viper.Viper, out io.Writer) Completer
+}
+
+// fork returns a copy of the base client with config and out.
+func (c *baseClient) fork(config *viper.Viper, out io.Writer) baseClient {
+	base := *c
+	base.config = config
+	base.out = out
+	base.logprobs = nil
+	return base
+}
+
+// Fork implements Forker.
+func (c *OpenAIClient) Fork(config *viper.Viper, out io.Writer) Completer {
+	fork := *c
+	fork.baseClient = c.baseClient.fork(config, out)
+	return &fork
+}
+
+// Fork implements Forker.
+func (c *AnthropicClient) Fork(config *viper.Viper, out io.Writer) Completer {
+	fork := *c
+	fork.baseClient = c.baseClient.fork(config, out)
+	return &fork
+}
+
+// Fork implements Forker.
+func (c *OllamaClient) Fork(config *viper.Viper, out io.Writer) Completer {
+	fork := *c
+	fork.baseClient = c.baseClient.fork(config, out)
+	return &fork
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForkConcurrent(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	// Answer every request with the requested model
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(req *http.Request) (*http.Response, error) {
+			var body openai.ChatCompletionRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			resp := httpmock.NewStringResponse(200, chatResponse(body.Model))
+			resp.Header.Set("Content-Type", "application/json")
+			return resp, nil
+		})
+
+	var wg sync.WaitGroup
+	outs := make([]bytes.Buffer, 8)
+	responses := make([]string, len(outs))
+	errs := make([]error, len(outs))
+	for i := range outs {
+		config := viper.New()
+		require.NoError(t, config.MergeConfigMap(testCtx.Config.AllSettings()))
+		config.Set("model", fmt.Sprintf("model-%d", i))
+		fork := client.Fork(config, &outs[i])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = fork.CreateCompletion(context.Background(), "", []string{"Which model?"}, "txt", nil)
+		}()
+	}
+	wg.Wait()
+
+	for i := range outs {
+		require.NoError(t, errs[i])
+		model := fmt.Sprintf("model-%d", i)
+		require.Equal(t, model, responses[i])
+		require.Equal(t, model+"\n", outs[i].String())
+	}
+	// The forked client is left untouched
+	require.Empty(t, out.String())
+	require.Equal(t, len(outs), httpmock.GetTotalCallCount())
+}
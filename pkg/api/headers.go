@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the values of sensitive headers in debug logs.
+const redacted = "REDACTED"
+
+// ErrInvalidHeader is returned, if a header of the header flag is not "Name: value".
+var ErrInvalidHeader = errors.New(`header must be "Name: value"`)
+
+// sensitiveHeaderParts mark headers whose values are never logged.
+var sensitiveHeaderParts = []string{"auth", "key", "token", "secret", "cookie", "password"}
+
+// requestHeaders returns the headers added to every API request. The
+// organization and project are sent as OpenAI-Organization and
+// OpenAI-Project, the headers section and the header flag may override them.
+func requestHeaders(config *viper.Viper) (http.Header, error) {
+	header := make(http.Header)
+	if config == nil {
+		return header, nil
+	}
+	if organization := config.GetString("organization"); organization != "" {
+		header.Set("OpenAI-Organization", organization)
+	}
+	if project := config.GetString("project"); project != "" {
+		header.Set("OpenAI-Project", project)
+	}
+	for name, value := range config.GetStringMapString("headers") {
+		header.Set(name, value)
+	}
+	for _, entry := range config.GetStringSlice("header") {
+		name, value, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, entry)
+		}
+		header.Set(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// headerTransport adds the configured headers to requests to the API host.
+// Redirects to other hosts do not get them, like the Authorization header.
+// Every request is logged with the values of sensitive headers redacted.
+type headerTransport struct {
+	base   http.RoundTripper
+	host   string
+	header http.Header
+}
+
+// newHeaderTransport wraps base, so requests to host get header.
+func newHeaderTransport(base http.RoundTripper, host string, header http.Header) *headerTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &headerTransport{base: base, host: host, header: header}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host && len(t.header) > 0 {
+		// A RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		for name, values := range t.header {
+			req.Header[name] = values
+		}
+	}
+	slog.Debug("Sending request", "method", req.Method, "url", req.URL.Redacted(), "headers", redactedHeader(req.Header))
+	return t.base.RoundTrip(req)
+}
+
+// redactedHeader logs headers with the values of sensitive headers, like
+// Authorization or x-api-key, replaced.
+type redactedHeader http.Header
+
+// LogValue implements slog.LogValuer.
+func (h redactedHeader) LogValue() slog.Value {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if isSensitiveHeader(name) {
+			value = redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// isSensitiveHeader reports whether the value of the header may hold a credential.
+func isSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveHeaderParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
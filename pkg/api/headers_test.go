@@ -0,0 +1,153 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+func TestRequestHeaders(t *testing.T) {
+	config := testlib.NewTestCtx(t).Config
+	config.Set("organization", "org-1")
+	config.Set("project", "proj-1")
+	config.Set("headers", map[string]string{"x-team": "platform", "OpenAI-Project": "proj-2"})
+	config.Set("header", []string{"X-Team: search", "X-Empty:"})
+
+	header, err := requestHeaders(config)
+	require.NoError(t, err)
+	require.Equal(t, http.Header{
+		"Openai-Organization": {"org-1"},
+		"Openai-Project":      {"proj-2"},
+		"X-Team":              {"search"},
+		"X-Empty":             {""},
+	}, header)
+
+	for _, entry := range []string{"X-Team", ": value", "X Team: value", "X-Team: a\r\nX-Evil: b"} {
+		config.Set("header", []string{entry})
+		_, err = requestHeaders(config)
+		require.ErrorIs(t, err, ErrInvalidHeader, entry)
+	}
+}
+
+func TestCreateClientInvalidHeader(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("header", []string{"X-Team"})
+
+	_, err := CreateClient(testCtx.Config, io.Discard)
+	require.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestOrganizationProjectAndUser(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("organization", "org-1")
+	testCtx.Config.Set("project", "proj-1")
+	testCtx.Config.Set("user", "dev-42")
+
+	var header http.Header
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(req *http.Request) (*http.Response, error) {
+			header = req.Header
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+			return httpmock.NewStringResponse(http.StatusOK, chatResponse("Hi")), nil
+		})
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "org-1", header.Get("OpenAI-Organization"))
+	require.Equal(t, "proj-1", header.Get("OpenAI-Project"))
+	require.Equal(t, "dev-42", body["user"])
+}
+
+func TestAnthropicUser(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-test")
+	testCtx.Config.Set("user", "dev-42")
+	testCtx.Config.Set("header", []string{"X-Team: platform"})
+	_, httpReq, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		writeAnthropicMessage(w, "ok")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, &anthropicMetadata{UserID: "dev-42"}, req.Metadata)
+	require.Equal(t, "platform", httpReq.Header.Get("X-Team"))
+}
+
+func TestHeaderTransportRedirect(t *testing.T) {
+	var redirected http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		redirected = r.Header
+	}))
+	t.Cleanup(other.Close)
+	var received http.Header
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		http.Redirect(w, r, other.URL, http.StatusFound)
+	}))
+	t.Cleanup(api.Close)
+
+	req, err := http.NewRequest(http.MethodGet, api.URL, nil)
+	require.NoError(t, err)
+	header := http.Header{"X-Team": {"platform"}}
+	client := &http.Client{Transport: newHeaderTransport(nil, req.URL.Host, header)}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	require.Equal(t, "platform", received.Get("X-Team"))
+	// Headers are only sent to the API host
+	require.NotNil(t, redirected)
+	require.Empty(t, redirected.Get("X-Team"))
+	// The request of the caller is not modified
+	require.Empty(t, req.Header.Get("X-Team"))
+}
+
+func TestRedactedHeader(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	logger.Info("Sending request", "headers", redactedHeader(http.Header{
+		"Authorization": {"Bearer sk-secret"},
+		"X-Api-Key":     {"secret"},
+		"Api-Key":       {"secret"},
+		"X-Team":        {"platform"},
+	}))
+
+	require.NotContains(t, logs.String(), "secret")
+	require.Contains(t, logs.String(), "headers.Authorization=REDACTED")
+	require.Contains(t, logs.String(), "headers.X-Api-Key=REDACTED")
+	require.Contains(t, logs.String(), "headers.X-Team=platform")
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// DefaultImageModel is used when neither the images.model config key nor
+	// the --model flag of the image command is set.
+	DefaultImageModel = openai.CreateImageModelDallE3
+	// maxImageDownloadSize limits images downloaded from response URLs (50 MiB).
+	maxImageDownloadSize = 50 << 20
+)
+
+var (
+	// ErrImagesUnsupported is returned, if the selected provider cannot generate images.
+	ErrImagesUnsupported = errors.New("provider does not support image generation")
+	// ErrEmptyImage is returned, if an image of the response has neither data nor a URL.
+	ErrEmptyImage = errors.New("image response contains neither data nor a URL")
+	// ErrImageDownloadTooLarge is returned, if an image URL serves more than 50 MiB.
+	ErrImageDownloadTooLarge = errors.New("image download exceeds 50 MiB limit")
+)
+
+// ImageRequest describes the images to generate.
+type ImageRequest struct {
+	Model  string
+	Prompt string
+	// Size and Quality are passed as is; empty values use the model's default.
+	Size    string
+	Quality string
+	Count   int
+}
+
+// Image is a generated image.
+type Image struct {
+	Data []byte
+	// RevisedPrompt is the prompt the model actually used, if it rewrote it.
+	RevisedPrompt string
+}
+
+// ImageGenerator is the interface that wraps the CreateImages method. It is
+// implemented by the OpenAI and Azure clients.
+type ImageGenerator interface {
+	CreateImages(ctx context.Context, req ImageRequest) ([]Image, error)
+}
+
+// CreateImages generates images with the OpenAI or Azure images API. The API
+// answers with either base64 data or URLs, which are downloaded.
+func (c *OpenAIClient) CreateImages(ctx context.Context, req ImageRequest) ([]Image, error) {
+	count := max(req.Count, 1)
+	imageReq := openai.ImageRequest{
+		Prompt:         req.Prompt,
+		Model:          req.Model,
+		N:              count,
+		Size:           req.Size,
+		Quality:        req.Quality,
+		ResponseFormat: c.imageResponseFormat(req.Model),
+		User:           c.config.GetString("user"),
+	}
+	// dall-e-3 only generates one image per request
+	requests := 1
+	if strings.HasPrefix(req.Model, openai.CreateImageModelDallE3) {
+		imageReq.N, requests = 1, count
+	}
+
+	images := make([]Image, 0, count)
+	for i := range requests {
+		slog.Debug("Requesting images", "request", i+1, "requests", requests, "model", req.Model)
+		resp, err := c.api.CreateImage(ctx, imageReq)
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range resp.Data {
+			var image Image
+			image, err = c.decodeImage(ctx, data)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+		c.recordModelUsage(providerName(c.config), req.Model, "", "image", openai.Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		})
+	}
+	return images, nil
+}
+
+// imageResponseFormat returns the response format to request. The GPT image
+// models always answer with base64 data and reject the parameter. Endpoints
+// other than OpenAI, like local stand-ins, are asked for base64 data too, so
+// no second request to a URL of unknown origin is needed.
+func (c *OpenAIClient) imageResponseFormat(model string) string {
+	if strings.HasPrefix(model, "gpt-image") || strings.HasPrefix(model, "chatgpt-image") {
+		return ""
+	}
+	if c.endpoint != openai.DefaultConfig("").BaseURL {
+		return openai.CreateImageResponseFormatB64JSON
+	}
+	return openai.CreateImageResponseFormatURL
+}
+
+// decodeImage returns the image of data, decoding base64 data and data URLs
+// or downloading it from its URL.
+func (c *OpenAIClient) decodeImage(ctx context.Context, data openai.ImageResponseDataInner) (Image, error) {
+	image := Image{RevisedPrompt: data.RevisedPrompt}
+	var err error
+	switch {
+	case data.B64JSON != "":
+		image.Data, err = base64.StdEncoding.DecodeString(data.B64JSON)
+	case strings.HasPrefix(data.URL, "data:"):
+		// Some stand-ins return base64 data URLs instead of b64_json
+		_, encoded, _ := strings.Cut(data.URL, ",")
+		image.Data, err = base64.StdEncoding.DecodeString(encoded)
+	case data.URL != "":
+		image.Data, err = c.downloadImage(ctx, data.URL)
+	default:
+		err = ErrEmptyImage
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("decode image: %w", err)
+	}
+	return image, nil
+}
+
+// downloadImage fetches an image URL of a response. The URL is validated like
+// an API base URL, and no API key or configured header is sent with it.
+func (c *OpenAIClient) downloadImage(ctx context.Context, url string) ([]byte, error) {
+	if err := validateAPIBaseURL(c.config, "image url", url); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	resp, err = c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download image: %s", resp.Status)
+	}
+	var data []byte
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxImageDownloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageDownloadSize {
+		return nil, ErrImageDownloadTooLarge
+	}
+	return data, nil
+}
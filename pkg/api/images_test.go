@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+)
+
+const imagesURL = "https://api.openai.com/v1/images/generations"
+
+// registerImageResponder answers image requests with data and records the requests.
+func registerImageResponder(t *testing.T, data string) *[]openai.ImageRequest {
+	t.Helper()
+	var requests []openai.ImageRequest
+	httpmock.RegisterResponder("POST", imagesURL, func(req *http.Request) (*http.Response, error) {
+		var imageReq openai.ImageRequest
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&imageReq))
+		requests = append(requests, imageReq)
+		return httpmock.NewStringResponse(http.StatusOK, fmt.Sprintf(`{"created":1,"data":[%s]}`, data)), nil
+	})
+	return &requests
+}
+
+func TestCreateImagesBase64(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	encoded := base64.StdEncoding.EncodeToString([]byte("png"))
+	requests := registerImageResponder(t, fmt.Sprintf(`{"b64_json":%q,"revised_prompt":"a fox"},{"b64_json":%q}`, encoded, encoded))
+
+	images, err := client.CreateImages(context.Background(), ImageRequest{
+		Model:   openai.CreateImageModelGptImage1,
+		Prompt:  "fox",
+		Size:    openai.CreateImageSize1024x1024,
+		Quality: openai.CreateImageQualityHigh,
+		Count:   2,
+	})
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	require.Equal(t, []byte("png"), images[0].Data)
+	require.Equal(t, "a fox", images[0].RevisedPrompt)
+	require.Len(t, *requests, 1)
+	require.Equal(t, 2, (*requests)[0].N)
+	require.Equal(t, openai.CreateImageQualityHigh, (*requests)[0].Quality)
+	// GPT image models reject the response format parameter
+	require.Empty(t, (*requests)[0].ResponseFormat)
+}
+
+func TestCreateImagesURL(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	requests := registerImageResponder(t, `{"url":"https://cdn.example.com/fox.png"}`)
+	var authorization string
+	httpmock.RegisterResponder("GET", "https://cdn.example.com/fox.png", func(req *http.Request) (*http.Response, error) {
+		authorization = req.Header.Get("Authorization")
+		return httpmock.NewBytesResponse(http.StatusOK, []byte("png")), nil
+	})
+
+	images, err := client.CreateImages(context.Background(), ImageRequest{Model: openai.CreateImageModelDallE3, Prompt: "fox", Count: 2})
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	require.Equal(t, []byte("png"), images[1].Data)
+	// dall-e-3 generates one image per request
+	require.Len(t, *requests, 2)
+	require.Equal(t, 1, (*requests)[0].N)
+	require.Equal(t, openai.CreateImageResponseFormatURL, (*requests)[0].ResponseFormat)
+	require.Empty(t, authorization)
+}
+
+func TestCreateImagesURLValidation(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	registerImageResponder(t, `{"url":"http://cdn.example.com/fox.png"}`)
+
+	_, err := client.CreateImages(context.Background(), ImageRequest{Model: openai.CreateImageModelDallE2, Prompt: "fox"})
+	require.ErrorContains(t, err, "image url")
+}
+
+func TestCreateImagesDataURL(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	registerImageResponder(t, fmt.Sprintf(`{"url":"data:image/png;base64,%s"}`, base64.StdEncoding.EncodeToString([]byte("png"))))
+
+	images, err := client.CreateImages(context.Background(), ImageRequest{Model: openai.CreateImageModelDallE2, Prompt: "fox"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("png"), images[0].Data)
+}
+
+func TestCreateImagesEmpty(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	registerImageResponder(t, `{}`)
+
+	_, err := client.CreateImages(context.Background(), ImageRequest{Model: openai.CreateImageModelDallE2, Prompt: "fox"})
+	require.ErrorIs(t, err, ErrEmptyImage)
+}
+
+func TestImageResponseFormatLocalStandIn(t *testing.T) {
+	client := &OpenAIClient{endpoint: "http://localhost:8080/v1"}
+	require.Equal(t, openai.CreateImageResponseFormatB64JSON, client.imageResponseFormat(openai.CreateImageModelDallE3))
+	require.Empty(t, client.imageResponseFormat(openai.CreateImageModelGptImage1))
+
+	client.endpoint = openai.DefaultConfig("").BaseURL
+	require.Equal(t, openai.CreateImageResponseFormatURL, client.imageResponseFormat(openai.CreateImageModelDallE3))
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+// ErrInterrupted is returned with the partial response, if the context of a
+// streamed completion is cancelled before the stream finished, e.g. by Ctrl-C.
+var ErrInterrupted = errors.New("response was interrupted")
+
+// interruptStream ends the output of a stream whose context was cancelled and
+// returns ErrInterrupted wrapping the error of the context. Reading a stream
+// fails in different ways when its context is cancelled, so callers check the
+// context instead of the read error.
+func interruptStream(ctx context.Context, out io.Writer) error {
+	slog.Debug("Stream interrupted", "cause", context.Cause(ctx))
+	if _, err := fmt.Fprintln(out); err != nil {
+		slog.Warn("Could not print final linebreak")
+	}
+	return fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+}
+
+// keepInterrupted returns the content received before a stream was
+// interrupted together with err. Unless saveInterrupted is disabled, the
+// partial message is saved to the chat session and marked as truncated in its
+// metadata. Tool calls are dropped, their arguments are incomplete.
+func (c *baseClient) keepInterrupted(chatID, model string, messages []openai.ChatCompletionMessage, received openai.ChatCompletionMessage, err error) (string, error) {
+	received.ToolCalls = nil
+	if received.Content == "" {
+		return "", err
+	}
+	if received.Role == "" {
+		received.Role = openai.ChatMessageRoleAssistant
+	}
+	if chatID == "" || !c.config.GetBool("saveInterrupted") {
+		return received.Content, err
+	}
+	if saveErr := c.saveChatMessages(chatID, model, messages, received); saveErr != nil {
+		return received.Content, errors.Join(err, saveErr)
+	}
+	c.markTruncated(chatID, len(messages))
+	return received.Content, err
+}
+
+// markTruncated records the message at index as truncated in the metadata of
+// the chat session, if the session manager stores metadata. Like the
+// answering model, failing to record it is only logged.
+func (c *baseClient) markTruncated(chatID string, index int) {
+	store, ok := c.chatSessionManager.(chat.MetadataStore)
+	if !ok {
+		return
+	}
+	metadata, err := store.GetMetadata(chatID)
+	if err == nil && !slices.Contains(metadata.Truncated, index) {
+		metadata.Truncated = append(metadata.Truncated, index)
+		err = store.SaveMetadata(chatID, metadata)
+	}
+	if err != nil {
+		slog.Warn("Could not save chat session metadata", "error", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+// interruptedBody returns data and then cancels the request, like a user
+// pressing Ctrl-C while the rest of the response is still on its way.
+type interruptedBody struct {
+	data   *strings.Reader
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *interruptedBody) Read(p []byte) (int, error) {
+	if b.data.Len() > 0 {
+		return b.data.Read(p)
+	}
+	b.cancel()
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func (b *interruptedBody) Close() error {
+	return nil
+}
+
+// registerInterruptedStream answers chat completions with the chunks of data
+// and cancels ctx before the stream finishes.
+func registerInterruptedStream(t *testing.T, data string) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(req *http.Request) (*http.Response, error) {
+			resp := streamResponse("")
+			resp.Body = &interruptedBody{data: strings.NewReader(data), ctx: req.Context(), cancel: cancel}
+			return resp, nil
+		})
+	return ctx
+}
+
+const interruptedStreamData = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello \"}}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Wor\"}}]}\n\n"
+
+func TestCreateCompletionInterrupted(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("stream", true)
+	testCtx.Config.Set("saveInterrupted", true)
+	ctx := registerInterruptedStream(t, interruptedStreamData)
+
+	result, err := client.CreateCompletion(ctx, "interrupted", []string{"Say: Hello World!"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, "Hello Wor", result)
+	require.Equal(t, "Hello Wor\n", out.String())
+
+	// The partial answer is saved and marked as truncated
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	messages, err := manager.GetSession("interrupted")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, openai.ChatMessageRoleAssistant, messages[1].Role)
+	require.Equal(t, "Hello Wor", messages[1].Content)
+	metadata, err := manager.(chat.MetadataStore).GetMetadata("interrupted")
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, metadata.Truncated)
+}
+
+func TestCreateCompletionInterruptedNotSaved(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("stream", true)
+	testCtx.Config.Set("saveInterrupted", false)
+	testCtx.Config.Set("fallbackModels", []string{"gpt-4o-mini"})
+	ctx := registerInterruptedStream(t, interruptedStreamData)
+
+	result, err := client.CreateCompletion(ctx, "interrupted", []string{"Say: Hello World!"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.Equal(t, "Hello Wor", result)
+	// An interruption never falls back to another model
+	require.Equal(t, 1, httpmock.GetTotalCallCount())
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	exists, err := manager.SessionExists("interrupted")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestCreateCompletionInterruptedToolCall(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("stream", true)
+	testCtx.Config.Set("saveInterrupted", true)
+	ctx := registerInterruptedStream(t,
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"shell\",\"arguments\":\"{\\\"comm\"}}]}}]}\n\n")
+
+	// Without content there is nothing to keep
+	result, err := client.CreateCompletion(ctx, "interrupted", []string{"List files"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.Empty(t, result)
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	exists, err := manager.SessionExists("interrupted")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestOllamaStreamInterrupted(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("stream", true)
+	testCtx.Config.Set("saveInterrupted", true)
+	release := make(chan struct{})
+	newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = fmt.Fprintf(w, `{"model":"llama3","message":{"role":"assistant","content":%q},"done":false}`+"\n", "Hello")
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	// The handler has to return before the stand-in closes
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out bytes.Buffer
+	client, err := CreateOllamaClient(testCtx.Config, &cancelWriter{w: &out, cancel: cancel})
+	require.NoError(t, err)
+
+	result, err := client.CreateCompletion(ctx, "interrupted", []string{"Say: Hello World!"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.Equal(t, "Hello", result)
+	require.Equal(t, "Hello\n", out.String())
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	metadata, err := manager.(chat.MetadataStore).GetMetadata("interrupted")
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, metadata.Truncated)
+}
+
+// cancelWriter cancels the request as soon as the first output is written.
+type cancelWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (c *cancelWriter) Write(p []byte) (int, error) {
+	defer c.cancel()
+	return c.w.Write(p)
+}
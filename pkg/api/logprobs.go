@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+// maxTopLogprobs is the largest number of alternatives per token the API returns.
+const maxTopLogprobs = 20
+
+// OutputFormats are the values accepted by the output config key and the --output flag.
+var OutputFormats = []string{"text", "json"}
+
+var (
+	// ErrUnknownOutputFormat is returned, if output is not one of OutputFormats.
+	ErrUnknownOutputFormat = fmt.Errorf("output must be one of %s", strings.Join(OutputFormats, ", "))
+	// ErrInvalidTopLogprobs is returned, if topLogprobs is out of range.
+	ErrInvalidTopLogprobs = fmt.Errorf("top logprobs must be between 0 and %d", maxTopLogprobs)
+	// ErrLogprobsUnsupported is returned, if logprobs are requested from a provider that does not return them.
+	ErrLogprobsUnsupported = errors.New("provider does not support logprobs")
+)
+
+// TokenLogprob is the log probability of a token of the response and of the
+// most likely alternatives at its position.
+type TokenLogprob struct {
+	Token        string             `json:"token"`
+	Logprob      float64            `json:"logprob"`
+	Alternatives []TokenAlternative `json:"alternatives"`
+}
+
+// TokenAlternative is a likely token at the position of a response token.
+type TokenAlternative struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// logprobsOutput is written instead of the response with the json output.
+type logprobsOutput struct {
+	Content  string         `json:"content"`
+	Logprobs []TokenLogprob `json:"logprobs"`
+}
+
+// applyLogprobs requests logprobs, if logprobs or top logprobs are configured
+// or the output is json.
+func applyLogprobs(config *viper.Viper, req *openai.ChatCompletionRequest) error {
+	jsonOutput, err := isJSONOutput(config)
+	if err != nil {
+		return err
+	}
+	top := config.GetInt("topLogprobs")
+	if top < 0 || top > maxTopLogprobs {
+		return ErrInvalidTopLogprobs
+	}
+	req.LogProbs = config.GetBool("logprobs") || top > 0 || jsonOutput
+	req.TopLogProbs = top
+	return nil
+}
+
+// isJSONOutput reports whether the response is written as JSON with its logprobs.
+func isJSONOutput(config *viper.Viper) (bool, error) {
+	output := config.GetString("output")
+	if output != "" && !slices.Contains(OutputFormats, output) {
+		return false, fmt.Errorf("%w: %q", ErrUnknownOutputFormat, output)
+	}
+	return output == "json", nil
+}
+
+// checkNoLogprobs returns ErrLogprobsUnsupported, if logprobs are configured
+// for a provider that cannot return them.
+func checkNoLogprobs(config *viper.Viper) error {
+	var req openai.ChatCompletionRequest
+	if err := applyLogprobs(config, &req); err != nil {
+		return err
+	}
+	if req.LogProbs {
+		return fmt.Errorf("%w: %s", ErrLogprobsUnsupported, providerName(config))
+	}
+	return nil
+}
+
+// convertLogprobs converts the logprobs of a complete response.
+func convertLogprobs(logprobs *openai.LogProbs) []TokenLogprob {
+	if logprobs == nil {
+		return nil
+	}
+	converted := make([]TokenLogprob, 0, len(logprobs.Content))
+	for _, token := range logprobs.Content {
+		alternatives := make([]TokenAlternative, 0, len(token.TopLogProbs))
+		for _, alternative := range token.TopLogProbs {
+			alternatives = append(alternatives, TokenAlternative{Token: alternative.Token, Logprob: alternative.LogProb})
+		}
+		converted = append(converted, TokenLogprob{Token: token.Token, Logprob: token.LogProb, Alternatives: alternatives})
+	}
+	return converted
+}
+
+// convertStreamLogprobs converts the logprobs of a streamed chunk.
+func convertStreamLogprobs(logprobs *openai.ChatCompletionStreamChoiceLogprobs) []TokenLogprob {
+	if logprobs == nil {
+		return nil
+	}
+	converted := make([]TokenLogprob, 0, len(logprobs.Content))
+	for _, token := range logprobs.Content {
+		alternatives := make([]TokenAlternative, 0, len(token.TopLogprobs))
+		for _, alternative := range token.TopLogprobs {
+			alternatives = append(alternatives, TokenAlternative{Token: alternative.Token, Logprob: alternative.Logprob})
+		}
+		converted = append(converted, TokenLogprob{Token: token.Token, Logprob: token.Logprob, Alternatives: alternatives})
+	}
+	return converted
+}
+
+// printLogprobs writes the logprobs of the response after it. The text
+// output has a line per token with its logprob, probability and the
+// alternatives, separated by tabs. The json output writes the response and
+// its logprobs as a single object instead of the response.
+func (c *baseClient) printLogprobs(content string, logprobs []TokenLogprob) error {
+	jsonOutput, err := isJSONOutput(c.config)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		if logprobs == nil {
+			logprobs = []TokenLogprob{}
+		}
+		encoder := json.NewEncoder(c.out)
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(logprobsOutput{Content: content, Logprobs: logprobs})
+	}
+	if !c.config.GetBool("logprobs") && c.config.GetInt("topLogprobs") == 0 {
+		return nil
+	}
+	slog.Debug("Printing logprobs", "tokens", len(logprobs))
+	if _, err = fmt.Fprintln(c.out, "--- logprobs ---"); err != nil {
+		return err
+	}
+	for _, token := range logprobs {
+		line := formatLogprob(token.Token, token.Logprob)
+		for _, alternative := range token.Alternatives {
+			line += "\t" + formatLogprob(alternative.Token, alternative.Logprob)
+		}
+		if _, err = fmt.Fprintln(c.out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLogprob formats a token with its logprob and probability.
+func formatLogprob(token string, logprob float64) string {
+	return fmt.Sprintf("%q %.4f (%.2f%%)", token, logprob, math.Exp(logprob)*100)
+}
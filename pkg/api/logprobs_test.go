@@ -0,0 +1,124 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+const logprobsResponse = `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Yes"},
+"logprobs":{"content":[{"token":"Yes","logprob":-0.01,"top_logprobs":[{"token":"Yes","logprob":-0.01},{"token":"No","logprob":-4.7}]}]}}]}`
+
+func logprobsStream() string {
+	chunk := func(content, token string, logprob float64) string {
+		return fmt.Sprintf(`data: {"id":"1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":%q},"logprobs":{"content":[{"token":%q,"logprob":%g,"top_logprobs":[]}]}}]}`+"\n\n", content, token, logprob)
+	}
+	return chunk("Yes", "Yes", -0.01) + chunk("!", "!", -0.5) + "data: [DONE]\n\n"
+}
+
+func TestCreateCompletionLogprobs(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("topLogprobs", 2)
+	requests := registerChatResponses(t, "application/json", logprobsResponse)
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Yes", result)
+	require.Equal(t, "Yes\n--- logprobs ---\n\"Yes\" -0.0100 (99.00%)\t\"Yes\" -0.0100 (99.00%)\t\"No\" -4.7000 (0.91%)\n", out.String())
+	// Top logprobs imply logprobs
+	require.True(t, (*requests)[0].LogProbs)
+	require.Equal(t, 2, (*requests)[0].TopLogProbs)
+}
+
+func TestCreateCompletionLogprobsJSON(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("output", "json")
+	requests := registerChatResponses(t, "application/json", logprobsResponse)
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Yes", result)
+	require.JSONEq(t, `{"content":"Yes","logprobs":[{"token":"Yes","logprob":-0.01,"alternatives":[{"token":"Yes","logprob":-0.01},{"token":"No","logprob":-4.7}]}]}`, out.String())
+	require.True(t, (*requests)[0].LogProbs)
+}
+
+func TestCreateCompletionLogprobsStream(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("stream", true)
+	testCtx.Config.Set("logprobs", true)
+	registerChatResponses(t, "text/event-stream", logprobsStream())
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Yes!", result)
+	require.Equal(t, "Yes!\n--- logprobs ---\n\"Yes\" -0.0100 (99.00%)\n\"!\" -0.5000 (60.65%)\n", out.String())
+
+	// The streamed response is held back for the json output
+	out.Reset()
+	httpmock.Reset()
+	testCtx.Config.Set("output", "json")
+	registerChatResponses(t, "text/event-stream", logprobsStream())
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"content":"Yes!","logprobs":[{"token":"Yes","logprob":-0.01,"alternatives":[]},{"token":"!","logprob":-0.5,"alternatives":[]}]}`, out.String())
+}
+
+func TestCreateCompletionLogprobsInvalid(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("topLogprobs", 21)
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInvalidTopLogprobs)
+
+	testCtx.Config.Set("topLogprobs", 0)
+	testCtx.Config.Set("output", "yaml")
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Is the sky blue?"}, "txt", nil)
+	require.ErrorIs(t, err, ErrUnknownOutputFormat)
+	require.Zero(t, httpmock.GetTotalCallCount())
+}
+
+func TestLogprobsUnsupportedProviders(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("logprobs", true)
+	newOllamaStandIn(t, func(http.ResponseWriter, ollamaChatRequest) {
+		t.Fatal("unexpected request")
+	})
+	ollama, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = ollama.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrLogprobsUnsupported)
+
+	newAnthropicStandIn(t, func(http.ResponseWriter, anthropicRequest) {
+		t.Fatal("unexpected request")
+	})
+	anthropic, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = anthropic.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrLogprobsUnsupported)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// modelsCacheDir is the directory model lists are cached in, inside the
+	// cache dir. The leading dot keeps it apart from chat sessions.
+	modelsCacheDir = ".models"
+	// modelsCacheTTL is how long a cached model list is used.
+	modelsCacheTTL = 24 * time.Hour
+)
+
+// ErrModelListingUnsupported is returned, if the selected provider cannot list its models.
+var ErrModelListingUnsupported = errors.New("provider does not support listing models")
+
+// Model is a model offered by the provider.
+type Model struct {
+	ID      string    `json:"id"`
+	OwnedBy string    `json:"ownedBy,omitempty"`
+	Created time.Time `json:"created,omitzero"`
+}
+
+// ModelLister is the interface that wraps the ListModels method. It is
+// implemented by all built-in provider clients.
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]Model, error)
+}
+
+// ClearModelCache removes all cached model lists, so the next ListModels call
+// asks the provider again.
+func ClearModelCache(config *viper.Viper) error {
+	cacheDir := config.GetString("cacheDir")
+	if cacheDir == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(cacheDir, modelsCacheDir))
+}
+
+// cachedModels returns the model list of the provider at endpoint from the
+// cache, or calls fetch and caches its result. Cache errors are logged, so a
+// broken cache only costs another request.
+func (c *baseClient) cachedModels(ctx context.Context, provider, endpoint string, fetch func(context.Context) ([]Model, error)) ([]Model, error) {
+	cacheDir := c.config.GetString("cacheDir")
+	if cacheDir == "" {
+		return fetch(ctx)
+	}
+	hash := sha256.Sum256([]byte(provider + "\x00" + endpoint))
+	path := filepath.Join(cacheDir, modelsCacheDir, provider+"-"+hex.EncodeToString(hash[:8])+".json")
+
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < modelsCacheTTL {
+		var data []byte
+		data, err = os.ReadFile(path)
+		var cached []Model
+		if err == nil && json.Unmarshal(data, &cached) == nil {
+			slog.Debug("Using cached model list", "path", path)
+			return cached, nil
+		}
+		slog.Debug("Ignoring unreadable model cache", "path", path)
+	}
+
+	models, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].ID < models[j].ID
+	})
+
+	var data []byte
+	if data, err = json.Marshal(models); err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			err = os.WriteFile(path, data, 0600)
+		}
+	}
+	if err != nil {
+		slog.Warn("Could not cache model list", "error", err)
+	}
+	return models, nil
+}
+
+// ListModels returns the models available at the configured endpoint. The
+// list is cached for a day.
+func (c *OpenAIClient) ListModels(ctx context.Context) ([]Model, error) {
+	return c.cachedModels(ctx, providerName(c.config), c.endpoint, func(ctx context.Context) ([]Model, error) {
+		list, err := c.api.ListModels(ctx)
+		if err != nil {
+			return nil, err
+		}
+		models := make([]Model, 0, len(list.Models))
+		for _, model := range list.Models {
+			converted := Model{ID: model.ID, OwnedBy: model.OwnedBy}
+			if model.CreatedAt > 0 {
+				converted.Created = time.Unix(model.CreatedAt, 0).UTC()
+			}
+			models = append(models, converted)
+		}
+		return models, nil
+	})
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+func TestOpenAIListModels(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	calls := 0
+	httpmock.RegisterResponder("GET", "https://api.openai.com/v1/models",
+		func(_ *http.Request) (*http.Response, error) {
+			calls++
+			return httpmock.NewStringResponse(200, `{"object":"list","data":[
+				{"id":"gpt-4o","object":"model","created":1715367049,"owned_by":"system"},
+				{"id":"dall-e-3","object":"model","created":1698785189,"owned_by":"system"}]}`), nil
+		})
+
+	models, err := client.ListModels(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Model{
+		{ID: "dall-e-3", OwnedBy: "system", Created: time.Unix(1698785189, 0).UTC()},
+		{ID: "gpt-4o", OwnedBy: "system", Created: time.Unix(1715367049, 0).UTC()},
+	}, models)
+
+	// The second call is served from the cache
+	models, err = client.ListModels(context.Background())
+	require.NoError(t, err)
+	require.Len(t, models, 2)
+	require.Equal(t, 1, calls)
+
+	require.NoError(t, ClearModelCache(testCtx.Config))
+	_, err = client.ListModels(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestAnthropicListModels(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, anthropicModelsSuffix, r.URL.Path)
+		require.Equal(t, "test", r.Header.Get("x-api-key"))
+		w.Header().Set("Content-Type", "application/json")
+		// Two pages
+		if r.URL.Query().Get("after_id") == "" {
+			_, _ = fmt.Fprint(w, `{"data":[{"type":"model","id":"claude-sonnet-4-5","created_at":"2025-09-29T00:00:00Z"}],"has_more":true,"last_id":"claude-sonnet-4-5"}`)
+			return
+		}
+		require.Equal(t, "claude-sonnet-4-5", r.URL.Query().Get("after_id"))
+		_, _ = fmt.Fprint(w, `{"data":[{"type":"model","id":"claude-haiku-4-5","created_at":"2025-10-01T00:00:00Z"}],"has_more":false,"last_id":"claude-haiku-4-5"}`)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	client, err := CreateAnthropicClient(testCtx.Config, nil)
+	require.NoError(t, err)
+
+	var models []Model
+	models, err = client.ListModels(context.Background())
+	require.NoError(t, err)
+	require.Len(t, models, 2)
+	require.Equal(t, "claude-haiku-4-5", models[0].ID)
+	require.Equal(t, ProviderAnthropic, models[0].OwnedBy)
+	require.Equal(t, time.Date(2025, 9, 29, 0, 0, 0, 0, time.UTC), models[1].Created)
+}
+
+func TestOllamaListModels(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, ollamaTagsSuffix, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"models":[{"name":"llama3.1:8b","model":"llama3.1:8b","modified_at":"2025-01-02T03:04:05Z","size":4920753328}]}`)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OLLAMA_HOST", server.URL)
+
+	client, err := CreateOllamaClient(testCtx.Config, nil)
+	require.NoError(t, err)
+
+	var models []Model
+	models, err = client.ListModels(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Model{{ID: "llama3.1:8b", Created: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)}}, models)
+}
@@ -0,0 +1,470 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+const (
+	// envKeyOllamaHost is the environment variable the Ollama CLI itself uses for the server address.
+	envKeyOllamaHost = "OLLAMA_HOST"
+
+	defaultOllamaHost = "http://localhost:11434"
+	ollamaChatSuffix  = "/api/chat"
+	ollamaTagsSuffix  = "/api/tags"
+	ollamaEmbedSuffix = "/api/embed"
+	// ollamaResponseHeaderTimeout replaces defaultResponseHeaderTimeout for
+	// Ollama: the server loads the model into memory before it sends response
+	// headers, which takes well over 30 seconds for large models.
+	ollamaResponseHeaderTimeout = 5 * time.Minute
+)
+
+var (
+	// ErrOllamaModelNotPulled is returned when the requested model is not available on the Ollama server.
+	ErrOllamaModelNotPulled = errors.New("model is not pulled")
+	// ErrOllamaRemoteImage is returned for image URLs; Ollama only accepts inline image data.
+	ErrOllamaRemoteImage = errors.New("ollama only supports local image files as input")
+)
+
+// OllamaClient is a client for the native Ollama chat API.
+type OllamaClient struct {
+	baseClient
+
+	HTTPClient *http.Client
+	baseURL    string
+}
+
+// CreateOllamaClient creates a new Ollama client with the given config and output writer.
+// The server address is read from OLLAMA_HOST, which may omit the scheme just like for the Ollama CLI.
+func CreateOllamaClient(config *viper.Viper, out io.Writer, opts ...ClientOption) (*OllamaClient, error) {
+	baseURL := defaultOllamaHost
+	if host, source, isSet := lookupAPIBase(config, envKeyOllamaHost); isSet && host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		if err := validateAPIBaseURL(config, source, host); err != nil {
+			return nil, err
+		}
+		baseURL = strings.TrimSuffix(host, "/")
+		slog.Debug(source+" override active", "url", baseURL)
+	}
+
+	base, err := newBaseClient(config, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	transport.ResponseHeaderTimeout = ollamaResponseHeaderTimeout
+	client := &OllamaClient{
+		baseClient: base,
+		HTTPClient: &http.Client{Transport: transport},
+		baseURL:    baseURL,
+	}
+	slog.Debug("Ollama client created")
+	return client, nil
+}
+
+type ollamaChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []ollamaMessage `json:"messages"`
+	Stream    bool            `json:"stream"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
+	Options   map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+type ollamaChatResponse struct {
+	Model      string        `json:"model"`
+	Message    ollamaMessage `json:"message"`
+	Done       bool          `json:"done"`
+	DoneReason string        `json:"done_reason"`
+	Error      string        `json:"error"`
+	// The token counts are only sent with the final response.
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+func (r ollamaChatResponse) usage() openai.Usage {
+	return openai.Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+// CreateCompletion creates a completion for the given prompt and modifier via the Ollama chat API.
+// Chat sessions are stored in the same format as for the other providers.
+func (c *OllamaClient) CreateCompletion(ctx context.Context, chatID string, prompt []string, modifier string, input []string) (string, error) {
+	if err := checkSingleChoice(c.config); err != nil {
+		return "", err
+	}
+	if err := checkNoLogprobs(c.config); err != nil {
+		return "", err
+	}
+	if err := checkNoStructuredOutput(c.config); err != nil {
+		return "", err
+	}
+	messages, history, err := c.buildMessages(chatID, prompt, modifier, input)
+	if err != nil {
+		return "", err
+	}
+	if err = c.checkNoTools(modifier, messages); err != nil {
+		return "", err
+	}
+
+	var receivedMessage openai.ChatCompletionMessage
+	var usage openai.Usage
+	// Output of a failed model that reached the out writer rules out a fallback
+	printed := &outputTracker{w: c.out}
+	retriever := *c
+	retriever.out = printed
+	// The fallback models are tried in order, if a model fails
+	models := completionModels(c.config)
+	var model string
+	for i := range models {
+		model = models[i]
+		var req ollamaChatRequest
+		req, err = c.newRequest(model, c.fitContextWindowFor(model, messages, history))
+		if err != nil {
+			return "", err
+		}
+		printed.written = false
+		if req.Stream {
+			receivedMessage, usage, err = retriever.retrieveChatStream(ctx, req)
+		} else {
+			receivedMessage, usage, err = retriever.retrieveChat(ctx, req)
+		}
+		c.recordModelUsage(ProviderOllama, model, chatID, modifier, usage)
+		if i+1 < len(models) && shouldFallBack(err, printed) {
+			slog.Warn("Falling back to the next model", "failed", model, "model", models[i+1], "error", err)
+			continue
+		}
+		break
+	}
+	if errors.Is(err, ErrInterrupted) {
+		return c.keepInterrupted(chatID, model, messages, receivedMessage, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("Model answered", "model", model)
+	slog.Debug("Received message from Ollama API")
+
+	if err = c.saveChatMessages(chatID, model, messages, receivedMessage); err != nil {
+		return "", err
+	}
+	return receivedMessage.Content, nil
+}
+
+func (c *OllamaClient) newRequest(model string, messages []openai.ChatCompletionMessage) (ollamaChatRequest, error) {
+	ollamaMessages, err := toOllamaMessages(messages)
+	if err != nil {
+		return ollamaChatRequest{}, err
+	}
+	options, keepAlive := ollamaSettings(c.config, model)
+	return ollamaChatRequest{
+		Model:     model,
+		Messages:  ollamaMessages,
+		Stream:    c.config.GetBool("stream"),
+		KeepAlive: keepAlive,
+		Options:   options,
+	}, nil
+}
+
+// ollamaSettings resolves the options and keep_alive value sent for model.
+// The generic sampling settings come first, followed by the ollama section of
+// the config and finally ollama.models.<model>, so the most specific setting
+// wins. Model names are matched against the map keys directly because they
+// usually contain dots (llama3.1:8b) that viper would treat as key separators.
+func ollamaSettings(config *viper.Viper, model string) (map[string]any, any) {
+	options := make(map[string]any)
+	if config.IsSet("temperature") {
+		options["temperature"] = config.GetFloat64("temperature")
+	}
+	if config.IsSet("topP") {
+		options["top_p"] = config.GetFloat64("topP")
+	}
+	if maxTokens := config.GetInt("maxTokens"); maxTokens > 0 {
+		options["num_predict"] = maxTokens
+	}
+	if config.IsSet("seed") {
+		options["seed"] = config.GetInt("seed")
+	}
+	if stop := config.GetStringSlice("stop"); len(stop) > 0 {
+		options["stop"] = stop
+	}
+	if penalty := config.GetFloat64("presencePenalty"); penalty != 0 {
+		options["presence_penalty"] = penalty
+	}
+	if penalty := config.GetFloat64("frequencyPenalty"); penalty != 0 {
+		options["frequency_penalty"] = penalty
+	}
+
+	var keepAlive any
+	applyOllamaSection(config.GetStringMap("ollama"), options, &keepAlive)
+	models := config.GetStringMap("ollama.models")
+	if modelSection, ok := models[strings.ToLower(model)].(map[string]any); ok {
+		slog.Debug("Applying model specific Ollama settings for " + model)
+		applyOllamaSection(modelSection, options, &keepAlive)
+	}
+
+	if len(options) == 0 {
+		options = nil
+	}
+	return options, keepAlive
+}
+
+// applyOllamaSection merges one level of Ollama settings. viper lowercases
+// all keys, hence the lowercase lookups.
+func applyOllamaSection(section map[string]any, options map[string]any, keepAlive *any) {
+	if sectionOptions, ok := section["options"].(map[string]any); ok {
+		for key, value := range sectionOptions {
+			options[key] = value
+		}
+	}
+	if numCtx, ok := section["numctx"]; ok {
+		options["num_ctx"] = numCtx
+	}
+	if value, ok := section["keepalive"]; ok {
+		*keepAlive = value
+	}
+}
+
+// toOllamaMessages maps the conversation onto the Ollama chat API, which
+// takes plain text content plus base64 encoded images without the data URL
+// prefix.
+func toOllamaMessages(messages []openai.ChatCompletionMessage) ([]ollamaMessage, error) {
+	converted := make([]ollamaMessage, 0, len(messages))
+	for _, message := range messages {
+		ollamaMsg := ollamaMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		}
+		var texts []string
+		for _, part := range message.MultiContent {
+			switch part.Type {
+			case openai.ChatMessagePartTypeText:
+				texts = append(texts, part.Text)
+			case openai.ChatMessagePartTypeImageURL:
+				if part.ImageURL == nil || !strings.HasPrefix(part.ImageURL.URL, "data:") {
+					return nil, ErrOllamaRemoteImage
+				}
+				_, data, found := strings.Cut(part.ImageURL.URL, ";base64,")
+				if !found {
+					return nil, errors.New("image data URL must be base64 encoded")
+				}
+				ollamaMsg.Images = append(ollamaMsg.Images, data)
+			}
+		}
+		if len(texts) > 0 {
+			ollamaMsg.Content = strings.Join(texts, "\n")
+		}
+		converted = append(converted, ollamaMsg)
+	}
+	return converted, nil
+}
+
+// post sends req for model to the endpoint at suffix. Error statuses are
+// returned as *APIError, or wrapped in ErrOllamaModelNotPulled if the model is
+// missing.
+func (c *OllamaClient) post(ctx context.Context, suffix, model string, req any) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var httpReq *http.Request
+	httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+suffix, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	var resp *http.Response
+	resp, err = newRetryingDoer(c.HTTPClient, c.config).Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, newOllamaAPIError(resp, model)
+	}
+	return resp, nil
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name       string    `json:"name"`
+		ModifiedAt time.Time `json:"modified_at"`
+	} `json:"models"`
+}
+
+// ListModels returns the models pulled on the Ollama server. The list is
+// cached for a day.
+func (c *OllamaClient) ListModels(ctx context.Context) ([]Model, error) {
+	return c.cachedModels(ctx, ProviderOllama, c.baseURL, func(ctx context.Context) ([]Model, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+ollamaTagsSuffix, nil)
+		if err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = newRetryingDoer(c.HTTPClient, c.config).Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, newOllamaAPIError(resp, "")
+		}
+		var tags ollamaTagsResponse
+		if err = json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+			return nil, err
+		}
+		models := make([]Model, 0, len(tags.Models))
+		for _, model := range tags.Models {
+			models = append(models, Model{ID: model.Name, Created: model.ModifiedAt})
+		}
+		return models, nil
+	})
+}
+
+func newOllamaAPIError(resp *http.Response, model string) error {
+	apiErr := &APIError{
+		Provider:   ProviderOllama,
+		StatusCode: resp.StatusCode,
+		Message:    resp.Status,
+	}
+	var errResp ollamaChatResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+		apiErr.Message = errResp.Error
+	}
+	// Ollama answers 404 with "model ... not found, try pulling it first".
+	if resp.StatusCode == http.StatusNotFound && strings.Contains(apiErr.Message, "not found") {
+		return fmt.Errorf("%w: %q, run \"ollama pull %s\" first: %w", ErrOllamaModelNotPulled, model, model, apiErr)
+	}
+	return apiErr
+}
+
+func (c *OllamaClient) retrieveChat(ctx context.Context, req ollamaChatRequest) (openai.ChatCompletionMessage, openai.Usage, error) {
+	resp, err := c.post(ctx, ollamaChatSuffix, req.Model, req)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	defer resp.Body.Close()
+	slog.Debug("Received response")
+
+	var chatResp ollamaChatResponse
+	if err = json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	usage := chatResp.usage()
+	if chatResp.Error != "" {
+		return openai.ChatCompletionMessage{}, usage, &APIError{Provider: ProviderOllama, StatusCode: resp.StatusCode, Message: chatResp.Error}
+	}
+	if chatResp.Message.Content == "" {
+		return openai.ChatCompletionMessage{}, usage, ErrEmptyResponse
+	}
+	message := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: chatResp.Message.Content,
+	}
+
+	if _, err = fmt.Fprintln(c.out, message.Content); err != nil {
+		return openai.ChatCompletionMessage{}, usage, err
+	}
+	slog.Debug("Printed response")
+	return message, usage, nil
+}
+
+func (c *OllamaClient) retrieveChatStream(ctx context.Context, req ollamaChatRequest) (openai.ChatCompletionMessage, openai.Usage, error) {
+	resp, err := c.post(ctx, ollamaChatSuffix, req.Model, req)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, openai.Usage{}, err
+	}
+	defer resp.Body.Close()
+	slog.Debug("Streaming response")
+
+	receivedMessage := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+	}
+	var usage openai.Usage
+	// The response is newline delimited JSON, one chunk per line.
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaChatResponse
+		if err = json.Unmarshal(line, &chunk); err != nil {
+			return openai.ChatCompletionMessage{}, usage, err
+		}
+		if chunk.Error != "" {
+			slog.Debug("Stream error encountered")
+			return openai.ChatCompletionMessage{}, usage, &APIError{Provider: ProviderOllama, StatusCode: resp.StatusCode, Message: chunk.Error}
+		}
+		receivedMessage.Content += chunk.Message.Content
+		if _, err = fmt.Fprint(c.out, chunk.Message.Content); err != nil {
+			return openai.ChatCompletionMessage{}, usage, err
+		}
+		if chunk.Done {
+			usage = chunk.usage()
+			slog.Debug("Stream finished", "reason", chunk.DoneReason)
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			// Keep what was received before the interruption
+			return receivedMessage, usage, interruptStream(ctx, c.out)
+		}
+		return openai.ChatCompletionMessage{}, usage, err
+	}
+	// Print final linebreak
+	if _, err = fmt.Fprintf(c.out, "\n"); err != nil {
+		slog.Warn("Could not print final linebreak")
+	}
+	return receivedMessage, usage, nil
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func newOllamaStandIn(t *testing.T, handler func(w http.ResponseWriter, req ollamaChatRequest)) *ollamaChatRequest {
+	t.Helper()
+	var lastRequest ollamaChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, ollamaChatSuffix, r.URL.Path)
+		lastRequest = ollamaChatRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&lastRequest))
+		handler(w, lastRequest)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OLLAMA_HOST", server.URL)
+	return &lastRequest
+}
+
+func TestCreateOllamaClientHostWithoutScheme(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "127.0.0.1:11434")
+
+	client, err := CreateOllamaClient(testlib.NewTestCtx(t).Config, nil)
+	require.NoError(t, err)
+	require.Equal(t, "http://127.0.0.1:11434", client.baseURL)
+}
+
+func TestCreateOllamaClientHostValidation(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://1.2.3.4:11434")
+
+	client, err := CreateOllamaClient(testlib.NewTestCtx(t).Config, nil)
+	require.Error(t, err)
+	require.Nil(t, client)
+	require.Contains(t, err.Error(), "OLLAMA_HOST")
+}
+
+func TestOllamaSimplePrompt(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "llama3")
+	req := newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		_, _ = io.WriteString(w, `{"model":"llama3","message":{"role":"assistant","content":"Hello World!"},"done":true,"done_reason":"stop"}`)
+	})
+
+	var out bytes.Buffer
+	client, err := CreateOllamaClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, "Hello World!\n", out.String())
+	require.Equal(t, "llama3", req.Model)
+	require.False(t, req.Stream)
+	require.Len(t, req.Messages, 1)
+	require.Equal(t, "user", req.Messages[0].Role)
+}
+
+func TestOllamaStream(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("stream", true)
+	req := newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, part := range []string{"Hello", " World", "!"} {
+			_, _ = fmt.Fprintf(w, `{"model":"llama3","message":{"role":"assistant","content":%q},"done":false}`+"\n", part)
+		}
+		_, _ = io.WriteString(w, `{"model":"llama3","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":26,"eval_count":4}`+"\n")
+	})
+
+	var out bytes.Buffer
+	client, err := CreateOllamaClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	var result string
+	result, err = client.CreateCompletion(context.Background(), "test_chat", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, "Hello World!\n", out.String())
+	require.True(t, req.Stream)
+	require.FileExists(t, filepath.Join(testCtx.CacheDir, "test_chat"))
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "test_chat", records[0].ChatID)
+	require.Equal(t, 30, records[0].TotalTokens)
+	require.Nil(t, records[0].Cost)
+}
+
+func TestOllamaModelSpecificSettings(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.SetConfigType("yaml")
+	require.NoError(t, testCtx.Config.ReadConfig(strings.NewReader(`
+model: llama3.1:8b
+temperature: 0.5
+ollama:
+  keepAlive: 10m
+  numCtx: 4096
+  options:
+    num_gpu: 1
+    temperature: 0.7
+  models:
+    llama3.1:8b:
+      numCtx: 32768
+      keepAlive: -1
+      options:
+        repeat_penalty: 1.1
+    other:
+      numCtx: 1024
+`)))
+	req := newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		_, _ = io.WriteString(w, `{"message":{"role":"assistant","content":"ok"},"done":true}`)
+	})
+
+	client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "llama3.1:8b", req.Model)
+	require.InDelta(t, -1, req.KeepAlive, 0)
+	require.InDelta(t, 32768, req.Options["num_ctx"], 0)
+	require.InDelta(t, 1, req.Options["num_gpu"], 0)
+	require.InDelta(t, 1.1, req.Options["repeat_penalty"], 0.001)
+	// ollama.options overrides the generic sampling settings.
+	require.InDelta(t, 0.7, req.Options["temperature"], 0.001)
+}
+
+func TestOllamaModelNotPulled(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "llama9")
+	newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"error":"model \"llama9\" not found, try pulling it first"}`)
+	})
+
+	client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrOllamaModelNotPulled)
+	require.Contains(t, err.Error(), `ollama pull llama9`)
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+}
+
+func TestOllamaServerError(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	// The error is retried otherwise, which only slows this test down
+	testCtx.Config.Set("retry.maxAttempts", 1)
+	newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, `{"error":"out of memory"}`)
+	})
+
+	client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.NotErrorIs(t, err, ErrOllamaModelNotPulled)
+	require.ErrorContains(t, err, "out of memory")
+}
+
+func TestOllamaImages(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	req := newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		_, _ = io.WriteString(w, `{"message":{"role":"assistant","content":"A robot."},"done":true}`)
+	})
+
+	client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"what can you see?"}, "txt", []string{"testdata/marvin.jpg"})
+	require.NoError(t, err)
+	require.Len(t, req.Messages, 1)
+	require.Equal(t, "what can you see?", req.Messages[0].Content)
+	require.Len(t, req.Messages[0].Images, 1)
+	require.NotContains(t, req.Messages[0].Images[0], "data:")
+
+	_, err = client.CreateCompletion(context.Background(), "", []string{"what can you see?"}, "txt", []string{"https://example.com/marvin.jpg"})
+	require.ErrorIs(t, err, ErrOllamaRemoteImage)
+}
+
+func TestOllamaStructuredOutputUnsupported(t *testing.T) {
+	for key, value := range map[string]any{"jsonMode": true, "jsonSchema": "person.schema.json"} {
+		testCtx := testlib.NewTestCtx(t)
+		testCtx.Config.Set(key, value)
+		testCtx.Config.Set("schemaRetries", 2)
+		newOllamaStandIn(t, func(http.ResponseWriter, ollamaChatRequest) {
+			t.Fatal("unexpected request")
+		})
+		client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+		require.NoError(t, err)
+		_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+		require.ErrorIs(t, err, ErrStructuredOutputUnsupported, key)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// ProviderOpenAI selects the OpenAI backend. It also serves every
+	// OpenAI-compatible endpoint configured via OPENAI_API_BASE.
+	ProviderOpenAI = "openai"
+	// ProviderAnthropic selects the native Anthropic Messages API backend.
+	ProviderAnthropic = "anthropic"
+	// ProviderOllama selects the native Ollama chat API backend.
+	ProviderOllama = "ollama"
+	// ProviderAzure selects the OpenAI backend in Azure OpenAI mode.
+	ProviderAzure = "azure"
+
+	// DefaultProvider is used when neither the provider config key nor the
+	// --provider flag is set.
+	DefaultProvider = ProviderOpenAI
+)
+
+// ErrUnknownProvider is returned by NewCompleter when the configured provider
+// has not been registered.
+var ErrUnknownProvider = errors.New("unknown provider")
+
+// ProviderFactory creates a Completer for a provider backend.
+type ProviderFactory func(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ProviderFactory{
+		ProviderOpenAI: func(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error) {
+			return CreateClient(config, out, opts...)
+		},
+		ProviderAzure: func(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error) {
+			return CreateClient(config, out, opts...)
+		},
+		ProviderAnthropic: func(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error) {
+			return CreateAnthropicClient(config, out, opts...)
+		},
+		ProviderOllama: func(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error) {
+			return CreateOllamaClient(config, out, opts...)
+		},
+	}
+)
+
+// RegisterProvider makes a provider backend available under name. Registering
+// an existing name replaces the previous factory.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[strings.ToLower(name)] = factory
+}
+
+// Providers returns the sorted names of all registered provider backends.
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCompleter creates a Completer for the provider selected by the provider
+// config key. If no provider is configured, DefaultProvider is used.
+func NewCompleter(config *viper.Viper, out io.Writer, opts ...ClientOption) (Completer, error) {
+	name := providerName(config)
+
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q (available: %s)", ErrUnknownProvider, name, strings.Join(Providers(), ", "))
+	}
+	slog.Debug("Using provider: " + name)
+	return factory(config, out, opts...)
+}
+
+// providerName returns the lowercased provider selected in config, or
+// DefaultProvider if none is set.
+func providerName(config *viper.Viper) string {
+	if config == nil || config.GetString("provider") == "" {
+		return DefaultProvider
+	}
+	return strings.ToLower(config.GetString("provider"))
+}
+
+// APIError is returned by the native provider backends when the endpoint
+// answers with an error status. The OpenAI backend keeps returning go-openai's
+// own error types.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s error, status code: %d, type: %s, message: %s", e.Provider, e.StatusCode, e.Type, e.Message)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCompleter struct{}
+
+func (fakeCompleter) CreateCompletion(_ context.Context, _ string, _ []string, _ string, _ []string) (string, error) {
+	return "fake", nil
+}
+
+func TestNewCompleterDefaultsToOpenAI(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test")
+
+	completer, err := NewCompleter(viper.New(), io.Discard)
+	require.NoError(t, err)
+	require.IsType(t, &OpenAIClient{}, completer)
+}
+
+func TestNewCompleterAnthropic(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	config := viper.New()
+	config.Set("provider", "Anthropic")
+
+	completer, err := NewCompleter(config, io.Discard)
+	require.NoError(t, err)
+	require.IsType(t, &AnthropicClient{}, completer)
+}
+
+func TestNewCompleterUnknownProvider(t *testing.T) {
+	config := viper.New()
+	config.Set("provider", "nope")
+
+	completer, err := NewCompleter(config, io.Discard)
+	require.ErrorIs(t, err, ErrUnknownProvider)
+	require.Contains(t, err.Error(), ProviderAnthropic)
+	require.Nil(t, completer)
+}
+
+func TestRegisterProvider(t *testing.T) {
+	RegisterProvider("fake", func(_ *viper.Viper, _ io.Writer, _ ...ClientOption) (Completer, error) {
+		return fakeCompleter{}, nil
+	})
+	t.Cleanup(func() {
+		providersMu.Lock()
+		delete(providers, "fake")
+		providersMu.Unlock()
+	})
+	require.Contains(t, Providers(), "fake")
+
+	config := viper.New()
+	config.Set("provider", "fake")
+	completer, err := NewCompleter(config, io.Discard)
+	require.NoError(t, err)
+
+	result, err := completer.CreateCompletion(context.Background(), "", nil, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "fake", result)
+}
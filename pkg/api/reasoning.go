@@ -0,0 +1,73 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+)
+
+// ReasoningEfforts are the values accepted by the reasoningEffort config key
+// and the --reasoning-effort flag.
+var ReasoningEfforts = []string{"minimal", "low", "medium", "high"}
+
+// ErrInvalidReasoningEffort is returned, if reasoningEffort is not one of ReasoningEfforts.
+var ErrInvalidReasoningEffort = fmt.Errorf("reasoning effort must be one of %s", strings.Join(ReasoningEfforts, ", "))
+
+// isReasoningModel reports whether the configured model is a reasoning model.
+// Models missing from the model metadata count as reasoning models, if a
+// reasoning effort is set, so new reasoning models work without an update.
+func isReasoningModel(config *viper.Viper, model string) bool {
+	info, ok := models.Lookup(model)
+	if !ok {
+		return config.GetString("reasoningEffort") != ""
+	}
+	return info.Reasoning
+}
+
+// printReasoning prints the reasoning summary of a response to the error
+// writer, if showReasoning is set. The reasoning is never part of the
+// response, so it is not stored in chat sessions or the response cache.
+func (c *baseClient) printReasoning(text string) {
+	if !c.config.GetBool("showReasoning") {
+		return
+	}
+	if _, err := fmt.Fprint(c.errOut, text); err != nil {
+		slog.Warn("Could not print reasoning", "error", err)
+	}
+}
+
+// printReasoningTokens prints the number of reasoning tokens of a completion
+// to the error writer. They are billed as completion tokens but not visible
+// in the response.
+func (c *baseClient) printReasoningTokens(tokens int) {
+	if tokens == 0 {
+		return
+	}
+	if _, err := fmt.Fprintf(c.errOut, "Reasoning tokens: %d\n", tokens); err != nil {
+		slog.Warn("Could not print reasoning tokens", "error", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+func TestApplyGenerationParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		effort   string
+		expected openai.ChatCompletionRequest
+	}{
+		{
+			name:     "Chat",
+			model:    "gpt-4o",
+			expected: openai.ChatCompletionRequest{Model: "gpt-4o", MaxTokens: 100, Temperature: 0.5, TopP: 0.9},
+		},
+		{
+			name:     "ChatIgnoresEffort",
+			model:    "gpt-4o",
+			effort:   "high",
+			expected: openai.ChatCompletionRequest{Model: "gpt-4o", MaxTokens: 100, Temperature: 0.5, TopP: 0.9},
+		},
+		{
+			name:     "Reasoning",
+			model:    "o3-mini-2025-01-31",
+			effort:   "high",
+			expected: openai.ChatCompletionRequest{Model: "o3-mini-2025-01-31", MaxCompletionTokens: 100, ReasoningEffort: "high"},
+		},
+		{
+			name:     "ReasoningDefaultEffort",
+			model:    "gpt-5",
+			expected: openai.ChatCompletionRequest{Model: "gpt-5", MaxCompletionTokens: 100},
+		},
+		{
+			name:     "UnknownModelWithEffort",
+			model:    "my-reasoner",
+			effort:   "low",
+			expected: openai.ChatCompletionRequest{Model: "my-reasoner", MaxCompletionTokens: 100, ReasoningEffort: "low"},
+		},
+		{
+			name:     "UnknownModel",
+			model:    "my-model",
+			expected: openai.ChatCompletionRequest{Model: "my-model", MaxTokens: 100, Temperature: 0.5, TopP: 0.9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testlib.NewTestCtx(t).Config
+			config.Set("maxTokens", 100)
+			config.Set("temperature", 0.5)
+			config.Set("topP", 0.9)
+			config.Set("reasoningEffort", tt.effort)
+
+			req := openai.ChatCompletionRequest{Model: tt.model}
+			require.NoError(t, applyGenerationParams(config, &req))
+			require.Equal(t, tt.expected, req)
+		})
+	}
+}
+
+func TestApplyGenerationParamsInvalidEffort(t *testing.T) {
+	config := testlib.NewTestCtx(t).Config
+	config.Set("reasoningEffort", "extreme")
+	req := openai.ChatCompletionRequest{Model: "o3"}
+	require.ErrorIs(t, applyGenerationParams(config, &req), ErrInvalidReasoningEffort)
+}
+
+func newReasoningTestClient(t *testing.T) (*testlib.TestCtx, *OpenAIClient, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	testCtx.Config.Set("model", "o4-mini")
+
+	var out, errOut bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out, WithErrorWriter(&errOut))
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	return testCtx, client, &out, &errOut
+}
+
+func TestCreateCompletionReasoning(t *testing.T) {
+	testCtx, client, out, errOut := newReasoningTestClient(t)
+	testCtx.Config.Set("showReasoning", true)
+	requests := registerChatResponses(t, "application/json", `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"42","reasoning_content":"Six times seven."}}],`+
+		`"usage":{"prompt_tokens":10,"completion_tokens":50,"total_tokens":60,"completion_tokens_details":{"reasoning_tokens":48}}}`)
+
+	result, err := client.CreateCompletion(context.Background(), "reasoning_chat", []string{"What is six times seven?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "42", result)
+	require.Equal(t, "42\n", out.String())
+	require.Equal(t, "Six times seven.\nReasoning tokens: 48\n", errOut.String())
+
+	require.Len(t, *requests, 1)
+	require.Zero(t, (*requests)[0].MaxTokens)
+	require.Zero(t, (*requests)[0].Temperature)
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	var messages []openai.ChatCompletionMessage
+	messages, err = manager.GetSession("reasoning_chat")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "42", messages[1].Content)
+	require.Empty(t, messages[1].ReasoningContent)
+}
+
+func TestCreateCompletionReasoningStream(t *testing.T) {
+	testCtx, client, out, errOut := newReasoningTestClient(t)
+	testCtx.Config.Set("stream", true)
+
+	chunk := func(delta string) string {
+		return fmt.Sprintf("data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":%s}]}\n\n", delta)
+	}
+	stream := chunk(`{"role":"assistant","reasoning_content":"Six times "}`) + chunk(`{"reasoning_content":"seven."}`) + chunk(`{"content":"42"}`) +
+		`data: {"id":"1","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":50,"total_tokens":60,"completion_tokens_details":{"reasoning_tokens":48}}}` + "\n\n" +
+		"data: [DONE]\n\n"
+	registerChatResponses(t, "text/event-stream", stream)
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"What is six times seven?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "42", result)
+	require.Equal(t, "42\n", out.String())
+	// Reasoning summaries are only shown on request
+	require.Equal(t, "Reasoning tokens: 48\n", errOut.String())
+
+	errOut.Reset()
+	out.Reset()
+	testCtx.Config.Set("showReasoning", true)
+	httpmock.Reset()
+	registerChatResponses(t, "text/event-stream", stream)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"What is six times seven?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Six times seven.\nReasoning tokens: 48\n", errOut.String())
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// Defaults for the retry policy, used if the retry section of the config
+	// does not set a value.
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = time.Second
+	defaultRetryJitter      = 0.2
+
+	// maxRetryDelay caps the exponential backoff.
+	maxRetryDelay = 30 * time.Second
+	// maxRetryWait is the longest server-requested wait sgpt honors. If a
+	// rate limit resets later, failing fast beats hanging a CI job.
+	maxRetryWait = time.Minute
+)
+
+// retryPolicy decides how often and how long to wait before a request that
+// failed with 429 or 5xx is sent again.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	jitter      float64
+}
+
+// newRetryPolicy reads the retry section of config. A maxAttempts of 1
+// disables retries.
+func newRetryPolicy(config *viper.Viper) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts: defaultRetryMaxAttempts,
+		baseDelay:   defaultRetryBaseDelay,
+		jitter:      defaultRetryJitter,
+	}
+	if config == nil {
+		return policy
+	}
+	if config.IsSet("retry.maxAttempts") {
+		policy.maxAttempts = max(config.GetInt("retry.maxAttempts"), 1)
+	}
+	if config.IsSet("retry.baseDelay") {
+		policy.baseDelay = max(config.GetDuration("retry.baseDelay"), 0)
+	}
+	if config.IsSet("retry.jitter") {
+		policy.jitter = min(max(config.GetFloat64("retry.jitter"), 0), 1)
+	}
+	return policy
+}
+
+// backoff returns the delay before the retry following attempt (starting at
+// 1): baseDelay doubled per attempt, capped at maxRetryDelay and randomized
+// by ±jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.baseDelay) * math.Pow(2, float64(attempt-1))
+	delay = min(delay, float64(maxRetryDelay))
+	if p.jitter > 0 {
+		delay *= 1 + p.jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// isRetryableStatus reports whether a response status is worth retrying:
+// rate limits and server errors.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryDelayFromHeaders returns the wait requested by the server for a
+// response with status. It checks retry-after-ms, Retry-After (seconds or
+// HTTP date) and, for 429, the OpenAI x-ratelimit-reset-requests/-tokens
+// headers, in this order. OpenAI sends the reset headers with every
+// response, but they only say when a rate limit is lifted.
+func retryDelayFromHeaders(status int, header http.Header, now time.Time) (time.Duration, bool) {
+	if value := header.Get("retry-after-ms"); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(date.Sub(now), 0), true
+		}
+	}
+	if status != http.StatusTooManyRequests {
+		return 0, false
+	}
+	// The rate limit is lifted once both limits are reset
+	var reset time.Duration
+	found := false
+	for _, key := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+		if d, err := time.ParseDuration(header.Get(key)); err == nil && d >= 0 {
+			reset = max(reset, d)
+			found = true
+		}
+	}
+	return reset, found
+}
+
+// retryingDoer sends requests through client and retries responses with a
+// retryable status. Retries happen before the response body is handed to the
+// caller, so a stream that already printed output is never sent again. The
+// policy is read from config per request, like every other request setting.
+// As every provider sends its requests through it, it also adds the
+// configured headers, see headerTransport.
+type retryingDoer struct {
+	client *http.Client
+	config *viper.Viper
+	// auth sets the API key, if the client does not set it itself
+	auth *keyAuth
+}
+
+func newRetryingDoer(client *http.Client, config *viper.Viper) *retryingDoer {
+	return &retryingDoer{client: client, config: config}
+}
+
+// Do implements openai.HTTPDoer.
+func (d *retryingDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.auth != nil {
+		if err := d.auth.authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	header, err := requestHeaders(d.config)
+	if err != nil {
+		return nil, err
+	}
+	// The transport is wrapped per request, so a transport replaced after
+	// the client was created, e.g. by a test, gets the headers as well
+	client := *d.client
+	client.Transport = newHeaderTransport(d.client.Transport, req.URL.Host, header)
+	policy := newRetryPolicy(d.config)
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil || !isRetryableStatus(resp.StatusCode) || attempt >= policy.maxAttempts {
+			return resp, err
+		}
+		// Requests with a body can only be sent again if it can be rewound
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+
+		delay, fromHeader := retryDelayFromHeaders(resp.StatusCode, resp.Header, time.Now())
+		if !fromHeader {
+			delay = policy.backoff(attempt)
+		} else if delay > maxRetryWait {
+			slog.Debug("Server requested retry wait exceeds limit", "wait", delay, "limit", maxRetryWait)
+			return resp, nil
+		}
+
+		// Release the connection of the failed attempt
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+
+		slog.Debug("Retrying request", "status", resp.StatusCode, "attempt", attempt, "delay", delay)
+		if err = sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			var body io.ReadCloser
+			body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// sleepContext waits for delay or until ctx is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+func newRetryTestClient(t *testing.T, out io.Writer) (*testlib.TestCtx, *OpenAIClient) {
+	t.Helper()
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	testCtx.Config.Set("retry.baseDelay", "1ms")
+
+	client, err := CreateClient(testCtx.Config, out)
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	return testCtx, client
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	var out bytes.Buffer
+	_, client := newRetryTestClient(t, &out)
+	calls := testlib.RegisterRateLimitedChatResponse(2, http.StatusTooManyRequests,
+		map[string]string{"retry-after-ms": "5"}, "Hello World!")
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, "Hello World!\n", out.String())
+	require.Equal(t, 3, *calls)
+}
+
+func TestRetryStreamSetup(t *testing.T) {
+	var out bytes.Buffer
+	testCtx, client := newRetryTestClient(t, &out)
+	testCtx.Config.Set("stream", true)
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		httpmock.ResponderFromMultipleResponses([]*http.Response{
+			httpmock.NewStringResponse(http.StatusServiceUnavailable, `{"error":{"message":"overloaded"}}`),
+			streamResponse("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"),
+		}))
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", result)
+	require.Equal(t, "Hi\n", out.String())
+	require.Equal(t, 2, httpmock.GetTotalCallCount())
+}
+
+func TestRetryExhausted(t *testing.T) {
+	testCtx, client := newRetryTestClient(t, io.Discard)
+	testCtx.Config.Set("retry.maxAttempts", 2)
+	calls := testlib.RegisterRateLimitedChatResponse(5, http.StatusInternalServerError, nil, "unused")
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	var apiErr *openai.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusInternalServerError, apiErr.HTTPStatusCode)
+	require.Equal(t, 2, *calls)
+}
+
+func TestRetryNotOnClientError(t *testing.T) {
+	_, client := newRetryTestClient(t, io.Discard)
+	calls := testlib.RegisterRateLimitedChatResponse(5, http.StatusBadRequest, nil, "unused")
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.Error(t, err)
+	require.Equal(t, 1, *calls)
+}
+
+func TestRetryWaitTooLong(t *testing.T) {
+	_, client := newRetryTestClient(t, io.Discard)
+	calls := testlib.RegisterRateLimitedChatResponse(5, http.StatusTooManyRequests,
+		map[string]string{"Retry-After": "3600"}, "unused")
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.Error(t, err)
+	require.Equal(t, 1, *calls)
+}
+
+func TestRetryServerErrorIgnoresRateLimitReset(t *testing.T) {
+	_, client := newRetryTestClient(t, io.Discard)
+	// OpenAI sends the reset headers with every response
+	calls := testlib.RegisterRateLimitedChatResponse(1, http.StatusServiceUnavailable,
+		map[string]string{"x-ratelimit-reset-tokens": "1h"}, "Hello World!")
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say: Hello World!"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World!", result)
+	require.Equal(t, 2, *calls)
+}
+
+func TestRetryDelayFromHeaders(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	reset := map[string]string{"x-ratelimit-reset-requests": "20ms", "x-ratelimit-reset-tokens": "1m30s"}
+	for name, tc := range map[string]struct {
+		status   int
+		headers  map[string]string
+		expected time.Duration
+		found    bool
+	}{
+		"none":                   {http.StatusTooManyRequests, nil, 0, false},
+		"retry-after-ms":         {http.StatusTooManyRequests, map[string]string{"retry-after-ms": "250", "Retry-After": "9"}, 250 * time.Millisecond, true},
+		"retry-after":            {http.StatusTooManyRequests, map[string]string{"Retry-After": "2"}, 2 * time.Second, true},
+		"retry-after date":       {http.StatusTooManyRequests, map[string]string{"Retry-After": "Mon, 01 Jan 2024 12:00:05 GMT"}, 5 * time.Second, true},
+		"ratelimit reset":        {http.StatusTooManyRequests, reset, 90 * time.Second, true},
+		"ratelimit reset on 5xx": {http.StatusServiceUnavailable, reset, 0, false},
+		"retry-after on 5xx":     {http.StatusServiceUnavailable, map[string]string{"Retry-After": "2"}, 2 * time.Second, true},
+		"invalid":                {http.StatusTooManyRequests, map[string]string{"Retry-After": "soon"}, 0, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range tc.headers {
+				header.Set(key, value)
+			}
+			delay, found := retryDelayFromHeaders(tc.status, header, now)
+			require.Equal(t, tc.found, found)
+			require.Equal(t, tc.expected, delay)
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := newRetryPolicy(nil)
+	require.Equal(t, defaultRetryMaxAttempts, policy.maxAttempts)
+
+	config := viper.New()
+	config.Set("retry.maxAttempts", 0)
+	config.Set("retry.baseDelay", "100ms")
+	config.Set("retry.jitter", 0)
+	policy = newRetryPolicy(config)
+	require.Equal(t, 1, policy.maxAttempts)
+	require.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	require.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	require.Equal(t, maxRetryDelay, policy.backoff(20))
+
+	config.Set("retry.jitter", 0.5)
+	policy = newRetryPolicy(config)
+	for range 20 {
+		require.InDelta(t, float64(200*time.Millisecond), float64(policy.backoff(2)), float64(100*time.Millisecond))
+	}
+}
+
+func streamResponse(data string) *http.Response {
+	resp := httpmock.NewStringResponse(http.StatusOK, data)
+	resp.Header.Set("Content-Type", "text/event-stream")
+	return resp
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/tokens"
+)
+
+// maxLogitBias is the largest absolute bias the API accepts.
+const maxLogitBias = 100
+
+var (
+	// ErrInvalidLogitBias is returned, if a logit bias is not token=bias with a bias from -100 to 100.
+	ErrInvalidLogitBias = fmt.Errorf("logit bias must be token=bias with a bias from %d to %d", -maxLogitBias, maxLogitBias)
+	// ErrChoicesUnsupported is returned, if n > 1 is requested from a provider that returns a single choice.
+	ErrChoicesUnsupported = errors.New("provider does not support more than one choice")
+	// ErrChoicesWithTools is returned, if n > 1 is combined with tools or structured output.
+	ErrChoicesWithTools = errors.New("more than one choice cannot be combined with tools or structured output")
+)
+
+// applyGenerationParams sets the token limit, the sampling parameters and the
+// reasoning effort of req from config. Reasoning models reject max_tokens,
+// temperature, top_p and the penalties, so they get max_completion_tokens
+// and reasoning_effort instead.
+func applyGenerationParams(config *viper.Viper, req *openai.ChatCompletionRequest) error {
+	effort := config.GetString("reasoningEffort")
+	if effort != "" && !slices.Contains(ReasoningEfforts, effort) {
+		return ErrInvalidReasoningEffort
+	}
+	// A seed of 0 is valid, so it is only sent when set
+	if config.IsSet("seed") {
+		seed := config.GetInt("seed")
+		req.Seed = &seed
+	}
+	req.Stop = config.GetStringSlice("stop")
+	if n := config.GetInt("n"); n > 1 {
+		req.N = n
+	}
+
+	if isReasoningModel(config, req.Model) {
+		req.MaxCompletionTokens = config.GetInt("maxTokens")
+		req.ReasoningEffort = effort
+		slog.Debug("Using reasoning model parameters", "model", req.Model, "reasoningEffort", effort)
+		return nil
+	}
+	if effort != "" {
+		slog.Warn("Ignoring reasoning effort for non-reasoning model", "model", req.Model)
+	}
+	req.MaxTokens = config.GetInt("maxTokens")
+	req.Temperature = float32(config.GetFloat64("temperature"))
+	req.TopP = float32(config.GetFloat64("topP"))
+	req.PresencePenalty = float32(config.GetFloat64("presencePenalty"))
+	req.FrequencyPenalty = float32(config.GetFloat64("frequencyPenalty"))
+	var err error
+	req.LogitBias, err = parseLogitBias(config.GetStringSlice("logitBias"), req.Model)
+	return err
+}
+
+// parseLogitBias parses token=bias entries into the logit_bias map of the
+// API. A token is either a token ID or text, which is encoded with the
+// tokenizer of model; every token of the text gets the bias.
+func parseLogitBias(entries []string, model string) (map[string]int, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	biases := make(map[string]int)
+	var counter *tokens.Counter
+	for _, entry := range entries {
+		// The token itself may contain "="
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLogitBias, entry)
+		}
+		token := entry[:i]
+		bias, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || bias < -maxLogitBias || bias > maxLogitBias {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLogitBias, entry)
+		}
+		if _, err = strconv.Atoi(token); err == nil {
+			biases[token] = bias
+			continue
+		}
+		if counter == nil {
+			counter, err = tokens.NewCounter(model)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, id := range counter.Encode(token) {
+			biases[strconv.Itoa(id)] = bias
+		}
+	}
+	slog.Debug("Parsed logit bias", "tokens", len(biases))
+	return biases, nil
+}
+
+// checkSingleChoice returns ErrChoicesUnsupported, if more than one choice is
+// configured for a provider that cannot return several.
+func checkSingleChoice(config *viper.Viper) error {
+	if config.GetInt("n") > 1 {
+		return fmt.Errorf("%w: %s", ErrChoicesUnsupported, providerName(config))
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+func TestApplyGenerationParamsSampling(t *testing.T) {
+	config := testlib.NewTestCtx(t).Config
+	config.Set("seed", 0)
+	config.Set("stop", []string{"END", "\n\n"})
+	config.Set("presencePenalty", 0.5)
+	config.Set("frequencyPenalty", -0.5)
+	config.Set("logitBias", []string{"50256=-100", "hello world=5"})
+	config.Set("n", 3)
+
+	req := openai.ChatCompletionRequest{Model: "gpt-4"}
+	require.NoError(t, applyGenerationParams(config, &req))
+	require.NotNil(t, req.Seed)
+	require.Zero(t, *req.Seed)
+	require.Equal(t, []string{"END", "\n\n"}, req.Stop)
+	require.InDelta(t, 0.5, req.PresencePenalty, 1e-6)
+	require.InDelta(t, -0.5, req.FrequencyPenalty, 1e-6)
+	require.Equal(t, map[string]int{"50256": -100, "15339": 5, "1917": 5}, req.LogitBias)
+	require.Equal(t, 3, req.N)
+
+	// Reasoning models reject penalties and logit bias
+	req = openai.ChatCompletionRequest{Model: "o3"}
+	require.NoError(t, applyGenerationParams(config, &req))
+	require.NotNil(t, req.Seed)
+	require.Zero(t, req.PresencePenalty)
+	require.Nil(t, req.LogitBias)
+}
+
+func TestApplyGenerationParamsDefaults(t *testing.T) {
+	config := testlib.NewTestCtx(t).Config
+	config.Set("n", 1)
+	req := openai.ChatCompletionRequest{Model: "gpt-4"}
+	require.NoError(t, applyGenerationParams(config, &req))
+	require.Nil(t, req.Seed)
+	require.Empty(t, req.Stop)
+	require.Nil(t, req.LogitBias)
+	require.Zero(t, req.N)
+}
+
+func TestParseLogitBias(t *testing.T) {
+	biases, err := parseLogitBias([]string{"a=b=1", "42= -3"}, "gpt-4")
+	require.NoError(t, err)
+	require.Equal(t, -3, biases["42"])
+	// "a=b" is split at the last "=" and encodes to two tokens
+	require.Len(t, biases, 3)
+
+	for _, entry := range []string{"42", "=5", "42=101", "42=-101", "42=high"} {
+		_, err = parseLogitBias([]string{entry}, "gpt-4")
+		require.ErrorIs(t, err, ErrInvalidLogitBias, entry)
+	}
+}
+
+const choicesResponse = `{"choices":[` +
+	`{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Red"}},` +
+	`{"index":1,"finish_reason":"stop","message":{"role":"assistant","content":"Green"}},` +
+	`{"index":2,"finish_reason":"stop","message":{"role":"assistant","content":"Blue"}}]}`
+
+func newChoicesTestClient(t *testing.T, input string) (*testlib.TestCtx, *OpenAIClient, *bytes.Buffer) {
+	t.Helper()
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	testCtx.Config.Set("n", 3)
+	testCtx.Config.Set("stream", true)
+
+	var out bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out, WithInput(strings.NewReader(input)))
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	return testCtx, client, &out
+}
+
+func TestCreateCompletionChoices(t *testing.T) {
+	_, client, out := newChoicesTestClient(t, "")
+	requests := registerChatResponses(t, "application/json", choicesResponse)
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Name a color"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Red", result)
+	require.Equal(t, "--- choice 1/3 ---\nRed\n--- choice 2/3 ---\nGreen\n--- choice 3/3 ---\nBlue\n", out.String())
+	require.Equal(t, 3, (*requests)[0].N)
+	// Choices are printed at once
+	require.False(t, (*requests)[0].Stream)
+}
+
+func TestCreateCompletionPickChoice(t *testing.T) {
+	testCtx, client, out := newChoicesTestClient(t, "4\nsecond\n2\n")
+	testCtx.Config.Set("pick", true)
+	registerChatResponses(t, "application/json", choicesResponse)
+
+	result, err := client.CreateCompletion(context.Background(), "colors", []string{"Name a color"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Green", result)
+	require.Equal(t, 3, strings.Count(out.String(), "Pick a choice (1-3): "))
+
+	// Only the picked choice is saved
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	var messages []openai.ChatCompletionMessage
+	messages, err = manager.GetSession("colors")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "Green", messages[1].Content)
+}
+
+func TestCreateCompletionPickChoiceNoInput(t *testing.T) {
+	testCtx, client, _ := newChoicesTestClient(t, "nope")
+	testCtx.Config.Set("pick", true)
+	registerChatResponses(t, "application/json", choicesResponse)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Name a color"}, "txt", nil)
+	require.ErrorIs(t, err, ErrNoChoicePicked)
+}
+
+func TestCreateCompletionPickChoiceCancelled(t *testing.T) {
+	testCtx, _, _ := newChoicesTestClient(t, "")
+	testCtx.Config.Set("pick", true)
+	// Nothing is written, like a terminal waiting for the user
+	input, writer := io.Pipe()
+	t.Cleanup(func() { _ = writer.Close() })
+	var out bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out, WithInput(input))
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	registerChatResponses(t, "application/json", choicesResponse)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err = client.CreateCompletion(ctx, "", []string{"Name a color"}, "txt", nil)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Contains(t, out.String(), "Pick a choice (1-3): ")
+}
+
+func TestCreateCompletionChoicesWithStructuredOutput(t *testing.T) {
+	testCtx, client, _ := newChoicesTestClient(t, "")
+	testCtx.Config.Set("jsonMode", true)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Name a color"}, "txt", nil)
+	require.ErrorIs(t, err, ErrChoicesWithTools)
+	require.Zero(t, httpmock.GetTotalCallCount())
+}
+
+func TestSingleChoiceProviders(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("n", 2)
+	newOllamaStandIn(t, func(http.ResponseWriter, ollamaChatRequest) {
+		t.Fatal("unexpected request")
+	})
+	ollama, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = ollama.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrChoicesUnsupported)
+
+	newAnthropicStandIn(t, func(http.ResponseWriter, anthropicRequest) {
+		t.Fatal("unexpected request")
+	})
+	anthropic, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = anthropic.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.ErrorIs(t, err, ErrChoicesUnsupported)
+}
+
+func TestOllamaSamplingOptions(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "llama3")
+	testCtx.Config.Set("seed", 7)
+	testCtx.Config.Set("stop", []string{"END"})
+	testCtx.Config.Set("presencePenalty", 0.5)
+	req := newOllamaStandIn(t, func(w http.ResponseWriter, _ ollamaChatRequest) {
+		_, _ = io.WriteString(w, `{"message":{"role":"assistant","content":"ok"},"done":true}`)
+	})
+
+	client, err := CreateOllamaClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.InDelta(t, 7, req.Options["seed"], 0)
+	require.Equal(t, []any{"END"}, req.Options["stop"])
+	require.InDelta(t, 0.5, req.Options["presence_penalty"], 0.001)
+	require.NotContains(t, req.Options, "frequency_penalty")
+}
+
+func TestAnthropicStopSequences(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("model", "claude-test")
+	testCtx.Config.Set("stop", []string{"END"})
+	_, _, req := newAnthropicStandIn(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		writeAnthropicMessage(w, "ok")
+	})
+
+	client, err := CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	_, err = client.CreateCompletion(context.Background(), "", []string{"hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"END"}, req.Stop)
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// DefaultSpeechModel is used when neither the speech.model config key
+	// nor the --model flag of the speak command is set.
+	DefaultSpeechModel = string(openai.TTSModel1)
+	// DefaultSpeechVoice is used when the speech.voice config key is not set.
+	DefaultSpeechVoice = string(openai.VoiceAlloy)
+	// MaxSpeechInput is the maximum number of characters the speech API
+	// accepts per request. Longer texts are split into several requests.
+	MaxSpeechInput = 4096
+	// maxSpeechChunkSize limits the audio read for a single request.
+	maxSpeechChunkSize = 64 << 20
+)
+
+// SpeechFormats are the audio formats that can be written by Speak.
+var SpeechFormats = []string{
+	string(openai.SpeechResponseFormatMp3),
+	string(openai.SpeechResponseFormatOpus),
+	string(openai.SpeechResponseFormatWav),
+}
+
+// speechExtensions maps file extensions to speech formats.
+var speechExtensions = map[string]string{
+	".mp3":  string(openai.SpeechResponseFormatMp3),
+	".opus": string(openai.SpeechResponseFormatOpus),
+	".ogg":  string(openai.SpeechResponseFormatOpus),
+	".wav":  string(openai.SpeechResponseFormatWav),
+}
+
+var (
+	// ErrSpeechUnsupported is returned, if the selected provider cannot synthesize speech.
+	ErrSpeechUnsupported = errors.New("provider does not support speech synthesis")
+	// ErrUnknownSpeechFormat is returned, if the speech format is not mp3, opus or wav.
+	ErrUnknownSpeechFormat = errors.New("speech file must end in .mp3, .opus, .ogg or .wav")
+	// ErrInvalidSpeechSpeed is returned, if the speed is outside of 0.25 to 4.0.
+	ErrInvalidSpeechSpeed = errors.New("speech speed must be between 0.25 and 4.0")
+	// ErrEmptySpeechInput is returned, if there is no text to speak.
+	ErrEmptySpeechInput = errors.New("no text to speak")
+	// ErrSpeechTooLarge is returned, if the audio of a single request exceeds maxSpeechChunkSize.
+	ErrSpeechTooLarge = errors.New("speech audio too large")
+	// ErrInvalidSpeechAudio is returned, if audio returned by the API cannot be joined.
+	ErrInvalidSpeechAudio = errors.New("invalid speech audio")
+)
+
+// SpeechRequest describes text to convert to speech.
+type SpeechRequest struct {
+	Model string
+	Voice string
+	// Speed is the playback speed from 0.25 to 4.0. Zero uses the default of
+	// the API.
+	Speed float64
+	// Format is mp3, opus or wav.
+	Format string
+	Text   string
+}
+
+// Speaker is the interface that wraps the Speak method. It is implemented by
+// the OpenAI and Azure clients.
+type Speaker interface {
+	// Speak returns the text as audio in the requested format. Texts longer
+	// than MaxSpeechInput are split and the audio of the parts is joined.
+	Speak(ctx context.Context, req SpeechRequest) ([]byte, error)
+}
+
+// SpeechFormatFromFile returns the speech format matching the extension of file.
+func SpeechFormatFromFile(file string) (string, error) {
+	format, ok := speechExtensions[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownSpeechFormat, file)
+	}
+	return format, nil
+}
+
+// Speak converts text to speech with the speech API.
+func (c *OpenAIClient) Speak(ctx context.Context, req SpeechRequest) ([]byte, error) {
+	if req.Speed != 0 && (req.Speed < 0.25 || req.Speed > 4) {
+		return nil, ErrInvalidSpeechSpeed
+	}
+	chunks := splitSpeechText(req.Text, MaxSpeechInput)
+	if len(chunks) == 0 {
+		return nil, ErrEmptySpeechInput
+	}
+	parts := make([][]byte, 0, len(chunks))
+	for i, chunk := range chunks {
+		slog.Debug("Requesting speech", "model", req.Model, "voice", req.Voice, "chunk", i+1, "chunks", len(chunks))
+		data, err := c.speakChunk(ctx, req, chunk)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, data)
+	}
+	return joinSpeech(req.Format, parts)
+}
+
+func (c *OpenAIClient) speakChunk(ctx context.Context, req SpeechRequest, text string) ([]byte, error) {
+	resp, err := c.api.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(req.Model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(req.Voice),
+		ResponseFormat: openai.SpeechResponseFormat(req.Format),
+		Speed:          req.Speed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	data, err := io.ReadAll(io.LimitReader(resp, maxSpeechChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSpeechChunkSize {
+		return nil, ErrSpeechTooLarge
+	}
+	return data, nil
+}
+
+// splitSpeechText splits text into chunks of at most limit characters. It
+// prefers to split at paragraphs, then at the end of sentences and then at
+// whitespace, so the speech does not break off within a word.
+func splitSpeechText(text string, limit int) []string {
+	var chunks []string
+	rest := []rune(strings.TrimSpace(text))
+	for len(rest) > limit {
+		cut := speechCut(rest, limit)
+		if chunk := strings.TrimSpace(string(rest[:cut])); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		rest = []rune(strings.TrimLeftFunc(string(rest[cut:]), unicode.IsSpace))
+	}
+	if len(rest) > 0 {
+		chunks = append(chunks, string(rest))
+	}
+	return chunks
+}
+
+// speechCut returns the index at which the first chunk of text is cut. Break
+// points in the first half of the window are ignored in favour of weaker
+// ones, which would otherwise produce many tiny chunks.
+func speechCut(text []rune, limit int) int {
+	paragraph, sentence, space := 0, 0, 0
+	for i := 1; i <= limit; i++ {
+		if !unicode.IsSpace(text[i]) {
+			continue
+		}
+		space = i
+		switch {
+		case text[i] == '\n' && text[i-1] == '\n':
+			paragraph = i
+		case strings.ContainsRune(".!?", text[i-1]):
+			sentence = i
+		}
+	}
+	for _, cut := range []int{paragraph, sentence, space} {
+		if cut > limit/2 {
+			return cut
+		}
+	}
+	if space > 0 {
+		return space
+	}
+	return limit
+}
+
+// joinSpeech joins the audio of consecutive speech requests into one file.
+func joinSpeech(format string, parts [][]byte) ([]byte, error) {
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	switch format {
+	case string(openai.SpeechResponseFormatMp3):
+		return joinMP3(parts), nil
+	case string(openai.SpeechResponseFormatWav):
+		return joinWAV(parts)
+	case string(openai.SpeechResponseFormatOpus):
+		return joinOgg(parts)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSpeechFormat, format)
+	}
+}
+
+// joinMP3 concatenates MP3 streams. MP3 frames are self-contained, but the
+// tags and the Xing/Info frame of each stream describe only that stream:
+// ID3 tags are dropped except for the first ID3v2 and the last ID3v1 tag and
+// Xing/Info frames are dropped, so players do not stop after the first part
+// or show its duration.
+func joinMP3(parts [][]byte) []byte {
+	var out bytes.Buffer
+	for i, part := range parts {
+		tag := id3v2Size(part)
+		if i == 0 {
+			out.Write(part[:tag])
+		}
+		part = part[tag:]
+		if n := xingFrameSize(part); n > 0 {
+			part = part[n:]
+		}
+		if i < len(parts)-1 && len(part) >= 128 && string(part[len(part)-128:len(part)-125]) == "TAG" {
+			part = part[:len(part)-128]
+		}
+		out.Write(part)
+	}
+	return out.Bytes()
+}
+
+// id3v2Size returns the size of the ID3v2 tag at the start of data or zero.
+func id3v2Size(data []byte) int {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	// The size is a 28 bit syncsafe integer without the header
+	size := 10 + (int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f))
+	if data[5]&0x10 != 0 {
+		// footer present
+		size += 10
+	}
+	return min(size, len(data))
+}
+
+var (
+	mp3Bitrates = [2][16]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}, // MPEG-1
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},     // MPEG-2 and 2.5
+	}
+	mp3SampleRates = map[byte][3]int{
+		3: {44100, 48000, 32000}, // MPEG-1
+		2: {22050, 24000, 16000}, // MPEG-2
+		0: {11025, 12000, 8000},  // MPEG-2.5
+	}
+)
+
+// xingFrameSize returns the size of the Xing or Info frame at the start of
+// data or zero, if data does not start with one.
+func xingFrameSize(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+		return 0
+	}
+	version, layer := (data[1]>>3)&3, (data[1]>>1)&3
+	rates, ok := mp3SampleRates[version]
+	if !ok || layer != 1 {
+		// not a layer III frame
+		return 0
+	}
+	table, factor := 0, 144
+	if version != 3 {
+		table, factor = 1, 72
+	}
+	bitrate := mp3Bitrates[table][data[2]>>4]
+	rateIdx := (data[2] >> 2) & 3
+	if bitrate == 0 || rateIdx == 3 {
+		return 0
+	}
+	size := factor*bitrate*1000/rates[rateIdx] + int((data[2]>>1)&1)
+	if size > len(data) {
+		return 0
+	}
+	// The tag follows the side information, which is at most 32 bytes long
+	head := data[4:min(size, 4+32+4)]
+	if !bytes.Contains(head, []byte("Xing")) && !bytes.Contains(head, []byte("Info")) {
+		return 0
+	}
+	return size
+}
+
+// joinWAV joins WAV files with the same format by concatenating their
+// samples under a single header.
+func joinWAV(parts [][]byte) ([]byte, error) {
+	var fmtChunk, samples []byte
+	for _, part := range parts {
+		f, data, err := parseWAV(part)
+		if err != nil {
+			return nil, err
+		}
+		if fmtChunk == nil {
+			fmtChunk = f
+		} else if !bytes.Equal(fmtChunk, f) {
+			return nil, fmt.Errorf("%w: wav parts differ in format", ErrInvalidSpeechAudio)
+		}
+		samples = append(samples, data...)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	_ = binary.Write(&out, binary.LittleEndian, uint32(4+8+len(fmtChunk)+8+len(samples)+len(samples)%2))
+	out.WriteString("WAVEfmt ")
+	_ = binary.Write(&out, binary.LittleEndian, uint32(len(fmtChunk)))
+	out.Write(fmtChunk)
+	out.WriteString("data")
+	_ = binary.Write(&out, binary.LittleEndian, uint32(len(samples)))
+	out.Write(samples)
+	if len(samples)%2 == 1 {
+		out.WriteByte(0)
+	}
+	return out.Bytes(), nil
+}
+
+// parseWAV returns the body of the fmt chunk and the samples of a WAV file.
+// Streamed WAV files do not know their length in advance, so a data chunk
+// size exceeding the file is read to the end of the file.
+func parseWAV(data []byte) ([]byte, []byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, nil, fmt.Errorf("%w: not a wav file", ErrInvalidSpeechAudio)
+	}
+	var fmtChunk []byte
+	for rest := data[12:]; len(rest) >= 8; {
+		id, size := string(rest[:4]), int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if id == "data" {
+			if fmtChunk == nil {
+				break
+			}
+			return fmtChunk, rest[:min(size, len(rest))], nil
+		}
+		if size > len(rest) {
+			break
+		}
+		if id == "fmt " {
+			fmtChunk = rest[:size]
+		}
+		// chunks are padded to an even size
+		rest = rest[min(size+size%2, len(rest)):]
+	}
+	return nil, nil, fmt.Errorf("%w: wav file without fmt or data chunk", ErrInvalidSpeechAudio)
+}
+
+// joinOgg chains Ogg streams, which is valid per RFC 3533 as long as every
+// stream has its own serial number. The serial numbers of the parts are
+// therefore renumbered consecutively from the serial number of the first.
+func joinOgg(parts [][]byte) ([]byte, error) {
+	if _, err := oggPageSize(parts[0]); err != nil {
+		return nil, err
+	}
+	serial := binary.LittleEndian.Uint32(parts[0][14:18])
+	out := bytes.NewBuffer(bytes.Clone(parts[0]))
+	for i, part := range parts[1:] {
+		part = bytes.Clone(part)
+		for page := part; len(page) > 0; {
+			size, err := oggPageSize(page)
+			if err != nil {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint32(page[14:18], serial+uint32(i)+1)
+			binary.LittleEndian.PutUint32(page[22:26], 0)
+			binary.LittleEndian.PutUint32(page[22:26], oggCRC(page[:size]))
+			page = page[size:]
+		}
+		out.Write(part)
+	}
+	return out.Bytes(), nil
+}
+
+// oggPageSize returns the size of the Ogg page at the start of data.
+func oggPageSize(data []byte) (int, error) {
+	if len(data) < 27 || string(data[:4]) != "OggS" {
+		return 0, fmt.Errorf("%w: not an ogg page", ErrInvalidSpeechAudio)
+	}
+	segments := int(data[26])
+	size := 27 + segments
+	if len(data) < size {
+		return 0, fmt.Errorf("%w: truncated ogg page", ErrInvalidSpeechAudio)
+	}
+	for _, lacing := range data[27 : 27+segments] {
+		size += int(lacing)
+	}
+	if len(data) < size {
+		return 0, fmt.Errorf("%w: truncated ogg page", ErrInvalidSpeechAudio)
+	}
+	return size, nil
+}
+
+// oggCRCTable is the table of the unreflected CRC-32 with polynomial
+// 0x04c11db7 used by Ogg, which hash/crc32 does not provide.
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for range 8 {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC returns the checksum of an Ogg page whose checksum field is zero.
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSpeechText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		limit  int
+		chunks []string
+	}{
+		{name: "Short", text: "  Hello.  ", limit: 20, chunks: []string{"Hello."}},
+		{name: "Empty", text: " \n ", limit: 20, chunks: nil},
+		{name: "Paragraph", text: "One two. Three four.\n\nFive six.", limit: 25, chunks: []string{"One two. Three four.", "Five six."}},
+		{name: "Sentence", text: "One two three. Four five six.", limit: 20, chunks: []string{"One two three.", "Four five six."}},
+		{name: "Whitespace", text: "one two three four five", limit: 10, chunks: []string{"one two", "three four", "five"}},
+		{name: "Word", text: "abcdefghij", limit: 4, chunks: []string{"abcd", "efgh", "ij"}},
+		{name: "Runes", text: "äöü äöü", limit: 4, chunks: []string{"äöü", "äöü"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitSpeechText(tt.text, tt.limit)
+			require.Equal(t, tt.chunks, chunks)
+			for _, chunk := range chunks {
+				require.LessOrEqual(t, len([]rune(chunk)), tt.limit)
+			}
+		})
+	}
+}
+
+func TestSpeechFormatFromFile(t *testing.T) {
+	for file, format := range map[string]string{"a.mp3": "mp3", "b.OPUS": "opus", "c.ogg": "opus", "d/e.wav": "wav"} {
+		got, err := SpeechFormatFromFile(file)
+		require.NoError(t, err)
+		require.Equal(t, format, got)
+	}
+	_, err := SpeechFormatFromFile("speech.flac")
+	require.ErrorIs(t, err, ErrUnknownSpeechFormat)
+}
+
+// mp3Frame returns a 128 kbit/s 44.1 kHz MPEG-1 layer III frame, which is
+// 417 bytes long. If tag is set, it is a Xing/Info frame.
+func mp3Frame(fill byte, tag string) []byte {
+	frame := bytes.Repeat([]byte{fill}, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x64})
+	copy(frame[36:], tag)
+	return frame
+}
+
+func TestJoinMP3(t *testing.T) {
+	id3 := []byte("ID3\x04\x00\x00\x00\x00\x00\x02xx")
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	first := join(id3, mp3Frame(0, "Info"), mp3Frame(1, ""), id3v1)
+	second := join(id3, mp3Frame(0, "Xing"), mp3Frame(2, ""), id3v1)
+
+	out, err := joinSpeech("mp3", [][]byte{first, second})
+	require.NoError(t, err)
+	require.Equal(t, join(id3, mp3Frame(1, ""), mp3Frame(2, ""), id3v1), out)
+}
+
+func wavFile(samples string) []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 24000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 48000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+
+	var out bytes.Buffer
+	out.WriteString("RIFF\xff\xff\xff\xffWAVEfmt \x10\x00\x00\x00")
+	out.Write(fmtChunk)
+	out.WriteString("LIST\x03\x00\x00\x00abc\x00")
+	// streamed files do not know the size of the data chunk
+	out.WriteString("data\xff\xff\xff\xff")
+	out.WriteString(samples)
+	return out.Bytes()
+}
+
+func TestJoinWAV(t *testing.T) {
+	out, err := joinSpeech("wav", [][]byte{wavFile("abcd"), wavFile("ef")})
+	require.NoError(t, err)
+
+	fmtChunk, samples, err := parseWAV(out)
+	require.NoError(t, err)
+	require.Len(t, fmtChunk, 16)
+	require.Equal(t, "abcdef", string(samples))
+	require.Equal(t, uint32(len(out)-8), binary.LittleEndian.Uint32(out[4:8]))
+	require.Equal(t, uint32(6), binary.LittleEndian.Uint32(out[40:44]))
+
+	other := wavFile("gh")
+	other[24] = 0x80
+	_, err = joinSpeech("wav", [][]byte{wavFile("abcd"), other})
+	require.ErrorIs(t, err, ErrInvalidSpeechAudio)
+
+	_, err = joinSpeech("wav", [][]byte{wavFile("abcd"), []byte("not a wav file")})
+	require.ErrorIs(t, err, ErrInvalidSpeechAudio)
+}
+
+// oggPage returns an Ogg page with a single segment.
+func oggPage(serial uint32, payload string) []byte {
+	page := []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	binary.LittleEndian.PutUint32(page[14:18], serial)
+	page = append(page, byte(len(payload)))
+	page = append(page, payload...)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+	return page
+}
+
+func TestJoinOgg(t *testing.T) {
+	first := append(oggPage(7, "OpusHead"), oggPage(7, "audio1")...)
+	second := append(oggPage(7, "OpusHead"), oggPage(7, "audio2")...)
+
+	out, err := joinSpeech("opus", [][]byte{first, second})
+	require.NoError(t, err)
+	expected := append(bytes.Clone(first), oggPage(8, "OpusHead")...)
+	expected = append(expected, oggPage(8, "audio2")...)
+	require.Equal(t, expected, out)
+
+	_, err = joinSpeech("opus", [][]byte{first, second[:30]})
+	require.ErrorIs(t, err, ErrInvalidSpeechAudio)
+}
+
+func TestOggCRC(t *testing.T) {
+	// Check value of the CRC used by Ogg: polynomial 0x04c11db7, initial
+	// value 0, no reflection and no final XOR.
+	require.Equal(t, uint32(0x89a1897f), oggCRC([]byte("123456789")))
+}
+
+func TestSpeak(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	var inputs []string
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/audio/speech", func(req *http.Request) (*http.Response, error) {
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		require.Equal(t, "tts-1-hd", body["model"])
+		require.Equal(t, "nova", body["voice"])
+		require.Equal(t, "mp3", body["response_format"])
+		require.InDelta(t, 1.5, body["speed"], 0.001)
+		inputs = append(inputs, body["input"].(string))
+		return httpmock.NewBytesResponse(http.StatusOK, mp3Frame(byte(len(inputs)), "")), nil
+	})
+
+	text := strings.Repeat("word ", MaxSpeechInput/5) + "\n\nThe end."
+	data, err := client.Speak(t.Context(), SpeechRequest{Model: "tts-1-hd", Voice: "nova", Speed: 1.5, Format: "mp3", Text: text})
+	require.NoError(t, err)
+	require.Equal(t, []string{strings.TrimSpace(strings.Repeat("word ", MaxSpeechInput/5)), "The end."}, inputs)
+	require.Equal(t, append(mp3Frame(1, ""), mp3Frame(2, "")...), data)
+}
+
+func TestSpeakErrors(t *testing.T) {
+	_, client, _ := newStructuredTestClient(t)
+	_, err := client.Speak(t.Context(), SpeechRequest{Format: "mp3", Speed: 5, Text: "hi"})
+	require.ErrorIs(t, err, ErrInvalidSpeechSpeed)
+	_, err = client.Speak(t.Context(), SpeechRequest{Format: "mp3", Text: "  "})
+	require.ErrorIs(t, err, ErrEmptySpeechInput)
+	require.Zero(t, httpmock.GetTotalCallCount())
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+const (
+	// defaultSchemaName is sent if no valid name can be derived from the schema file name.
+	defaultSchemaName = "response"
+	// maxSchemaRetries bounds the re-ask loop, whatever is configured.
+	maxSchemaRetries = 5
+)
+
+var (
+	schemaNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+	// ErrSchemaValidation is returned, if the response is still not valid JSON
+	// or does not match the JSON schema after all retries.
+	ErrSchemaValidation = errors.New("response does not match the requested format")
+	// ErrInvalidSchema is returned, if the JSON schema file cannot be compiled.
+	ErrInvalidSchema = errors.New("invalid JSON schema")
+	// ErrStructuredOutputUnsupported is returned, if JSON mode or a JSON schema is configured for a provider that
+	// cannot request structured output.
+	ErrStructuredOutputUnsupported = errors.New("provider does not support structured output")
+)
+
+// structuredOutput requests JSON responses via response_format and validates
+// them locally, because json_object mode and non-strict schemas are only
+// best effort on the provider side.
+type structuredOutput struct {
+	format  *openai.ChatCompletionResponseFormat
+	schema  *jsonschema.Schema
+	retries int
+}
+
+// checkNoStructuredOutput returns ErrStructuredOutputUnsupported, if JSON
+// mode or a JSON schema is configured for a provider that cannot request
+// structured output. Without it, the response would never be validated.
+func checkNoStructuredOutput(config *viper.Viper) error {
+	if config.GetBool("jsonMode") || config.GetString("jsonSchema") != "" {
+		return fmt.Errorf("%w: %s", ErrStructuredOutputUnsupported, providerName(config))
+	}
+	return nil
+}
+
+// newStructuredOutput reads the jsonSchema and jsonMode settings. It returns
+// nil, if neither is set.
+func newStructuredOutput(config *viper.Viper) (*structuredOutput, error) {
+	if config == nil {
+		return nil, nil
+	}
+	retries := min(max(config.GetInt("schemaRetries"), 0), maxSchemaRetries)
+
+	schemaPath := config.GetString("jsonSchema")
+	if schemaPath == "" {
+		if !config.GetBool("jsonMode") {
+			return nil, nil
+		}
+		slog.Debug("JSON mode active")
+		return &structuredOutput{
+			format:  &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+			retries: retries,
+		}, nil
+	}
+
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	doc, err = jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidSchema, schemaPath, err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err = compiler.AddResource(schemaPath, doc); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidSchema, schemaPath, err)
+	}
+	var schema *jsonschema.Schema
+	schema, err = compiler.Compile(schemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidSchema, schemaPath, err)
+	}
+	slog.Debug("JSON schema loaded", "path", schemaPath)
+
+	return &structuredOutput{
+		format: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   schemaName(schemaPath),
+				Schema: json.RawMessage(data),
+			},
+		},
+		schema:  schema,
+		retries: retries,
+	}, nil
+}
+
+// schemaName derives the schema name the API requires from the file name.
+func schemaName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = schemaNameInvalidChars.ReplaceAllString(name, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if strings.Trim(name, "_") == "" {
+		return defaultSchemaName
+	}
+	return name
+}
+
+// validate checks that content is JSON and matches the schema, if one is set.
+func (s *structuredOutput) validate(content string) error {
+	instance, err := jsonschema.UnmarshalJSON(strings.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	if s.schema == nil {
+		return nil
+	}
+	return s.schema.Validate(instance)
+}
+
+// correction returns the message asking the model to fix its last response.
+func (s *structuredOutput) correction(validationErr error) openai.ChatCompletionMessage {
+	target := "valid JSON"
+	if s.schema != nil {
+		target = "JSON that matches the JSON schema"
+	}
+	return openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		Content: fmt.Sprintf("Your response was rejected: %s\nReply again with only %s, without any other text.",
+			validationErr, target),
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+const testSchema = `{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`
+
+func chatResponse(content string) string {
+	return fmt.Sprintf(`{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}]}`, content)
+}
+
+func newStructuredTestClient(t *testing.T) (*testlib.TestCtx, *OpenAIClient, *bytes.Buffer) {
+	t.Helper()
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+
+	var out bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	return testCtx, client, &out
+}
+
+func writeTestSchema(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "person.schema.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestJSONModeRetry(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("jsonMode", true)
+	testCtx.Config.Set("schemaRetries", 1)
+	requests := registerChatResponses(t, "application/json", chatResponse("Sure! {"), chatResponse(`{"ok":true}`))
+
+	result, err := client.CreateCompletion(context.Background(), "json", []string{"Reply in json"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, `{"ok":true}`, result)
+	// The rejected response is never printed
+	require.Equal(t, "{\"ok\":true}\n", out.String())
+
+	require.Len(t, *requests, 2)
+	require.Equal(t, openai.ChatCompletionResponseFormatTypeJSONObject, (*requests)[0].ResponseFormat.Type)
+	retry := (*requests)[1].Messages
+	require.Len(t, retry, 3)
+	require.Equal(t, "Sure! {", retry[1].Content)
+	require.Contains(t, retry[2].Content, "Reply again with only valid JSON")
+
+	// Only the prompt and the valid answer are saved to the chat session
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	var messages []openai.ChatCompletionMessage
+	messages, err = manager.GetSession("json")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "Reply in json", messages[0].Content)
+	require.Equal(t, `{"ok":true}`, messages[1].Content)
+}
+
+func TestJSONSchemaValid(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("jsonSchema", writeTestSchema(t, testSchema))
+	testCtx.Config.Set("stream", true)
+	requests := registerChatResponses(t, "text/event-stream",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"{\\\"name\\\":\"}}]}\n\n"+
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"\\\"sgpt\\\"}\"}}]}\n\n"+
+			"data: [DONE]\n\n")
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Who are you?"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"sgpt"}`, result)
+	require.Equal(t, "{\"name\":\"sgpt\"}\n", out.String())
+
+	format := (*requests)[0].ResponseFormat
+	require.Equal(t, openai.ChatCompletionResponseFormatTypeJSONSchema, format.Type)
+	require.Equal(t, "person_schema", format.JSONSchema.Name)
+}
+
+func TestJSONSchemaInvalidResponse(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("jsonSchema", writeTestSchema(t, testSchema))
+	requests := registerChatResponses(t, "application/json", chatResponse(`{"age":3}`))
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Who are you?"}, "txt", nil)
+	require.ErrorIs(t, err, ErrSchemaValidation)
+	require.Contains(t, err.Error(), "name")
+	require.Empty(t, out.String())
+	// Retries are off by default
+	require.Len(t, *requests, 1)
+}
+
+func TestJSONSchemaInvalidSchema(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("jsonSchema", writeTestSchema(t, `{"type":"no-such-type"}`))
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Who are you?"}, "txt", nil)
+	require.ErrorIs(t, err, ErrInvalidSchema)
+}
+
+func TestSchemaName(t *testing.T) {
+	require.Equal(t, "person", schemaName("/tmp/person.json"))
+	require.Equal(t, "my_schema_v2", schemaName("my schema.v2.json"))
+	require.Equal(t, defaultSchemaName, schemaName("..json"))
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// ErrInvalidCAFile is returned, if tls.caFile holds no PEM encoded certificate.
+	ErrInvalidCAFile = errors.New("tls.caFile contains no PEM encoded certificate")
+	// ErrIncompleteClientCert is returned, if only one of tls.certFile and tls.keyFile is set.
+	ErrIncompleteClientCert = errors.New("tls.certFile and tls.keyFile must be set together")
+	// ErrInsecureKeyFile is returned, if tls.keyFile is accessible by other users.
+	ErrInsecureKeyFile = errors.New("tls.keyFile must only be accessible by its owner (chmod 600)")
+)
+
+// newTLSConfig returns the TLS configuration of the tls section, or nil if
+// it is empty. The CA bundle of tls.caFile is trusted in addition to the
+// system roots, tls.certFile and tls.keyFile hold a client certificate for
+// mutual TLS and tls.serverName replaces the host name used to verify the
+// server certificate. Like every other setting, it may be set by a profile.
+func newTLSConfig(config *viper.Viper) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+	caFile := config.GetString("tls.caFile")
+	certFile := config.GetString("tls.certFile")
+	keyFile := config.GetString("tls.keyFile")
+	serverName := config.GetString("tls.serverName")
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := loadCAFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, ErrIncompleteClientCert
+		}
+		cert, err := loadClientCert(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	slog.Debug("TLS configured", "caFile", caFile, "certFile", certFile, "serverName", serverName)
+	return tlsConfig, nil
+}
+
+// loadCAFile returns the system roots extended by the certificates of file.
+func loadCAFile(file string) (*x509.CertPool, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tls.caFile: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		slog.Debug("System certificate pool unavailable", "error", err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCAFile, file)
+	}
+	return pool, nil
+}
+
+// loadClientCert loads the client certificate of certFile and keyFile. The
+// key file must not be accessible by other users, like the chat sessions.
+func loadClientCert(certFile, keyFile string) (tls.Certificate, error) {
+	certFile, err := expandHome(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyFile, err = expandHome(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls.keyFile: %w", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return tls.Certificate{}, fmt.Errorf("%w: %s has mode %s", ErrInsecureKeyFile, keyFile, info.Mode().Perm())
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls client certificate: %w", err)
+	}
+	return cert, nil
+}
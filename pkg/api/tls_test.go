@@ -0,0 +1,179 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+)
+
+// newTLSStandIn starts an HTTPS stand-in for the chat completions API and
+// writes its certificate to a CA file.
+func newTLSStandIn(t *testing.T, clientCAs *x509.CertPool) (*httptest.Server, string) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, chatResponse("Hi"))
+	}))
+	if clientCAs != nil {
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, data, 0o644))
+	return server, caFile
+}
+
+// writeClientCert writes a self-signed client certificate and its key and
+// returns a pool trusting it.
+func writeClientCert(t *testing.T, keyMode os.FileMode) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sgpt"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), keyMode))
+	require.NoError(t, os.Chmod(keyFile, keyMode))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func newTLSTestCtx(t *testing.T, server *httptest.Server) *testlib.TestCtx {
+	t.Helper()
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testCtx.Config.Set("apiBase", server.URL+"/v1")
+	return testCtx
+}
+
+func completeOverTLS(t *testing.T, testCtx *testlib.TestCtx) error {
+	t.Helper()
+	client, err := CreateClient(testCtx.Config, io.Discard)
+	if err != nil {
+		return err
+	}
+	_, err = client.CreateCompletion(context.Background(), "", []string{"Say: Hi"}, "txt", nil)
+	return err
+}
+
+func TestTLSCAFile(t *testing.T) {
+	server, caFile := newTLSStandIn(t, nil)
+	testCtx := newTLSTestCtx(t, server)
+
+	// The certificate of the stand-in is not trusted by the system
+	err := completeOverTLS(t, testCtx)
+	require.ErrorContains(t, err, "certificate")
+
+	testCtx.Config.Set("tls.caFile", caFile)
+	require.NoError(t, completeOverTLS(t, testCtx))
+}
+
+func TestTLSServerName(t *testing.T) {
+	server, caFile := newTLSStandIn(t, nil)
+	testCtx := newTLSTestCtx(t, server)
+	testCtx.Config.Set("tls.caFile", caFile)
+
+	// The certificate of the stand-in is valid for example.com
+	testCtx.Config.Set("tls.serverName", "example.com")
+	require.NoError(t, completeOverTLS(t, testCtx))
+
+	testCtx.Config.Set("tls.serverName", "gateway.example.org")
+	require.ErrorContains(t, completeOverTLS(t, testCtx), "gateway.example.org")
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	certFile, keyFile, clientCAs := writeClientCert(t, 0o600)
+	server, caFile := newTLSStandIn(t, clientCAs)
+	testCtx := newTLSTestCtx(t, server)
+	testCtx.Config.Set("tls.caFile", caFile)
+
+	// The stand-in requires a client certificate
+	require.Error(t, completeOverTLS(t, testCtx))
+
+	testCtx.Config.Set("tls.certFile", certFile)
+	testCtx.Config.Set("tls.keyFile", keyFile)
+	require.NoError(t, completeOverTLS(t, testCtx))
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+
+	certFile, keyFile, _ := writeClientCert(t, 0o644)
+	testCtx.Config.Set("tls.certFile", certFile)
+	_, err := CreateClient(testCtx.Config, io.Discard)
+	require.ErrorIs(t, err, ErrIncompleteClientCert)
+
+	testCtx.Config.Set("tls.keyFile", keyFile)
+	_, err = CreateClient(testCtx.Config, io.Discard)
+	require.ErrorIs(t, err, ErrInsecureKeyFile)
+
+	testCtx.Config.Set("tls.certFile", "")
+	testCtx.Config.Set("tls.keyFile", "")
+	testCtx.Config.Set("tls.caFile", certFile+".missing")
+	_, err = CreateClient(testCtx.Config, io.Discard)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	invalid := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(invalid, []byte("not a certificate"), 0o644))
+	testCtx.Config.Set("tls.caFile", invalid)
+	_, err = CreateAnthropicClient(testCtx.Config, io.Discard)
+	require.ErrorIs(t, err, ErrInvalidCAFile)
+}
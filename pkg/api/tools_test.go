@@ -0,0 +1,233 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/chat"
+)
+
+const (
+	toolCallResponse = `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":"",` +
+		`"tool_calls":[{"id":"call_1","type":"function","function":{"name":"echo_args","arguments":"{\"text\": \"hi\"}"}}]}}]}`
+	toolAnswerResponse = `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"The tool said hi"}}]}`
+)
+
+// registerChatResponses answers the first chat request with responses[0], the
+// second with responses[1] and so on, and records the decoded requests.
+func registerChatResponses(t *testing.T, contentType string, responses ...string) *[]openai.ChatCompletionRequest {
+	t.Helper()
+	var requests []openai.ChatCompletionRequest
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(r *http.Request) (*http.Response, error) {
+			var req openai.ChatCompletionRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			requests = append(requests, req)
+			require.LessOrEqual(t, len(requests), len(responses))
+			resp := httpmock.NewStringResponse(200, responses[len(requests)-1])
+			resp.Header.Set("Content-Type", contentType)
+			return resp, nil
+		})
+	return &requests
+}
+
+func newToolTestClient(t *testing.T, confirmation string) (*testlib.TestCtx, *OpenAIClient, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("tool tests require bash and are not supported on Windows")
+	}
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	testCtx.Config.Set("tools", []map[string]any{{
+		"name":        "echo_args",
+		"description": "Echo the arguments",
+		"parameters":  `{"type":"object","properties":{"text":{"type":"string"}}}`,
+		"command":     "cat",
+	}})
+
+	var out, prompts bytes.Buffer
+	client, err := CreateClient(testCtx.Config, &out, WithInput(strings.NewReader(confirmation)), WithErrorWriter(&prompts))
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	return testCtx, client, &out, &prompts
+}
+
+func TestToolCallRoundTrip(t *testing.T) {
+	testCtx, client, out, prompts := newToolTestClient(t, "y\n")
+	requests := registerChatResponses(t, "application/json", toolCallResponse, toolAnswerResponse)
+
+	result, err := client.CreateCompletion(context.Background(), "tool_chat", []string{"Say hi via the tool"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "The tool said hi", result)
+	require.Contains(t, prompts.String(), `Tool call: echo_args {"text":"hi"}`)
+	require.Equal(t, "The tool said hi\n", out.String())
+
+	// Both requests declare the tool, the second carries its result
+	require.Len(t, *requests, 2)
+	require.Len(t, (*requests)[0].Tools, 1)
+	require.Equal(t, "echo_args", (*requests)[0].Tools[0].Function.Name)
+	second := (*requests)[1].Messages
+	require.Len(t, second, 3)
+	require.Equal(t, openai.ChatMessageRoleTool, second[2].Role)
+	require.Equal(t, "call_1", second[2].ToolCallID)
+	require.Equal(t, `{"text":"hi"}`, second[2].Content)
+
+	manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+	require.NoError(t, err)
+	var messages []openai.ChatCompletionMessage
+	messages, err = manager.GetSession("tool_chat")
+	require.NoError(t, err)
+	require.Len(t, messages, 4)
+	require.Len(t, messages[1].ToolCalls, 1)
+	require.Equal(t, openai.ChatMessageRoleTool, messages[2].Role)
+	require.Equal(t, "The tool said hi", messages[3].Content)
+}
+
+func TestToolCallJSONOutput(t *testing.T) {
+	testCtx, client, out, prompts := newToolTestClient(t, "y\n")
+	testCtx.Config.Set("jsonMode", true)
+	registerChatResponses(t, "application/json", toolCallResponse, chatResponse(`{"said":"hi"}`))
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say hi via the tool"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, `{"said":"hi"}`, result)
+	// Scripts reading stdout only get the JSON
+	require.Equal(t, "{\"said\":\"hi\"}\n", out.String())
+	require.Contains(t, prompts.String(), "Tool call: echo_args")
+}
+
+func TestToolCallDeclined(t *testing.T) {
+	_, client, _, _ := newToolTestClient(t, "n\n")
+	requests := registerChatResponses(t, "application/json", toolCallResponse, toolAnswerResponse)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say hi via the tool"}, "txt", nil)
+	require.NoError(t, err)
+	require.Len(t, *requests, 2)
+	require.Equal(t, "The user declined to run this tool.", (*requests)[1].Messages[2].Content)
+}
+
+func TestToolCallNoConfirmationInput(t *testing.T) {
+	_, client, _, _ := newToolTestClient(t, "")
+	registerChatResponses(t, "application/json", toolCallResponse)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say hi via the tool"}, "txt", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "confirm tool call echo_args")
+}
+
+func TestToolCallTooManyRounds(t *testing.T) {
+	_, client, _, _ := newToolTestClient(t, strings.Repeat("y\n", maxToolRounds+1))
+	responses := make([]string, maxToolRounds+1)
+	for i := range responses {
+		responses[i] = toolCallResponse
+	}
+	registerChatResponses(t, "application/json", responses...)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Loop forever"}, "txt", nil)
+	require.ErrorIs(t, err, ErrTooManyToolRounds)
+}
+
+func TestToolCallStream(t *testing.T) {
+	testCtx, client, out, _ := newToolTestClient(t, "y\n")
+	testCtx.Config.Set("stream", true)
+
+	chunk := func(delta string) string {
+		return fmt.Sprintf("data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":%s}]}\n\n", delta)
+	}
+	toolStream := chunk(`{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"echo_args","arguments":""}}]}`) +
+		chunk(`{"tool_calls":[{"index":0,"function":{"arguments":"{\"text\":"}}]}`) +
+		chunk(`{"tool_calls":[{"index":0,"function":{"arguments":" \"hi\"}"}}]}`) +
+		"data: [DONE]\n\n"
+	answerStream := chunk(`{"content":"The tool "}`) + chunk(`{"content":"said hi"}`) + "data: [DONE]\n\n"
+	requests := registerChatResponses(t, "text/event-stream", toolStream, answerStream)
+
+	result, err := client.CreateCompletion(context.Background(), "", []string{"Say hi via the tool"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "The tool said hi", result)
+	require.Len(t, *requests, 2)
+
+	assistant := (*requests)[1].Messages[1]
+	require.Len(t, assistant.ToolCalls, 1)
+	require.Equal(t, "call_1", assistant.ToolCalls[0].ID)
+	require.Equal(t, `{"text": "hi"}`, assistant.ToolCalls[0].Function.Arguments)
+	require.Equal(t, `{"text":"hi"}`, (*requests)[1].Messages[2].Content)
+	require.True(t, strings.HasSuffix(out.String(), "The tool said hi\n"))
+}
+
+func TestToolsUnsupportedProviders(t *testing.T) {
+	toolSession := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "Say hi via echo"},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{ID: "call_1", Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "echo_args", Arguments: `{"text":"hi"}`}}}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "hi"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "The tool said hi"},
+	}
+	clients := map[string]func(t *testing.T, testCtx *testlib.TestCtx) (Completer, error){
+		ProviderAnthropic: func(t *testing.T, testCtx *testlib.TestCtx) (Completer, error) {
+			newAnthropicStandIn(t, func(http.ResponseWriter, anthropicRequest) {
+				t.Fatal("unexpected request")
+			})
+			return CreateAnthropicClient(testCtx.Config, &bytes.Buffer{})
+		},
+		ProviderOllama: func(t *testing.T, testCtx *testlib.TestCtx) (Completer, error) {
+			newOllamaStandIn(t, func(http.ResponseWriter, ollamaChatRequest) {
+				t.Fatal("unexpected request")
+			})
+			return CreateOllamaClient(testCtx.Config, &bytes.Buffer{})
+		},
+	}
+	for provider, createClient := range clients {
+		t.Run(provider+" declared tools", func(t *testing.T) {
+			testCtx := testlib.NewTestCtx(t)
+			testCtx.Config.Set("tools", []map[string]any{{"name": "echo_args", "description": "Echo", "command": "cat"}})
+			client, err := createClient(t, testCtx)
+			require.NoError(t, err)
+			_, err = client.CreateCompletion(context.Background(), "", []string{"Say hi via echo"}, "txt", nil)
+			require.ErrorIs(t, err, ErrToolsUnsupported)
+		})
+		t.Run(provider+" session with tool calls", func(t *testing.T) {
+			testCtx := testlib.NewTestCtx(t)
+			manager, err := chat.NewFilesystemChatSessionManager(testCtx.Config)
+			require.NoError(t, err)
+			require.NoError(t, manager.SaveSession("tools", toolSession))
+			client, err := createClient(t, testCtx)
+			require.NoError(t, err)
+			_, err = client.CreateCompletion(context.Background(), "tools", []string{"And again"}, "txt", nil)
+			require.ErrorIs(t, err, ErrToolsUnsupported)
+			require.ErrorContains(t, err, "chat session")
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func TestUsageRecorded(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("model", "gpt-4o")
+	registerChatResponses(t, "application/json",
+		`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}],"usage":{"prompt_tokens":1000,"completion_tokens":100,"total_tokens":1100}}`)
+
+	_, err := client.CreateCompletion(context.Background(), "usage_chat", []string{"Say hi"}, "txt", nil)
+	require.NoError(t, err)
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	record := records[0]
+	require.Equal(t, ProviderOpenAI, record.Provider)
+	require.Equal(t, "gpt-4o", record.Model)
+	require.Equal(t, "txt", record.Persona)
+	require.Equal(t, "usage_chat", record.ChatID)
+	require.Equal(t, 1100, record.TotalTokens)
+	require.NotNil(t, record.Cost)
+	require.InDelta(t, 0.0035, *record.Cost, 1e-9)
+}
+
+func TestUsageRecordedStream(t *testing.T) {
+	testCtx, client, out := newStructuredTestClient(t)
+	testCtx.Config.Set("stream", true)
+	requests := registerChatResponses(t, "text/event-stream",
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n"+
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":8,\"completion_tokens\":2,\"total_tokens\":10}}\n\n"+
+			"data: [DONE]\n\n")
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.Equal(t, "Hi\n", out.String())
+	require.NotNil(t, (*requests)[0].StreamOptions)
+	require.True(t, (*requests)[0].StreamOptions.IncludeUsage)
+
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, 10, records[0].TotalTokens)
+}
+
+func TestUsageLedgerDisabled(t *testing.T) {
+	testCtx, client, _ := newStructuredTestClient(t)
+	testCtx.Config.Set("usage.ledger", false)
+	registerChatResponses(t, "application/json",
+		`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+
+	_, err := client.CreateCompletion(context.Background(), "", []string{"Say hi"}, "txt", nil)
+	require.NoError(t, err)
+	require.NoFileExists(t, ledger.Path(testCtx.Config))
+}
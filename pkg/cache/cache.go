@@ -0,0 +1,288 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package cache stores completions on disk, so repeated requests are answered
+// without calling the API again.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+const (
+	// dirName is the cache directory inside the cache dir. The leading dot
+	// keeps it apart from chat sessions, whose names cannot start with a dot.
+	dirName   = ".responses"
+	entryExt  = ".json"
+	keyPrefix = "v1"
+
+	dirPermissions  = 0700
+	filePermissions = 0600
+
+	// DefaultTTL and DefaultMaxSize apply, if cache.ttl or cache.maxSize are not set.
+	DefaultTTL     = 24 * time.Hour
+	DefaultMaxSize = 100 << 20
+)
+
+// Entry is a cached completion.
+type Entry struct {
+	Created time.Time                    `json:"created"`
+	Model   string                       `json:"model"`
+	Message openai.ChatCompletionMessage `json:"message"`
+}
+
+// Stats describes the content of the cache.
+type Stats struct {
+	Entries int
+	Expired int
+	Size    int64
+	MaxSize int64
+	TTL     time.Duration
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+// Cache is a directory of completions keyed by a hash of their request.
+type Cache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+	now     func() time.Time
+}
+
+// Enabled reports whether the cache is switched on via cache.enabled.
+func Enabled(config *viper.Viper) bool {
+	return config.GetBool("cache.enabled") && config.GetString("cacheDir") != ""
+}
+
+// New returns the cache in the cache dir. A cache.ttl of 0 keeps entries
+// until they are evicted by size; a cache.maxSize of 0 disables the size limit.
+func New(config *viper.Viper) *Cache {
+	c := &Cache{
+		dir:     filepath.Join(config.GetString("cacheDir"), dirName),
+		ttl:     DefaultTTL,
+		maxSize: DefaultMaxSize,
+		now:     time.Now,
+	}
+	if config.IsSet("cache.ttl") {
+		c.ttl = max(config.GetDuration("cache.ttl"), 0)
+	}
+	if config.IsSet("cache.maxSize") {
+		c.maxSize = int64(config.GetSizeInBytes("cache.maxSize"))
+	}
+	return c
+}
+
+// Key hashes everything that determines a completion: the provider, the
+// endpoint and the request. Streaming does not change the completion, so
+// streamed and regular requests share their entries.
+func Key(provider, endpoint string, req openai.ChatCompletionRequest) (string, error) {
+	req.Stream = false
+	req.StreamOptions = nil
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, part := range []string{keyPrefix, provider, endpoint} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+entryExt)
+}
+
+func (c *Cache) expired(created time.Time) bool {
+	return c.ttl > 0 && c.now().Sub(created) > c.ttl
+}
+
+// Get returns the entry for key. Expired entries are removed and reported as
+// missing.
+func (c *Cache) Get(key string) (Entry, bool, error) {
+	data, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	var entry Entry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		slog.Debug("Removing unreadable cache entry", "key", key, "error", err)
+		return Entry{}, false, os.Remove(c.path(key))
+	}
+	if c.expired(entry.Created) {
+		slog.Debug("Removing expired cache entry", "key", key)
+		return Entry{}, false, os.Remove(c.path(key))
+	}
+	return entry, true, nil
+}
+
+// Put stores entry under key and evicts the oldest entries once the cache
+// exceeds its size limit.
+func (c *Cache) Put(key string, entry Entry) error {
+	if entry.Created.IsZero() {
+		entry.Created = c.now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.dir, dirPermissions); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so concurrent readers never see a
+	// partial entry
+	var tmp *os.File
+	tmp, err = os.CreateTemp(c.dir, key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), filePermissions); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return err
+	}
+	slog.Debug("Stored response in cache", "key", key)
+	return c.prune()
+}
+
+type fileInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *Cache) list() ([]fileInfo, error) {
+	dirEntries, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []fileInfo
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), entryExt) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fileInfo{
+			path:    filepath.Join(c.dir, dirEntry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+// prune removes expired entries and then the oldest entries until the cache
+// fits into its size limit. Entries are never rewritten, so the modification
+// time is the creation time.
+func (c *Cache) prune() error {
+	files, err := c.list()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+	for _, file := range files {
+		if !c.expired(file.modTime) && (c.maxSize <= 0 || size <= c.maxSize) {
+			continue
+		}
+		if err = os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		size -= file.size
+		slog.Debug("Evicted cache entry", "path", file.path)
+	}
+	return nil
+}
+
+// Clear removes all entries and returns how many were removed.
+func (c *Cache) Clear() (int, error) {
+	files, err := c.list()
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err = os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
+
+// Stats returns the number and size of the stored entries.
+func (c *Cache) Stats() (Stats, error) {
+	stats := Stats{MaxSize: c.maxSize, TTL: c.ttl}
+	files, err := c.list()
+	if err != nil {
+		return Stats{}, err
+	}
+	for _, file := range files {
+		stats.Entries++
+		stats.Size += file.size
+		if c.expired(file.modTime) {
+			stats.Expired++
+		}
+		if stats.Oldest.IsZero() || file.modTime.Before(stats.Oldest) {
+			stats.Oldest = file.modTime
+		}
+		if file.modTime.After(stats.Newest) {
+			stats.Newest = file.modTime
+		}
+	}
+	return stats, nil
+}
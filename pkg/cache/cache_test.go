@@ -0,0 +1,164 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestCache(t *testing.T) (*viper.Viper, *Cache) {
+	config := viper.New()
+	config.Set("cacheDir", t.TempDir())
+	return config, New(config)
+}
+
+func testMessage(content string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}
+}
+
+func TestKey(t *testing.T) {
+	req := openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+	}
+	key, err := Key("openai", "https://api.openai.com/v1", req)
+	require.NoError(t, err)
+	require.Len(t, key, 64)
+
+	// Streaming does not change the key
+	streamed := req
+	streamed.Stream = true
+	streamed.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	var other string
+	other, err = Key("openai", "https://api.openai.com/v1", streamed)
+	require.NoError(t, err)
+	require.Equal(t, key, other)
+
+	// Everything else does
+	changed := req
+	changed.Temperature = 0.5
+	for _, args := range []struct {
+		provider, endpoint string
+		req                openai.ChatCompletionRequest
+	}{
+		{"azure", "https://api.openai.com/v1", req},
+		{"openai", "http://localhost:11434/v1", req},
+		{"openai", "https://api.openai.com/v1", changed},
+	} {
+		other, err = Key(args.provider, args.endpoint, args.req)
+		require.NoError(t, err)
+		require.NotEqual(t, key, other)
+	}
+}
+
+func TestGetPut(t *testing.T) {
+	_, c := createTestCache(t)
+
+	_, hit, err := c.Get("key")
+	require.NoError(t, err)
+	require.False(t, hit)
+
+	require.NoError(t, c.Put("key", Entry{Model: "gpt-4o", Message: testMessage("Hello")}))
+
+	var entry Entry
+	entry, hit, err = c.Get("key")
+	require.NoError(t, err)
+	require.True(t, hit)
+	require.Equal(t, "Hello", entry.Message.Content)
+	require.Equal(t, "gpt-4o", entry.Model)
+
+	info, err := os.Stat(c.path("key"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestGetExpired(t *testing.T) {
+	config, c := createTestCache(t)
+	config.Set("cache.ttl", time.Hour)
+	c = New(config)
+
+	require.NoError(t, c.Put("key", Entry{Created: time.Now().Add(-2 * time.Hour), Message: testMessage("old")}))
+	_, hit, err := c.Get("key")
+	require.NoError(t, err)
+	require.False(t, hit)
+	require.NoFileExists(t, c.path("key"))
+}
+
+func TestPutEvictsOldest(t *testing.T) {
+	config, _ := createTestCache(t)
+	config.Set("cache.maxSize", "1KB")
+	c := New(config)
+
+	content := strings.Repeat("a", 400)
+	for i, key := range []string{"first", "second", "third"} {
+		require.NoError(t, c.Put(key, Entry{Message: testMessage(content)}))
+		// Entries are evicted by age, so make it unambiguous
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(c.path(key), modTime, modTime))
+	}
+	require.NoError(t, c.prune())
+
+	require.NoFileExists(t, c.path("first"))
+	require.FileExists(t, c.path("second"))
+	require.FileExists(t, c.path("third"))
+}
+
+func TestStatsAndClear(t *testing.T) {
+	_, c := createTestCache(t)
+	require.NoError(t, c.Put("a", Entry{Message: testMessage("A")}))
+	require.NoError(t, c.Put("b", Entry{Message: testMessage("B")}))
+	// Unrelated files are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(c.dir, "notes.txt"), []byte("notes"), 0600))
+
+	stats, err := c.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Entries)
+	require.Zero(t, stats.Expired)
+	require.Positive(t, stats.Size)
+	require.Equal(t, int64(DefaultMaxSize), stats.MaxSize)
+	require.Equal(t, DefaultTTL, stats.TTL)
+
+	var removed int
+	removed, err = c.Clear()
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+
+	stats, err = c.Stats()
+	require.NoError(t, err)
+	require.Zero(t, stats.Entries)
+	require.FileExists(t, filepath.Join(c.dir, "notes.txt"))
+}
+
+func TestEnabled(t *testing.T) {
+	config, _ := createTestCache(t)
+	require.False(t, Enabled(config))
+	config.Set("cache.enabled", true)
+	require.True(t, Enabled(config))
+}
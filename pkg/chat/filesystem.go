@@ -196,6 +196,10 @@ func (m FilesystemChatSessionManager) ListSessions() ([]string, error) {
 	slog.Debug("Iterating files in cache directory")
 	var files []string
 	for _, file := range dirFiles {
+		// The cache dir also holds other data, e.g. the usage ledger
+		if file.IsDir() || validateSessionName(file.Name()) != nil {
+			continue
+		}
 		files = append(files, file.Name())
 	}
 	return files, nil
@@ -225,6 +229,9 @@ func (m FilesystemChatSessionManager) DeleteSession(sessionName string) error {
 	if err != nil {
 		return err
 	}
+	if err = m.deleteMetadata(sessionName); err != nil {
+		return err
+	}
 	slog.Debug("Session deleted")
 	return nil
 }
@@ -197,6 +197,24 @@ func TestFilesystemChatSessionManager_ListSessions(t *testing.T) {
 	require.Equal(t, []string{"test"}, sessions)
 }
 
+func TestFilesystemChatSessionManager_ListSessionsSkipsOtherData(t *testing.T) {
+	config := createTestConfig(t)
+	cacheDir := config.GetString("cacheDir")
+
+	manager, err := NewFilesystemChatSessionManager(config)
+	require.NoError(t, err)
+	require.NoError(t, manager.SaveSession("test", createTestMessages()))
+
+	require.NoError(t, os.Mkdir(filepath.Join(cacheDir, ".usage"), 0700))
+	require.NoError(t, os.Mkdir(filepath.Join(cacheDir, "dir"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "notes.txt"), nil, 0600))
+
+	var sessions []string
+	sessions, err = manager.ListSessions()
+	require.NoError(t, err)
+	require.Equal(t, []string{"test"}, sessions)
+}
+
 func TestFilesystemChatSessionManager_DeleteSession(t *testing.T) {
 	config := createTestConfig(t)
 
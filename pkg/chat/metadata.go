@@ -0,0 +1,109 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// metadataDir is the directory in the cache directory holding the
+	// metadata of the sessions. Session names cannot start with a dot, so
+	// it is never listed as a session.
+	metadataDir            = ".metadata"
+	metadataDirPermissions = 0700
+)
+
+// Metadata holds information about a chat session that is not part of its
+// messages and never sent to a model.
+type Metadata struct {
+	// Models maps the index of an assistant message in the session to the
+	// model that answered it.
+	Models map[int]string `json:"models,omitempty"`
+	// Truncated lists the indexes of assistant messages that were
+	// interrupted before the model finished them.
+	Truncated []int `json:"truncated,omitempty"`
+}
+
+// MetadataStore is implemented by session managers that store metadata next
+// to the sessions.
+type MetadataStore interface {
+	GetMetadata(sessionName string) (Metadata, error)
+	SaveMetadata(sessionName string, metadata Metadata) error
+}
+
+func (m FilesystemChatSessionManager) getFilepathForMetadata(sessionName string) string {
+	return filepath.Join(m.config.GetString("cacheDir"), metadataDir, sessionName+".json")
+}
+
+// GetMetadata returns the metadata of the session. Sessions without
+// metadata, e.g. those saved by older versions, return empty metadata.
+func (m FilesystemChatSessionManager) GetMetadata(sessionName string) (Metadata, error) {
+	if err := validateSessionName(sessionName); err != nil {
+		return Metadata{}, err
+	}
+	data, err := os.ReadFile(m.getFilepathForMetadata(sessionName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Metadata{}, nil
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	var metadata Metadata
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return Metadata{}, err
+	}
+	return metadata, nil
+}
+
+// SaveMetadata replaces the metadata of the session.
+func (m FilesystemChatSessionManager) SaveMetadata(sessionName string, metadata Metadata) error {
+	if err := validateSessionName(sessionName); err != nil {
+		return err
+	}
+	metadataFilepath := m.getFilepathForMetadata(sessionName)
+	if err := os.MkdirAll(filepath.Dir(metadataFilepath), metadataDirPermissions); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(metadataFilepath, data, defaultFilePermissions); err != nil {
+		return err
+	}
+	slog.Debug("Saved session metadata at: " + metadataFilepath)
+	return nil
+}
+
+// deleteMetadata removes the metadata of the session, if there is any.
+func (m FilesystemChatSessionManager) deleteMetadata(sessionName string) error {
+	err := os.Remove(m.getFilepathForMetadata(sessionName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesystemChatSessionManager_Metadata(t *testing.T) {
+	config := createTestConfig(t)
+
+	manager, err := NewFilesystemChatSessionManager(config)
+	require.NoError(t, err)
+	store, ok := manager.(MetadataStore)
+	require.True(t, ok)
+
+	// Sessions without metadata have empty metadata
+	var metadata Metadata
+	metadata, err = store.GetMetadata("test")
+	require.NoError(t, err)
+	require.Empty(t, metadata.Models)
+
+	require.NoError(t, manager.SaveSession("test", createTestMessages()))
+	require.NoError(t, store.SaveMetadata("test", Metadata{Models: map[int]string{1: "gpt-4o-mini"}}))
+	metadata, err = store.GetMetadata("test")
+	require.NoError(t, err)
+	require.Equal(t, map[int]string{1: "gpt-4o-mini"}, metadata.Models)
+
+	metadataFile := filepath.Join(config.GetString("cacheDir"), metadataDir, "test.json")
+	info, err := os.Stat(metadataFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The metadata directory is not a session
+	var sessions []string
+	sessions, err = manager.ListSessions()
+	require.NoError(t, err)
+	require.Equal(t, []string{"test"}, sessions)
+
+	// The metadata is deleted with the session
+	require.NoError(t, manager.DeleteSession("test"))
+	require.NoFileExists(t, metadataFile)
+}
+
+func TestFilesystemChatSessionManager_MetadataInvalidSessionName(t *testing.T) {
+	manager, err := NewFilesystemChatSessionManager(createTestConfig(t))
+	require.NoError(t, err)
+	store := manager.(MetadataStore)
+
+	_, err = store.GetMetadata("../escape")
+	require.ErrorIs(t, err, ErrChatSessionNameInvalid)
+	require.ErrorIs(t, store.SaveMetadata("../escape", Metadata{}), ErrChatSessionNameInvalid)
+}
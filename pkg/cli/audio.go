@@ -0,0 +1,154 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// audioFormats are the output formats of the transcribe and translate commands.
+var audioFormats = []string{
+	string(openai.AudioResponseFormatText),
+	string(openai.AudioResponseFormatSRT),
+	string(openai.AudioResponseFormatVTT),
+	string(openai.AudioResponseFormatVerboseJSON),
+}
+
+var (
+	// ErrUnknownAudioFormat is returned, if the output format of the transcribe or translate command is not supported.
+	ErrUnknownAudioFormat = fmt.Errorf("output format must be one of %s", strings.Join(audioFormats, ", "))
+	// ErrTemplateWithAudio is returned when --template and --audio are both set.
+	ErrTemplateWithAudio = errors.New("--template cannot be combined with --audio")
+)
+
+type audioCmd struct {
+	cmd      *cobra.Command
+	language string
+	prompt   string
+	output   string
+}
+
+func newTranscribeCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *audioCmd {
+	return newAudioCmd(config, createClientFn, false)
+}
+
+func newTranslateCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *audioCmd {
+	return newAudioCmd(config, createClientFn, true)
+}
+
+func newAudioCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error), translate bool) *audioCmd {
+	audio := &audioCmd{}
+	cmd := &cobra.Command{
+		Use:   "transcribe <file>",
+		Short: "Transcribe speech in an audio file",
+		Long: strings.TrimSpace(`
+Transcribe the speech in an audio file with the configured provider. The file
+must be inside the working directory and at most 25 MiB. Supported formats are
+FLAC, M4A, MP3, MP4, OGG, WAV and WebM.
+
+To pass the transcript to a prompt in one invocation, use the --audio flag of
+the root command instead.
+`),
+		Example: strings.TrimSpace(`
+sgpt transcribe standup.m4a
+sgpt transcribe --language de -o srt interview.mp3 > interview.srt
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, _ []string) error {
+			// Bound here, because transcribe and translate share the key
+			if err := config.BindPFlag("audio.model", cmd.Flags().Lookup("model")); err != nil {
+				return err
+			}
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains(audioFormats, audio.output) {
+				return ErrUnknownAudioFormat
+			}
+			transcript, err := transcribe(cmd.Context(), config, createClientFn, api.AudioRequest{
+				File:      args[0],
+				Translate: translate,
+				Language:  audio.language,
+				Prompt:    audio.prompt,
+				Format:    audio.output,
+			})
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(transcript, "\n") {
+				transcript += "\n"
+			}
+			_, err = fmt.Fprint(cmd.OutOrStdout(), transcript)
+			return err
+		},
+	}
+	if translate {
+		cmd.Use = "translate <file>"
+		cmd.Short = "Translate speech in an audio file to English"
+		cmd.Long = strings.TrimSpace(`
+Translate the speech in an audio file to English text with the configured
+provider. The file must be inside the working directory and at most 25 MiB.
+Supported formats are FLAC, M4A, MP3, MP4, OGG, WAV and WebM.
+`)
+		cmd.Example = "sgpt translate -o vtt interview.mp3 > interview.vtt"
+	} else {
+		cmd.Flags().StringVar(&audio.language, "language", "", "ISO-639-1 language of the speech, e.g. de")
+	}
+	cmd.Flags().StringP("model", "m", api.DefaultAudioModel, "audio model name")
+	cmd.Flags().StringVar(&audio.prompt, "prompt", "", "text to guide the style or spelling of the transcript")
+	cmd.Flags().StringVarP(&audio.output, "output", "o", string(openai.AudioResponseFormatText), "output format ("+strings.Join(audioFormats, ", ")+")")
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
+	_ = cmd.RegisterFlagCompletionFunc("output", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return audioFormats, cobra.ShellCompDirectiveNoFileComp
+	})
+	audio.cmd = cmd
+	return audio
+}
+
+// transcribe transcribes req with the audio model of the config.
+func transcribe(ctx context.Context, config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error), req api.AudioRequest) (string, error) {
+	client, err := createClientFn(config, io.Discard)
+	if err != nil {
+		return "", err
+	}
+	transcriber, ok := client.(api.Transcriber)
+	if !ok {
+		return "", api.ErrAudioUnsupported
+	}
+	req.Model = config.GetString("audio.model")
+	if req.Model == "" {
+		req.Model = api.DefaultAudioModel
+	}
+	return transcriber.Transcribe(ctx, req)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// fakeTranscriber returns a fixed transcript and records the audio requests
+// and the prompts of completions.
+type fakeTranscriber struct {
+	transcript string
+	requests   *[]api.AudioRequest
+	prompts    *[]string
+	mode       *string
+}
+
+func (f fakeTranscriber) CreateCompletion(_ context.Context, _ string, prompts []string, mode string, _ []string) (string, error) {
+	*f.prompts = prompts
+	*f.mode = mode
+	return "", nil
+}
+
+func (f fakeTranscriber) Transcribe(_ context.Context, req api.AudioRequest) (string, error) {
+	*f.requests = append(*f.requests, req)
+	return f.transcript, nil
+}
+
+type audioRun struct {
+	out      string
+	code     int
+	requests []api.AudioRequest
+	prompts  []string
+	mode     string
+}
+
+func runAudioCmd(t *testing.T, config *viper.Viper, isPiped bool, stdin string, args ...string) audioRun {
+	t.Helper()
+	var run audioRun
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, config, mockIsPipedShell(isPiped, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return fakeTranscriber{transcript: "Hello team.\n", requests: &run.requests, prompts: &run.prompts, mode: &run.mode}, nil
+	})
+	root.cmd.SetIn(bytes.NewBufferString(stdin))
+	root.cmd.SetOut(&out)
+	root.Execute(args)
+	run.out = out.String()
+	run.code = mem.code
+	return run
+}
+
+func TestTranscribeCmd(t *testing.T) {
+	run := runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "transcribe", "--language", "de", "--prompt", "sgpt", "-o", "srt", "standup.m4a")
+	require.Equal(t, 0, run.code)
+	require.Equal(t, "Hello team.\n", run.out)
+	require.Equal(t, []api.AudioRequest{{
+		Model:    api.DefaultAudioModel,
+		File:     "standup.m4a",
+		Language: "de",
+		Prompt:   "sgpt",
+		Format:   "srt",
+	}}, run.requests)
+}
+
+func TestTranslateCmd(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("audio.model", "my-whisper")
+
+	run := runAudioCmd(t, testCtx.Config, false, "", "translate", "interview.mp3")
+	require.Equal(t, 0, run.code)
+	require.Len(t, run.requests, 1)
+	require.True(t, run.requests[0].Translate)
+	require.Equal(t, "my-whisper", run.requests[0].Model)
+	require.Equal(t, "text", run.requests[0].Format)
+
+	run = runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "translate", "-m", "whisper-2", "interview.mp3")
+	require.Equal(t, 0, run.code)
+	require.Equal(t, "whisper-2", run.requests[0].Model)
+
+	// Translations are always to English
+	run = runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "translate", "--language", "de", "interview.mp3")
+	require.Equal(t, 1, run.code)
+}
+
+func TestTranscribeCmdErrors(t *testing.T) {
+	run := runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "transcribe", "-o", "docx", "standup.m4a")
+	require.Equal(t, 1, run.code)
+	require.Empty(t, run.requests)
+
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"transcribe", "standup.m4a"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestRootCmdAudio(t *testing.T) {
+	run := runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "--audio", "standup.m4a")
+	require.Equal(t, 0, run.code)
+	require.Equal(t, []string{"Hello team."}, run.prompts)
+	require.Equal(t, "txt", run.mode)
+	require.Equal(t, "standup.m4a", run.requests[0].File)
+	require.Equal(t, api.DefaultAudioModel, run.requests[0].Model)
+
+	run = runAudioCmd(t, testlib.NewTestCtx(t).Config, false, "", "--audio", "standup.m4a", "Summarize the decisions")
+	require.Equal(t, 0, run.code)
+	require.Equal(t, []string{"Hello team.", "Summarize the decisions"}, run.prompts)
+
+	run = runAudioCmd(t, testlib.NewTestCtx(t).Config, true, "Notes: ship on Friday", "--audio", "standup.m4a", "code", "Write a checklist")
+	require.Equal(t, 0, run.code)
+	require.Equal(t, []string{"Hello team.", "Notes: ship on Friday", "Write a checklist"}, run.prompts)
+	require.Equal(t, "code", run.mode)
+
+	run = runAudioCmd(t, testlib.NewTestCtx(t).Config, true, "name: Dave", "--audio", "standup.m4a", "--template", "Hi {{ .name }}")
+	require.Equal(t, 1, run.code)
+	require.Empty(t, run.requests)
+}
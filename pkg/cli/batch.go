@@ -0,0 +1,784 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+	"github.com/tbckr/sgpt/v2/pkg/modifiers"
+	"github.com/tbckr/sgpt/v2/pkg/tokens"
+	"github.com/tbckr/sgpt/v2/pkg/tools"
+)
+
+const (
+	defaultBatchWorkers = 4
+	// maxBatchLineSize bounds a single line of the input and the results file.
+	maxBatchLineSize = 1 << 20
+	batchResultsPerm = 0644
+)
+
+var (
+	// ErrBatchUnsupported is returned, if the client of the selected provider cannot run batches.
+	ErrBatchUnsupported = errors.New("provider does not support batches")
+	// ErrInvalidBatchWorkers is returned, if fewer than one worker is configured.
+	ErrInvalidBatchWorkers = errors.New("batch workers must be at least 1")
+	// ErrInvalidBatchRateLimit is returned, if a rate limit is negative.
+	ErrInvalidBatchRateLimit = errors.New("batch rate limits must not be negative")
+	// ErrBatchResumeRequiresOut is returned, if --resume is used without a results file.
+	ErrBatchResumeRequiresOut = errors.New("--resume requires --out: the results file is the checkpoint")
+	// ErrInvalidBatchLine is returned, if a line of the input is not a valid batch request.
+	ErrInvalidBatchLine = errors.New("invalid batch line")
+	// ErrBatchMissingPrompt is returned, if a line has neither a prompt nor vars.
+	ErrBatchMissingPrompt = errors.New("batch line has neither a prompt nor vars")
+	// ErrBatchVarsWithoutTemplate is returned, if a line has vars but no --template is given.
+	ErrBatchVarsWithoutTemplate = errors.New("batch line has vars, but no --template is given")
+	// ErrBatchTools is returned, if the config or the persona of a line declares tools. Every tool call
+	// needs a confirmation, which the workers of a batch cannot ask for.
+	ErrBatchTools = errors.New("batch lines cannot use tools, remove them from the config or the persona")
+	// ErrUnknownBatchOverride is returned, if a line overrides a config key that is not supported.
+	ErrUnknownBatchOverride = errors.New("unknown batch override")
+	// ErrBatchCheckpointMismatch is returned, if the results file to resume does not belong to the input.
+	ErrBatchCheckpointMismatch = errors.New("results file does not match the input")
+	// ErrBatchChatAborted is the result of the lines of a chat session after a failed line.
+	ErrBatchChatAborted = errors.New("skipped, because an earlier line of the chat session failed")
+	// ErrBatchFailed is returned, if at least one line of the batch failed.
+	ErrBatchFailed = errors.New("batch lines failed")
+)
+
+type batchCmd struct {
+	batchInput
+
+	cmd       *cobra.Command
+	out       string
+	resume    bool
+	unordered bool
+}
+
+// batchInput reads the lines of a batch input and prepares them to be sent.
+// It is shared by the batch command and its submit subcommand.
+type batchInput struct {
+	persona  string
+	model    string
+	template string
+}
+
+// batchLine is a line of the batch input.
+type batchLine struct {
+	ID        string         `json:"id,omitempty"`
+	Prompt    string         `json:"prompt,omitempty"`
+	Persona   string         `json:"persona,omitempty"`
+	ChatID    string         `json:"chatId,omitempty"`
+	Vars      map[string]any `json:"vars,omitempty"`
+	Overrides map[string]any `json:"overrides,omitempty"`
+}
+
+// batchResult is a line of the batch output.
+type batchResult struct {
+	Line     int    `json:"line"`
+	ID       string `json:"id,omitempty"`
+	Response string `json:"response"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchJob is a line of the input, prepared to be sent.
+type batchJob struct {
+	line    int
+	id      string
+	persona string
+	chatID  string
+	prompts []string
+	config  *viper.Viper
+	// tokens is the estimate the tokens per minute are limited by
+	tokens int
+}
+
+func newBatchCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *batchCmd {
+	batch := &batchCmd{}
+	cmd := &cobra.Command{
+		Use:   "batch <file>",
+		Short: "Run the prompts of a JSON Lines file concurrently",
+		Long: strings.TrimSpace(`
+Run every line of a JSON Lines file as a completion and write the responses
+as JSON Lines. Use "-" to read the lines from stdin. A line may set:
+
+  id         an identifier copied to the result
+  prompt     the prompt
+  persona    the persona, instead of --persona
+  chatId     a chat session to use or create
+  vars       variables to render --template with, followed by the prompt
+  overrides  config keys to override, e.g. model or temperature
+
+The lines are sent by a pool of workers sharing one client. Lines of the
+same chat session are sent one after another, in the order of the input.
+The requests and tokens per minute can be limited to stay within the rate
+limits of the provider.
+
+The results are written in input order, or as they complete with
+--unordered. With --out, the results file is also the checkpoint: after an
+interruption, --resume skips the lines that already succeeded.
+
+To run the lines with the OpenAI Batch API at half the price, use the
+submit, status, fetch and cancel subcommands.
+`),
+		Example: strings.TrimSpace(`
+sgpt batch prompts.jsonl > results.jsonl
+sgpt batch --persona classify --template "Classify: {{ .text }}" --workers 8 --rpm 500 tickets.jsonl
+sgpt batch --out results.jsonl --resume prompts.jsonl
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			workers := config.GetInt("batch.workers")
+			if workers < 1 {
+				return ErrInvalidBatchWorkers
+			}
+			requestsPerMinute, tokensPerMinute := config.GetInt("batch.requestsPerMinute"), config.GetInt("batch.tokensPerMinute")
+			if requestsPerMinute < 0 || tokensPerMinute < 0 {
+				return ErrInvalidBatchRateLimit
+			}
+			if batch.resume && batch.out == "" {
+				return ErrBatchResumeRequiresOut
+			}
+
+			lines, err := batch.readLines(cmd.InOrStdin(), args[0])
+			if err != nil {
+				return err
+			}
+			var done map[int]bool
+			var kept []byte
+			if batch.resume {
+				done, kept, err = readBatchCheckpoint(batch.out, lines)
+				if err != nil {
+					return err
+				}
+				slog.Debug("Resuming batch", "done", len(done))
+			}
+			var jobs []*batchJob
+			jobs, err = batch.prepareJobs(cmd, config, lines, done)
+			if err != nil {
+				return err
+			}
+
+			var client api.Completer
+			client, err = createClientFn(config, io.Discard)
+			if err != nil {
+				return err
+			}
+			forker, ok := client.(api.Forker)
+			if !ok {
+				return ErrBatchUnsupported
+			}
+
+			out := cmd.OutOrStdout()
+			if batch.out != "" {
+				var file *os.File
+				file, err = openBatchResults(batch.out, batch.resume, kept)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				out = file
+			}
+
+			slog.Debug("Running batch", "lines", len(jobs), "workers", workers)
+			limiter := newRateLimiter(requestsPerMinute, tokensPerMinute, time.Now())
+			writer := newBatchWriter(out, jobs, !batch.unordered)
+			if err = runBatch(cmd.Context(), forker, limiter, workers, groupBatchJobs(jobs), writer); err != nil {
+				return err
+			}
+			if writer.failed > 0 {
+				return fmt.Errorf("%w: %d of %d", ErrBatchFailed, writer.failed, len(jobs))
+			}
+			return nil
+		},
+	}
+	batch.addFlags(cmd, config, createClientFn)
+	cmd.Flags().StringVar(&batch.out, "out", "", "write the results to this file instead of stdout")
+	cmd.Flags().BoolVar(&batch.resume, "resume", false, "skip the lines that already succeeded according to the --out file")
+	cmd.Flags().BoolVar(&batch.unordered, "unordered", false, "write results as they complete instead of in input order")
+
+	var bindErrors []error
+	cmd.Flags().IntP("workers", "w", defaultBatchWorkers, "number of lines sent concurrently")
+	if err := config.BindPFlag("batch.workers", cmd.Flags().Lookup("workers")); err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	cmd.Flags().Int("rpm", 0, "maximum requests per minute, 0 for no limit")
+	if err := config.BindPFlag("batch.requestsPerMinute", cmd.Flags().Lookup("rpm")); err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	cmd.Flags().Int("tpm", 0, "maximum estimated tokens per minute, 0 for no limit")
+	if err := config.BindPFlag("batch.tokensPerMinute", cmd.Flags().Lookup("tpm")); err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	if len(bindErrors) > 0 {
+		for _, err := range bindErrors {
+			slog.Error("Failed to bind flag to viper", "error", err)
+		}
+		panic("Failed to bind batch flags to viper")
+	}
+	_ = cmd.MarkFlagFilename("out", "jsonl")
+	cmd.AddCommand(
+		newBatchSubmitCmd(config, createClientFn),
+		newBatchStatusCmd(config, createClientFn),
+		newBatchFetchCmd(config, createClientFn),
+		newBatchCancelCmd(config, createClientFn),
+	)
+	batch.cmd = cmd
+	return batch
+}
+
+// addFlags adds the flags of the batch input to cmd.
+func (b *batchInput) addFlags(cmd *cobra.Command, config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) {
+	cmd.Flags().StringVar(&b.persona, "persona", "txt", "persona of lines that do not set one")
+	cmd.Flags().StringVarP(&b.model, "model", "m", "", "model of lines that do not override it")
+	cmd.Flags().StringVarP(&b.template, "template", "T", "", "Go template string rendered with the vars of a line as its prompt")
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
+}
+
+// readLines parses the batch input of file, or of stdin if file is "-".
+// Blank lines are skipped; the keys of the returned map are line numbers.
+func (b *batchInput) readLines(stdin io.Reader, file string) (map[int]batchLine, error) {
+	in := stdin
+	if file != "-" {
+		resolved, err := fs.ResolveUnderCwd(file)
+		if err != nil {
+			return nil, err
+		}
+		var f *os.File
+		f, err = os.Open(resolved)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	lines := make(map[int]batchLine)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineSize)
+	for number := 1; scanner.Scan(); number++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line batchLine
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&line); err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidBatchLine, number, err)
+		}
+		lines[number] = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// prepareJobs renders the prompts and the configs of the lines that are not
+// done yet, so that an invalid line fails the batch before anything is sent.
+// The jobs are returned in input order.
+func (b *batchInput) prepareJobs(cmd *cobra.Command, config *viper.Viper, lines map[int]batchLine, done map[int]bool) ([]*batchJob, error) {
+	defaults := make(map[string]any)
+	if cmd.Flags().Changed("model") {
+		defaults["model"] = b.model
+	}
+	personas := make(map[string]modifiers.Persona)
+	counters := make(map[string]*tokens.Counter)
+	var jobs []*batchJob
+	for _, number := range slices.Sorted(maps.Keys(lines)) {
+		if done[number] {
+			continue
+		}
+		line := lines[number]
+		job, err := b.prepareJob(config, line, defaults, personas, counters)
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidBatchLine, number, err)
+		}
+		job.line = number
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (b *batchInput) prepareJob(config *viper.Viper, line batchLine, defaults map[string]any, personas map[string]modifiers.Persona, counters map[string]*tokens.Counter) (*batchJob, error) {
+	var prompts []string
+	switch {
+	case len(line.Vars) > 0 && b.template == "":
+		return nil, ErrBatchVarsWithoutTemplate
+	case len(line.Vars) > 0:
+		rendered, err := renderTemplate(b.template, line.Vars)
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, rendered)
+	case line.Prompt == "":
+		return nil, ErrBatchMissingPrompt
+	}
+	if line.Prompt != "" {
+		prompts = append(prompts, line.Prompt)
+	}
+	for key := range line.Overrides {
+		if key != "model" && !slices.Contains(modifiers.Options, key) {
+			return nil, fmt.Errorf("%w: %q (available: model, %s)", ErrUnknownBatchOverride, key, strings.Join(modifiers.Options, ", "))
+		}
+	}
+
+	name := line.Persona
+	if name == "" {
+		name = b.persona
+	}
+	persona, ok := personas[name]
+	if !ok {
+		var err error
+		persona, err = modifiers.GetPersona(config, name)
+		if err != nil {
+			return nil, err
+		}
+		personas[name] = persona
+	}
+
+	// Settings of the line take precedence over the persona and the flags
+	jobConfig, err := newJobConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, settings := range []map[string]any{defaults, persona.Options, line.Overrides} {
+		for key, value := range settings {
+			jobConfig.Set(key, value)
+		}
+	}
+	// The response is written to the results, so it is neither streamed nor
+	// picked interactively
+	jobConfig.Set("stream", false)
+	jobConfig.Set("pick", false)
+	var configTools []tools.Tool
+	configTools, err = tools.FromConfig(jobConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(configTools) > 0 || len(persona.Tools) > 0 {
+		return nil, ErrBatchTools
+	}
+
+	model := jobConfig.GetString("model")
+	counter, ok := counters[model]
+	if !ok {
+		var err error
+		counter, err = tokens.NewCounter(model)
+		if err != nil {
+			return nil, err
+		}
+		counters[model] = counter
+	}
+	// Like the rate limits of the providers, the estimate reserves the
+	// maximum number of completion tokens
+	estimate := counter.Count(persona.Prompt) + jobConfig.GetInt("maxTokens")
+	for _, prompt := range prompts {
+		estimate += counter.Count(prompt)
+	}
+
+	return &batchJob{
+		id:      line.ID,
+		persona: name,
+		chatID:  line.ChatID,
+		prompts: prompts,
+		config:  jobConfig,
+		tokens:  estimate,
+	}, nil
+}
+
+// newJobConfig returns a copy of config for a line. The settings of config
+// are copied, but the defaults of flags that were not given stay defaults:
+// copied as settings, they would be sent even by providers that only send
+// the options that are set, like the temperature of ollama.
+func newJobConfig(config *viper.Viper) (*viper.Viper, error) {
+	jobConfig := viper.New()
+	settings := config.AllSettings()
+	for key, value := range settings {
+		if !config.IsSet(key) {
+			delete(settings, key)
+			if err := bindFlagDefault(jobConfig, key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return jobConfig, jobConfig.MergeConfigMap(settings)
+}
+
+// bindFlagDefault binds value to key of config as the default of a flag
+// that was not given. The values of nested keys are bound one by one.
+func bindFlagDefault(config *viper.Viper, key string, value any) error {
+	values, ok := value.(map[string]any)
+	if !ok {
+		return config.BindFlagValue(key, flagDefault{name: key, value: value})
+	}
+	for name, nested := range values {
+		if err := bindFlagDefault(config, key+"."+name, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagDefault is a viper.FlagValue of a flag that was not given. viper reads
+// its value, but does not count it as set.
+type flagDefault struct {
+	name  string
+	value any
+}
+
+func (f flagDefault) HasChanged() bool { return false }
+
+func (f flagDefault) Name() string { return f.name }
+
+func (f flagDefault) ValueString() string {
+	if values, ok := f.value.([]string); ok {
+		return "[" + strings.Join(values, ",") + "]"
+	}
+	return fmt.Sprint(f.value)
+}
+
+func (f flagDefault) ValueType() string {
+	switch f.value.(type) {
+	case int:
+		return "int"
+	case bool:
+		return "bool"
+	case []string:
+		return "stringSlice"
+	case float64:
+		return "float64"
+	default:
+		return "string"
+	}
+}
+
+// groupBatchJobs groups the jobs of a chat session, so that they are sent
+// one after another. Every other job is a group on its own. The groups are
+// ordered by their first job.
+func groupBatchJobs(jobs []*batchJob) [][]*batchJob {
+	var groups [][]*batchJob
+	chats := make(map[string]int)
+	for _, job := range jobs {
+		if job.chatID == "" {
+			groups = append(groups, []*batchJob{job})
+			continue
+		}
+		if i, ok := chats[job.chatID]; ok {
+			groups[i] = append(groups[i], job)
+			continue
+		}
+		chats[job.chatID] = len(groups)
+		groups = append(groups, []*batchJob{job})
+	}
+	return groups
+}
+
+// runBatch sends the groups of jobs with a pool of workers and writes the
+// results. Lines interrupted by the cancellation of ctx have no result, so
+// they are sent again on resume.
+func runBatch(ctx context.Context, client api.Forker, limiter *rateLimiter, workers int, groups [][]*batchJob, writer *batchWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan []*batchJob)
+	results := make(chan batchResult)
+	go func() {
+		defer close(queue)
+		for _, group := range groups {
+			select {
+			case queue <- group:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				runBatchGroup(ctx, client, limiter, group, results)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var writeErr error
+	for result := range results {
+		if writeErr != nil {
+			continue
+		}
+		if writeErr = writer.write(result); writeErr != nil {
+			// Stop the workers, but keep draining their results
+			cancel()
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return ctx.Err()
+}
+
+// runBatchGroup sends the jobs of a group one after another. After a failed
+// job of a chat session, the remaining jobs are skipped, as they would
+// continue a conversation without its answer.
+func runBatchGroup(ctx context.Context, client api.Forker, limiter *rateLimiter, group []*batchJob, results chan<- batchResult) {
+	var failed bool
+	for _, job := range group {
+		result := batchResult{Line: job.line, ID: job.id}
+		if failed {
+			result.Error = ErrBatchChatAborted.Error()
+			results <- result
+			continue
+		}
+		if err := limiter.wait(ctx, job.tokens); err != nil {
+			return
+		}
+		response, err := client.Fork(job.config, io.Discard).CreateCompletion(ctx, job.chatID, job.prompts, job.persona, nil)
+		if err != nil && ctx.Err() != nil {
+			slog.Debug("Batch line interrupted", "line", job.line)
+			return
+		}
+		if err != nil {
+			slog.Debug("Batch line failed", "line", job.line, "error", err)
+			result.Error = err.Error()
+			failed = true
+		} else {
+			slog.Debug("Batch line completed", "line", job.line)
+			result.Response = response
+		}
+		results <- result
+	}
+}
+
+// batchWriter writes results as JSON Lines, either as they complete or in
+// the order of the jobs.
+type batchWriter struct {
+	encoder *json.Encoder
+	ordered bool
+	// order lists the lines in input order, next is the index of the first
+	// line without a written result
+	order   []int
+	next    int
+	pending map[int]batchResult
+	failed  int
+}
+
+func newBatchWriter(out io.Writer, jobs []*batchJob, ordered bool) *batchWriter {
+	order := make([]int, len(jobs))
+	for i, job := range jobs {
+		order[i] = job.line
+	}
+	return &batchWriter{
+		encoder: json.NewEncoder(out),
+		ordered: ordered,
+		order:   order,
+		pending: make(map[int]batchResult),
+	}
+}
+
+func (w *batchWriter) write(result batchResult) error {
+	if result.Error != "" {
+		w.failed++
+	}
+	if !w.ordered {
+		return w.encoder.Encode(result)
+	}
+	w.pending[result.Line] = result
+	for w.next < len(w.order) {
+		next, ok := w.pending[w.order[w.next]]
+		if !ok {
+			break
+		}
+		if err := w.encoder.Encode(next); err != nil {
+			return err
+		}
+		delete(w.pending, next.Line)
+		w.next++
+	}
+	return nil
+}
+
+// readBatchCheckpoint returns the lines that succeeded according to the
+// results file path and their results. A missing file is an empty
+// checkpoint. The IDs of the results must match the lines, so that a results
+// file is not resumed with another input.
+func readBatchCheckpoint(path string, lines map[int]batchLine) (map[int]bool, []byte, error) {
+	resolved, err := fs.ResolveUnderCwd(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(resolved)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	done := make(map[int]bool)
+	var kept []byte
+	reader := bufio.NewReader(file)
+	for {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			// An incomplete last line was cut off by the interruption
+			break
+		}
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		if len(data) > maxBatchLineSize {
+			return nil, nil, bufio.ErrTooLong
+		}
+		var result batchResult
+		if err = json.Unmarshal(data, &result); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrBatchCheckpointMismatch, err)
+		}
+		line, ok := lines[result.Line]
+		if !ok || line.ID != result.ID {
+			return nil, nil, fmt.Errorf("%w: line %d", ErrBatchCheckpointMismatch, result.Line)
+		}
+		// Failed lines are sent again, so their results are replaced
+		if result.Error == "" && !done[result.Line] {
+			done[result.Line] = true
+			kept = append(kept, data...)
+		}
+	}
+	return done, kept, nil
+}
+
+// openBatchResults opens the results file path. On resume, the file is
+// replaced by the kept results and new results are appended; otherwise the
+// file is truncated.
+func openBatchResults(path string, resume bool, kept []byte) (*os.File, error) {
+	resolved, err := fs.ResolveUnderCwd(path)
+	if err != nil {
+		return nil, err
+	}
+	if !resume {
+		return os.OpenFile(resolved, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, batchResultsPerm)
+	}
+	// The kept results are written to a new file, which replaces the results
+	// file, so that the checkpoint survives an interruption while writing
+	file, err := os.CreateTemp(filepath.Dir(resolved), "."+filepath.Base(resolved)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(kept); err == nil {
+		if err = file.Chmod(batchResultsPerm); err == nil {
+			err = os.Rename(file.Name(), resolved)
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// rateLimiter spaces requests, so that on average no more than the limits of
+// requests and tokens are sent per minute.
+type rateLimiter struct {
+	mu       sync.Mutex
+	requests rateBucket
+	tokens   rateBucket
+}
+
+// rateBucket is a token bucket holding up to a minute's worth of its limit.
+// A limit of 0 is unlimited.
+type rateBucket struct {
+	perMinute float64
+	available float64
+	last      time.Time
+}
+
+func newRateLimiter(requestsPerMinute, tokensPerMinute int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		requests: rateBucket{perMinute: float64(requestsPerMinute), available: float64(requestsPerMinute), last: now},
+		tokens:   rateBucket{perMinute: float64(tokensPerMinute), available: float64(tokensPerMinute), last: now},
+	}
+}
+
+// wait blocks until a request of tokens is within the limits or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, tokens int) error {
+	l.mu.Lock()
+	now := time.Now()
+	delay := max(l.requests.reserve(now, 1), l.tokens.reserve(now, float64(tokens)))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	slog.Debug("Waiting for the rate limit", "delay", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n from the bucket at now and returns the time until they
+// are available. The reservation is kept, so later requests wait behind it.
+func (b *rateBucket) reserve(now time.Time, n float64) time.Duration {
+	if b.perMinute <= 0 {
+		return 0
+	}
+	b.available = min(b.perMinute, b.available+now.Sub(b.last).Minutes()*b.perMinute)
+	b.last = now
+	// A request above the limit waits for a full minute instead of forever
+	b.available -= min(n, b.perMinute)
+	if b.available >= 0 {
+		return 0
+	}
+	return time.Duration(-b.available / b.perMinute * float64(time.Minute))
+}
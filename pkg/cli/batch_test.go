@@ -0,0 +1,338 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// newBatchTestDir changes into a new working directory holding input as
+// prompts.jsonl and returns the directory.
+func newBatchTestDir(t *testing.T, input string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prompts.jsonl"), []byte(input), 0600))
+	return dir
+}
+
+// runBatchCmd runs the batch command. Every request is answered with its
+// model and its last message, a prompt containing "fail" is rejected.
+func runBatchCmd(t *testing.T, config *viper.Viper, args ...string) (string, []openai.ChatCompletionRequest, int) {
+	t.Helper()
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	client, err := api.CreateClient(config, io.Discard)
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var mu sync.Mutex
+	var requests []openai.ChatCompletionRequest
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions",
+		func(r *http.Request) (*http.Response, error) {
+			var req openai.ChatCompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			requests = append(requests, req)
+			mu.Unlock()
+			prompt := req.Messages[len(req.Messages)-1].Content
+			if strings.Contains(prompt, "fail") {
+				return httpmock.NewStringResponse(400, `{"error":{"message":"rejected","type":"invalid_request_error"}}`), nil
+			}
+			resp := httpmock.NewStringResponse(200, fmt.Sprintf(`{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%q}}]}`, req.Model+": "+prompt))
+			resp.Header.Set("Content-Type", "application/json")
+			return resp, nil
+		})
+
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.cmd.SetOut(&out)
+	root.Execute(append([]string{"batch"}, args...))
+	return out.String(), requests, mem.code
+}
+
+func decodeBatchResults(t *testing.T, out string) []batchResult {
+	t.Helper()
+	var results []batchResult
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		var result batchResult
+		require.NoError(t, decoder.Decode(&result))
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestBatchCmd(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	input := `{"id":"a","prompt":"first"}
+
+{"id":"b","vars":{"text":"second"}}
+{"id":"c","vars":{"text":"third"},"persona":"sh","overrides":{"model":"gpt-4o","temperature":0.5}}
+`
+	newBatchTestDir(t, input)
+	out, requests, code := runBatchCmd(t, testCtx.Config, "--workers", "3", "-m", "gpt-4o-mini", "-T", "Say {{ .text }}", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Len(t, requests, 3)
+
+	// The template is rendered before the prompt of the line
+	require.Equal(t, []batchResult{
+		{Line: 1, ID: "a", Response: "gpt-4o-mini: first"},
+		{Line: 3, ID: "b", Response: "gpt-4o-mini: Say second"},
+		{Line: 4, ID: "c", Response: "gpt-4o: Say third"},
+	}, decodeBatchResults(t, out))
+	for _, req := range requests {
+		if req.Model == "gpt-4o" {
+			require.InDelta(t, 0.5, req.Temperature, 1e-6)
+			require.Equal(t, openai.ChatMessageRoleSystem, req.Messages[0].Role)
+		}
+		require.Nil(t, req.Seed)
+		require.False(t, req.Stream)
+	}
+}
+
+func TestBatchCmdChatSession(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	input := `{"prompt":"hello","chatId":"batch"}
+{"prompt":"single"}
+{"prompt":"again","chatId":"batch"}
+`
+	newBatchTestDir(t, input)
+	out, requests, code := runBatchCmd(t, testCtx.Config, "--unordered", "-w", "4", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Len(t, decodeBatchResults(t, out), 3)
+
+	// The second line of the chat session continues the first one
+	var continued *openai.ChatCompletionRequest
+	for i := range requests {
+		if requests[i].Messages[len(requests[i].Messages)-1].Content == "again" {
+			continued = &requests[i]
+		}
+	}
+	require.NotNil(t, continued)
+	require.Len(t, continued.Messages, 3)
+	require.Equal(t, "hello", continued.Messages[0].Content)
+	require.Equal(t, "gpt-4o-mini: hello", continued.Messages[1].Content)
+}
+
+func TestBatchCmdFailedLines(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	input := `{"prompt":"please fail","chatId":"broken"}
+{"prompt":"works"}
+{"prompt":"follow-up","chatId":"broken"}
+`
+	newBatchTestDir(t, input)
+	out, requests, code := runBatchCmd(t, testCtx.Config, "prompts.jsonl")
+	require.Equal(t, 1, code)
+	// The follow-up is not sent without the answer it builds on
+	require.Len(t, requests, 2)
+
+	results := decodeBatchResults(t, out)
+	require.Len(t, results, 3)
+	require.Contains(t, results[0].Error, "rejected")
+	require.Equal(t, "gpt-4o-mini: works", results[1].Response)
+	require.Empty(t, results[1].Error)
+	require.Equal(t, ErrBatchChatAborted.Error(), results[2].Error)
+}
+
+func TestBatchCmdResume(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	input := `{"id":"a","prompt":"first"}
+{"id":"b","prompt":"second"}
+{"id":"c","prompt":"third"}
+`
+	// The first line succeeded, the second failed and the third was cut off
+	checkpoint := `{"line":1,"id":"a","response":"done"}
+{"line":2,"id":"b","response":"","error":"rate limited"}
+{"line":3,"id":"c","resp`
+	dir := newBatchTestDir(t, input)
+	results := filepath.Join(dir, "results.jsonl")
+	require.NoError(t, os.WriteFile(results, []byte(checkpoint), 0600))
+
+	out, requests, code := runBatchCmd(t, testCtx.Config, "--out", "results.jsonl", "--resume", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Empty(t, out)
+	require.Len(t, requests, 2)
+
+	data, err := os.ReadFile(results)
+	require.NoError(t, err)
+	// The failed result is replaced, so every line has exactly one result
+	require.Equal(t, []batchResult{
+		{Line: 1, ID: "a", Response: "done"},
+		{Line: 2, ID: "b", Response: "gpt-4o-mini: second"},
+		{Line: 3, ID: "c", Response: "gpt-4o-mini: third"},
+	}, decodeBatchResults(t, string(data)))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// A results file of another input is not resumed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prompts.jsonl"), []byte(`{"id":"x","prompt":"first"}`), 0600))
+	_, requests, code = runBatchCmd(t, testlib.NewTestCtx(t).Config, "--out", "results.jsonl", "--resume", "prompts.jsonl")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+}
+
+func TestBatchCmdResumeFailedLine(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	dir := newBatchTestDir(t, `{"id":"a","prompt":"first"}
+{"id":"b","prompt":"please fail"}
+`)
+	_, _, code := runBatchCmd(t, testCtx.Config, "--out", "results.jsonl", "prompts.jsonl")
+	require.Equal(t, 1, code)
+
+	// The failed line is fixed and sent again on resume
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prompts.jsonl"), []byte(`{"id":"a","prompt":"first"}
+{"id":"b","prompt":"second"}
+`), 0600))
+	_, requests, code := runBatchCmd(t, testCtx.Config, "--out", "results.jsonl", "--resume", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Len(t, requests, 1)
+
+	data, err := os.ReadFile(filepath.Join(dir, "results.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, []batchResult{
+		{Line: 1, ID: "a", Response: "gpt-4o-mini: first"},
+		{Line: 2, ID: "b", Response: "gpt-4o-mini: second"},
+	}, decodeBatchResults(t, string(data)))
+}
+
+func TestBatchCmdErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		input string
+		args  []string
+	}{
+		"unknown override":      {`{"prompt":"hi","overrides":{"apiKey":"x"}}`, nil},
+		"unknown field":         {`{"promt":"hi"}`, nil},
+		"missing prompt":        {`{"id":"a"}`, nil},
+		"vars without template": {`{"prompt":"hi","vars":{"a":1}}`, nil},
+		"missing var":           {`{"vars":{"a":1}}`, []string{"-T", "{{ .b }}"}},
+		"unknown persona":       {`{"prompt":"hi","persona":"unknown"}`, nil},
+		"resume without out":    {`{"prompt":"hi"}`, []string{"--resume"}},
+		"no workers":            {`{"prompt":"hi"}`, []string{"-w", "0"}},
+		"negative rate limit":   {`{"prompt":"hi"}`, []string{"--rpm", "-1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			newBatchTestDir(t, tc.input+"\n{\"prompt\":\"valid\"}\n")
+			_, requests, code := runBatchCmd(t, testlib.NewTestCtx(t).Config, append(tc.args, "prompts.jsonl")...)
+			require.Equal(t, 1, code)
+			// Nothing is sent, if a line is invalid
+			require.Empty(t, requests)
+		})
+	}
+
+	newBatchTestDir(t, `{"prompt":"hi"}`)
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"batch", "prompts.jsonl"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestBatchCmdTools(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	persona := "---\ntools:\n  - name: list_files\n    description: List files\n    command: ls\n---\nYou list files."
+	require.NoError(t, os.WriteFile(filepath.Join(testCtx.PersonasDir, "files"), []byte(persona), 0600))
+
+	// Confirmations of tool calls cannot be asked for by the workers
+	newBatchTestDir(t, `{"prompt":"hi"}`+"\n"+`{"prompt":"list","persona":"files"}`)
+	_, requests, code := runBatchCmd(t, testCtx.Config, "prompts.jsonl")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+
+	testCtx = testlib.NewTestCtx(t)
+	testCtx.Config.Set("tools", []map[string]any{{"name": "list_files", "description": "List files", "command": "ls"}})
+	newBatchTestDir(t, `{"prompt":"hi"}`)
+	_, requests, code = runBatchCmd(t, testCtx.Config, "prompts.jsonl")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+}
+
+func TestNewJobConfig(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	newRootCmd(nil, testCtx.Config, nil, nil)
+	testCtx.Config.Set("maxTokens", 100)
+
+	jobConfig, err := newJobConfig(testCtx.Config)
+	require.NoError(t, err)
+	require.Equal(t, 100, jobConfig.GetInt("maxTokens"))
+	// The defaults of the flags are read, but not set
+	require.InDelta(t, 1, jobConfig.GetFloat64("temperature"), 0)
+	require.False(t, jobConfig.IsSet("temperature"))
+	require.Equal(t, api.DefaultModel, jobConfig.GetString("model"))
+	require.False(t, jobConfig.GetBool("cache.enabled"))
+	require.False(t, jobConfig.IsSet("seed"))
+}
+
+func TestBatchWriterOrder(t *testing.T) {
+	var out bytes.Buffer
+	writer := newBatchWriter(&out, []*batchJob{{line: 1}, {line: 2}, {line: 5}}, true)
+	require.NoError(t, writer.write(batchResult{Line: 5, Response: "c"}))
+	require.NoError(t, writer.write(batchResult{Line: 2, Error: "failed"}))
+	require.Empty(t, out.String())
+	require.NoError(t, writer.write(batchResult{Line: 1, Response: "a"}))
+	require.Equal(t, []batchResult{{Line: 1, Response: "a"}, {Line: 2, Error: "failed"}, {Line: 5, Response: "c"}}, decodeBatchResults(t, out.String()))
+	require.Equal(t, 1, writer.failed)
+}
+
+func TestRateBucket(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(60, 1000, start)
+
+	// A full minute's worth is available right away
+	for range 60 {
+		require.Zero(t, limiter.requests.reserve(start, 1))
+	}
+	// Then one request per second
+	require.Equal(t, time.Second, limiter.requests.reserve(start, 1))
+	require.Equal(t, 2*time.Second, limiter.requests.reserve(start, 1))
+	require.Equal(t, time.Second, limiter.requests.reserve(start.Add(2*time.Second), 1))
+
+	// A request above the limit waits a minute at most
+	require.Equal(t, time.Duration(0), limiter.tokens.reserve(start, 500))
+	require.Equal(t, 30*time.Second, limiter.tokens.reserve(start, 5000))
+
+	// Without limit, nothing waits
+	unlimited := newRateLimiter(0, 0, start)
+	require.Zero(t, unlimited.requests.reserve(start, 1))
+	require.Zero(t, unlimited.tokens.reserve(start, 1e9))
+}
@@ -0,0 +1,479 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+const (
+	// batchRecordsDir is the directory of the submitted batches inside the
+	// cache dir. The leading dot keeps it apart from chat sessions.
+	batchRecordsDir = ".batches"
+
+	batchRecordsDirPerm = 0700
+	batchRecordPerm     = 0600
+)
+
+var (
+	// ErrBatchAPIChat is returned, if a line submitted to the Batch API continues a chat session.
+	ErrBatchAPIChat = errors.New("chat sessions cannot be used with the Batch API")
+	// ErrEmptyBatch is returned, if a batch to submit has no lines.
+	ErrEmptyBatch = errors.New("batch input has no lines")
+	// ErrInvalidBatchID is returned, if a batch ID contains characters other than letters, digits, "_" and "-".
+	ErrInvalidBatchID = errors.New("invalid batch ID")
+	// ErrUnknownBatch is returned, if a batch was not submitted with sgpt batch submit.
+	ErrUnknownBatch = errors.New("batch was not submitted by sgpt")
+	// ErrBatchRejected is returned, if the provider failed the batch as a whole.
+	ErrBatchRejected = errors.New("batch failed")
+	// ErrBatchResultMissing is the result of a line the output of the batch has no result for,
+	// e.g. because the batch expired or was cancelled.
+	ErrBatchResultMissing = errors.New("no result in the batch output")
+)
+
+var batchIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// batchRecord is a batch submitted to the Batch API. It maps the requests
+// of the batch back to the lines of the input.
+type batchRecord struct {
+	ID        string            `json:"id"`
+	Input     string            `json:"input"`
+	Submitted time.Time         `json:"submitted"`
+	Lines     []batchRecordLine `json:"lines"`
+	// UsageRecorded is set, once the usage of the results is in the ledger,
+	// so that fetching the results again does not count it twice.
+	UsageRecorded bool `json:"usageRecorded,omitempty"`
+}
+
+// batchRecordLine is a line of a submitted batch input.
+type batchRecordLine struct {
+	CustomID string `json:"customId"`
+	Line     int    `json:"line"`
+	ID       string `json:"id,omitempty"`
+	Persona  string `json:"persona,omitempty"`
+}
+
+func newBatchSubmitCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *cobra.Command {
+	input := &batchInput{}
+	cmd := &cobra.Command{
+		Use:   "submit <file>",
+		Short: "Submit the prompts of a JSON Lines file to the OpenAI Batch API",
+		Long: strings.TrimSpace(`
+Submit every line of a JSON Lines file to the Batch API of OpenAI, which
+answers within 24 hours at half the price. The lines are read like by
+sgpt batch, except that they cannot use chat sessions or tools.
+
+The ID of the batch is printed. It is tracked in the cache dir, so that
+sgpt batch fetch can map the results back to the lines of the input.
+`),
+		Example: strings.TrimSpace(`
+id=$(sgpt batch submit --persona classify --template "Classify: {{ .text }}" tickets.jsonl)
+sgpt batch status "$id"
+sgpt batch fetch --out results.jsonl "$id"
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lines, err := input.readLines(cmd.InOrStdin(), args[0])
+			if err != nil {
+				return err
+			}
+			var jobs []*batchJob
+			jobs, err = input.prepareJobs(cmd, config, lines, nil)
+			if err != nil {
+				return err
+			}
+			if len(jobs) == 0 {
+				return ErrEmptyBatch
+			}
+
+			var client api.Completer
+			client, err = createClientFn(config, io.Discard)
+			if err != nil {
+				return err
+			}
+			forker, isForker := client.(api.Forker)
+			submitter, isSubmitter := client.(api.BatchSubmitter)
+			if !isForker || !isSubmitter {
+				return api.ErrBatchesUnsupported
+			}
+
+			record := batchRecord{Input: args[0]}
+			batchLines := make([]api.BatchLine, 0, len(jobs))
+			for _, job := range jobs {
+				if job.chatID != "" {
+					return fmt.Errorf("%w %d: %w", ErrInvalidBatchLine, job.line, ErrBatchAPIChat)
+				}
+				customID := fmt.Sprintf("line-%d", job.line)
+				fork, ok := forker.Fork(job.config, io.Discard).(api.BatchSubmitter)
+				if !ok {
+					return api.ErrBatchesUnsupported
+				}
+				var line api.BatchLine
+				line, err = fork.NewBatchLine(customID, job.prompts, job.persona)
+				if err != nil {
+					return fmt.Errorf("%w %d: %w", ErrInvalidBatchLine, job.line, err)
+				}
+				batchLines = append(batchLines, line)
+				record.Lines = append(record.Lines, batchRecordLine{CustomID: customID, Line: job.line, ID: job.id, Persona: job.persona})
+			}
+
+			var batch api.Batch
+			batch, err = submitter.SubmitBatch(cmd.Context(), args[0], batchLines)
+			if err != nil {
+				return err
+			}
+			record.ID, record.Submitted = batch.ID, time.Now().UTC()
+			if err = saveBatchRecord(config, record); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), batch.ID)
+			return err
+		},
+	}
+	input.addFlags(cmd, config, createClientFn)
+	return cmd
+}
+
+func newBatchStatusCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status [batch]",
+		Short: "Show the status of submitted batches",
+		Long: strings.TrimSpace(`
+Show the status of a batch submitted to the Batch API, or of all batches
+submitted with sgpt batch submit.
+`),
+		Args: cobra.MaximumNArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		ValidArgsFunction: completeBatchIDs(config),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ids := args
+			if len(ids) == 0 {
+				records, err := listBatchRecords(config)
+				if err != nil {
+					return err
+				}
+				for _, record := range records {
+					ids = append(ids, record.ID)
+				}
+			} else if err := validateBatchID(ids[0]); err != nil {
+				return err
+			}
+			submitter, err := createBatchSubmitter(config, createClientFn)
+			if err != nil {
+				return err
+			}
+			batches := make([]api.Batch, 0, len(ids))
+			for _, id := range ids {
+				var batch api.Batch
+				batch, err = submitter.RetrieveBatch(cmd.Context(), id)
+				if err != nil {
+					return err
+				}
+				batches = append(batches, batch)
+			}
+			return printBatches(cmd.OutOrStdout(), batches)
+		},
+	}
+}
+
+func newBatchFetchCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *cobra.Command {
+	var out string
+	cmd := &cobra.Command{
+		Use:   "fetch <batch>",
+		Short: "Download the results of a submitted batch",
+		Long: strings.TrimSpace(`
+Download the results of a batch that is done and write them like sgpt batch
+does: one JSON object per line of the input, in input order, with the line
+number, the id of the line and the response or the error.
+
+The token usage of the results is recorded in the usage ledger at the
+discounted price of the Batch API, once per batch.
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		ValidArgsFunction: completeBatchIDs(config),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			record, err := loadBatchRecord(config, args[0])
+			if err != nil {
+				return err
+			}
+			var submitter api.BatchSubmitter
+			submitter, err = createBatchSubmitter(config, createClientFn)
+			if err != nil {
+				return err
+			}
+			var batch api.Batch
+			batch, err = submitter.RetrieveBatch(cmd.Context(), record.ID)
+			if err != nil {
+				return err
+			}
+			if batch.Status == api.BatchStatusFailed && len(batch.Errors) > 0 {
+				return fmt.Errorf("%w: %s", ErrBatchRejected, strings.Join(batch.Errors, "; "))
+			}
+			var outputs []api.BatchOutput
+			outputs, err = submitter.BatchOutputs(cmd.Context(), batch)
+			if err != nil {
+				return err
+			}
+
+			results, failed := batchRecordResults(record, outputs)
+			if !record.UsageRecorded {
+				personas := make(map[string]string, len(record.Lines))
+				for _, line := range record.Lines {
+					personas[line.CustomID] = line.Persona
+				}
+				for _, output := range outputs {
+					submitter.RecordBatchUsage(output, personas[output.CustomID])
+				}
+				record.UsageRecorded = true
+				if err = saveBatchRecord(config, record); err != nil {
+					return err
+				}
+			}
+
+			w := cmd.OutOrStdout()
+			if out != "" {
+				var file *os.File
+				file, err = openBatchResults(out, false, nil)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				w = file
+			}
+			encoder := json.NewEncoder(w)
+			for _, result := range results {
+				if err = encoder.Encode(result); err != nil {
+					return err
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%w: %d of %d", ErrBatchFailed, failed, len(results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&out, "out", "", "write the results to this file instead of stdout")
+	_ = cmd.MarkFlagFilename("out", "jsonl")
+	return cmd
+}
+
+func newBatchCancelCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <batch>",
+		Short: "Cancel a submitted batch",
+		Long: strings.TrimSpace(`
+Cancel a batch submitted to the Batch API. Requests that already completed
+are kept and can be downloaded with sgpt batch fetch once the batch is
+cancelled.
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		ValidArgsFunction: completeBatchIDs(config),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateBatchID(args[0]); err != nil {
+				return err
+			}
+			submitter, err := createBatchSubmitter(config, createClientFn)
+			if err != nil {
+				return err
+			}
+			var batch api.Batch
+			batch, err = submitter.CancelBatch(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return printBatches(cmd.OutOrStdout(), []api.Batch{batch})
+		},
+	}
+}
+
+func createBatchSubmitter(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) (api.BatchSubmitter, error) {
+	client, err := createClientFn(config, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	submitter, ok := client.(api.BatchSubmitter)
+	if !ok {
+		return nil, api.ErrBatchesUnsupported
+	}
+	return submitter, nil
+}
+
+// batchRecordResults maps the outputs of a batch to the lines of record and
+// returns the results in input order and the number of failed lines.
+func batchRecordResults(record batchRecord, outputs []api.BatchOutput) ([]batchResult, int) {
+	byCustomID := make(map[string]api.BatchOutput, len(outputs))
+	for _, output := range outputs {
+		byCustomID[output.CustomID] = output
+	}
+	results := make([]batchResult, 0, len(record.Lines))
+	var failed int
+	for _, line := range record.Lines {
+		result := batchResult{Line: line.Line, ID: line.ID}
+		output, ok := byCustomID[line.CustomID]
+		switch {
+		case !ok:
+			result.Error = ErrBatchResultMissing.Error()
+		case output.Error != "":
+			result.Error = output.Error
+		default:
+			result.Response = output.Content
+		}
+		if result.Error != "" {
+			failed++
+		}
+		results = append(results, result)
+	}
+	return results, failed
+}
+
+func printBatches(out io.Writer, batches []api.Batch) error {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(writer, "ID\tSTATUS\tCOMPLETED\tFAILED\tTOTAL\tCREATED"); err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		if _, err := fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%d\t%s\n",
+			batch.ID, batch.Status, batch.Completed, batch.Failed, batch.Total, formatDate(batch.CreatedAt)); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func completeBatchIDs(config *viper.Viper) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		if err := loadViperConfig(config); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		records, err := listBatchRecords(config)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ids := make([]string, 0, len(records))
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		return ids, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+func validateBatchID(id string) error {
+	if !batchIDPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidBatchID, id)
+	}
+	return nil
+}
+
+func batchRecordPath(config *viper.Viper, id string) string {
+	return filepath.Join(config.GetString("cacheDir"), batchRecordsDir, id+".json")
+}
+
+func saveBatchRecord(config *viper.Viper, record batchRecord) error {
+	if err := validateBatchID(record.ID); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path := batchRecordPath(config, record.ID)
+	if err = os.MkdirAll(filepath.Dir(path), batchRecordsDirPerm); err != nil {
+		return err
+	}
+	slog.Debug("Saving batch record", "id", record.ID)
+	return os.WriteFile(path, data, batchRecordPerm)
+}
+
+func loadBatchRecord(config *viper.Viper, id string) (batchRecord, error) {
+	if err := validateBatchID(id); err != nil {
+		return batchRecord{}, err
+	}
+	data, err := os.ReadFile(batchRecordPath(config, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return batchRecord{}, fmt.Errorf("%w: %s", ErrUnknownBatch, id)
+	}
+	if err != nil {
+		return batchRecord{}, err
+	}
+	var record batchRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return batchRecord{}, err
+	}
+	return record, nil
+}
+
+// listBatchRecords returns the submitted batches, oldest first.
+func listBatchRecords(config *viper.Viper) ([]batchRecord, error) {
+	entries, err := os.ReadDir(filepath.Join(config.GetString("cacheDir"), batchRecordsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []batchRecord
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		var record batchRecord
+		record, err = loadBatchRecord(config, id)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Submitted.Before(records[j].Submitted)
+	})
+	return records, nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func createBatchTestClient(config *viper.Viper, out io.Writer) (api.Completer, error) {
+	return api.CreateClient(config, out)
+}
+
+// runBatchAPICmd runs a batch subcommand against the stand-in of the Batch API.
+func runBatchAPICmd(t *testing.T, config *viper.Viper, args ...string) (string, int) {
+	t.Helper()
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, config, mockIsPipedShell(false, nil), createBatchTestClient)
+	root.cmd.SetOut(&out)
+	root.Execute(append([]string{"batch"}, args...))
+	return out.String(), mem.code
+}
+
+func TestBatchSubmitFetch(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := testlib.NewBatchServer(t)
+	respond := server.Respond
+	server.Respond = func(request openai.BatchChatCompletionRequest) (int, string) {
+		if strings.Contains(request.Body.Messages[len(request.Body.Messages)-1].Content, "fail") {
+			return http.StatusBadRequest, `{"error":{"message":"rejected","type":"invalid_request_error"}}`
+		}
+		return respond(request)
+	}
+	dir := newBatchTestDir(t, `{"id":"a","prompt":"first","persona":"sh"}
+
+{"id":"b","vars":{"text":"second"},"overrides":{"model":"gpt-4o"}}
+{"id":"c","prompt":"please fail"}
+`)
+
+	out, code := runBatchAPICmd(t, testCtx.Config, "submit", "-T", "Say {{ .text }}", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Equal(t, "batch_1\n", out)
+	requests := server.Requests()
+	require.Len(t, requests, 3)
+	require.Equal(t, []string{"line-1", "line-3", "line-4"}, []string{requests[0].CustomID, requests[1].CustomID, requests[2].CustomID})
+	require.Equal(t, openai.ChatMessageRoleSystem, requests[0].Body.Messages[0].Role)
+	require.Equal(t, "gpt-4o", requests[1].Body.Model)
+	require.Equal(t, "Say second", requests[1].Body.Messages[0].Content)
+	for _, request := range requests {
+		require.Nil(t, request.Body.Seed)
+	}
+
+	out, code = runBatchAPICmd(t, testCtx.Config, "status")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "ID       STATUS     COMPLETED  FAILED  TOTAL  CREATED\nbatch_1  completed  2          1       3")
+
+	out, code = runBatchAPICmd(t, testCtx.Config, "fetch", "--out", "results.jsonl", "batch_1")
+	require.Equal(t, 1, code)
+	require.Empty(t, out)
+	data, err := os.ReadFile(filepath.Join(dir, "results.jsonl"))
+	require.NoError(t, err)
+	require.Equal(t, []batchResult{
+		{Line: 1, ID: "a", Response: "gpt-4o-mini: first"},
+		{Line: 3, ID: "b", Response: "gpt-4o: Say second"},
+		{Line: 4, ID: "c", Error: "status 400: rejected"},
+	}, decodeBatchResults(t, string(data)))
+
+	// The usage is recorded once, even if the results are fetched again
+	records, err := ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "sh", records[0].Persona)
+	out, code = runBatchAPICmd(t, testCtx.Config, "fetch", "batch_1")
+	require.Equal(t, 1, code)
+	require.Len(t, decodeBatchResults(t, out), 3)
+	records, err = ledger.Read(testCtx.Config)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
+
+func TestBatchCancelCmd(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := testlib.NewBatchServer(t)
+	server.Hold = true
+	newBatchTestDir(t, `{"id":"a","prompt":"first"}`)
+
+	out, code := runBatchAPICmd(t, testCtx.Config, "submit", "prompts.jsonl")
+	require.Equal(t, 0, code)
+	require.Equal(t, "batch_1\n", out)
+
+	// Results are only available once the batch is done
+	_, code = runBatchAPICmd(t, testCtx.Config, "fetch", "batch_1")
+	require.Equal(t, 1, code)
+
+	out, code = runBatchAPICmd(t, testCtx.Config, "cancel", "batch_1")
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "batch_1  cancelled")
+
+	out, code = runBatchAPICmd(t, testCtx.Config, "fetch", "batch_1")
+	require.Equal(t, 1, code)
+	require.Equal(t, []batchResult{{Line: 1, ID: "a", Error: ErrBatchResultMissing.Error()}}, decodeBatchResults(t, out))
+}
+
+func TestBatchAPIErrors(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	server := testlib.NewBatchServer(t)
+
+	newBatchTestDir(t, `{"prompt":"hi","chatId":"session"}`)
+	_, code := runBatchAPICmd(t, testCtx.Config, "submit", "prompts.jsonl")
+	require.Equal(t, 1, code)
+
+	newBatchTestDir(t, "\n")
+	_, code = runBatchAPICmd(t, testCtx.Config, "submit", "prompts.jsonl")
+	require.Equal(t, 1, code)
+	require.Empty(t, server.Requests())
+
+	for _, args := range [][]string{
+		{"fetch", "batch_unknown"},
+		{"fetch", "../config"},
+		{"status", "../config"},
+		{"cancel", "batch_unknown"},
+	} {
+		_, code = runBatchAPICmd(t, testCtx.Config, args...)
+		require.Equal(t, 1, code, args)
+	}
+
+	newBatchTestDir(t, `{"prompt":"hi"}`)
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"batch", "submit", "prompts.jsonl"})
+	require.Equal(t, 1, mem.code)
+}
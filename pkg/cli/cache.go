@@ -0,0 +1,161 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/cache"
+)
+
+type cacheCmd struct {
+	cmd *cobra.Command
+}
+
+type cacheClearCmd struct {
+	cmd *cobra.Command
+}
+
+type cacheStatsCmd struct {
+	cmd *cobra.Command
+}
+
+func newCacheCmd(config *viper.Viper) *cacheCmd {
+	cacheStruct := &cacheCmd{}
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the response cache",
+		Long: strings.TrimSpace(`
+Manage the response cache - show statistics and clear cached responses.
+Responses are only cached if the cache is enabled via --cache or cache.enabled.
+`),
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		ValidArgsFunction:     cobra.NoFileCompletions,
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return cmd.Help()
+		},
+	}
+	cmd.AddCommand(
+		newCacheClearCmd(config).cmd,
+		newCacheStatsCmd(config).cmd,
+	)
+	cacheStruct.cmd = cmd
+	return cacheStruct
+}
+
+func newCacheClearCmd(config *viper.Viper) *cacheClearCmd {
+	cacheClear := &cacheClearCmd{}
+	cmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove all cached responses",
+		Long: strings.TrimSpace(`
+Remove all cached responses.
+`),
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		ValidArgsFunction:     cobra.NoFileCompletions,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			removed, err := cache.New(config).Clear()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(), "Removed %d cached responses\n", removed)
+			return err
+		},
+	}
+	cacheClear.cmd = cmd
+	return cacheClear
+}
+
+func newCacheStatsCmd(config *viper.Viper) *cacheStatsCmd {
+	cacheStats := &cacheStatsCmd{}
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show statistics of the response cache",
+		Long: strings.TrimSpace(`
+Show the number and size of cached responses and the configured limits.
+`),
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		ValidArgsFunction:     cobra.NoFileCompletions,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			stats, err := cache.New(config).Stats()
+			if err != nil {
+				return err
+			}
+			writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			rows := [][2]string{
+				{"Enabled", fmt.Sprint(cache.Enabled(config))},
+				{"Entries", fmt.Sprintf("%d (%d expired)", stats.Entries, stats.Expired)},
+				{"Size", formatLimit(formatBytes(stats.Size), formatBytes(stats.MaxSize), stats.MaxSize > 0)},
+				{"TTL", formatLimit("", stats.TTL.String(), stats.TTL > 0)},
+			}
+			if stats.Entries > 0 {
+				rows = append(rows,
+					[2]string{"Oldest", stats.Oldest.Local().Format(time.DateTime)},
+					[2]string{"Newest", stats.Newest.Local().Format(time.DateTime)},
+				)
+			}
+			for _, row := range rows {
+				if _, err = fmt.Fprintf(writer, "%s:\t%s\n", row[0], row[1]); err != nil {
+					return err
+				}
+			}
+			return writer.Flush()
+		},
+	}
+	cacheStats.cmd = cmd
+	return cacheStats
+}
+
+// formatLimit renders value together with its limit, or "unlimited".
+func formatLimit(value, limit string, isLimited bool) string {
+	if !isLimited {
+		limit = "unlimited"
+	}
+	if value == "" {
+		return limit
+	}
+	return value + " of " + limit
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/cache"
+)
+
+func TestCacheCmdStatsAndClear(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	responses := cache.New(testCtx.Config)
+	require.NoError(t, responses.Put("key", cache.Entry{Message: openai.ChatCompletionMessage{Content: "Hi"}}))
+
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"cache", "stats"})
+	require.Equal(t, 0, mem.code)
+	require.Contains(t, out.String(), "Enabled:  false\n")
+	require.Contains(t, out.String(), "Entries:  1 (0 expired)\n")
+	require.Contains(t, out.String(), "of 100.0 MiB\n")
+
+	out.Reset()
+	root = newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"cache", "clear"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "Removed 1 cached responses\n", out.String())
+
+	stats, err := responses.Stats()
+	require.NoError(t, err)
+	require.Zero(t, stats.Entries)
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "512 B", formatBytes(512))
+	require.Equal(t, "1.5 KiB", formatBytes(1536))
+	require.Equal(t, "100.0 MiB", formatBytes(100<<20))
+}
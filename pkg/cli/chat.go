@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 
 	chat2 "github.com/tbckr/sgpt/v2/pkg/chat"
@@ -151,7 +152,14 @@ Show the conversation for the given chat session.
 			if err != nil {
 				return err
 			}
-			return showConversation(cmd.OutOrStdout(), messages)
+			var metadata chat2.Metadata
+			if store, ok := chatSessionManager.(chat2.MetadataStore); ok {
+				metadata, err = store.GetMetadata(sessionName)
+				if err != nil {
+					return err
+				}
+			}
+			return showConversation(cmd.OutOrStdout(), messages, metadata)
 		},
 	}
 	show.cmd = cmd
@@ -197,11 +205,40 @@ Remove the specified chat session. The --all flag removes all chat sessions.
 	return rm
 }
 
-func showConversation(out io.Writer, messages []openai.ChatCompletionMessage) error {
-	for _, message := range messages {
-		if _, err := fmt.Fprintf(out, "%s%s:%s %s\n", chatRoleFormat, message.Role, resetFormat,
-			message.Content); err != nil {
-			return err
+// showConversation prints the messages of a chat session. Answers are labeled
+// with the model that answered them, if metadata records it, and as truncated,
+// if they were interrupted.
+func showConversation(out io.Writer, messages []openai.ChatCompletionMessage, metadata chat2.Metadata) error {
+	// Tool results only reference their call by ID
+	toolNames := make(map[string]string)
+	for i, message := range messages {
+		role := message.Role
+		if message.Role == openai.ChatMessageRoleTool {
+			role = fmt.Sprintf("%s (%s)", message.Role, toolNames[message.ToolCallID])
+		} else {
+			var labels []string
+			if model := metadata.Models[i]; model != "" {
+				labels = append(labels, model)
+			}
+			if slices.Contains(metadata.Truncated, i) {
+				labels = append(labels, "truncated")
+			}
+			if len(labels) > 0 {
+				role = fmt.Sprintf("%s (%s)", message.Role, strings.Join(labels, ", "))
+			}
+		}
+		if message.Content != "" || len(message.ToolCalls) == 0 {
+			if _, err := fmt.Fprintf(out, "%s%s:%s %s\n", chatRoleFormat, role, resetFormat,
+				message.Content); err != nil {
+				return err
+			}
+		}
+		for _, call := range message.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+			if _, err := fmt.Fprintf(out, "%s%s:%s calls %s %s\n", chatRoleFormat, role, resetFormat,
+				call.Function.Name, call.Function.Arguments); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -25,6 +25,7 @@ import (
 	"bytes"
 	"io"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -185,6 +186,26 @@ func TestChatCmdShowSession(t *testing.T) {
 	wg.Wait()
 }
 
+func TestShowConversationToolMessages(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "What is in notes.txt?"},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{
+			ID:       "call_1",
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "read_file", Arguments: `{"path":"notes.txt"}`},
+		}}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "call_1", Content: "buy milk"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "You need to buy milk."},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, showConversation(&buf, messages, chat.Metadata{}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, chatRoleFormat+"assistant:"+resetFormat+` calls read_file {"path":"notes.txt"}`, lines[1])
+	require.Equal(t, chatRoleFormat+"tool (read_file):"+resetFormat+" buy milk", lines[2])
+}
+
 func TestChatCmdShowSessionMissingName(t *testing.T) {
 	testCtx := testlib.NewTestCtx(t)
 	mem := &exitMemento{}
@@ -330,3 +351,21 @@ func createTestMessages() []openai.ChatCompletionMessage {
 		},
 	}
 }
+
+func TestShowConversationModels(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "Say: Hi"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "Hi"},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, showConversation(&buf, messages, chat.Metadata{Models: map[int]string{1: "gpt-4o-mini"}}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, chatRoleFormat+"user:"+resetFormat+" Say: Hi", lines[0])
+	require.Equal(t, chatRoleFormat+"assistant (gpt-4o-mini):"+resetFormat+" Hi", lines[1])
+
+	buf.Reset()
+	require.NoError(t, showConversation(&buf, messages, chat.Metadata{Models: map[int]string{1: "gpt-4o-mini"}, Truncated: []int{1}}))
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, chatRoleFormat+"assistant (gpt-4o-mini, truncated):"+resetFormat+" Hi", lines[1])
+}
@@ -83,3 +83,19 @@ func TestCheckCmdInsecureAPIBaseFlag(t *testing.T) {
 	}).Execute([]string{"--insecure-api-base", "check"})
 	require.Equal(t, 0, memOK.code)
 }
+
+func TestCheckCmdProviderFlag(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	t.Setenv("ANTHROPIC_API_KEY", "test")
+	createClient := func(v *viper.Viper, w io.Writer) (api.Completer, error) {
+		return api.NewCompleter(v, w)
+	}
+
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), createClient).Execute([]string{"--provider", "anthropic", "check"})
+	require.Equal(t, 0, mem.code)
+
+	memUnknown := &exitMemento{}
+	newRootCmd(memUnknown.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), createClient).Execute([]string{"--provider", "nope", "check"})
+	require.Equal(t, 1, memUnknown.code)
+}
@@ -94,6 +94,12 @@ func newConfigShowCmd(config *viper.Viper) *configShowCmd {
 			if err != nil {
 				return err
 			}
+			// A YAML comment keeps the output a valid config file
+			if profile := activeProfile(config); profile != "" {
+				if _, err = fmt.Fprintf(cmd.OutOrStdout(), "# active profile: %s\n", profile); err != nil {
+					return err
+				}
+			}
 			_, err = fmt.Fprint(cmd.OutOrStdout(), string(data))
 			return err
 		},
@@ -48,13 +48,14 @@ func TestConfigCmdInit(t *testing.T) {
 	require.Equal(t, 0, mem.code)
 
 	require.FileExists(t, filepath.Join(testCtx.ConfigDir, "config.yaml"))
-	// config must only contain values for model, maxtokens, temperature, topp
+	// config contains the defaults of the flags bound to config and the
+	// settings of the test context, including TESTING
 	require.NoError(t, testCtx.Config.ReadInConfig())
-	// TESTING may be in the config, because this is a test
-	require.Equal(t, 9, len(testCtx.Config.AllSettings()))
-	for _, key := range []string{"model", "maxtokens", "temperature", "topp", "cachedir", "personas", "stream", "insecureapibase", "testing"} {
+	for _, key := range []string{"model", "maxtokens", "temperature", "topp", "cachedir", "personas", "stream", "insecureapibase", "provider", "jsonmode", "jsonschema", "schemaretries", "cache", "profile", "header", "embeddings", "images", "speech", "presencepenalty", "frequencypenalty", "n", "pick", "stop", "logitbias", "logprobs", "toplogprobs", "output", "reasoningeffort", "showreasoning", "batch", "testing"} {
 		require.Contains(t, testCtx.Config.AllSettings(), key)
 	}
+	// 0 is a valid seed, so an unset seed is not written
+	require.NotContains(t, testCtx.Config.AllSettings(), "seed")
 }
 
 func TestConfigCmdInitAlreadyExists(t *testing.T) {
@@ -0,0 +1,273 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+const (
+	outputJSONL  = "jsonl"
+	outputCSV    = "csv"
+	outputBinary = "binary"
+)
+
+var (
+	// ErrUnknownEmbedOutputFormat is returned, if the output format of the embed command is not supported.
+	ErrUnknownEmbedOutputFormat = fmt.Errorf("output format must be %s, %s or %s", outputJSONL, outputCSV, outputBinary)
+	// ErrNoEmbedInput is returned, if neither args, files nor piped input provide text to embed.
+	ErrNoEmbedInput = errors.New("no input to embed; pass text as args, files via --file or pipe it")
+)
+
+type embedCmd struct {
+	cmd        *cobra.Command
+	files      []string
+	lines      bool
+	dimensions int
+	batchSize  int
+	output     string
+}
+
+// embedInput is a text to embed and where it came from.
+type embedInput struct {
+	source string
+	text   string
+}
+
+// embedRecord is a line of the jsonl output.
+type embedRecord struct {
+	Index     int       `json:"index"`
+	Source    string    `json:"source"`
+	Embedding []float32 `json:"embedding"`
+}
+
+func newEmbedCmd(config *viper.Viper, isPipedShell func() (bool, error), createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *embedCmd {
+	embed := &embedCmd{}
+	cmd := &cobra.Command{
+		Use:   "embed [text]...",
+		Short: "Create embeddings for text from args, files or stdin",
+		Long: strings.TrimSpace(`
+Create embeddings with the configured provider. Every arg, every file given
+via --file and the piped input are embedded as one text each; with --lines,
+every non-empty line of files and piped input is embedded on its own.
+
+Inputs are sent in batches that respect the limits of the API. Embeddings
+are written in input order as JSON Lines, CSV or raw little-endian float32
+values.
+`),
+		Example: strings.TrimSpace(`
+sgpt embed "How do I reset my password?"
+cat faq.txt | sgpt embed --lines -o csv > faq.csv
+sgpt embed -f docs/intro.md -f docs/setup.md -o binary > docs.f32
+`),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if embed.output != outputJSONL && embed.output != outputCSV && embed.output != outputBinary {
+				return ErrUnknownEmbedOutputFormat
+			}
+			isPiped, err := isPipedShell()
+			if err != nil {
+				return err
+			}
+			var inputs []embedInput
+			inputs, err = embed.collectInputs(cmd.InOrStdin(), isPiped, args)
+			if err != nil {
+				return err
+			}
+			if len(inputs) == 0 {
+				return ErrNoEmbedInput
+			}
+
+			var client api.Completer
+			client, err = createClientFn(config, io.Discard)
+			if err != nil {
+				return err
+			}
+			embedder, ok := client.(api.Embedder)
+			if !ok {
+				return api.ErrEmbeddingsUnsupported
+			}
+			texts := make([]string, len(inputs))
+			for i, input := range inputs {
+				texts[i] = input.text
+			}
+			var embeddings [][]float32
+			embeddings, err = embedder.CreateEmbeddings(cmd.Context(), api.EmbeddingRequest{
+				Model:      config.GetString("embeddings.model"),
+				Inputs:     texts,
+				Dimensions: embed.dimensions,
+				BatchSize:  embed.batchSize,
+			})
+			if err != nil {
+				return err
+			}
+			return embed.write(cmd.OutOrStdout(), inputs, embeddings)
+		},
+	}
+	cmd.Flags().StringSliceVarP(&embed.files, "file", "f", nil, "embed the content of a file in the working directory")
+	cmd.Flags().BoolVar(&embed.lines, "lines", false, "embed every non-empty line of files and piped input separately")
+	cmd.Flags().StringP("model", "m", api.DefaultEmbeddingModel, "embedding model name")
+	cmd.Flags().IntVar(&embed.dimensions, "dimensions", 0, "shorten the embeddings to this many dimensions, if the model supports it")
+	cmd.Flags().IntVar(&embed.batchSize, "batch-size", api.MaxEmbeddingBatchSize, "maximum number of inputs per request")
+	cmd.Flags().StringVarP(&embed.output, "output", "o", outputJSONL, "output format (jsonl, csv, binary)")
+	if err := config.BindPFlag("embeddings.model", cmd.Flags().Lookup("model")); err != nil {
+		panic("Failed to bind embed model flag to viper")
+	}
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
+	_ = cmd.RegisterFlagCompletionFunc("output", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputJSONL, outputCSV, outputBinary}, cobra.ShellCompDirectiveNoFileComp
+	})
+	embed.cmd = cmd
+	return embed
+}
+
+// collectInputs returns the texts to embed in the order args, files, stdin.
+func (e *embedCmd) collectInputs(stdin io.Reader, isPiped bool, args []string) ([]embedInput, error) {
+	var inputs []embedInput
+	for i, arg := range args {
+		if strings.TrimSpace(arg) != "" {
+			inputs = append(inputs, embedInput{source: "arg:" + strconv.Itoa(i+1), text: arg})
+		}
+	}
+	for _, file := range e.files {
+		// Reject paths outside the working directory like --input, so a
+		// file list from an untrusted source cannot send e.g. ~/.ssh to the API.
+		resolved, err := fs.ResolveUnderCwd(file)
+		if err != nil {
+			return nil, err
+		}
+		var f *os.File
+		f, err = os.Open(resolved)
+		if err != nil {
+			return nil, err
+		}
+		var content string
+		content, err = fs.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		inputs = append(inputs, e.split(file, content)...)
+	}
+	if isPiped {
+		content, err := fs.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, e.split("stdin", content)...)
+	}
+	return inputs, nil
+}
+
+// split returns content as a single input, or one input per non-empty line
+// with --lines. Empty inputs are skipped, because the API rejects them.
+func (e *embedCmd) split(source, content string) []embedInput {
+	if !e.lines {
+		if strings.TrimSpace(content) == "" {
+			return nil
+		}
+		return []embedInput{{source: source, text: strings.TrimRight(content, "\r\n")}}
+	}
+	var inputs []embedInput
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		inputs = append(inputs, embedInput{source: source + ":" + strconv.Itoa(i+1), text: line})
+	}
+	return inputs
+}
+
+func (e *embedCmd) write(out io.Writer, inputs []embedInput, embeddings [][]float32) error {
+	w := bufio.NewWriter(out)
+	var err error
+	switch e.output {
+	case outputCSV:
+		err = writeEmbeddingsCSV(w, inputs, embeddings)
+	case outputBinary:
+		// Raw little-endian float32 values without a header, ready for
+		// e.g. numpy.fromfile(path, dtype="<f4").reshape(-1, dimensions)
+		for _, embedding := range embeddings {
+			if err = binary.Write(w, binary.LittleEndian, embedding); err != nil {
+				break
+			}
+		}
+	default:
+		encoder := json.NewEncoder(w)
+		for i, embedding := range embeddings {
+			if err = encoder.Encode(embedRecord{Index: i, Source: inputs[i].source, Embedding: embedding}); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeEmbeddingsCSV writes one row per embedding with the index, the source
+// and one column per dimension.
+func writeEmbeddingsCSV(out io.Writer, inputs []embedInput, embeddings [][]float32) error {
+	w := csv.NewWriter(out)
+	dimensions := 0
+	if len(embeddings) > 0 {
+		dimensions = len(embeddings[0])
+	}
+	header := []string{"index", "source"}
+	for i := range dimensions {
+		header = append(header, "e"+strconv.Itoa(i))
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for i, embedding := range embeddings {
+		row := []string{strconv.Itoa(i), inputs[i].source}
+		for _, value := range embedding {
+			row = append(row, strconv.FormatFloat(float64(value), 'g', -1, 32))
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// fakeEmbedder returns an embedding of the input length and its position for every input.
+type fakeEmbedder struct {
+	completerOnly
+	requests *[]api.EmbeddingRequest
+}
+
+func (f fakeEmbedder) CreateEmbeddings(_ context.Context, req api.EmbeddingRequest) ([][]float32, error) {
+	*f.requests = append(*f.requests, req)
+	embeddings := make([][]float32, len(req.Inputs))
+	for i, input := range req.Inputs {
+		embeddings[i] = []float32{float32(len(input)), float32(i) + 0.5}
+	}
+	return embeddings, nil
+}
+
+func runEmbedCmd(t *testing.T, config *viper.Viper, isPiped bool, stdin string, args ...string) (string, []api.EmbeddingRequest, int) {
+	t.Helper()
+	var requests []api.EmbeddingRequest
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, config, mockIsPipedShell(isPiped, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return fakeEmbedder{requests: &requests}, nil
+	})
+	root.cmd.SetIn(strings.NewReader(stdin))
+	root.cmd.SetOut(&out)
+	root.Execute(append([]string{"embed"}, args...))
+	return out.String(), requests, mem.code
+}
+
+func TestEmbedCmdArgs(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+
+	out, requests, code := runEmbedCmd(t, testCtx.Config, false, "", "hello", "hi", "--dimensions", "2")
+	require.Equal(t, 0, code)
+	require.Equal(t, `{"index":0,"source":"arg:1","embedding":[5,0.5]}
+{"index":1,"source":"arg:2","embedding":[2,1.5]}
+`, out)
+	require.Len(t, requests, 1)
+	require.Equal(t, api.DefaultEmbeddingModel, requests[0].Model)
+	require.Equal(t, []string{"hello", "hi"}, requests[0].Inputs)
+	require.Equal(t, 2, requests[0].Dimensions)
+	require.Equal(t, api.MaxEmbeddingBatchSize, requests[0].BatchSize)
+}
+
+func TestEmbedCmdModel(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("embeddings.model", "nomic-embed-text")
+
+	_, requests, code := runEmbedCmd(t, testCtx.Config, false, "", "hello")
+	require.Equal(t, 0, code)
+	require.Equal(t, "nomic-embed-text", requests[0].Model)
+
+	_, requests, code = runEmbedCmd(t, testlib.NewTestCtx(t).Config, false, "", "-m", "text-embedding-3-large", "hello")
+	require.Equal(t, 0, code)
+	require.Equal(t, "text-embedding-3-large", requests[0].Model)
+}
+
+func TestEmbedCmdStdinLines(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+
+	out, requests, code := runEmbedCmd(t, testCtx.Config, true, "first\n\nthird\r\n", "--lines", "-o", "csv")
+	require.Equal(t, 0, code)
+	require.Equal(t, []string{"first", "third"}, requests[0].Inputs)
+	require.Equal(t, "index,source,e0,e1\n0,stdin:1,5,0.5\n1,stdin:3,5,1.5\n", out)
+}
+
+func TestEmbedCmdFiles(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha\n"), 0600))
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(outside, []byte("secret"), 0600))
+
+	out, requests, code := runEmbedCmd(t, testCtx.Config, false, "", "-f", "a.txt", "-o", "binary")
+	require.Equal(t, 0, code)
+	require.Equal(t, []string{"alpha"}, requests[0].Inputs)
+	values := make([]float32, 2)
+	require.NoError(t, binary.Read(strings.NewReader(out), binary.LittleEndian, values))
+	require.Equal(t, []float32{5, 0.5}, values)
+
+	_, requests, code = runEmbedCmd(t, testlib.NewTestCtx(t).Config, false, "", "-f", outside)
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+}
+
+func TestEmbedCmdErrors(t *testing.T) {
+	_, _, code := runEmbedCmd(t, testlib.NewTestCtx(t).Config, false, "")
+	require.Equal(t, 1, code)
+
+	_, _, code = runEmbedCmd(t, testlib.NewTestCtx(t).Config, false, "", "-o", "xml", "hello")
+	require.Equal(t, 1, code)
+
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"embed", "hello"})
+	require.Equal(t, 1, mem.code)
+}
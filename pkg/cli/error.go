@@ -25,6 +25,14 @@ import "errors"
 
 var ErrMissingInput = errors.New("no input prompt provided")
 
+// exitCodeInvalidOutput is the exit code if a structured output response
+// does not validate, so scripts can tell it apart from other failures.
+const exitCodeInvalidOutput = 3
+
+// exitCodeInterrupted is the exit code after Ctrl-C, 128 plus the number of
+// SIGINT as in shells.
+const exitCodeInterrupted = 130
+
 type exitError struct {
 	err     error
 	code    int
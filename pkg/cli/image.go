@@ -0,0 +1,209 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+const (
+	// maxImageFilePrefix limits the part of the file name derived from the prompt.
+	maxImageFilePrefix = 40
+	imageFilePerm      = 0644
+	imageDirPerm       = 0755
+)
+
+// ErrInvalidImageCount is returned, if fewer than one image is requested.
+var ErrInvalidImageCount = errors.New("count must be at least 1")
+
+// imageExtensions maps the sniffed content type of generated images to file extensions.
+var imageExtensions = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/webp": "webp",
+}
+
+type imageCmd struct {
+	cmd       *cobra.Command
+	size      string
+	quality   string
+	count     int
+	outputDir string
+}
+
+func newImageCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *imageCmd {
+	image := &imageCmd{}
+	cmd := &cobra.Command{
+		Use:   "image <prompt>",
+		Short: "Generate images from a prompt",
+		Long: strings.TrimSpace(`
+Generate images with the configured provider and write them as files into the
+output directory, which must be inside the working directory. Files are named
+after the prompt and never overwrite existing files. The paths of the written
+files are printed.
+`),
+		Example: strings.TrimSpace(`
+sgpt image "a watercolor fox in the snow"
+sgpt image --size 1792x1024 --quality hd -n 2 -d images "a lighthouse at dusk"
+`),
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if image.count < 1 {
+				return ErrInvalidImageCount
+			}
+			// Check the output directory before paying for the images
+			dir, err := fs.ResolveUnderCwd(image.outputDir)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(dir, imageDirPerm); err != nil {
+				return err
+			}
+
+			var client api.Completer
+			client, err = createClientFn(config, io.Discard)
+			if err != nil {
+				return err
+			}
+			generator, ok := client.(api.ImageGenerator)
+			if !ok {
+				return api.ErrImagesUnsupported
+			}
+			var images []api.Image
+			images, err = generator.CreateImages(cmd.Context(), api.ImageRequest{
+				Model:   config.GetString("images.model"),
+				Prompt:  args[0],
+				Size:    image.size,
+				Quality: image.quality,
+				Count:   image.count,
+			})
+			if err != nil {
+				return err
+			}
+			prefix := imageFilePrefix(args[0])
+			for _, generated := range images {
+				var path string
+				path, err = writeImage(dir, prefix, generated.Data)
+				if err != nil {
+					return err
+				}
+				if generated.RevisedPrompt != "" {
+					slog.Debug("Prompt revised by the model", "file", path, "prompt", generated.RevisedPrompt)
+				}
+				if _, err = fmt.Fprintln(cmd.OutOrStdout(), filepath.Join(image.outputDir, filepath.Base(path))); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringP("model", "m", api.DefaultImageModel, "image model name")
+	cmd.Flags().StringVar(&image.size, "size", "", "image size, e.g. 1024x1024 (default of the model if empty)")
+	cmd.Flags().StringVar(&image.quality, "quality", "", "image quality, e.g. standard, hd, low, medium or high (default of the model if empty)")
+	cmd.Flags().IntVarP(&image.count, "count", "n", 1, "number of images")
+	cmd.Flags().StringVarP(&image.outputDir, "output-dir", "d", ".", "directory the images are written to, inside the working directory")
+	if err := config.BindPFlag("images.model", cmd.Flags().Lookup("model")); err != nil {
+		panic("Failed to bind image model flag to viper")
+	}
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
+	_ = cmd.RegisterFlagCompletionFunc("size", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{
+			openai.CreateImageSize256x256, openai.CreateImageSize512x512, openai.CreateImageSize1024x1024,
+			openai.CreateImageSize1792x1024, openai.CreateImageSize1024x1792,
+			openai.CreateImageSize1536x1024, openai.CreateImageSize1024x1536,
+		}, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = cmd.RegisterFlagCompletionFunc("quality", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{
+			openai.CreateImageQualityStandard, openai.CreateImageQualityHD,
+			openai.CreateImageQualityLow, openai.CreateImageQualityMedium, openai.CreateImageQualityHigh,
+		}, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = cmd.RegisterFlagCompletionFunc("output-dir", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	})
+	image.cmd = cmd
+	return image
+}
+
+// imageFilePrefix derives a file name from the first words of prompt, e.g.
+// "a-watercolor-fox-in-the-snow".
+func imageFilePrefix(prompt string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(prompt) {
+		if sb.Len() >= maxImageFilePrefix {
+			break
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	if sb.Len() == 0 {
+		return "image"
+	}
+	return sb.String()
+}
+
+// writeImage writes data to the next free file prefix-N.<ext> in dir. The
+// extension follows the sniffed content type; data that is no image, like
+// an error page, is rejected.
+func writeImage(dir, prefix string, data []byte) (string, error) {
+	ext, ok := imageExtensions[http.DetectContentType(data)]
+	if !ok {
+		return "", fs.ErrNotImage
+	}
+	f, err := fs.CreateNumberedUnderCwd(dir, prefix, ext, imageFilePerm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
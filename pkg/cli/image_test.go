@@ -0,0 +1,137 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// pngHeader is enough for content sniffing to detect a PNG.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+// fakeImageGenerator returns data for every requested image.
+type fakeImageGenerator struct {
+	completerOnly
+	data     []byte
+	requests *[]api.ImageRequest
+}
+
+func (f fakeImageGenerator) CreateImages(_ context.Context, req api.ImageRequest) ([]api.Image, error) {
+	*f.requests = append(*f.requests, req)
+	images := make([]api.Image, req.Count)
+	for i := range images {
+		images[i] = api.Image{Data: f.data}
+	}
+	return images, nil
+}
+
+func runImageCmd(t *testing.T, data []byte, args ...string) (string, []api.ImageRequest, int) {
+	t.Helper()
+	var requests []api.ImageRequest
+	mem := &exitMemento{}
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return fakeImageGenerator{data: data, requests: &requests}, nil
+	})
+	root.cmd.SetOut(&out)
+	root.Execute(append([]string{"image"}, args...))
+	return out.String(), requests, mem.code
+}
+
+func TestImageCmd(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a-watercolor-fox-1.png"), nil, 0600))
+
+	out, requests, code := runImageCmd(t, pngHeader, "-n", "2", "--size", "1024x1024", "--quality", "hd", "A watercolor fox!")
+	require.Equal(t, 0, code)
+	require.Equal(t, "a-watercolor-fox-2.png\na-watercolor-fox-3.png\n", out)
+	require.Equal(t, []api.ImageRequest{{
+		Model:   api.DefaultImageModel,
+		Prompt:  "A watercolor fox!",
+		Size:    "1024x1024",
+		Quality: "hd",
+		Count:   2,
+	}}, requests)
+	data, err := os.ReadFile(filepath.Join(dir, "a-watercolor-fox-3.png"))
+	require.NoError(t, err)
+	require.Equal(t, pngHeader, data)
+	// The existing file is left untouched
+	data, err = os.ReadFile(filepath.Join(dir, "a-watercolor-fox-1.png"))
+	require.NoError(t, err)
+	require.Empty(t, data)
+}
+
+func TestImageCmdOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	out, _, code := runImageCmd(t, pngHeader, "-d", filepath.Join("images", "foxes"), "fox")
+	require.Equal(t, 0, code)
+	require.Equal(t, filepath.Join("images", "foxes", "fox-1.png")+"\n", out)
+	require.FileExists(t, filepath.Join(dir, "images", "foxes", "fox-1.png"))
+
+	// Directories outside the working directory are rejected before any request
+	_, requests, code := runImageCmd(t, pngHeader, "-d", t.TempDir(), "fox")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+}
+
+func TestImageCmdRejectsNonImage(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	_, _, code := runImageCmd(t, []byte("<html>error</html>"), "fox")
+	require.Equal(t, 1, code)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestImageCmdUnsupported(t *testing.T) {
+	t.Chdir(t.TempDir())
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"image", "fox"})
+	require.Equal(t, 1, mem.code)
+
+	_, _, code := runImageCmd(t, pngHeader, "-n", "0", "fox")
+	require.Equal(t, 1, code)
+}
+
+func TestImageFilePrefix(t *testing.T) {
+	require.Equal(t, "a-watercolor-fox-in-the-snow", imageFilePrefix("A watercolor fox, in the snow."))
+	require.Equal(t, "image", imageFilePrefix("🦊 ../"))
+	require.Equal(t, "caf-au-lait", imageFilePrefix("café au lait"))
+	require.LessOrEqual(t, len(imageFilePrefix("a very long prompt that goes on and on and on and on")), maxImageFilePrefix+1)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// interruptedClient answers like a stream that was interrupted, once the
+// context of the command is cancelled.
+type interruptedClient struct{}
+
+func (interruptedClient) CreateCompletion(ctx context.Context, _ string, _ []string, _ string, _ []string) (string, error) {
+	if ctx.Err() == nil {
+		return "Hello World!", nil
+	}
+	return "Hello", fmt.Errorf("%w: %w", api.ErrInterrupted, ctx.Err())
+}
+
+func TestRootCmd_InterruptedExitCode(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return interruptedClient{}, nil
+	})
+	root.cmd.SetOut(io.Discard)
+	root.cmd.SetErr(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	root.ExecuteContext(ctx, []string{"Say: Hello World!"})
+	require.Equal(t, exitCodeInterrupted, mem.code)
+}
+
+func TestNotifyInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sending an interrupt is not supported on Windows")
+	}
+	exited := make(chan int, 1)
+	ctx, stop := notifyInterrupt(context.Background(), func(code int) {
+		exited <- code
+	})
+	defer stop()
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+
+	// The first interrupt cancels the context
+	require.NoError(t, process.Signal(os.Interrupt))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled")
+	}
+	require.Empty(t, exited)
+
+	// The second interrupt aborts
+	require.NoError(t, process.Signal(os.Interrupt))
+	select {
+	case code := <-exited:
+		require.Equal(t, exitCodeInterrupted, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("second interrupt did not abort")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+)
+
+// modelCompletionTimeout bounds the request for --model completions, so a slow
+// endpoint does not block the shell.
+const modelCompletionTimeout = 3 * time.Second
+
+// ErrModelNotFound is returned, if a described model is not offered by the provider.
+var ErrModelNotFound = errors.New("model not found")
+
+type modelsCmd struct {
+	cmd     *cobra.Command
+	output  string
+	refresh bool
+}
+
+// modelDescription is a model as offered by the provider, completed with the
+// built-in knowledge about it.
+type modelDescription struct {
+	api.Model
+	ContextWindow int     `json:"contextWindow,omitempty"`
+	Encoding      string  `json:"encoding,omitempty"`
+	InputPrice    float64 `json:"inputPrice,omitempty"`
+	OutputPrice   float64 `json:"outputPrice,omitempty"`
+}
+
+func newModelsCmd(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *modelsCmd {
+	modelsStruct := &modelsCmd{}
+	cmd := &cobra.Command{
+		Use:   "models [model]",
+		Short: "List or describe the models of the provider",
+		Long: strings.TrimSpace(`
+List the models the configured provider offers, or describe a single model.
+The list is cached for a day; use --refresh to ask the provider again.
+`),
+		Args: cobra.MaximumNArgs(1),
+		ValidArgsFunction: func(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return completeModels(config, createClientFn, toComplete)
+		},
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if modelsStruct.output != outputTable && modelsStruct.output != outputJSON {
+				return ErrUnknownOutputFormat
+			}
+			if modelsStruct.refresh {
+				if err := api.ClearModelCache(config); err != nil {
+					return err
+				}
+			}
+			available, err := listModels(cmd.Context(), config, createClientFn)
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				return modelsStruct.describe(cmd.OutOrStdout(), available, args[0])
+			}
+			return modelsStruct.list(cmd.OutOrStdout(), available)
+		},
+	}
+	cmd.Flags().StringVarP(&modelsStruct.output, "output", "o", outputTable, "output format (table, json)")
+	cmd.Flags().BoolVar(&modelsStruct.refresh, "refresh", false, "ignore the cached model list")
+	_ = cmd.RegisterFlagCompletionFunc("output", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputTable, outputJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+	modelsStruct.cmd = cmd
+	return modelsStruct
+}
+
+func listModels(ctx context.Context, config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) ([]api.Model, error) {
+	client, err := createClientFn(config, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := client.(api.ModelLister)
+	if !ok {
+		return nil, api.ErrModelListingUnsupported
+	}
+	return lister.ListModels(ctx)
+}
+
+// completeModels completes --model and the models argument from the model
+// list of the provider. Errors, e.g. a missing API key, yield no completions.
+// Completion never runs apiKeyCommand or asks the keyring for the key, so it
+// completes nothing if the key comes from there.
+func completeModels(config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error), toComplete string) ([]string, cobra.ShellCompDirective) {
+	if createClientFn == nil || loadViperConfig(config) != nil || api.DefersAPIKey(config) {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), modelCompletionTimeout)
+	defer cancel()
+	available, err := listModels(ctx, config, createClientFn)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var ids []string
+	for _, model := range available {
+		if strings.HasPrefix(model.ID, toComplete) {
+			ids = append(ids, model.ID)
+		}
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+func describeModel(model api.Model) modelDescription {
+	description := modelDescription{Model: model}
+	if info, ok := models.Lookup(model.ID); ok {
+		description.ContextWindow = info.ContextWindow
+		description.Encoding = info.Encoding
+		description.InputPrice = info.InputPrice
+		description.OutputPrice = info.OutputPrice
+	}
+	return description
+}
+
+func (m *modelsCmd) list(out io.Writer, available []api.Model) error {
+	descriptions := make([]modelDescription, 0, len(available))
+	for _, model := range available {
+		descriptions = append(descriptions, describeModel(model))
+	}
+	if m.output == outputJSON {
+		return writeJSON(out, descriptions)
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(writer, "ID\tOWNED BY\tCREATED\tCONTEXT"); err != nil {
+		return err
+	}
+	for _, description := range descriptions {
+		if _, err := fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n",
+			description.ID,
+			valueOrDash(description.OwnedBy),
+			formatDate(description.Created),
+			formatContextWindow(description.ContextWindow),
+		); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (m *modelsCmd) describe(out io.Writer, available []api.Model, id string) error {
+	var description *modelDescription
+	for _, model := range available {
+		if model.ID == id {
+			found := describeModel(model)
+			description = &found
+			break
+		}
+	}
+	if description == nil {
+		return fmt.Errorf("%w: %q", ErrModelNotFound, id)
+	}
+	if m.output == outputJSON {
+		return writeJSON(out, description)
+	}
+
+	rows := [][2]string{
+		{"ID", description.ID},
+		{"Owned by", valueOrDash(description.OwnedBy)},
+		{"Created", formatDate(description.Created)},
+		{"Context window", formatContextWindow(description.ContextWindow)},
+		{"Encoding", valueOrDash(description.Encoding)},
+	}
+	if description.InputPrice > 0 || description.OutputPrice > 0 {
+		rows = append(rows, [2]string{"Price", fmt.Sprintf("$%g input / $%g output per 1M tokens", description.InputPrice, description.OutputPrice)})
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		if _, err := fmt.Fprintf(writer, "%s:\t%s\n", row[0], row[1]); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func writeJSON(out io.Writer, value any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "-"
+	}
+	return date.Local().Format(time.DateOnly)
+}
+
+func formatContextWindow(window int) string {
+	if window == 0 {
+		return "-"
+	}
+	return fmt.Sprint(window)
+}
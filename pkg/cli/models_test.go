@@ -0,0 +1,142 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+type fakeModelClient struct {
+	models []api.Model
+}
+
+func (f fakeModelClient) CreateCompletion(context.Context, string, []string, string, []string) (string, error) {
+	return "", nil
+}
+
+func (f fakeModelClient) ListModels(context.Context) ([]api.Model, error) {
+	return f.models, nil
+}
+
+// completerOnly is a client that cannot list models.
+type completerOnly struct{}
+
+func (completerOnly) CreateCompletion(context.Context, string, []string, string, []string) (string, error) {
+	return "", nil
+}
+
+func fakeModelClientFn(_ *viper.Viper, _ io.Writer) (api.Completer, error) {
+	return fakeModelClient{models: []api.Model{
+		{ID: "gpt-4o", OwnedBy: "system", Created: time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)},
+		{ID: "gpt-4o-mini", OwnedBy: "system"},
+		{ID: "my-finetune"},
+	}}, nil
+}
+
+func TestModelsCmdList(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, fakeModelClientFn)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"models"})
+	require.Equal(t, 0, mem.code)
+
+	expected := `ID           OWNED BY  CREATED     CONTEXT
+gpt-4o       system    2024-05-10  128000
+gpt-4o-mini  system    -           128000
+my-finetune  -         -           -
+`
+	require.Equal(t, expected, out.String())
+}
+
+func TestModelsCmdDescribe(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, fakeModelClientFn)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"models", "gpt-4o-mini", "-o", "json"})
+	require.Equal(t, 0, mem.code)
+
+	var description modelDescription
+	require.NoError(t, json.Unmarshal(out.Bytes(), &description))
+	require.Equal(t, "gpt-4o-mini", description.ID)
+	require.Equal(t, 128000, description.ContextWindow)
+	require.InDelta(t, 0.15, description.InputPrice, 1e-9)
+
+	root = newRootCmd(mem.Exit, testCtx.Config, nil, fakeModelClientFn)
+	root.Execute([]string{"models", "unknown-model"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestModelsCmdUnsupportedProvider(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, func(_ *viper.Viper, _ io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	})
+	root.Execute([]string{"models"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestModelFlagCompletion(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, fakeModelClientFn)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"__complete", "--model", "gpt-4o"})
+	require.Equal(t, 0, mem.code)
+	require.True(t, strings.HasPrefix(out.String(), "gpt-4o\ngpt-4o-mini\n:4\n"), out.String())
+}
+
+func TestModelFlagCompletionDeferredAPIKey(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("apiKeyCommand", "pass show openai")
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, func(*viper.Viper, io.Writer) (api.Completer, error) {
+		require.Fail(t, "completion must not create a client that resolves the API key")
+		return nil, nil
+	})
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"__complete", "--model", "gpt-4o"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, ":4\n", strings.SplitAfter(out.String(), "\n")[0])
+}
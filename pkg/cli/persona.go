@@ -0,0 +1,63 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"log/slog"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/modifiers"
+)
+
+// personaOptionFlags maps the options of the persona front matter to the
+// flags setting the same config keys.
+var personaOptionFlags = map[string]string{
+	"maxTokens":        "max-tokens",
+	"temperature":      "temperature",
+	"topP":             "top-p",
+	"seed":             "seed",
+	"stop":             "stop",
+	"presencePenalty":  "presence-penalty",
+	"frequencyPenalty": "frequency-penalty",
+	"logitBias":        "logit-bias",
+	"n":                "n",
+}
+
+// applyPersonaOptions applies the options of the persona front matter to
+// config. They override the config file and the active profile, but not
+// flags given on the command line.
+func applyPersonaOptions(cmd *cobra.Command, config *viper.Viper, persona string) error {
+	loaded, err := modifiers.GetPersona(config, persona)
+	if err != nil {
+		return err
+	}
+	for key, value := range loaded.Options {
+		if flag := cmd.Flags().Lookup(personaOptionFlags[key]); flag != nil && flag.Changed {
+			slog.Debug("Persona option overridden by flag", "option", key)
+			continue
+		}
+		slog.Debug("Applying persona option", "option", key)
+		config.Set(key, value)
+	}
+	return nil
+}
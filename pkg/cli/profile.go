@@ -0,0 +1,72 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// envKeyProfile is the environment variable that selects a profile, if --profile is not set.
+const envKeyProfile = "SGPT_PROFILE"
+
+// ErrUnknownProfile is returned, if the selected profile is not defined in the profiles section.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// applyProfile merges the settings of the selected profile into the config
+// file layer. They override the top-level settings of the config file, while
+// command line flags and environment variables bound to a key still win.
+func applyProfile(config *viper.Viper) error {
+	name := activeProfile(config)
+	if name == "" {
+		return nil
+	}
+	// viper lowercases map keys
+	profile, ok := config.GetStringMap("profiles")[strings.ToLower(name)].(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %q (available: %s)", ErrUnknownProfile, name, strings.Join(profileNames(config), ", "))
+	}
+	slog.Debug("Using profile: " + name)
+	return config.MergeConfigMap(profile)
+}
+
+// activeProfile returns the name of the profile selected via --profile,
+// SGPT_PROFILE or the profile key of the config file.
+func activeProfile(config *viper.Viper) string {
+	return config.GetString("profile")
+}
+
+// profileNames returns the sorted names of all defined profiles.
+func profileNames(config *viper.Viper) []string {
+	profiles := config.GetStringMap("profiles")
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
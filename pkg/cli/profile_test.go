@@ -0,0 +1,157 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+const profileTestConfig = `model: gpt-4o
+temperature: 1
+profiles:
+  local:
+    apiBase: http://localhost:11434/v1
+    apiKeyEnv: LOCAL_LLM_KEY
+    model: llama3
+    temperature: 0.2
+    insecureAPIBase: true
+    headers:
+      X-Team: platform
+`
+
+func writeProfileTestConfig(t *testing.T, testCtx *testlib.TestCtx) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(testCtx.ConfigDir, "config.yaml"), []byte(profileTestConfig), 0o600))
+}
+
+// captureConfig returns a createClientFn that records the config the client is created with.
+func captureConfig(captured **viper.Viper) func(*viper.Viper, io.Writer) (api.Completer, error) {
+	return func(v *viper.Viper, w io.Writer) (api.Completer, error) {
+		*captured = v
+		return api.CreateClient(v, w)
+	}
+}
+
+func TestProfileFlag(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	t.Setenv("LOCAL_LLM_KEY", "local-key")
+	mem := &exitMemento{}
+
+	var config *viper.Viper
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), captureConfig(&config)).Execute([]string{"--profile", "local", "check"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "llama3", config.GetString("model"))
+	require.InDelta(t, 0.2, config.GetFloat64("temperature"), 0.0001)
+	require.Equal(t, "http://localhost:11434/v1", config.GetString("apiBase"))
+	require.True(t, config.GetBool("insecureAPIBase"))
+	require.Equal(t, "platform", config.GetStringMapString("headers")["x-team"])
+}
+
+func TestProfileNotSelected(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	testlib.SetAPIKey(t)
+	mem := &exitMemento{}
+
+	var config *viper.Viper
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), captureConfig(&config)).Execute([]string{"check"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "gpt-4o", config.GetString("model"))
+	require.Empty(t, config.GetString("apiBase"))
+}
+
+func TestProfileEnv(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	t.Setenv("LOCAL_LLM_KEY", "local-key")
+	t.Setenv(envKeyProfile, "Local")
+	mem := &exitMemento{}
+
+	var config *viper.Viper
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), captureConfig(&config)).Execute([]string{"check"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "llama3", config.GetString("model"))
+}
+
+func TestProfileOverriddenByFlag(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	mem := &exitMemento{}
+
+	var model string
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), func(v *viper.Viper, _ io.Writer) (api.Completer, error) {
+		model = v.GetString("model")
+		return completerOnly{}, nil
+	}).Execute([]string{"--profile", "local", "--model", "mistral", "txt", "Say hello"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "mistral", model)
+}
+
+func TestProfileMissingAPIKeyEnv(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	testlib.SetAPIKey(t)
+	// t.Setenv restores the variable after the test
+	t.Setenv("LOCAL_LLM_KEY", "")
+	require.NoError(t, os.Unsetenv("LOCAL_LLM_KEY"))
+	mem := &exitMemento{}
+
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), func(v *viper.Viper, w io.Writer) (api.Completer, error) {
+		return api.CreateClient(v, w)
+	}).Execute([]string{"--profile", "local", "check"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestProfileUnknown(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	testlib.SetAPIKey(t)
+	mem := &exitMemento{}
+
+	newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), func(v *viper.Viper, w io.Writer) (api.Completer, error) {
+		return api.CreateClient(v, w)
+	}).Execute([]string{"--profile", "remote", "check"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestConfigCmdShowActiveProfile(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	writeProfileTestConfig(t, testCtx)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"--profile", "local", "config", "show"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "# active profile: local\n"+profileTestConfig, out.String())
+}
@@ -22,12 +22,15 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/cache"
 	"github.com/tbckr/sgpt/v2/pkg/fs"
 	"github.com/tbckr/sgpt/v2/pkg/shell"
 
@@ -45,6 +48,8 @@ type rootCmd struct {
 	copyToClipboard bool
 	input           []string
 	templateStr     string
+	audio           string
+	speak           string
 
 	verbose bool
 }
@@ -68,12 +73,20 @@ func Execute(args []string) {
 		slog.Error("Failed to create viper config", "error", err)
 		os.Exit(1)
 	}
+	ctx, stop := notifyInterrupt(context.Background(), os.Exit)
+	defer stop()
 	newRootCmd(os.Exit, viperConfig, shell.IsPipedShell, func(v *viper.Viper, w io.Writer) (api.Completer, error) {
-		return api.CreateClient(v, w)
-	}).Execute(args)
+		return api.NewCompleter(v, w)
+	}).ExecuteContext(ctx, args)
 }
 
 func (r *rootCmd) Execute(args []string) {
+	r.ExecuteContext(context.Background(), args)
+}
+
+// ExecuteContext runs the command with ctx. Commands stop when ctx is
+// cancelled and exit with exitCodeInterrupted.
+func (r *rootCmd) ExecuteContext(ctx context.Context, args []string) {
 	defer func() {
 		if err := recover(); err != nil {
 			slog.Error("Panic occurred", "error", err)
@@ -84,7 +97,7 @@ func (r *rootCmd) Execute(args []string) {
 	// Set args for root command
 	r.cmd.SetArgs(args)
 
-	if err := r.cmd.Execute(); err != nil {
+	if err := r.cmd.ExecuteContext(ctx); err != nil {
 		// Defaults
 		code := 1
 		msg := "command failed"
@@ -96,6 +109,9 @@ func (r *rootCmd) Execute(args []string) {
 			if exitErr.details != "" {
 				msg = exitErr.details
 			}
+		} else if errors.Is(err, context.Canceled) {
+			code = exitCodeInterrupted
+			msg = "interrupted"
 		}
 
 		// Log error with details and exit
@@ -157,6 +173,12 @@ ls | sort
 # Use a template with piped YAML variables
 $ echo "name: Dave\ncountry: France" | sgpt --template "What would {{ .name }} be called in {{ .country }}?"
 
+# Summarize a recording
+$ sgpt --audio standup.m4a "Summarize the decisions of this standup"
+
+# Listen to the response
+$ sgpt --speak answer.mp3 "Explain the difference between TCP and UDP"
+
 # Use a template with a persona
 $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{ .lang }}"
 `,
@@ -173,8 +195,11 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 				slog.SetDefault(slog.New(handler))
 			}
 		},
-		PreRunE: func(_ *cobra.Command, _ []string) error {
-			return loadViperConfig(config)
+		PreRunE: func(cmd *cobra.Command, _ []string) error {
+			if err := loadViperConfig(config); err != nil {
+				return err
+			}
+			return applySeedFlag(cmd, config)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			isPiped, err := isPipedShell()
@@ -185,6 +210,27 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 			var prompts []string
 			mode := "txt"
 
+			// Fail before the completion is paid for
+			if root.speak != "" {
+				if _, err = api.SpeechFormatFromFile(root.speak); err != nil {
+					return err
+				}
+			}
+
+			if root.audio != "" {
+				if root.templateStr != "" {
+					return ErrTemplateWithAudio
+				}
+				// The transcript precedes the piped input and the prompt
+				var transcript string
+				slog.Debug("Transcribing audio input", "file", root.audio)
+				transcript, err = transcribe(cmd.Context(), config, createClientFn, api.AudioRequest{File: root.audio})
+				if err != nil {
+					return err
+				}
+				prompts = append(prompts, strings.TrimSpace(transcript))
+			}
+
 			if root.templateStr != "" {
 				// Template mode: piped input provides YAML/JSON variables; template string is the prompt.
 				if !isPiped {
@@ -248,7 +294,9 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 			} else {
 				// input is provided via command line args
 				if len(args) == 0 {
-					return ErrMissingInput
+					if root.audio == "" {
+						return ErrMissingInput
+					}
 				} else if len(args) == 1 {
 					// input is provided via command line args
 					slog.Debug("No mode provided via command line args - using default mode")
@@ -265,6 +313,10 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 				}
 			}
 
+			if err = applyPersonaOptions(cmd, config, mode); err != nil {
+				return err
+			}
+
 			// Create client
 			var client api.Completer
 			client, err = createClientFn(config, cmd.OutOrStdout())
@@ -274,6 +326,13 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 
 			var response string
 			response, err = client.CreateCompletion(cmd.Context(), root.chat, prompts, mode, root.input)
+			if errors.Is(err, api.ErrSchemaValidation) {
+				return &exitError{
+					err:     err,
+					code:    exitCodeInvalidOutput,
+					details: "response failed structured output validation",
+				}
+			}
 			if err != nil {
 				return err
 			}
@@ -287,9 +346,17 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 				}
 			}
 
+			if root.speak != "" {
+				slog.Debug("Converting client response to speech", "file", root.speak)
+				err = speak(cmd.Context(), config, client, response, root.speak)
+				if err != nil {
+					return err
+				}
+			}
+
 			if root.execute {
 				slog.Debug("Trying to execute response in shell")
-				return shell.ExecuteCommandWithConfirmation(cmd.Context(), cmd.InOrStdin(), cmd.OutOrStdout(), response)
+				return shell.ExecuteCommandWithConfirmation(cmd.Context(), cmd.InOrStdin(), cmd.OutOrStdout(), response, api.APIKeyEnvKeys(config)...)
 			}
 			return nil
 		},
@@ -301,9 +368,11 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 	cmd.Flags().StringVarP(&root.chat, "chat", "c", "", "use an existing chat session or create a new one")
 	cmd.Flags().StringSliceVarP(&root.input, "input", "i", nil, "provide images via command line args to a file or url (experimental)")
 	cmd.Flags().StringVarP(&root.templateStr, "template", "T", "", "Go template string; piped input provides template variables (YAML/JSON)")
+	cmd.Flags().StringVarP(&root.audio, "audio", "a", "", "transcribe an audio file and prepend the transcript to the prompt")
+	cmd.Flags().StringVar(&root.speak, "speak", "", "write the response as speech to an mp3, opus or wav file")
 
 	// flags with config binding
-	createFlagsWithConfigBinding(cmd, config)
+	createFlagsWithConfigBinding(cmd, config, createClientFn)
 
 	// verbose persistent flag
 	cmd.PersistentFlags().BoolVarP(&root.verbose, "verbose", "v", false,
@@ -324,6 +393,42 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 		panic("Failed to bind insecure-api-base flag to viper")
 	}
 
+	// provider persistent flag — selects the backend used by every command
+	// that creates a client, including check.
+	cmd.PersistentFlags().String("provider", api.DefaultProvider,
+		"provider backend ("+strings.Join(api.Providers(), ", ")+")")
+	if err := config.BindPFlag("provider", cmd.PersistentFlags().Lookup("provider")); err != nil {
+		slog.Error("Failed to bind provider flag to viper", "error", err)
+		panic("Failed to bind provider flag to viper")
+	}
+	_ = cmd.RegisterFlagCompletionFunc("provider", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return api.Providers(), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	// profile persistent flag — selects a named profile of the config file.
+	cmd.PersistentFlags().String("profile", "", "use the named profile of the config file (env "+envKeyProfile+")")
+	if err := config.BindPFlag("profile", cmd.PersistentFlags().Lookup("profile")); err != nil {
+		slog.Error("Failed to bind profile flag to viper", "error", err)
+		panic("Failed to bind profile flag to viper")
+	}
+	if err := config.BindEnv("profile", envKeyProfile); err != nil {
+		slog.Error("Failed to bind profile env variable to viper", "error", err)
+		panic("Failed to bind profile env variable to viper")
+	}
+	_ = cmd.RegisterFlagCompletionFunc("profile", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		if err := loadViperConfig(config); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return profileNames(config), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	// header persistent flag — adds a header to the requests of every command.
+	cmd.PersistentFlags().StringArray("header", nil, `add an HTTP header to every request, as "Name: value" (repeatable)`)
+	if err := config.BindPFlag("header", cmd.PersistentFlags().Lookup("header")); err != nil {
+		slog.Error("Failed to bind header flag to viper", "error", err)
+		panic("Failed to bind header flag to viper")
+	}
+
 	cmd.AddCommand(
 		newChatCmd(config).cmd,
 		newCheckCmd(config, createClientFn).cmd,
@@ -331,13 +436,22 @@ $ echo "lang: Python" | sgpt code --template "Write a hello world program in {{
 		newLicensesCmd().cmd,
 		newManCmd().cmd,
 		newConfigCmd(config).cmd,
+		newUsageCmd(config).cmd,
+		newCacheCmd(config).cmd,
+		newModelsCmd(config, createClientFn).cmd,
+		newEmbedCmd(config, isPipedShell, createClientFn).cmd,
+		newImageCmd(config, createClientFn).cmd,
+		newTranscribeCmd(config, createClientFn).cmd,
+		newTranslateCmd(config, createClientFn).cmd,
+		newSpeakCmd(config, isPipedShell, createClientFn).cmd,
+		newBatchCmd(config, createClientFn).cmd,
 	)
 
 	root.cmd = cmd
 	return root
 }
 
-func createFlagsWithConfigBinding(cmd *cobra.Command, config *viper.Viper) {
+func createFlagsWithConfigBinding(cmd *cobra.Command, config *viper.Viper, createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) {
 	var bindErrors []error
 	var err error
 	// text based commands
@@ -346,6 +460,9 @@ func createFlagsWithConfigBinding(cmd *cobra.Command, config *viper.Viper) {
 	if err != nil {
 		bindErrors = append(bindErrors, err)
 	}
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
 
 	cmd.Flags().IntP("max-tokens", "s", 2048, "strict length of output (tokens)")
 	err = config.BindPFlag("maxTokens", cmd.Flags().Lookup("max-tokens"))
@@ -365,12 +482,117 @@ func createFlagsWithConfigBinding(cmd *cobra.Command, config *viper.Viper) {
 		bindErrors = append(bindErrors, err)
 	}
 
+	// sampling, the seed is applied by applySeedFlag
+	cmd.Flags().Int("seed", 0, "seed for deterministic sampling")
+
+	cmd.Flags().StringArray("stop", nil, "stop generating at this sequence (repeatable)")
+	err = config.BindPFlag("stop", cmd.Flags().Lookup("stop"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().Float64("presence-penalty", 0, "penalize tokens that already appeared (-2.0 to 2.0)")
+	err = config.BindPFlag("presencePenalty", cmd.Flags().Lookup("presence-penalty"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().Float64("frequency-penalty", 0, "penalize tokens by how often they appeared (-2.0 to 2.0)")
+	err = config.BindPFlag("frequencyPenalty", cmd.Flags().Lookup("frequency-penalty"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().StringArray("logit-bias", nil, "bias a token ID or text by -100 to 100, as token=bias (repeatable)")
+	err = config.BindPFlag("logitBias", cmd.Flags().Lookup("logit-bias"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().Int("n", 1, "number of choices to generate")
+	err = config.BindPFlag("n", cmd.Flags().Lookup("n"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().Bool("pick", false, "ask which choice to keep, if more than one is generated")
+	err = config.BindPFlag("pick", cmd.Flags().Lookup("pick"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	// logprobs
+	cmd.Flags().Bool("logprobs", false, "print the log probability of each token after the response")
+	err = config.BindPFlag("logprobs", cmd.Flags().Lookup("logprobs"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().Int("top-logprobs", 0, "print this many likely alternatives for each token (0-20), implies --logprobs")
+	err = config.BindPFlag("topLogprobs", cmd.Flags().Lookup("top-logprobs"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().String("output", "text", "output format ("+strings.Join(api.OutputFormats, ", ")+"), json includes the logprobs")
+	err = config.BindPFlag("output", cmd.Flags().Lookup("output"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	_ = cmd.RegisterFlagCompletionFunc("output", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return api.OutputFormats, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	// reasoning models
+	cmd.Flags().String("reasoning-effort", "", "reasoning effort of reasoning models ("+strings.Join(api.ReasoningEfforts, ", ")+")")
+	err = config.BindPFlag("reasoningEffort", cmd.Flags().Lookup("reasoning-effort"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	_ = cmd.RegisterFlagCompletionFunc("reasoning-effort", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return api.ReasoningEfforts, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	cmd.Flags().Bool("show-reasoning", false, "print reasoning summaries of the model to stderr")
+	err = config.BindPFlag("showReasoning", cmd.Flags().Lookup("show-reasoning"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
 	cmd.Flags().Bool("stream", false, "stream output")
 	err = config.BindPFlag("stream", cmd.Flags().Lookup("stream"))
 	if err != nil {
 		bindErrors = append(bindErrors, err)
 	}
 
+	// structured output
+	cmd.Flags().Bool("json", false, "request a JSON object and validate that the response is JSON")
+	err = config.BindPFlag("jsonMode", cmd.Flags().Lookup("json"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	cmd.Flags().String("json-schema", "", "request JSON matching the schema in this file and validate the response")
+	err = config.BindPFlag("jsonSchema", cmd.Flags().Lookup("json-schema"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+	_ = cmd.MarkFlagFilename("json-schema", "json")
+	cmd.MarkFlagsMutuallyExclusive("json", "json-schema")
+
+	cmd.Flags().Int("schema-retries", 0, "re-ask the model this many times if the response does not validate")
+	err = config.BindPFlag("schemaRetries", cmd.Flags().Lookup("schema-retries"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
+	// response cache
+	cmd.Flags().Bool("cache", false, "answer repeated prompts from the local response cache")
+	err = config.BindPFlag("cache.enabled", cmd.Flags().Lookup("cache"))
+	if err != nil {
+		bindErrors = append(bindErrors, err)
+	}
+
 	if len(bindErrors) > 0 {
 		for _, err = range bindErrors {
 			slog.Error("Failed to bind flag to viper", "error", err)
@@ -379,6 +601,21 @@ func createFlagsWithConfigBinding(cmd *cobra.Command, config *viper.Viper) {
 	}
 }
 
+// applySeedFlag sets the seed, if it was given on the command line. The seed
+// flag is not bound to config, because viper would then write its default to
+// the file created by config init and every request would send seed 0.
+func applySeedFlag(cmd *cobra.Command, config *viper.Viper) error {
+	if !cmd.Flags().Changed("seed") {
+		return nil
+	}
+	seed, err := cmd.Flags().GetInt("seed")
+	if err != nil {
+		return err
+	}
+	config.Set("seed", seed)
+	return nil
+}
+
 func loadViperConfig(config *viper.Viper) error {
 	if !config.IsSet("TESTING") {
 		slog.Debug("Loading config")
@@ -388,16 +625,16 @@ func loadViperConfig(config *viper.Viper) error {
 		}
 	}
 	if err := config.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// Config file not found; ignore error
-			slog.Debug("Config file not found - using defaults")
-			return nil
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			// Config file was found but another error was produced
+			return err
 		}
-		// Config file was found but another error was produced
-		return err
+		// Config file not found; ignore error
+		slog.Debug("Config file not found - using defaults")
+	} else {
+		slog.Debug("Config file loaded")
 	}
-	slog.Debug("Config file loaded")
-	return nil
+	return applyProfile(config)
 }
 
 func setViperDefaults(config *viper.Viper) error {
@@ -419,14 +656,39 @@ func setViperDefaults(config *viper.Viper) error {
 	config.SetDefault("model", api.DefaultModel)
 	// max-tokens
 	config.SetDefault("maxTokens", 2048)
-	// temperature
-	config.SetDefault("temperature", 1)
-	// top-p
-	config.SetDefault("topP", 1)
+	// temperature and top-p have no defaults, so providers only send them
+	// when they are set and ollama keeps the parameters of the Modelfile
+	// sampling, the seed has no default because 0 is a valid seed
+	config.SetDefault("presencePenalty", 0)
+	config.SetDefault("frequencyPenalty", 0)
+	config.SetDefault("n", 1)
+	config.SetDefault("pick", false)
+	// logprobs
+	config.SetDefault("logprobs", false)
+	config.SetDefault("topLogprobs", 0)
+	config.SetDefault("output", "text")
+	// reasoning models
+	config.SetDefault("reasoningEffort", "")
+	config.SetDefault("showReasoning", false)
 	// stream
 	config.SetDefault("stream", false)
+	config.SetDefault("saveInterrupted", true)
+	// structured output
+	config.SetDefault("jsonMode", false)
+	config.SetDefault("jsonSchema", "")
+	config.SetDefault("schemaRetries", 0)
+	// response cache
+	config.SetDefault("cache.enabled", false)
+	config.SetDefault("cache.ttl", cache.DefaultTTL)
+	config.SetDefault("cache.maxSize", "100MB")
+	// batch
+	config.SetDefault("batch.workers", defaultBatchWorkers)
+	config.SetDefault("batch.requestsPerMinute", 0)
+	config.SetDefault("batch.tokensPerMinute", 0)
 	// insecure-api-base
 	config.SetDefault("insecureAPIBase", false)
+	// provider
+	config.SetDefault("provider", api.DefaultProvider)
 
 	return nil
 }
@@ -23,9 +23,12 @@ package cli
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -1178,3 +1181,242 @@ func TestRootCmd_TemplateWithExecute_Error(t *testing.T) {
 	root.Execute([]string{"sh", "--template", "run {{ .cmd }}", "--execute"})
 	require.Equal(t, 1, mem.code)
 }
+
+func TestRootCmd_JSONSchemaValidationExitCode(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`{"type":"object","required":["name"]}`), 0600))
+
+	var out bytes.Buffer
+	client, err := api.CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	testlib.RegisterExpectedChatResponse("not json")
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.cmd.SetOut(&out)
+
+	root.Execute([]string{"--json-schema", schemaPath, "Who are you?"})
+	require.Equal(t, exitCodeInvalidOutput, mem.code)
+	require.NotContains(t, out.String(), "not json\n")
+}
+
+func TestRootCmd_JSONFlagsMutuallyExclusive(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	mem := &exitMemento{}
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), nil)
+	root.cmd.SetOut(io.Discard)
+	root.cmd.SetErr(io.Discard)
+
+	root.Execute([]string{"--json", "--json-schema", "schema.json", "Who are you?"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestRootCmd_ReasoningEffort(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	client, err := api.CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		return httpmock.NewStringResponse(200, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"42"}}]}`), nil
+	})
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"-m", "o3-mini", "--reasoning-effort", "high", "What is six times seven?"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, "high", body["reasoning_effort"])
+	require.InDelta(t, 2048, body["max_completion_tokens"], 0)
+	require.NotContains(t, body, "max_tokens")
+	require.NotContains(t, body, "temperature")
+	require.NotContains(t, body, "top_p")
+}
+
+func TestRootCmd_InvalidReasoningEffort(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	client, err := api.CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.Execute([]string{"-m", "o3-mini", "--reasoning-effort", "extreme", "What is six times seven?"})
+	require.Equal(t, 1, mem.code)
+	require.Zero(t, httpmock.GetTotalCallCount())
+}
+
+func TestRootCmd_SamplingFlags(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	client, err := api.CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		return httpmock.NewStringResponse(200, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"one"}},{"index":1,"finish_reason":"stop","message":{"role":"assistant","content":"two"}}]}`), nil
+	})
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.cmd.SetOut(&out)
+	root.Execute([]string{
+		"--seed", "7", "--stop", "END", "--stop", "STOP",
+		"--presence-penalty", "0.5", "--frequency-penalty", "-0.5",
+		"--logit-bias", "50256=-100", "--n", "2",
+		"Count to two",
+	})
+	require.Equal(t, 0, mem.code)
+	require.InDelta(t, 7, body["seed"], 0)
+	require.Equal(t, []any{"END", "STOP"}, body["stop"])
+	require.InDelta(t, 0.5, body["presence_penalty"], 0)
+	require.InDelta(t, -0.5, body["frequency_penalty"], 0)
+	require.Equal(t, map[string]any{"50256": float64(-100)}, body["logit_bias"])
+	require.InDelta(t, 2, body["n"], 0)
+	require.Equal(t, "--- choice 1/2 ---\none\n--- choice 2/2 ---\ntwo\n", out.String())
+}
+
+func TestRootCmd_PersonaOptions(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	client, err := api.CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		return httpmock.NewStringResponse(200, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"42"}}]}`), nil
+	})
+
+	persona := "---\noptions:\n  temperature: 0.2\n  seed: 3\n  stop: [\"END\"]\n---\nYou are a fixture generator"
+	require.NoError(t, os.WriteFile(filepath.Join(testCtx.Config.GetString("personas"), "fixtures"), []byte(persona), 0o600))
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.Execute([]string{"--seed", "9", "fixtures", "What is six times seven?"})
+	require.Equal(t, 0, mem.code)
+	// the flag wins over the persona, the persona over the defaults
+	require.InDelta(t, 9, body["seed"], 0)
+	require.InDelta(t, 0.2, body["temperature"], 0.0001)
+	require.Equal(t, []any{"END"}, body["stop"])
+}
+
+func TestRootCmd_ConfigInitSendsNoSeed(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	newRootCmd(mem.Exit, testCtx.Config, nil, nil).Execute([]string{"config", "init"})
+	require.Equal(t, 0, mem.code)
+	data, err := os.ReadFile(filepath.Join(testCtx.ConfigDir, "config.yaml"))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "seed")
+
+	client, err := api.CreateClient(testCtx.Config, io.Discard)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		return httpmock.NewStringResponse(200, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"42"}}]}`), nil
+	})
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.Execute([]string{"What is six times seven?"})
+	require.Equal(t, 0, mem.code)
+	require.NotContains(t, body, "seed")
+}
+
+func TestRootCmd_OllamaSendsOnlySetOptions(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	require.NoError(t, setViperDefaults(testCtx.Config))
+	mem := &exitMemento{}
+
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = io.WriteString(w, `{"model":"llama3","message":{"role":"assistant","content":"42"},"done":true,"done_reason":"stop"}`)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OLLAMA_HOST", server.URL)
+	createClient := func(v *viper.Viper, w io.Writer) (api.Completer, error) {
+		return api.NewCompleter(v, w)
+	}
+
+	// the viper defaults must not override the parameters of the Modelfile
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), createClient)
+	root.cmd.SetOut(io.Discard)
+	root.Execute([]string{"--provider", "ollama", "-m", "llama3", "What is six times seven?"})
+	require.Equal(t, 0, mem.code)
+	options, _ := body["options"].(map[string]any)
+	require.NotContains(t, options, "temperature")
+	require.NotContains(t, options, "top_p")
+
+	root = newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), createClient)
+	root.cmd.SetOut(io.Discard)
+	root.Execute([]string{"--provider", "ollama", "-m", "llama3", "-t", "0.2", "What is six times seven?"})
+	require.Equal(t, 0, mem.code)
+	options, _ = body["options"].(map[string]any)
+	require.InDelta(t, 0.2, options["temperature"], 0.0001)
+	require.NotContains(t, options, "top_p")
+}
+
+func TestRootCmd_LogprobsJSONOutput(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testlib.SetAPIKey(t)
+	testlib.SetAPIBase(t)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	client, err := api.CreateClient(testCtx.Config, &out)
+	require.NoError(t, err)
+
+	httpmock.ActivateNonDefault(client.HTTPClient)
+	t.Cleanup(httpmock.DeactivateAndReset)
+	var body map[string]any
+	httpmock.RegisterResponder("POST", "https://api.openai.com/v1/chat/completions", func(req *http.Request) (*http.Response, error) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		return httpmock.NewStringResponse(200, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"spam"},"logprobs":{"content":[{"token":"spam","logprob":-0.2,"top_logprobs":[{"token":"spam","logprob":-0.2}]}]}}]}`), nil
+	})
+
+	root := newRootCmd(mem.Exit, testCtx.Config, mockIsPipedShell(false, nil), useMockClient(client))
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"--output", "json", "--top-logprobs", "1", "Is this spam?"})
+	require.Equal(t, 0, mem.code)
+	require.Equal(t, true, body["logprobs"])
+	require.InDelta(t, 1, body["top_logprobs"], 0)
+	require.JSONEq(t, `{"content":"spam","logprobs":[{"token":"spam","logprob":-0.2,"alternatives":[{"token":"spam","logprob":-0.2}]}]}`, out.String())
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+	"github.com/tbckr/sgpt/v2/pkg/fs"
+)
+
+const speechFilePerm = 0644
+
+// speechVoices are offered as completions of the --voice flag.
+var speechVoices = []string{"alloy", "ash", "ballad", "coral", "echo", "fable", "nova", "onyx", "sage", "shimmer", "verse"}
+
+type speakCmd struct {
+	cmd *cobra.Command
+}
+
+func newSpeakCmd(config *viper.Viper, isPipedShell func() (bool, error), createClientFn func(*viper.Viper, io.Writer) (api.Completer, error)) *speakCmd {
+	speakCommand := &speakCmd{}
+	cmd := &cobra.Command{
+		Use:   "speak <file> [text]",
+		Short: "Convert text to speech",
+		Long: strings.TrimSpace(`
+Convert text from the command line or stdin to speech and write it to a file
+inside the working directory. The extension of the file selects the format:
+.mp3, .opus (or .ogg) or .wav. An existing file is replaced.
+
+Texts longer than the limit of the speech API are split at paragraphs or
+sentences and the audio of the parts is joined into one file.
+
+To speak the response to a prompt, use the --speak flag of the root command.
+`),
+		Example: strings.TrimSpace(`
+sgpt speak hello.mp3 "Hello, world"
+cat README.md | sgpt speak --voice nova --speed 1.25 readme.opus
+`),
+		Args: cobra.RangeArgs(1, 2),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := api.SpeechFormatFromFile(args[0]); err != nil {
+				return err
+			}
+			var text string
+			if len(args) == 2 {
+				text = args[1]
+			} else {
+				isPiped, err := isPipedShell()
+				if err != nil {
+					return err
+				}
+				if !isPiped {
+					return ErrMissingInput
+				}
+				text, err = fs.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return err
+				}
+			}
+			client, err := createClientFn(config, io.Discard)
+			if err != nil {
+				return err
+			}
+			return speak(cmd.Context(), config, client, text, args[0])
+		},
+	}
+	cmd.Flags().StringP("model", "m", api.DefaultSpeechModel, "speech model name")
+	cmd.Flags().String("voice", api.DefaultSpeechVoice, "voice of the speech")
+	cmd.Flags().Float64("speed", 1, "speed of the speech from 0.25 to 4.0")
+	for key, flag := range map[string]string{"speech.model": "model", "speech.voice": "voice", "speech.speed": "speed"} {
+		if err := config.BindPFlag(key, cmd.Flags().Lookup(flag)); err != nil {
+			panic("Failed to bind speech " + flag + " flag to viper")
+		}
+	}
+	_ = cmd.RegisterFlagCompletionFunc("model", func(_ *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeModels(config, createClientFn, toComplete)
+	})
+	_ = cmd.RegisterFlagCompletionFunc("voice", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return speechVoices, cobra.ShellCompDirectiveNoFileComp
+	})
+	speakCommand.cmd = cmd
+	return speakCommand
+}
+
+// speak converts text to speech with the speech settings of the config and
+// writes it to file. The format is selected by the extension of file.
+func speak(ctx context.Context, config *viper.Viper, client api.Completer, text, file string) error {
+	format, err := api.SpeechFormatFromFile(file)
+	if err != nil {
+		return err
+	}
+	speaker, ok := client.(api.Speaker)
+	if !ok {
+		return api.ErrSpeechUnsupported
+	}
+	req := api.SpeechRequest{
+		Model:  config.GetString("speech.model"),
+		Voice:  config.GetString("speech.voice"),
+		Speed:  config.GetFloat64("speech.speed"),
+		Format: format,
+		Text:   text,
+	}
+	if req.Model == "" {
+		req.Model = api.DefaultSpeechModel
+	}
+	if req.Voice == "" {
+		req.Voice = api.DefaultSpeechVoice
+	}
+	var data []byte
+	data, err = speaker.Speak(ctx, req)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Writing speech", "file", file, "format", format, "bytes", len(data))
+	return fs.WriteFileUnderCwd(file, data, speechFilePerm)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/api"
+)
+
+// fakeSpeaker returns the text as audio and records the speech requests.
+type fakeSpeaker struct {
+	response string
+	requests *[]api.SpeechRequest
+}
+
+func (f fakeSpeaker) CreateCompletion(_ context.Context, _ string, _ []string, _ string, _ []string) (string, error) {
+	return f.response, nil
+}
+
+func (f fakeSpeaker) Speak(_ context.Context, req api.SpeechRequest) ([]byte, error) {
+	*f.requests = append(*f.requests, req)
+	return []byte("audio:" + req.Text), nil
+}
+
+func runSpeakCmd(t *testing.T, config *viper.Viper, isPiped bool, stdin string, args ...string) (int, []api.SpeechRequest) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	var requests []api.SpeechRequest
+	mem := &exitMemento{}
+	root := newRootCmd(mem.Exit, config, mockIsPipedShell(isPiped, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return fakeSpeaker{response: "The answer.", requests: &requests}, nil
+	})
+	root.cmd.SetIn(bytes.NewBufferString(stdin))
+	root.cmd.SetOut(io.Discard)
+	root.Execute(args)
+	return mem.code, requests
+}
+
+func TestSpeakCmd(t *testing.T) {
+	code, requests := runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "speak", "--voice", "nova", "--speed", "1.25", "hello.mp3", "Hello")
+	require.Equal(t, 0, code)
+	require.Equal(t, []api.SpeechRequest{{
+		Model:  api.DefaultSpeechModel,
+		Voice:  "nova",
+		Speed:  1.25,
+		Format: "mp3",
+		Text:   "Hello",
+	}}, requests)
+	data, err := os.ReadFile("hello.mp3")
+	require.NoError(t, err)
+	require.Equal(t, "audio:Hello", string(data))
+}
+
+func TestSpeakCmdStdin(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	testCtx.Config.Set("speech.model", "gpt-4o-mini-tts")
+	testCtx.Config.Set("speech.voice", "coral")
+
+	code, requests := runSpeakCmd(t, testCtx.Config, true, "Piped text", "speak", "readme.ogg")
+	require.Equal(t, 0, code)
+	require.Len(t, requests, 1)
+	require.Equal(t, "gpt-4o-mini-tts", requests[0].Model)
+	require.Equal(t, "coral", requests[0].Voice)
+	require.Equal(t, "opus", requests[0].Format)
+	require.Equal(t, "Piped text", requests[0].Text)
+	require.FileExists(t, "readme.ogg")
+}
+
+func TestSpeakCmdErrors(t *testing.T) {
+	// Unknown extension
+	code, requests := runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "speak", "hello.flac", "Hello")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+
+	// No text
+	code, _ = runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "speak", "hello.mp3")
+	require.Equal(t, 1, code)
+
+	// Outside of the working directory
+	code, _ = runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "speak", filepath.Join(t.TempDir(), "hello.mp3"), "Hello")
+	require.Equal(t, 1, code)
+
+	// Unsupported provider
+	mem := &exitMemento{}
+	newRootCmd(mem.Exit, testlib.NewTestCtx(t).Config, mockIsPipedShell(false, nil), func(*viper.Viper, io.Writer) (api.Completer, error) {
+		return completerOnly{}, nil
+	}).Execute([]string{"speak", "hello.mp3", "Hello"})
+	require.Equal(t, 1, mem.code)
+}
+
+func TestRootCmdSpeak(t *testing.T) {
+	code, requests := runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "--speak", "answer.wav", "What is the answer?")
+	require.Equal(t, 0, code)
+	require.Len(t, requests, 1)
+	require.Equal(t, "The answer.", requests[0].Text)
+	require.Equal(t, "wav", requests[0].Format)
+	require.Equal(t, api.DefaultSpeechVoice, requests[0].Voice)
+	data, err := os.ReadFile("answer.wav")
+	require.NoError(t, err)
+	require.Equal(t, "audio:The answer.", string(data))
+
+	// The extension is checked before the completion
+	code, requests = runSpeakCmd(t, testlib.NewTestCtx(t).Config, false, "", "--speak", "answer.txt", "What is the answer?")
+	require.Equal(t, 1, code)
+	require.Empty(t, requests)
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var (
+	// ErrUnknownOutputFormat is returned, if an unsupported output format is requested.
+	ErrUnknownOutputFormat = fmt.Errorf("output format must be %s or %s", outputTable, outputJSON)
+	// ErrInvalidSince is returned, if --since is neither a date nor a duration.
+	ErrInvalidSince = errors.New("since must be a date (YYYY-MM-DD) or a duration (e.g. 24h)")
+)
+
+type usageCmd struct {
+	cmd    *cobra.Command
+	by     []string
+	since  string
+	output string
+}
+
+func newUsageCmd(config *viper.Viper) *usageCmd {
+	usage := &usageCmd{}
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Show token usage and estimated cost",
+		Long: strings.TrimSpace(`
+Show the token usage and estimated cost of past requests, aggregated by day,
+model and chat session. Costs are estimated from list prices, which can be
+overridden in the prices section of the config.
+`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cobra.NoFileCompletions,
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return loadViperConfig(config)
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return usage.run(cmd.OutOrStdout(), config, time.Now())
+		},
+	}
+	cmd.Flags().StringSliceVar(&usage.by, "by", []string{ledger.GroupDay},
+		"group by day, model and/or session (comma separated)")
+	cmd.Flags().StringVar(&usage.since, "since", "", "only include requests since this date (YYYY-MM-DD) or duration (e.g. 24h)")
+	cmd.Flags().StringVarP(&usage.output, "output", "o", outputTable, "output format (table, json)")
+	_ = cmd.RegisterFlagCompletionFunc("by", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{ledger.GroupDay, ledger.GroupModel, ledger.GroupSession}, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = cmd.RegisterFlagCompletionFunc("output", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputTable, outputJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+	usage.cmd = cmd
+	return usage
+}
+
+func (u *usageCmd) run(out io.Writer, config *viper.Viper, now time.Time) error {
+	if u.output != outputTable && u.output != outputJSON {
+		return ErrUnknownOutputFormat
+	}
+	since, err := parseSince(u.since, now)
+	if err != nil {
+		return err
+	}
+
+	var records []ledger.Record
+	records, err = ledger.Read(config)
+	if err != nil {
+		return err
+	}
+	if !since.IsZero() {
+		filtered := records[:0]
+		for _, record := range records {
+			if !record.Time.Before(since) {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+
+	var summaries []ledger.Summary
+	summaries, err = ledger.Aggregate(records, u.by)
+	if err != nil {
+		return err
+	}
+
+	if u.output == outputJSON {
+		return writeJSON(out, summaries)
+	}
+	return writeUsageTable(out, u.by, summaries)
+}
+
+// parseSince accepts a date in local time or a duration before now. An empty
+// value disables the filter.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return date, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+		return now.Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidSince, value)
+}
+
+func writeUsageTable(out io.Writer, by []string, summaries []ledger.Summary) error {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	var header []string
+	for _, group := range by {
+		header = append(header, strings.ToUpper(group))
+	}
+	header = append(header, "REQUESTS", "PROMPT", "COMPLETION", "TOTAL", "COST")
+	if _, err := fmt.Fprintln(writer, strings.Join(header, "\t")); err != nil {
+		return err
+	}
+
+	var total ledger.Summary
+	for _, summary := range summaries {
+		var row []string
+		for _, group := range by {
+			row = append(row, usageGroupValue(summary, group))
+		}
+		if _, err := fmt.Fprintln(writer, strings.Join(append(row, usageColumns(summary)...), "\t")); err != nil {
+			return err
+		}
+		total.Requests += summary.Requests
+		total.PromptTokens += summary.PromptTokens
+		total.CompletionTokens += summary.CompletionTokens
+		total.TotalTokens += summary.TotalTokens
+		total.Cost += summary.Cost
+		total.UnpricedRequests += summary.UnpricedRequests
+	}
+	if len(summaries) > 1 {
+		row := make([]string, len(by))
+		row[0] = "TOTAL"
+		if _, err := fmt.Fprintln(writer, strings.Join(append(row, usageColumns(total)...), "\t")); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if total.UnpricedRequests > 0 {
+		_, err := fmt.Fprintf(out, "* excludes %d requests to models without a known price\n", total.UnpricedRequests)
+		return err
+	}
+	return nil
+}
+
+func usageGroupValue(summary ledger.Summary, group string) string {
+	switch group {
+	case ledger.GroupDay:
+		return valueOrDash(summary.Day)
+	case ledger.GroupModel:
+		return valueOrDash(summary.Model)
+	default:
+		return valueOrDash(summary.Session)
+	}
+}
+
+func usageColumns(summary ledger.Summary) []string {
+	cost := fmt.Sprintf("$%.4f", summary.Cost)
+	if summary.UnpricedRequests > 0 {
+		cost += "*"
+	}
+	return []string{
+		fmt.Sprint(summary.Requests),
+		fmt.Sprint(summary.PromptTokens),
+		fmt.Sprint(summary.CompletionTokens),
+		fmt.Sprint(summary.TotalTokens),
+		cost,
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbckr/sgpt/v2/internal/testlib"
+	"github.com/tbckr/sgpt/v2/pkg/ledger"
+)
+
+func appendTestUsage(t *testing.T, testCtx *testlib.TestCtx) {
+	cost := 0.01
+	records := []ledger.Record{
+		{Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local), Model: "gpt-4o", ChatID: "work", PromptTokens: 100, CompletionTokens: 50, Cost: &cost},
+		{Time: time.Date(2026, 3, 1, 13, 0, 0, 0, time.Local), Model: "gpt-4o", PromptTokens: 10, CompletionTokens: 5, Cost: &cost},
+		{Time: time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local), Model: "llama3", PromptTokens: 20, CompletionTokens: 10},
+	}
+	for _, record := range records {
+		require.NoError(t, ledger.Append(testCtx.Config, record))
+	}
+}
+
+func TestUsageCmdTable(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	appendTestUsage(t, testCtx)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"usage"})
+	require.Equal(t, 0, mem.code)
+
+	expected := `DAY         REQUESTS  PROMPT  COMPLETION  TOTAL  COST
+2026-03-01  2         110     55          165    $0.0200
+2026-03-02  1         20      10          30     $0.0000*
+TOTAL       3         130     65          195    $0.0200*
+* excludes 1 requests to models without a known price
+`
+	require.Equal(t, expected, out.String())
+}
+
+func TestUsageCmdJSON(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+	appendTestUsage(t, testCtx)
+	mem := &exitMemento{}
+
+	var out bytes.Buffer
+	root := newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+	root.cmd.SetOut(&out)
+	root.Execute([]string{"usage", "--by", "model,session", "-o", "json", "--since", "2026-03-01"})
+	require.Equal(t, 0, mem.code)
+
+	var summaries []ledger.Summary
+	require.NoError(t, json.Unmarshal(out.Bytes(), &summaries))
+	require.Len(t, summaries, 3)
+	require.Equal(t, ledger.Summary{Model: "gpt-4o", Requests: 1, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, Cost: 0.01}, summaries[0])
+	require.Equal(t, "work", summaries[1].Session)
+	require.Equal(t, 1, summaries[2].UnpricedRequests)
+}
+
+func TestUsageCmdInvalidFlags(t *testing.T) {
+	testCtx := testlib.NewTestCtx(t)
+
+	for _, args := range [][]string{
+		{"usage", "--by", "week"},
+		{"usage", "-o", "yaml"},
+		{"usage", "--since", "yesterday"},
+	} {
+		mem := &exitMemento{}
+		root := newRootCmd(mem.Exit, testCtx.Config, nil, nil)
+		root.Execute(args)
+		require.Equal(t, 1, mem.code, args)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+
+	since, err := parseSince("24h", now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-24*time.Hour), since)
+
+	since, err = parseSince("", now)
+	require.NoError(t, err)
+	require.True(t, since.IsZero())
+}
@@ -22,6 +22,8 @@
 package fs
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -39,6 +41,9 @@ const (
 	// maxImageSize is the upper limit for LoadBase64ImageFromFile (20 MiB),
 	// matching the OpenAI vision API's per-image limit.
 	maxImageSize = 20 << 20
+	// maxAudioSize is the upper limit for LoadAudioFromFile (25 MiB),
+	// matching the OpenAI audio API's per-file limit.
+	maxAudioSize = 25 << 20
 )
 
 // ErrInputTooLarge is returned by ReadAll when the input exceeds maxInputSize.
@@ -48,6 +53,10 @@ var ErrInputTooLarge = errors.New("input exceeds 1 MiB limit")
 // exceeds maxImageSize.
 var ErrImageTooLarge = errors.New("image exceeds 20 MiB limit")
 
+// ErrAudioTooLarge is returned by LoadAudioFromFile when the audio file
+// exceeds maxAudioSize.
+var ErrAudioTooLarge = errors.New("audio exceeds 25 MiB limit")
+
 // ErrPathOutsideCwd is returned by ResolveUnderCwd when the input path
 // resolves to a location outside the current working directory.
 var ErrPathOutsideCwd = errors.New("path is outside the working directory")
@@ -56,6 +65,23 @@ var ErrPathOutsideCwd = errors.New("path is outside the working directory")
 // type does not begin with "image/".
 var ErrNotImage = errors.New("file is not an image")
 
+// ErrNotAudio is returned by GetAudioFileType when the sniffed content type
+// is not one of the audio formats accepted by the audio API.
+var ErrNotAudio = errors.New("file is not a supported audio file")
+
+// audioExtensions maps the content types accepted by the audio API to the
+// file extension the API uses to detect the format.
+var audioExtensions = map[string]string{
+	"audio/flac": "flac",
+	"audio/mpeg": "mp3",
+	"audio/mp4":  "m4a",
+	"video/mp4":  "mp4",
+	"audio/ogg":  "ogg",
+	"audio/wave": "wav",
+	"audio/webm": "webm",
+	"video/webm": "webm",
+}
+
 // ResolveUnderCwd resolves p to an absolute path and rejects it if it
 // escapes the current working directory. It is used to prevent --input
 // from reading arbitrary files outside the working directory and
@@ -118,6 +144,61 @@ func resolveSymlinksBestEffort(p string) (string, error) {
 	return filepath.Join(resolvedParent, filepath.Base(p)), nil
 }
 
+// CreateUnderCwd creates the new file p for writing after the same
+// containment check as ResolveUnderCwd. An existing file is never
+// overwritten or followed, even if it is a symlink: os.ErrExist is returned
+// instead.
+func CreateUnderCwd(p string, perm os.FileMode) (*os.File, error) {
+	resolved, err := ResolveUnderCwd(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(resolved, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+}
+
+// CreateNumberedUnderCwd creates the first file named prefix-N.ext in dir
+// that does not exist yet, counting N from 1. dir must be inside the working
+// directory.
+func CreateNumberedUnderCwd(dir, prefix, ext string, perm os.FileMode) (*os.File, error) {
+	for n := 1; ; n++ {
+		f, err := CreateUnderCwd(filepath.Join(dir, fmt.Sprintf("%s-%d.%s", prefix, n, ext)), perm)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// WriteFileUnderCwd writes data to p after the same containment check as
+// ResolveUnderCwd, replacing an existing file. The data is written to a
+// temporary file that is renamed to p, so a symlink at p is replaced rather
+// than followed and readers never see a partially written file.
+func WriteFileUnderCwd(p string, data []byte, perm os.FileMode) error {
+	// Only the directory is resolved, the file itself is replaced
+	dir, err := ResolveUnderCwd(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(dir, filepath.Base(p))
+	f, err := os.CreateTemp(dir, "."+filepath.Base(resolved)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), resolved)
+}
+
 const (
 	defaultDirPermissions = 0755
 	appName               = "sgpt"
@@ -189,6 +270,28 @@ func ReadAll(in io.Reader) (string, error) {
 	return string(data), nil
 }
 
+// ReadContext calls read and returns its result, or ctx.Err() as soon as ctx
+// is done. Reads from a terminal cannot be cancelled, so an abandoned read
+// keeps blocking in the background and its reader must not be used anymore.
+func ReadContext[T any](ctx context.Context, read func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		value, err := read()
+		results <- result{value, err}
+	}()
+	select {
+	case r := <-results:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
 // GetImageFileType returns the file type of images
 func GetImageFileType(inputFile string) (string, error) {
 	file, err := os.Open(inputFile)
@@ -242,3 +345,68 @@ func LoadBase64ImageFromFile(inputFile string) (string, error) {
 	b64Image := base64.StdEncoding.EncodeToString(imageBytes)
 	return b64Image, nil
 }
+
+// GetAudioFileType returns the content type of audio files accepted by the
+// audio API, and the file extension that matches it. Formats that
+// http.DetectContentType does not know, like FLAC and MP3 without ID3 tag,
+// are sniffed by their magic numbers.
+func GetAudioFileType(inputFile string) (string, string, error) {
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// Only the first 512 bytes are used to sniff the content type.
+	buffer := make([]byte, 512)
+	n, err := file.Read(buffer)
+	if err != nil {
+		return "", "", err
+	}
+	buffer = buffer[:n]
+
+	var contentType string
+	switch {
+	case bytes.HasPrefix(buffer, []byte("fLaC")):
+		contentType = "audio/flac"
+	case len(buffer) >= 2 && buffer[0] == 0xFF && buffer[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync
+		contentType = "audio/mpeg"
+	case len(buffer) >= 12 && string(buffer[4:8]) == "ftyp" && string(buffer[8:11]) == "M4A":
+		contentType = "audio/mp4"
+	default:
+		contentType = http.DetectContentType(buffer)
+		if contentType == "application/ogg" {
+			contentType = "audio/ogg"
+		}
+	}
+
+	ext, ok := audioExtensions[contentType]
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s detected for %q", ErrNotAudio, contentType, inputFile)
+	}
+	return contentType, ext, nil
+}
+
+// LoadAudioFromFile loads an audio file.
+// Returns ErrAudioTooLarge if the file exceeds maxAudioSize.
+func LoadAudioFromFile(inputFile string) ([]byte, error) {
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	audioBytes, err := io.ReadAll(io.LimitReader(file, maxAudioSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read audio: %w", err)
+	}
+	if len(audioBytes) > maxAudioSize {
+		return nil, ErrAudioTooLarge
+	}
+	return audioBytes, nil
+}
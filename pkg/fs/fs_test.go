@@ -423,3 +423,128 @@ func TestGetImageFileType_RejectsNonImage(t *testing.T) {
 	_, err := GetImageFileType(notImage)
 	require.ErrorIs(t, err, ErrNotImage)
 }
+
+func TestCreateUnderCwd(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	f, err := CreateUnderCwd("out.png", 0o644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Existing files are never overwritten.
+	_, err = CreateUnderCwd("out.png", 0o644)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	_, err = CreateUnderCwd(filepath.Join(t.TempDir(), "out.png"), 0o644)
+	require.ErrorIs(t, err, ErrPathOutsideCwd)
+}
+
+func TestCreateUnderCwd_RejectsSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	target := filepath.Join(dir, "target.txt")
+	require.NoError(t, os.WriteFile(target, []byte("keep"), 0o600))
+	require.NoError(t, os.Symlink(target, filepath.Join(dir, "link.png")))
+
+	_, err := CreateUnderCwd("link.png", 0o644)
+	require.ErrorIs(t, err, os.ErrExist)
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "keep", string(data))
+}
+
+func TestCreateNumberedUnderCwd(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cat-1.png"), nil, 0o600))
+
+	f, err := CreateNumberedUnderCwd(".", "cat", "png", 0o644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "cat-2.png", filepath.Base(f.Name()))
+}
+
+func TestWriteFileUnderCwd(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	require.NoError(t, WriteFileUnderCwd("out.mp3", []byte("first"), 0o644))
+	// Existing files are replaced.
+	require.NoError(t, WriteFileUnderCwd("out.mp3", []byte("second"), 0o644))
+	data, err := os.ReadFile(filepath.Join(dir, "out.mp3"))
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	err = WriteFileUnderCwd(filepath.Join(t.TempDir(), "out.mp3"), nil, 0o644)
+	require.ErrorIs(t, err, ErrPathOutsideCwd)
+}
+
+func TestWriteFileUnderCwd_ReplacesSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	target := filepath.Join(dir, "target.txt")
+	require.NoError(t, os.WriteFile(target, []byte("keep"), 0o600))
+	require.NoError(t, os.Symlink(target, filepath.Join(dir, "link.mp3")))
+
+	require.NoError(t, WriteFileUnderCwd("link.mp3", []byte("audio"), 0o644))
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "keep", string(data))
+}
+
+func TestGetAudioFileType(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		contentType string
+		ext         string
+	}{
+		{name: "FLAC", header: "fLaC\x00\x00\x00\x22", contentType: "audio/flac", ext: "flac"},
+		{name: "MP3", header: "\xff\xfb\x90\x64\x00", contentType: "audio/mpeg", ext: "mp3"},
+		{name: "MP3WithID3", header: "ID3\x04\x00\x00\x00\x00\x00\x00", contentType: "audio/mpeg", ext: "mp3"},
+		{name: "M4A", header: "\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00M4A mp42isom", contentType: "audio/mp4", ext: "m4a"},
+		{name: "MP4", header: "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41", contentType: "video/mp4", ext: "mp4"},
+		{name: "WAV", header: "RIFF\x24\x08\x00\x00WAVEfmt ", contentType: "audio/wave", ext: "wav"},
+		{name: "OGG", header: "OggS\x00\x02\x00\x00", contentType: "audio/ogg", ext: "ogg"},
+		{name: "WebM", header: "\x1a\x45\xdf\xa3\x9f\x42\x86\x81", contentType: "video/webm", ext: "webm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audio")
+			require.NoError(t, os.WriteFile(path, []byte(tt.header), 0o600))
+			contentType, ext, err := GetAudioFileType(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.contentType, contentType)
+			require.Equal(t, tt.ext, ext)
+		})
+	}
+}
+
+func TestGetAudioFileType_RejectsNonAudio(t *testing.T) {
+	_, _, err := GetAudioFileType("testdata/marvin.png")
+	require.ErrorIs(t, err, ErrNotAudio)
+}
+
+func TestLoadAudioFromFile_LimitExceeded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.mp3")
+	require.NoError(t, os.WriteFile(path, make([]byte, maxAudioSize+1), 0o600))
+
+	_, err := LoadAudioFromFile(path)
+	require.ErrorIs(t, err, ErrAudioTooLarge)
+
+	require.NoError(t, os.Truncate(path, maxAudioSize))
+	data, err := LoadAudioFromFile(path)
+	require.NoError(t, err)
+	require.Len(t, data, maxAudioSize)
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package ledger records the token usage and estimated cost of every request
+// in an append-only JSON lines file in the cache directory.
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+)
+
+const (
+	// dirName is the ledger directory inside the cache dir. The leading dot
+	// keeps it apart from chat sessions, whose names cannot start with a dot.
+	dirName  = ".usage"
+	fileName = "ledger.jsonl"
+
+	dirPermissions  = 0700
+	filePermissions = 0600
+
+	// maxLineSize bounds a single record when reading the ledger.
+	maxLineSize = 1 << 20
+
+	// GroupDay, GroupModel and GroupSession are the keys usage can be aggregated by.
+	GroupDay     = "day"
+	GroupModel   = "model"
+	GroupSession = "session"
+)
+
+// ErrUnknownGroup is returned, if usage is aggregated by an unsupported key.
+var ErrUnknownGroup = fmt.Errorf("usage can only be grouped by %s, %s or %s", GroupDay, GroupModel, GroupSession)
+
+// Record is the usage of a single request.
+type Record struct {
+	Time             time.Time `json:"time"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	Persona          string    `json:"persona,omitempty"`
+	ChatID           string    `json:"chatId,omitempty"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	TotalTokens      int       `json:"totalTokens"`
+	// Cost is the estimated cost in USD. It is nil if the price of the model
+	// is unknown.
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+// Summary is the aggregated usage of a group of records. Only the fields of
+// the keys the records were grouped by are set.
+type Summary struct {
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Session          string  `json:"session,omitempty"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	TotalTokens      int     `json:"totalTokens"`
+	Cost             float64 `json:"cost"`
+	// UnpricedRequests counts the requests that are not included in Cost.
+	UnpricedRequests int `json:"unpricedRequests"`
+}
+
+// price is a configured model price in USD per million tokens.
+type price struct {
+	Input  float64 `mapstructure:"input"`
+	Output float64 `mapstructure:"output"`
+}
+
+// Enabled reports whether usage is recorded. It is, unless usage.ledger is
+// set to false or there is no cache dir.
+func Enabled(config *viper.Viper) bool {
+	if config.IsSet("usage.ledger") && !config.GetBool("usage.ledger") {
+		return false
+	}
+	return config.GetString("cacheDir") != ""
+}
+
+// Path returns the path of the ledger file.
+func Path(config *viper.Viper) string {
+	return filepath.Join(config.GetString("cacheDir"), dirName, fileName)
+}
+
+// Cost estimates the cost of a request in USD. Prices configured in the
+// prices section take precedence over the built-in list prices. Cost returns
+// nil, if the price of model is unknown.
+func Cost(config *viper.Viper, model string, promptTokens, completionTokens int) *float64 {
+	p, ok := lookupPrice(config, model)
+	if !ok {
+		return nil
+	}
+	cost := (float64(promptTokens)*p.Input + float64(completionTokens)*p.Output) / 1e6
+	return &cost
+}
+
+func lookupPrice(config *viper.Viper, model string) (price, bool) {
+	var configured map[string]price
+	if err := config.UnmarshalKey("prices", &configured); err != nil {
+		slog.Warn("Ignoring invalid prices config", "error", err)
+	}
+	// viper lowercases map keys, so the configured prices are matched like
+	// the built-in table
+	if match, ok := models.Match(model, configured); ok {
+		return configured[match], true
+	}
+	info, ok := models.Lookup(model)
+	if !ok || (info.InputPrice == 0 && info.OutputPrice == 0) {
+		return price{}, false
+	}
+	return price{Input: info.InputPrice, Output: info.OutputPrice}, true
+}
+
+// Append adds record to the ledger. The time and total are filled in, if they
+// are not set.
+func Append(config *viper.Viper, record Record) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	if record.TotalTokens == 0 {
+		record.TotalTokens = record.PromptTokens + record.CompletionTokens
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	path := Path(config)
+	if err = os.MkdirAll(filepath.Dir(path), dirPermissions); err != nil {
+		return err
+	}
+	var file *os.File
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePermissions)
+	if err != nil {
+		return err
+	}
+	// A single write per record keeps lines intact when several sgpt
+	// processes append at the same time.
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	slog.Debug("Recorded usage", "model", record.Model, "tokens", record.TotalTokens)
+	return file.Close()
+}
+
+// Read returns all records of the ledger. A missing ledger has no records.
+func Read(config *viper.Viper) ([]Record, error) {
+	file, err := os.Open(Path(config))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("ledger line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Aggregate sums up records grouped by the given keys. Days are local
+// calendar days. The summaries are sorted by their keys in the given order.
+func Aggregate(records []Record, by []string) ([]Summary, error) {
+	for _, key := range by {
+		if key != GroupDay && key != GroupModel && key != GroupSession {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownGroup, key)
+		}
+	}
+
+	type groupKey struct{ day, model, session string }
+	groups := make(map[groupKey]*Summary)
+	for _, record := range records {
+		var key groupKey
+		for _, group := range by {
+			switch group {
+			case GroupDay:
+				key.day = record.Time.Local().Format(time.DateOnly)
+			case GroupModel:
+				key.model = record.Model
+			case GroupSession:
+				key.session = record.ChatID
+			}
+		}
+		summary, ok := groups[key]
+		if !ok {
+			summary = &Summary{Day: key.day, Model: key.model, Session: key.session}
+			groups[key] = summary
+		}
+		summary.Requests++
+		summary.PromptTokens += record.PromptTokens
+		summary.CompletionTokens += record.CompletionTokens
+		summary.TotalTokens += record.TotalTokens
+		if record.Cost != nil {
+			summary.Cost += *record.Cost
+		} else {
+			summary.UnpricedRequests++
+		}
+	}
+
+	summaries := make([]Summary, 0, len(groups))
+	for _, summary := range groups {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		for _, group := range by {
+			if c := strings.Compare(summaries[i].field(group), summaries[j].field(group)); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return summaries, nil
+}
+
+func (s Summary) field(group string) string {
+	switch group {
+	case GroupDay:
+		return s.Day
+	case GroupModel:
+		return s.Model
+	default:
+		return s.Session
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package ledger
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestConfig(t *testing.T) *viper.Viper {
+	config := viper.New()
+	config.Set("cacheDir", t.TempDir())
+	return config
+}
+
+func TestAppendAndRead(t *testing.T) {
+	config := createTestConfig(t)
+
+	records, err := Read(config)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	require.NoError(t, Append(config, Record{Provider: "openai", Model: "gpt-4o", PromptTokens: 10, CompletionTokens: 5}))
+	require.NoError(t, Append(config, Record{Provider: "ollama", Model: "llama3", ChatID: "test", PromptTokens: 1, CompletionTokens: 2}))
+
+	records, err = Read(config)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, 15, records[0].TotalTokens)
+	require.False(t, records[0].Time.IsZero())
+	require.Equal(t, "test", records[1].ChatID)
+
+	info, err := os.Stat(Path(config))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestReadInvalidLedger(t *testing.T) {
+	config := createTestConfig(t)
+	require.NoError(t, Append(config, Record{Model: "gpt-4o", PromptTokens: 1}))
+
+	file, err := os.OpenFile(Path(config), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString("{broken\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = Read(config)
+	require.ErrorContains(t, err, "ledger line 2")
+}
+
+func TestEnabled(t *testing.T) {
+	config := createTestConfig(t)
+	require.True(t, Enabled(config))
+
+	config.Set("usage.ledger", false)
+	require.False(t, Enabled(config))
+
+	require.False(t, Enabled(viper.New()))
+}
+
+func TestCost(t *testing.T) {
+	config := createTestConfig(t)
+
+	cost := Cost(config, "gpt-4o-2024-08-06", 1_000_000, 100_000)
+	require.NotNil(t, cost)
+	require.InDelta(t, 3.5, *cost, 1e-9)
+
+	require.Nil(t, Cost(config, "llama3", 100, 100))
+
+	// Configured prices take precedence
+	config.Set("prices", map[string]any{
+		"llama3":  map[string]any{"input": 0.1, "output": 0.2},
+		"gpt-4o":  map[string]any{"input": 1, "output": 1},
+		"gpt-4.1": map[string]any{"input": 5, "output": 5},
+	})
+	cost = Cost(config, "llama3:8b", 1_000_000, 1_000_000)
+	require.NotNil(t, cost)
+	require.InDelta(t, 0.3, *cost, 1e-9)
+
+	cost = Cost(config, "GPT-4.1", 1_000_000, 0)
+	require.NotNil(t, cost)
+	require.InDelta(t, 5, *cost, 1e-9)
+}
+
+func TestAggregate(t *testing.T) {
+	cost := 1.5
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	records := []Record{
+		{Time: day, Model: "b", ChatID: "x", PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2, Cost: &cost},
+		{Time: day, Model: "a", PromptTokens: 2, CompletionTokens: 2, TotalTokens: 4},
+		{Time: day.Add(24 * time.Hour), Model: "b", PromptTokens: 3, CompletionTokens: 3, TotalTokens: 6, Cost: &cost},
+	}
+
+	summaries, err := Aggregate(records, []string{GroupModel})
+	require.NoError(t, err)
+	require.Equal(t, []Summary{
+		{Model: "a", Requests: 1, PromptTokens: 2, CompletionTokens: 2, TotalTokens: 4, UnpricedRequests: 1},
+		{Model: "b", Requests: 2, PromptTokens: 4, CompletionTokens: 4, TotalTokens: 8, Cost: 3},
+	}, summaries)
+
+	summaries, err = Aggregate(records, []string{GroupDay, GroupSession})
+	require.NoError(t, err)
+	require.Len(t, summaries, 3)
+	require.Equal(t, "2026-03-01", summaries[0].Day)
+	require.Equal(t, "", summaries[0].Session)
+	require.Equal(t, "x", summaries[1].Session)
+	require.Equal(t, "2026-03-02", summaries[2].Day)
+
+	_, err = Aggregate(records, []string{"week"})
+	require.ErrorIs(t, err, ErrUnknownGroup)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package models
+
+import (
+	"strings"
+)
+
+const (
+	// EncodingO200K is the tokenizer of the GPT-4o and newer model families.
+	EncodingO200K = "o200k_base"
+	// EncodingCL100K is the tokenizer of the GPT-3.5 and GPT-4 model families.
+	EncodingCL100K = "cl100k_base"
+)
+
+// Info describes the capabilities of a model family.
+type Info struct {
+	// ContextWindow is the number of tokens the model accepts, prompt and completion combined.
+	ContextWindow int
+	// Encoding is the tiktoken encoding used to count tokens. For models that
+	// are not tokenized by tiktoken, it is a close approximation.
+	Encoding string
+	// InputPrice and OutputPrice are the list prices in USD per million
+	// prompt and completion tokens. Zero means the price is unknown.
+	InputPrice  float64
+	OutputPrice float64
+	// Reasoning is set for models that think before they answer. They take
+	// max_completion_tokens instead of max_tokens and reject sampling
+	// parameters like temperature and top_p.
+	Reasoning bool
+}
+
+// known maps model name prefixes to their capabilities. Dated snapshots such
+// as gpt-4o-2024-08-06 are matched by the longest prefix.
+var known = map[string]Info{
+	"gpt-3.5-turbo":          {ContextWindow: 16385, Encoding: EncodingCL100K, InputPrice: 0.5, OutputPrice: 1.5},
+	"gpt-4":                  {ContextWindow: 8192, Encoding: EncodingCL100K, InputPrice: 30, OutputPrice: 60},
+	"gpt-4-32k":              {ContextWindow: 32768, Encoding: EncodingCL100K, InputPrice: 60, OutputPrice: 120},
+	"gpt-4-1106":             {ContextWindow: 128000, Encoding: EncodingCL100K, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-0125":             {ContextWindow: 128000, Encoding: EncodingCL100K, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-turbo":            {ContextWindow: 128000, Encoding: EncodingCL100K, InputPrice: 10, OutputPrice: 30},
+	"gpt-4o":                 {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 2.5, OutputPrice: 10},
+	"gpt-4o-mini":            {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 0.15, OutputPrice: 0.6},
+	"chatgpt-4o":             {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 5, OutputPrice: 15},
+	"gpt-4.1":                {ContextWindow: 1047576, Encoding: EncodingO200K, InputPrice: 2, OutputPrice: 8},
+	"gpt-4.1-mini":           {ContextWindow: 1047576, Encoding: EncodingO200K, InputPrice: 0.4, OutputPrice: 1.6},
+	"gpt-4.1-nano":           {ContextWindow: 1047576, Encoding: EncodingO200K, InputPrice: 0.1, OutputPrice: 0.4},
+	"gpt-4.5":                {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 75, OutputPrice: 150},
+	"gpt-5":                  {ContextWindow: 400000, Encoding: EncodingO200K, InputPrice: 1.25, OutputPrice: 10, Reasoning: true},
+	"gpt-5-chat":             {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 1.25, OutputPrice: 10},
+	"gpt-5-mini":             {ContextWindow: 400000, Encoding: EncodingO200K, InputPrice: 0.25, OutputPrice: 2, Reasoning: true},
+	"gpt-5-nano":             {ContextWindow: 400000, Encoding: EncodingO200K, InputPrice: 0.05, OutputPrice: 0.4, Reasoning: true},
+	"o1":                     {ContextWindow: 200000, Encoding: EncodingO200K, InputPrice: 15, OutputPrice: 60, Reasoning: true},
+	"o1-mini":                {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 1.1, OutputPrice: 4.4, Reasoning: true},
+	"o1-preview":             {ContextWindow: 128000, Encoding: EncodingO200K, InputPrice: 15, OutputPrice: 60, Reasoning: true},
+	"o3":                     {ContextWindow: 200000, Encoding: EncodingO200K, InputPrice: 2, OutputPrice: 8, Reasoning: true},
+	"o3-mini":                {ContextWindow: 200000, Encoding: EncodingO200K, InputPrice: 1.1, OutputPrice: 4.4, Reasoning: true},
+	"o4-mini":                {ContextWindow: 200000, Encoding: EncodingO200K, InputPrice: 1.1, OutputPrice: 4.4, Reasoning: true},
+	"claude":                 {ContextWindow: 200000, Encoding: EncodingCL100K},
+	"claude-3-5-haiku":       {ContextWindow: 200000, Encoding: EncodingCL100K, InputPrice: 0.8, OutputPrice: 4},
+	"claude-haiku-4-5":       {ContextWindow: 200000, Encoding: EncodingCL100K, InputPrice: 1, OutputPrice: 5},
+	"claude-sonnet-4":        {ContextWindow: 200000, Encoding: EncodingCL100K, InputPrice: 3, OutputPrice: 15},
+	"claude-opus-4":          {ContextWindow: 200000, Encoding: EncodingCL100K, InputPrice: 15, OutputPrice: 75},
+	"gemini-1.5":             {ContextWindow: 1048576, Encoding: EncodingCL100K},
+	"gemini-2":               {ContextWindow: 1048576, Encoding: EncodingCL100K},
+	"llama3":                 {ContextWindow: 8192, Encoding: EncodingCL100K},
+	"llama3.1":               {ContextWindow: 131072, Encoding: EncodingCL100K},
+	"mistral":                {ContextWindow: 32768, Encoding: EncodingCL100K},
+	"text-embedding-3":       {ContextWindow: 8191, Encoding: EncodingCL100K},
+	"text-embedding-3-small": {ContextWindow: 8191, Encoding: EncodingCL100K, InputPrice: 0.02},
+	"text-embedding-3-large": {ContextWindow: 8191, Encoding: EncodingCL100K, InputPrice: 0.13},
+	"text-embedding-ada":     {ContextWindow: 8191, Encoding: EncodingCL100K, InputPrice: 0.1},
+}
+
+// Lookup returns the capabilities of model. Provider prefixes like
+// "openai/gpt-4o" used by routers such as OpenRouter are ignored.
+func Lookup(model string) (Info, bool) {
+	match, ok := Match(model, known)
+	if !ok {
+		return Info{}, false
+	}
+	return known[match], true
+}
+
+// Match returns the key of table that is the longest prefix of model. Keys
+// must be lowercase; provider prefixes of model are ignored like in Lookup.
+func Match[T any](model string, table map[string]T) (string, bool) {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	var match string
+	for prefix := range table {
+		if len(prefix) > len(match) && hasModelPrefix(name, prefix) {
+			match = prefix
+		}
+	}
+	return match, match != ""
+}
+
+// hasModelPrefix reports whether name is prefix or a variant of it, like
+// prefix-2024-08-06 or prefix:latest. "gpt-4o" is no variant of "gpt-4".
+func hasModelPrefix(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	switch name[len(prefix)] {
+	case '-', ':', '@':
+		return true
+	default:
+		return false
+	}
+}
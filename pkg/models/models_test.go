@@ -0,0 +1,98 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	for model, expected := range map[string]int{
+		"gpt-4":                     8192,
+		"gpt-4-0613":                8192,
+		"gpt-4-1106-preview":        128000,
+		"gpt-4o":                    128000,
+		"gpt-4o-2024-08-06":         128000,
+		"GPT-4o-Mini":               128000,
+		"gpt-4.1-nano":              1047576,
+		"o1-mini-2024-09-12":        128000,
+		"o3-mini":                   200000,
+		"openai/gpt-3.5-turbo":      16385,
+		"claude-sonnet-4-5":         200000,
+		"llama3.1:8b":               131072,
+		"llama3:latest":             8192,
+		"anthropic/claude-3-opus@1": 200000,
+	} {
+		t.Run(model, func(t *testing.T) {
+			info, ok := Lookup(model)
+			require.True(t, ok)
+			require.Equal(t, expected, info.ContextWindow)
+		})
+	}
+}
+
+func TestLookupUnknown(t *testing.T) {
+	for _, model := range []string{"", "my-model", "gpt-40", "o10", "phi3"} {
+		_, ok := Lookup(model)
+		require.False(t, ok, model)
+	}
+}
+
+func TestLookupPrices(t *testing.T) {
+	info, ok := Lookup("gpt-4o-mini-2024-07-18")
+	require.True(t, ok)
+	require.InDelta(t, 0.15, info.InputPrice, 1e-9)
+	require.InDelta(t, 0.6, info.OutputPrice, 1e-9)
+
+	// Known context window, unknown price
+	info, ok = Lookup("claude-3-opus")
+	require.True(t, ok)
+	require.Zero(t, info.InputPrice)
+}
+
+func TestLookupReasoning(t *testing.T) {
+	for model, reasoning := range map[string]bool{
+		"o1-2024-12-17":     true,
+		"o3-mini":           true,
+		"openai/o4-mini":    true,
+		"gpt-5-mini":        true,
+		"gpt-5-chat-latest": false,
+		"gpt-4o":            false,
+		"claude-sonnet-4":   false,
+	} {
+		info, ok := Lookup(model)
+		require.True(t, ok, model)
+		require.Equal(t, reasoning, info.Reasoning, model)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	table := map[string]int{"my-model": 1, "my-model-large": 2}
+	match, ok := Match("vendor/My-Model-Large-v2", table)
+	require.True(t, ok)
+	require.Equal(t, "my-model-large", match)
+
+	_, ok = Match("other", table)
+	require.False(t, ok)
+}
@@ -23,15 +23,19 @@ package modifiers
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"text/template"
 
 	"github.com/tbckr/sgpt/v2/pkg/fs"
+	"github.com/tbckr/sgpt/v2/pkg/tools"
+	"gopkg.in/yaml.v3"
 
 	"github.com/spf13/viper"
 )
@@ -47,42 +51,137 @@ var (
 	personaNameMatcher = regexp.MustCompile(personaNameRegex)
 
 	ErrUnsupportedModifier = errors.New("unsupported modifier")
+	// ErrInvalidFrontMatter is returned, if the front matter of a persona file cannot be parsed.
+	ErrInvalidFrontMatter = errors.New("invalid persona front matter")
+	// ErrUnknownPersonaOption is returned, if the front matter sets an option that is not in Options.
+	ErrUnknownPersonaOption = errors.New("unknown persona option")
 )
 
+// Options are the config keys the front matter of a persona may override.
+var Options = []string{
+	"maxTokens",
+	"temperature",
+	"topP",
+	"seed",
+	"stop",
+	"presencePenalty",
+	"frequencyPenalty",
+	"logitBias",
+	"n",
+	"fallbackModels",
+}
+
+const frontMatterDelimiter = "---"
+
+// Persona is a resolved persona: the rendered system prompt and the settings
+// declared in the optional YAML front matter of a persona file.
+type Persona struct {
+	Prompt string
+	Tools  []tools.Tool
+	// Options override config keys while the persona is used. The keys are
+	// from Options.
+	Options map[string]any
+}
+
+// frontMatter is the YAML block enclosed in "---" lines at the top of a persona file.
+type frontMatter struct {
+	Tools   []tools.Tool   `yaml:"tools"`
+	Options map[string]any `yaml:"options"`
+}
+
+// GetChatModifier returns the rendered system prompt of the persona modifier.
 func GetChatModifier(config *viper.Viper, modifier string) (string, error) {
-	persona, err := getPersonasModifier(config, modifier)
+	persona, err := GetPersona(config, modifier)
 	if err != nil {
 		return "", err
 	}
+	return persona.Prompt, nil
+}
+
+// GetPersona resolves modifier to a custom persona from the personas directory
+// or to one of the default personas.
+func GetPersona(config *viper.Viper, modifier string) (Persona, error) {
+	persona, err := getPersonasModifier(config, modifier)
+	if err != nil {
+		return Persona{}, err
+	}
 	// if a persona is found, render the prompt
 	// this overrides the default personas
 	if persona != "" {
 		slog.Debug("Using custom persona: " + modifier)
-		return renderPrompt(persona)
+		var meta frontMatter
+		meta, persona, err = splitFrontMatter(persona)
+		if err != nil {
+			return Persona{}, err
+		}
+		var prompt string
+		prompt, err = renderPrompt(persona)
+		if err != nil {
+			return Persona{}, err
+		}
+		return Persona{Prompt: prompt, Tools: meta.Tools, Options: meta.Options}, nil
 	}
 	// if no persona is found, try to load the default prompt
 	var loadedDefaultPrompts map[string]Prompt
 	loadedDefaultPrompts, err = loadDefaultPrompts()
 	if err != nil {
-		return "", err
+		return Persona{}, err
 	}
+	var prompt string
 	switch modifier {
 	case "sh":
 		slog.Debug("Using default persona: " + modifier)
-		return renderPrompt(loadedDefaultPrompts[modifier].Messages[0].Text)
+		prompt, err = renderPrompt(loadedDefaultPrompts[modifier].Messages[0].Text)
 	case "code":
 		slog.Debug("Using default persona: " + modifier)
-		return renderPrompt(loadedDefaultPrompts[modifier].Messages[0].Text)
+		prompt, err = renderPrompt(loadedDefaultPrompts[modifier].Messages[0].Text)
 	case "txt":
 		slog.Debug("No persona provided")
-		return "", nil
 	case "stdin":
 		slog.Debug("No persona provided, just using stdin with additional prompt")
-		return "", nil
 	default:
 		slog.Debug("Unsupported persona: " + modifier)
-		return "", ErrUnsupportedModifier
+		return Persona{}, ErrUnsupportedModifier
+	}
+	if err != nil {
+		return Persona{}, err
+	}
+	return Persona{Prompt: prompt}, nil
+}
+
+// splitFrontMatter separates the optional YAML front matter from the prompt of
+// a persona file. Files without front matter are returned unchanged.
+func splitFrontMatter(content string) (frontMatter, string, error) {
+	var meta frontMatter
+	normalized := strings.ReplaceAll(content, "\r\n", "\n")
+	if !strings.HasPrefix(normalized, frontMatterDelimiter+"\n") {
+		return meta, content, nil
+	}
+	rest := strings.TrimPrefix(normalized, frontMatterDelimiter+"\n")
+	end := strings.Index("\n"+rest, "\n"+frontMatterDelimiter+"\n")
+	if end < 0 {
+		// Allow a closing delimiter without a trailing prompt
+		if !strings.HasSuffix("\n"+rest, "\n"+frontMatterDelimiter) {
+			return meta, "", fmt.Errorf("%w: missing closing %q", ErrInvalidFrontMatter, frontMatterDelimiter)
+		}
+		end = len(rest) - len(frontMatterDelimiter)
+		rest += "\n"
+	}
+	if err := yaml.Unmarshal([]byte(rest[:end]), &meta); err != nil {
+		return meta, "", fmt.Errorf("%w: %w", ErrInvalidFrontMatter, err)
+	}
+	for _, tool := range meta.Tools {
+		if err := tool.Validate(); err != nil {
+			return meta, "", err
+		}
+	}
+	for key := range meta.Options {
+		if !slices.Contains(Options, key) {
+			return meta, "", fmt.Errorf("%w: %q (available: %s)", ErrUnknownPersonaOption, key, strings.Join(Options, ", "))
+		}
 	}
+	slog.Debug("Parsed persona front matter", "tools", len(meta.Tools), "options", len(meta.Options))
+	return meta, rest[end+len(frontMatterDelimiter)+1:], nil
 }
 
 func getPersonasModifier(config *viper.Viper, modifier string) (string, error) {
@@ -22,6 +22,7 @@
 package modifiers
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -30,6 +31,7 @@ import (
 	"testing"
 
 	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/tools"
 
 	"github.com/stretchr/testify/require"
 )
@@ -199,6 +201,72 @@ func TestGetChatModifierBuiltinCaseSensitive(t *testing.T) {
 	}
 }
 
+func TestGetPersonaFrontMatter(t *testing.T) {
+	personaContent := `---
+tools:
+  - name: read_file
+    description: Read a file
+    command: cat "$(jq -r .filePath)"
+    parameters:
+      type: object
+      properties:
+        filePath:
+          type: string
+---
+# This is a comment
+You are a helpful assistant.`
+
+	config := createTestConfig(t)
+	require.NoError(t, os.WriteFile(filepath.Join(config.GetString("personas"), "files"), []byte(personaContent), 0600))
+
+	persona, err := GetPersona(config, "files")
+	require.NoError(t, err)
+	require.Equal(t, "You are a helpful assistant.", persona.Prompt)
+	require.Len(t, persona.Tools, 1)
+	require.Equal(t, "read_file", persona.Tools[0].Name)
+	require.Contains(t, string(persona.Tools[0].Definition().Function.Parameters.(json.RawMessage)), "filePath")
+
+	// The wrapper only returns the prompt
+	modifier, err := GetChatModifier(config, "files")
+	require.NoError(t, err)
+	require.Equal(t, "You are a helpful assistant.", modifier)
+}
+
+func TestGetPersonaOptions(t *testing.T) {
+	personaContent := `---
+options:
+  temperature: 0
+  seed: 42
+  stop: ["END"]
+---
+You write test fixtures.`
+
+	config := createTestConfig(t)
+	personasDir := config.GetString("personas")
+	require.NoError(t, os.WriteFile(filepath.Join(personasDir, "fixtures"), []byte(personaContent), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(personasDir, "unknown"), []byte("---\noptions:\n  model: gpt-4o\n---\nprompt"), 0600))
+
+	persona, err := GetPersona(config, "fixtures")
+	require.NoError(t, err)
+	require.Equal(t, "You write test fixtures.", persona.Prompt)
+	require.Equal(t, map[string]any{"temperature": 0, "seed": 42, "stop": []any{"END"}}, persona.Options)
+
+	_, err = GetPersona(config, "unknown")
+	require.ErrorIs(t, err, ErrUnknownPersonaOption)
+}
+
+func TestGetPersonaInvalidFrontMatter(t *testing.T) {
+	config := createTestConfig(t)
+	personasDir := config.GetString("personas")
+	require.NoError(t, os.WriteFile(filepath.Join(personasDir, "unclosed"), []byte("---\ntools: []\nprompt"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(personasDir, "nocommand"), []byte("---\ntools:\n  - name: x\n---\nprompt"), 0600))
+
+	_, err := GetPersona(config, "unclosed")
+	require.ErrorIs(t, err, ErrInvalidFrontMatter)
+	_, err = GetPersona(config, "nocommand")
+	require.ErrorIs(t, err, tools.ErrInvalidTool)
+}
+
 func TestGetChatModifierTxt(t *testing.T) {
 	config := createTestConfig(t)
 
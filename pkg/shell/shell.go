@@ -32,8 +32,11 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"unicode"
+
+	"github.com/tbckr/sgpt/v2/pkg/fs"
 )
 
 func IsPipedShell() (bool, error) {
@@ -101,7 +104,10 @@ func SanitizeCommand(command string) (string, error) {
 	return sanitized, nil
 }
 
-func ExecuteCommandWithConfirmation(ctx context.Context, input io.Reader, output io.Writer, command string) error {
+// ExecuteCommandWithConfirmation asks the user for confirmation and executes
+// command. The env variables named in scrubEnv, e.g. API keys, are removed from
+// the environment of the command.
+func ExecuteCommandWithConfirmation(ctx context.Context, input io.Reader, output io.Writer, command string, scrubEnv ...string) error {
 	// Sanitize command to prevent display manipulation and reject
 	// multi-line payloads before the user is given a confirmation prompt
 	// that can't see the hidden trailing commands.
@@ -112,17 +118,25 @@ func ExecuteCommandWithConfirmation(ctx context.Context, input io.Reader, output
 	}
 	command = sanitized
 	// Require user confirmation
-	ok, err := getUserConfirmation(input, output)
+	ok, err := GetUserConfirmationContext(ctx, input, output)
 	if err != nil {
 		return err
 	}
 	if ok {
-		return executeShellCommand(ctx, output, command)
+		return executeShellCommand(ctx, output, command, scrubEnv)
 	}
 	return nil
 }
 
-func getUserConfirmation(input io.Reader, output io.Writer) (bool, error) {
+// GetUserConfirmation asks the user on output whether to execute a command and
+// reads the answer from input. An empty answer counts as confirmation.
+func GetUserConfirmation(input io.Reader, output io.Writer) (bool, error) {
+	return GetUserConfirmationContext(context.Background(), input, output)
+}
+
+// GetUserConfirmationContext is like GetUserConfirmation, but stops waiting
+// for an answer and returns ctx.Err() as soon as ctx is done, e.g. by Ctrl-C.
+func GetUserConfirmationContext(ctx context.Context, input io.Reader, output io.Writer) (bool, error) {
 	// Constructed once, outside the loop: bufio.Reader fills its internal
 	// buffer from input on first use, so rebuilding it every iteration would
 	// discard any bytes already buffered but not yet consumed (#379).
@@ -131,7 +145,10 @@ func getUserConfirmation(input io.Reader, output io.Writer) (bool, error) {
 		if _, err := fmt.Fprint(output, "Do you want to execute this command? (Y/n) "); err != nil {
 			return false, err
 		}
-		char, _, err := reader.ReadRune()
+		char, err := fs.ReadContext(ctx, func() (rune, error) {
+			char, _, err := reader.ReadRune()
+			return char, err
+		})
 		if err != nil {
 			return false, err
 		}
@@ -148,7 +165,71 @@ func getUserConfirmation(input io.Reader, output io.Writer) (bool, error) {
 	}
 }
 
-func executeShellCommand(ctx context.Context, output io.Writer, command string) error {
+func executeShellCommand(ctx context.Context, output io.Writer, command string, scrubEnv []string) error {
+	cmd := shellCommand(ctx, command)
+	cmd.Env = scrubEnviron(os.Environ(), scrubEnv)
+	cmd.Stdout = output
+	// Without Stderr wired, os/exec discards it entirely, leaving the user
+	// with only a bare "exit status N" on failure (#380).
+	cmd.Stderr = output
+	err := cmd.Run()
+	if err != nil {
+		return err
+	}
+	slog.Debug("Command executed successfully")
+	return nil
+}
+
+// RunCommand runs command in the platform shell with stdin as its standard
+// input and returns the combined stdout and stderr. The output is returned
+// even if the command fails, so callers can report what went wrong. The env
+// variables named in scrubEnv, e.g. API keys, are removed from the
+// environment of the command.
+func RunCommand(ctx context.Context, command string, stdin io.Reader, scrubEnv ...string) ([]byte, error) {
+	cmd := shellCommand(ctx, command)
+	cmd.Env = scrubEnviron(os.Environ(), scrubEnv)
+	cmd.Stdin = stdin
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, err
+	}
+	slog.Debug("Command executed successfully")
+	return output, nil
+}
+
+// Output runs command in the platform shell and returns its standard output.
+// Standard error and input are passed through, so commands like pass can ask
+// for a passphrase. The env variables named in scrubEnv are removed from the
+// environment of the command.
+func Output(ctx context.Context, command string, scrubEnv ...string) ([]byte, error) {
+	cmd := shellCommand(ctx, command)
+	cmd.Env = scrubEnviron(os.Environ(), scrubEnv)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// scrubEnviron returns environ without the variables named in keys.
+func scrubEnviron(environ, keys []string) []string {
+	scrubbed := make([]string, 0, len(environ))
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if slices.ContainsFunc(keys, func(key string) bool {
+			// env variable names are case-insensitive on Windows
+			if runtime.GOOS == "windows" {
+				return strings.EqualFold(key, name)
+			}
+			return key == name
+		}) {
+			slog.Debug("Removed env variable from command environment", "name", name)
+			continue
+		}
+		scrubbed = append(scrubbed, entry)
+	}
+	return scrubbed
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
 	var executeCommand string
 	var args []string
 	switch runtime.GOOS {
@@ -162,15 +243,5 @@ func executeShellCommand(ctx context.Context, output io.Writer, command string)
 		args = []string{"-c", command}
 	}
 
-	cmd := exec.CommandContext(ctx, executeCommand, args...)
-	cmd.Stdout = output
-	// Without Stderr wired, os/exec discards it entirely, leaving the user
-	// with only a bare "exit status N" on failure (#380).
-	cmd.Stderr = output
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-	slog.Debug("Command executed successfully")
-	return nil
+	return exec.CommandContext(ctx, executeCommand, args...)
 }
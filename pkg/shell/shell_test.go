@@ -31,6 +31,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -100,7 +101,7 @@ func TestGetUserConfirmationYes(t *testing.T) {
 	var ok bool
 	var err error
 
-	ok, err = getUserConfirmation(stdinReader, stdoutWriter)
+	ok, err = GetUserConfirmation(stdinReader, stdoutWriter)
 
 	require.NoError(t, stdinReader.Close())
 	require.NoError(t, stdoutWriter.Close())
@@ -138,7 +139,7 @@ func TestGetUserConfirmationLinuxEnter(t *testing.T) {
 	var ok bool
 	var err error
 
-	ok, err = getUserConfirmation(stdinReader, stdoutWriter)
+	ok, err = GetUserConfirmation(stdinReader, stdoutWriter)
 
 	require.NoError(t, stdinReader.Close())
 	require.NoError(t, stdoutWriter.Close())
@@ -176,7 +177,7 @@ func TestGetUserConfirmationWindowsEnter(t *testing.T) {
 	var ok bool
 	var err error
 
-	ok, err = getUserConfirmation(stdinReader, stdoutWriter)
+	ok, err = GetUserConfirmation(stdinReader, stdoutWriter)
 
 	require.NoError(t, stdinReader.Close())
 	require.NoError(t, stdoutWriter.Close())
@@ -214,7 +215,7 @@ func TestGetUserConfirmationNo(t *testing.T) {
 	var ok bool
 	var err error
 
-	ok, err = getUserConfirmation(stdinReader, stdoutWriter)
+	ok, err = GetUserConfirmation(stdinReader, stdoutWriter)
 
 	require.NoError(t, stdinReader.Close())
 	require.NoError(t, stdoutWriter.Close())
@@ -235,7 +236,7 @@ func TestGetUserConfirmationAsked2Times(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		// A single unrecognised byte with no newline, written separately
-		// from the confirming "Y\n" below. With getUserConfirmation's
+		// from the confirming "Y\n" below. With GetUserConfirmation's
 		// bufio.Reader now shared across loop iterations (#379), the "Y\n"
 		// written in the second Write call is still readable on the second
 		// iteration instead of being lost with a discarded reader.
@@ -259,7 +260,7 @@ func TestGetUserConfirmationAsked2Times(t *testing.T) {
 	var ok bool
 	var err error
 
-	ok, err = getUserConfirmation(stdinReader, stdoutWriter)
+	ok, err = GetUserConfirmation(stdinReader, stdoutWriter)
 
 	require.NoError(t, stdinReader.Close())
 	require.NoError(t, stdoutWriter.Close())
@@ -279,12 +280,24 @@ func TestGetUserConfirmation_BufferedInputNotLost(t *testing.T) {
 	input := strings.NewReader("zY\n")
 	var output bytes.Buffer
 
-	ok, err := getUserConfirmation(input, &output)
+	ok, err := GetUserConfirmation(input, &output)
 
 	require.NoError(t, err)
 	require.True(t, ok)
 }
 
+func TestGetUserConfirmationContextCancelled(t *testing.T) {
+	// Nothing is written, like a terminal waiting for the user
+	stdinReader, stdinWriter := io.Pipe()
+	t.Cleanup(func() { _ = stdinWriter.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	ok, err := GetUserConfirmationContext(ctx, stdinReader, io.Discard)
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, ok)
+}
+
 func TestExecuteShellCommandEcho(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("shell execution tests require bash and are not supported on Windows")
@@ -303,7 +316,7 @@ func TestExecuteShellCommandEcho(t *testing.T) {
 		require.Equal(t, "test\n", buf.String())
 	}()
 
-	err := executeShellCommand(context.Background(), stdoutWriter, "echo test")
+	err := executeShellCommand(context.Background(), stdoutWriter, "echo test", nil)
 
 	require.NoError(t, stdoutWriter.Close())
 
@@ -332,7 +345,7 @@ func TestExecuteShellCommand_StderrForwarded(t *testing.T) {
 		require.Contains(t, buf.String(), "oops")
 	}()
 
-	err := executeShellCommand(context.Background(), stdoutWriter, "echo oops >&2; exit 1")
+	err := executeShellCommand(context.Background(), stdoutWriter, "echo oops >&2; exit 1", nil)
 
 	require.NoError(t, stdoutWriter.Close())
 
@@ -341,6 +354,49 @@ func TestExecuteShellCommand_StderrForwarded(t *testing.T) {
 	wg.Wait()
 }
 
+func TestExecuteShellCommand_ScrubEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell execution tests require bash and are not supported on Windows")
+	}
+	t.Setenv("SGPT_TEST_SECRET", "secret")
+	t.Setenv("SGPT_TEST_KEPT", "kept")
+
+	var out bytes.Buffer
+	err := executeShellCommand(context.Background(), &out, `echo "${SGPT_TEST_SECRET:-unset} $SGPT_TEST_KEPT"`, []string{"SGPT_TEST_SECRET"})
+	require.NoError(t, err)
+	require.Equal(t, "unset kept\n", out.String())
+}
+
+func TestOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell execution tests require bash and are not supported on Windows")
+	}
+	output, err := Output(context.Background(), "echo key; echo noise >&2")
+	require.NoError(t, err)
+	require.Equal(t, "key\n", string(output))
+
+	_, err = Output(context.Background(), "exit 2")
+	require.Error(t, err)
+}
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell execution tests require bash and are not supported on Windows")
+	}
+	output, err := RunCommand(context.Background(), "cat; echo oops >&2", strings.NewReader(`{"a":1}`))
+	require.NoError(t, err)
+	require.Equal(t, "{\"a\":1}oops\n", string(output))
+
+	output, err = RunCommand(context.Background(), "echo failed; exit 3", nil)
+	require.Error(t, err)
+	require.Equal(t, "failed\n", string(output))
+
+	t.Setenv("SGPT_TEST_SECRET", "secret")
+	output, err = RunCommand(context.Background(), `echo "${SGPT_TEST_SECRET:-scrubbed}"`, nil, "SGPT_TEST_SECRET")
+	require.NoError(t, err)
+	require.Equal(t, "scrubbed\n", string(output))
+}
+
 func TestExecuteCommandWithConfirmation(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("shell execution tests require bash and are not supported on Windows")
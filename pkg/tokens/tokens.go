@@ -0,0 +1,129 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package tokens counts tokens with tiktoken. The BPE ranks are embedded in
+// the binary, so counting works offline and never downloads anything.
+package tokens
+
+import (
+	"log/slog"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tbckr/sgpt/v2/pkg/models"
+)
+
+const (
+	// Per-message overhead of the chat format, see
+	// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	// Every reply is primed with <|start|>assistant<|message|>
+	tokensReplyPriming = 3
+	// imageTokens approximates a high detail image of 1024x1024 pixels. The
+	// real cost depends on the image size, which is not known here.
+	imageTokens = 765
+)
+
+func init() {
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// Counter counts tokens with the encoding of one model.
+type Counter struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// NewCounter returns a Counter for model. Models missing from the model table
+// are counted with cl100k_base, which is close enough for budgeting.
+func NewCounter(model string) (*Counter, error) {
+	encodingName := models.EncodingCL100K
+	if info, ok := models.Lookup(model); ok {
+		encodingName = info.Encoding
+	}
+	encoding, err := tiktoken.GetEncoding(encodingName)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Token counter initialized", "model", model, "encoding", encodingName)
+	return &Counter{encoding: encoding}, nil
+}
+
+// Count returns the number of tokens in text. Special tokens are counted as
+// plain text, so user input can never be mistaken for control tokens.
+func (c *Counter) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	return len(c.encoding.EncodeOrdinary(text))
+}
+
+// Encode returns the token IDs of text. Like Count, special tokens are
+// encoded as plain text.
+func (c *Counter) Encode(text string) []int {
+	return c.encoding.EncodeOrdinary(text)
+}
+
+// CountMessage returns the number of tokens message takes up in a chat request.
+func (c *Counter) CountMessage(message openai.ChatCompletionMessage) int {
+	count := tokensPerMessage + c.Count(message.Role) + c.Count(message.Content)
+	if message.Name != "" {
+		count += tokensPerName + c.Count(message.Name)
+	}
+	for _, part := range message.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			count += c.Count(part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			count += imageTokens
+		}
+	}
+	for _, call := range message.ToolCalls {
+		count += c.Count(call.Function.Name) + c.Count(call.Function.Arguments)
+	}
+	return count
+}
+
+// CountMessages returns the number of prompt tokens of a chat request with messages.
+func (c *Counter) CountMessages(messages []openai.ChatCompletionMessage) int {
+	count := tokensReplyPriming
+	for _, message := range messages {
+		count += c.CountMessage(message)
+	}
+	return count
+}
+
+// UpperBound returns a cheap upper bound of CountMessages for any encoding.
+// BPE tokens span at least one byte, so the byte length bounds the count.
+func UpperBound(messages []openai.ChatCompletionMessage) int {
+	count := tokensReplyPriming
+	for _, message := range messages {
+		count += tokensPerMessage + tokensPerName + len(message.Role) + len(message.Content) + len(message.Name)
+		for _, part := range message.MultiContent {
+			count += len(part.Text) + imageTokens
+		}
+		for _, call := range message.ToolCalls {
+			count += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+	}
+	return count
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package tokens
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCount(t *testing.T) {
+	// Matches the example of the OpenAI cookbook for cl100k_base
+	counter, err := NewCounter("gpt-4")
+	require.NoError(t, err)
+	require.Equal(t, 0, counter.Count(""))
+	require.Equal(t, 6, counter.Count("tiktoken is great!"))
+	// Special tokens in user input are plain text
+	require.Positive(t, counter.Count("<|endoftext|>"))
+}
+
+func TestEncode(t *testing.T) {
+	counter, err := NewCounter("gpt-4")
+	require.NoError(t, err)
+	require.Equal(t, []int{15339, 1917}, counter.Encode("hello world"))
+	require.Empty(t, counter.Encode(""))
+}
+
+func TestCountMessages(t *testing.T) {
+	// Matches the example of the OpenAI cookbook for gpt-3.5-turbo
+	counter, err := NewCounter("gpt-3.5-turbo")
+	require.NoError(t, err)
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "You are a helpful assistant."},
+		{Role: openai.ChatMessageRoleUser, Content: "Hello!"},
+	}
+	require.Equal(t, 3+(3+1+6)+(3+1+2), counter.CountMessages(messages))
+}
+
+func TestNewCounterUnknownModel(t *testing.T) {
+	counter, err := NewCounter("my-local-model")
+	require.NoError(t, err)
+	require.Positive(t, counter.Count("hello world"))
+}
+
+func TestUpperBound(t *testing.T) {
+	counter, err := NewCounter("gpt-4o")
+	require.NoError(t, err)
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "You are a helpful assistant."},
+		{Role: openai.ChatMessageRoleUser, Content: "Grüße aus München! 🎉"},
+		{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: "What is this?"},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/a.png"}},
+		}},
+	}
+	require.GreaterOrEqual(t, UpperBound(messages), counter.CountMessages(messages))
+}
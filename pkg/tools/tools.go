@@ -0,0 +1,248 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/tbckr/sgpt/v2/pkg/shell"
+)
+
+const (
+	// maxOutputSize caps the tool output sent back to the model, so a chatty
+	// command cannot exhaust the context window.
+	maxOutputSize = 64 << 10
+)
+
+var (
+	// OpenAI restricts function names to this pattern.
+	nameMatcher = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+	// ErrInvalidTool is returned, if a tool declaration is incomplete or malformed.
+	ErrInvalidTool = errors.New("invalid tool")
+	// ErrUnknownTool is returned, if the model calls a tool that was not declared.
+	ErrUnknownTool = errors.New("unknown tool")
+)
+
+// Tool is a locally declared tool the model may call. The model's arguments
+// are passed to Command as JSON on stdin and its combined output is returned
+// to the model.
+type Tool struct {
+	Name        string `yaml:"name" mapstructure:"name"`
+	Description string `yaml:"description" mapstructure:"description"`
+	// Parameters is the JSON schema of the arguments, either as a map or as a
+	// JSON string. The string form preserves the case of property names,
+	// which viper lowercases for maps in config.yaml.
+	Parameters any    `yaml:"parameters" mapstructure:"parameters"`
+	Command    string `yaml:"command" mapstructure:"command"`
+}
+
+// Validate checks that the tool has a valid name, a command and a parsable schema.
+func (t Tool) Validate() error {
+	if !nameMatcher.MatchString(t.Name) {
+		return fmt.Errorf("%w: name %q must match %s", ErrInvalidTool, t.Name, nameMatcher.String())
+	}
+	if strings.TrimSpace(t.Command) == "" {
+		return fmt.Errorf("%w: %s has no command", ErrInvalidTool, t.Name)
+	}
+	if _, err := t.schema(); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidTool, t.Name, err)
+	}
+	return nil
+}
+
+func (t Tool) schema() (json.RawMessage, error) {
+	switch params := t.Parameters.(type) {
+	case nil:
+		return json.RawMessage(`{"type":"object","properties":{}}`), nil
+	case string:
+		if !json.Valid([]byte(params)) {
+			return nil, errors.New("parameters is not valid JSON")
+		}
+		return json.RawMessage(params), nil
+	default:
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("parameters: %w", err)
+		}
+		return data, nil
+	}
+}
+
+// Definition returns the tool in the format of the chat completions API.
+func (t Tool) Definition() openai.Tool {
+	// Validate guarantees a parsable schema
+	schema, _ := t.schema()
+	return openai.Tool{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        t.Name,
+			Description: t.Description,
+			Parameters:  schema,
+		},
+	}
+}
+
+// FromConfig loads and validates the tools declared in the tools section of config.
+func FromConfig(config *viper.Viper) ([]Tool, error) {
+	if config == nil || !config.IsSet("tools") {
+		return nil, nil
+	}
+	var tools []Tool
+	if err := config.UnmarshalKey("tools", &tools); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTool, err)
+	}
+	for _, tool := range tools {
+		if err := tool.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return tools, nil
+}
+
+// Merge combines the tools from config with the tools of a persona. Persona
+// tools replace config tools of the same name.
+func Merge(configTools, personaTools []Tool) []Tool {
+	merged := make([]Tool, 0, len(configTools)+len(personaTools))
+	for _, tool := range configTools {
+		if Find(personaTools, tool.Name) == nil {
+			merged = append(merged, tool)
+		}
+	}
+	return append(merged, personaTools...)
+}
+
+// Find returns the tool with the given name or nil.
+func Find(tools []Tool, name string) *Tool {
+	for i := range tools {
+		if tools[i].Name == name {
+			return &tools[i]
+		}
+	}
+	return nil
+}
+
+// Runner executes tool calls after asking the user for confirmation.
+type Runner struct {
+	tools    []Tool
+	input    *bufio.Reader
+	output   io.Writer
+	scrubEnv []string
+}
+
+// NewRunner creates a Runner for tools. Confirmations are read from input and
+// prompts are written to output. The env variables named in scrubEnv, e.g.
+// API keys, are removed from the environment of the tool commands.
+func NewRunner(tools []Tool, input io.Reader, output io.Writer, scrubEnv ...string) *Runner {
+	return &Runner{
+		tools: tools,
+		// A single reader for all calls: GetUserConfirmation reuses it
+		// instead of wrapping input anew, which would lose buffered answers.
+		input:    bufio.NewReader(input),
+		output:   output,
+		scrubEnv: scrubEnv,
+	}
+}
+
+// Run executes call and returns the content of the tool message sent back to
+// the model. Declined calls and failing commands are reported to the model
+// instead of aborting the conversation.
+func (r *Runner) Run(ctx context.Context, call openai.ToolCall) (string, error) {
+	tool := Find(r.tools, call.Function.Name)
+	if tool == nil {
+		slog.Debug("Model called unknown tool", "tool", call.Function.Name)
+		return fmt.Sprintf("error: %s: %s", ErrUnknownTool, call.Function.Name), nil
+	}
+
+	// Arguments are shown to the user for confirmation; compact JSON keeps
+	// them on one line, so nothing can hide below the prompt.
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(call.Function.Arguments)); err != nil {
+		slog.Debug("Model sent invalid tool arguments", "tool", tool.Name)
+		return "error: arguments are not valid JSON", nil
+	}
+	// The user must confirm exactly what the command receives, so arguments
+	// that would display differently are rejected instead of cleaned.
+	arguments, err := shell.SanitizeCommand(compacted.String())
+	if err != nil || arguments != compacted.String() {
+		slog.Debug("Model sent tool arguments with hidden characters", "tool", tool.Name)
+		return "error: arguments contain control or invisible characters", nil
+	}
+
+	if _, err = fmt.Fprintf(r.output, "Tool call: %s %s\n", tool.Name, arguments); err != nil {
+		return "", err
+	}
+	var ok bool
+	ok, err = shell.GetUserConfirmationContext(ctx, r.input, r.output)
+	if err != nil {
+		return "", fmt.Errorf("confirm tool call %s: %w", tool.Name, err)
+	}
+	r.discardLineEnd()
+	if !ok {
+		return "The user declined to run this tool.", nil
+	}
+
+	slog.Debug("Running tool", "tool", tool.Name)
+	output, runErr := shell.RunCommand(ctx, tool.Command, strings.NewReader(arguments), r.scrubEnv...)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	result := string(output)
+	if len(result) > maxOutputSize {
+		result = result[:maxOutputSize] + "\n[output truncated]"
+	}
+	if runErr != nil {
+		return fmt.Sprintf("error: %s\n%s", runErr, result), nil
+	}
+	return result, nil
+}
+
+// discardLineEnd drops the line break following a "y" or "n" answer, which
+// would otherwise confirm the next tool call. Only buffered input is
+// inspected, so this never blocks on a terminal.
+func (r *Runner) discardLineEnd() {
+	for r.input.Buffered() > 0 {
+		next, err := r.input.Peek(1)
+		if err != nil {
+			return
+		}
+		char := next[0]
+		if char != '\r' && char != '\n' {
+			return
+		}
+		_, _ = r.input.ReadByte()
+		if char == '\n' {
+			return
+		}
+	}
+}
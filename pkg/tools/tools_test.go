@@ -0,0 +1,155 @@
+// Copyright (c) 2023 Tim <tbckr>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func toolCall(name, arguments string) openai.ToolCall {
+	return openai.ToolCall{
+		ID:       "call_1",
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: arguments},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Tool{Name: "ok", Command: "true"}.Validate())
+	require.NoError(t, Tool{Name: "ok", Command: "true", Parameters: map[string]any{"type": "object"}}.Validate())
+
+	for _, tool := range []Tool{
+		{Name: "", Command: "true"},
+		{Name: "has space", Command: "true"},
+		{Name: "no_command"},
+		{Name: "bad_schema", Command: "true", Parameters: "{"},
+	} {
+		require.ErrorIs(t, tool.Validate(), ErrInvalidTool, tool.Name)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	config := viper.New()
+	tools, err := FromConfig(config)
+	require.NoError(t, err)
+	require.Empty(t, tools)
+
+	config.Set("tools", []map[string]any{{
+		"name":       "read_file",
+		"command":    "cat",
+		"parameters": `{"type":"object","properties":{"filePath":{"type":"string"}}}`,
+	}})
+	tools, err = FromConfig(config)
+	require.NoError(t, err)
+	require.Len(t, tools, 1)
+
+	definition := tools[0].Definition()
+	require.Equal(t, openai.ToolTypeFunction, definition.Type)
+	require.Equal(t, "read_file", definition.Function.Name)
+	// The JSON string form keeps the case of property names
+	require.Contains(t, string(definition.Function.Parameters.(json.RawMessage)), "filePath")
+
+	config.Set("tools", []map[string]any{{"name": "missing_command"}})
+	_, err = FromConfig(config)
+	require.ErrorIs(t, err, ErrInvalidTool)
+}
+
+func TestMerge(t *testing.T) {
+	merged := Merge(
+		[]Tool{{Name: "a", Command: "config"}, {Name: "b", Command: "config"}},
+		[]Tool{{Name: "b", Command: "persona"}},
+	)
+	require.Len(t, merged, 2)
+	require.Equal(t, "config", Find(merged, "a").Command)
+	require.Equal(t, "persona", Find(merged, "b").Command)
+	require.Nil(t, Find(merged, "c"))
+}
+
+func TestRunnerRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tool tests require bash and are not supported on Windows")
+	}
+	tools := []Tool{
+		{Name: "echo_args", Command: "cat"},
+		{Name: "fail", Command: "echo broken; exit 2"},
+	}
+	var out bytes.Buffer
+	// One reader for all calls, so buffered answers are not lost
+	runner := NewRunner(tools, strings.NewReader("y\nn\ny\n"), &out)
+
+	result, err := runner.Run(context.Background(), toolCall("echo_args", "{\n  \"a\": 1\n}"))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, result)
+	require.Contains(t, out.String(), `Tool call: echo_args {"a":1}`)
+
+	result, err = runner.Run(context.Background(), toolCall("echo_args", `{}`))
+	require.NoError(t, err)
+	require.Equal(t, "The user declined to run this tool.", result)
+
+	result, err = runner.Run(context.Background(), toolCall("fail", `{}`))
+	require.NoError(t, err)
+	require.Equal(t, "error: exit status 2\nbroken\n", result)
+}
+
+func TestRunnerScrubsEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tool tests require bash and are not supported on Windows")
+	}
+	t.Setenv("OPENAI_API_KEY", "secret")
+	tools := []Tool{{Name: "print_key", Command: `echo "${OPENAI_API_KEY:-unset}"`}}
+	runner := NewRunner(tools, strings.NewReader("y\n"), io.Discard, "OPENAI_API_KEY")
+
+	result, err := runner.Run(context.Background(), toolCall("print_key", `{}`))
+	require.NoError(t, err)
+	require.Equal(t, "unset\n", result)
+}
+
+func TestRunnerRejectsWithoutConfirmation(t *testing.T) {
+	tools := []Tool{{Name: "echo_args", Command: "cat"}}
+	var out bytes.Buffer
+	runner := NewRunner(tools, strings.NewReader(""), &out)
+
+	result, err := runner.Run(context.Background(), toolCall("unknown", `{}`))
+	require.NoError(t, err)
+	require.Equal(t, "error: unknown tool: unknown", result)
+
+	result, err = runner.Run(context.Background(), toolCall("echo_args", `not json`))
+	require.NoError(t, err)
+	require.Equal(t, "error: arguments are not valid JSON", result)
+
+	result, err = runner.Run(context.Background(), toolCall("echo_args", "{\"a\":\"x‮y\"}"))
+	require.NoError(t, err)
+	require.Equal(t, "error: arguments contain control or invisible characters", result)
+
+	// None of the calls above may prompt the user
+	require.Empty(t, out.String())
+}